@@ -0,0 +1,54 @@
+#!/bin/bash
+
+# Mailuminati Guardian 
+# Copyright (C) 2025 Simon Bressier
+#
+# This program is free software: you can redistribute it and/or modify
+# it under the terms of the GNU General Public License as published by
+# the Free Software Foundation, version 3.
+#
+# This program is distributed in the hope that it will be useful,
+# but WITHOUT ANY WARRANTY; without even the implied warranty of
+# MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+# GNU General Public License for more details.
+#
+# You should have received a copy of the GNU General Public License
+# along with this program.  If not, see <https://www.gnu.org/licenses/>.
+# Exim adapter: posts a message to Guardian and prints its verdict as an Exim
+# ${extract} list, e.g.: action=deny verdict=spam label=local_spam message="554 5.7.1 ..."
+#
+# Called from acl_smtp_data with ${run} (see mailuminati.conf):
+#   guardian-exim.sh <message file> <client ip> <helo> <sender> <recipients> <auth user>
+# Empty values are passed as "-".
+
+# Configuration
+API_URL="http://127.0.0.1:12421/analyze?format=exim"
+TIMEOUT=5
+
+MESSAGE_FILE=$1
+
+# Envelope headers, skipping the values Exim did not have
+HEADERS=(-H "Content-Type: message/rfc822")
+add_header() {
+    [ -n "$2" ] && [ "$2" != "-" ] && HEADERS+=(-H "$1: $2")
+}
+add_header X-Guardian-Client-IP "$2"
+add_header X-Guardian-Helo "$3"
+add_header X-Guardian-Mail-From "$4"
+add_header X-Guardian-Rcpt-To "$5"
+add_header X-Guardian-Auth-User "$6"
+
+# Fail open: without a readable message or an answer, the message is accepted
+if [ ! -r "$MESSAGE_FILE" ]; then
+    echo 'action=accept status=unavailable'
+    exit 0
+fi
+
+RESPONSE=$(curl -s -f --max-time "$TIMEOUT" -X POST "$API_URL" "${HEADERS[@]}" \
+     --data-binary @"$MESSAGE_FILE")
+
+if [ -z "$RESPONSE" ]; then
+    echo 'action=accept status=unavailable'
+    exit 0
+fi
+echo "$RESPONSE"
@@ -35,7 +35,7 @@ install_source() {
             go mod tidy
             log_info "Building the binary..."
             started_ok=0
-            if go build; then
+            if go build -o mailuminati-guardian ./cmd/guardian; then
                 log_success "Build complete. The binary is available in the src/mi_guardian directory."
                 
                 # Setup paths
@@ -158,6 +158,9 @@ ExecReload=/bin/kill -HUP \$MAINPID
 Restart=always
 RestartSec=5
 User=mailuminati
+# Node signing key (NODE_KEY_FILE)
+StateDirectory=mailuminati-guardian
+StateDirectoryMode=0700
 # Logging
 StandardOutput=append:${LOG_FILE}
 StandardError=append:${LOG_FILE}
@@ -0,0 +1,85 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// --- Connection access control ---
+//
+// Defense in depth when Guardian binds beyond localhost: GUARDIAN_ALLOWED_CIDRS
+// (IPs or CIDRs, empty = any) restricts the peers of every listener, by the
+// connection address, never by forwarded headers. An endpoint can override it with
+// GUARDIAN_ALLOWED_CIDRS_<PATH>: /report -> _REPORT, /v1/verdict -> _V1_VERDICT,
+// and _ADMIN for all of /admin/ (a more specific /admin/bands -> _ADMIN_BANDS wins).
+
+// ipInList reports whether ip matches one of the IPs or CIDRs of entries
+func ipInList(ip net.IP, entries []string) bool {
+	for _, entry := range entries {
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedCIDRs returns the allowlist of a path: its most specific override, else
+// GUARDIAN_ALLOWED_CIDRS
+func allowedCIDRs(path string) []string {
+	segments := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	for n := len(segments); n > 0; n-- {
+		key := strings.TrimPrefix(actionKey(strings.Join(segments[:n], "_")), "ACTION_")
+		if list := getEnvList("GUARDIAN_ALLOWED_CIDRS_" + key); len(list) > 0 {
+			return list
+		}
+	}
+	return getEnvList("GUARDIAN_ALLOWED_CIDRS")
+}
+
+// connAllowed checks a peer address (host:port or IP) against the allowlist of path.
+// Listeners other than HTTP can call it with their own service name as path.
+func connAllowed(remoteAddr, path string) bool {
+	allowed := allowedCIDRs(path)
+	if len(allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ipInList(ip, allowed)
+}
+
+// connACL rejects requests from peers outside the allowlist of their path
+func connACL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !connAllowed(r.RemoteAddr, r.URL.Path) {
+			logger.Warn("Connection from disallowed address", "address", reportClientIP(r), "path", r.URL.Path)
+			promACLDenied.Inc()
+			writeError(w, http.StatusForbidden, ErrForbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
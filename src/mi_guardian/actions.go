@@ -0,0 +1,68 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strings"
+)
+
+// --- MTA actions ---
+
+// actionKey builds the config key of a verdict label: local_spam -> ACTION_LOCAL_SPAM
+func actionKey(label string) string {
+	key := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, label)
+	return "ACTION_" + strings.ToUpper(key)
+}
+
+// multiRecipient tells whether a message has enough envelope recipients (MULTI_RCPT_MIN,
+// 0 = disabled) for the *_MULTI_RCPT actions, e.g. to tag rather than reject mail
+// where a false positive would hit many people at once
+func multiRecipient(recipients int) bool {
+	limit := getEnvInt("MULTI_RCPT_MIN", 0)
+	return limit > 0 && int64(recipients) >= limit
+}
+
+// mtaAction maps a verdict to the action and SMTP response configured for the MTA.
+// ACTION_<LABEL> wins over ACTION_SPAM / ACTION_ALLOW, and for multi-recipient
+// messages ACTION_<LABEL>_MULTI_RCPT / ACTION_SPAM_MULTI_RCPT win over both. Values
+// read "<action> [<smtp response>]", e.g. "reject 554 5.7.1 Message rejected as spam".
+// Both results are empty when nothing is configured.
+func mtaAction(res AnalysisResult, recipients int) (string, string) {
+	keys := []string{actionKey(res.Action)}
+	if res.Label != "" {
+		keys = append([]string{actionKey(res.Label)}, keys...)
+	}
+	if multiRecipient(recipients) {
+		keys = append([]string{keys[0] + "_MULTI_RCPT", keys[len(keys)-1] + "_MULTI_RCPT"}, keys...)
+	}
+	value := ""
+	for _, key := range keys {
+		if value = getEnv(key, ""); value != "" {
+			break
+		}
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", ""
+	}
+	action, smtpResponse, _ := strings.Cut(value, " ")
+	return strings.ToLower(action), strings.TrimSpace(smtpResponse)
+}
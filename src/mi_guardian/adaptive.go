@@ -0,0 +1,182 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Adaptive local threshold ---
+
+// The controller compares, per tenant, ham reports on messages flagged local_spam
+// with the number of such messages. Above the target ratio the tenant threshold is
+// raised by one; below half of it, lowered by one. One step per interval, at most,
+// so a burst of reports cannot swing it. Reports are not authenticated: no step is
+// taken before enough ham reports came in (no report says nothing about false
+// positives), and the threshold never goes below ADAPTIVE_MIN_THRESHOLD, which
+// defaults to SPAM_THRESHOLD.
+
+var (
+	adaptiveEnabled       atomic.Bool
+	adaptiveMinThreshold  int64 = 1
+	adaptiveMaxThreshold  int64 = DefaultAdaptiveMax
+	adaptiveTargetPercent int64 = DefaultAdaptiveTarget
+	adaptiveMinSamples    int64 = DefaultAdaptiveSamples
+	adaptiveMinHam        int64 = DefaultAdaptiveHam
+	adaptiveIntervalHours int64 = DefaultAdaptiveInterval
+
+	adaptiveMu         sync.RWMutex
+	adaptiveThresholds = map[string]int64{}
+)
+
+// loadAdaptiveConfig reads the ADAPTIVE_* settings
+func loadAdaptiveConfig() {
+	adaptiveEnabled.Store(strings.ToLower(getEnv("ADAPTIVE_THRESHOLD", "false")) == "true")
+	minTh := getEnvPositiveInt("ADAPTIVE_MIN_THRESHOLD", max(1, atomic.LoadInt64(&localSpamThreshold)))
+	maxTh := getEnvPositiveInt("ADAPTIVE_MAX_THRESHOLD", DefaultAdaptiveMax)
+	if maxTh < minTh {
+		maxTh = minTh
+	}
+	atomic.StoreInt64(&adaptiveMinThreshold, minTh)
+	atomic.StoreInt64(&adaptiveMaxThreshold, maxTh)
+	atomic.StoreInt64(&adaptiveTargetPercent, getEnvPositiveInt("ADAPTIVE_TARGET_HAM_PERCENT", DefaultAdaptiveTarget))
+	atomic.StoreInt64(&adaptiveMinSamples, getEnvPositiveInt("ADAPTIVE_MIN_SAMPLES", DefaultAdaptiveSamples))
+	atomic.StoreInt64(&adaptiveMinHam, getEnvPositiveInt("ADAPTIVE_MIN_HAM_REPORTS", DefaultAdaptiveHam))
+	atomic.StoreInt64(&adaptiveIntervalHours, getEnvPositiveInt("ADAPTIVE_INTERVAL_HOURS", DefaultAdaptiveInterval))
+}
+
+// forTenant applies the adjusted threshold of the tenant, when the controller set one
+func (p thresholdProfile) forTenant(tenant string) thresholdProfile {
+	if !adaptiveEnabled.Load() {
+		return p
+	}
+	adaptiveMu.RLock()
+	th, ok := adaptiveThresholds[tenant]
+	adaptiveMu.RUnlock()
+	if ok {
+		p.SpamThreshold = th
+	}
+	return p
+}
+
+// recordAdaptiveSample counts a message flagged local_spam, or a ham report on one
+func recordAdaptiveSample(tenant, field string) {
+	if !adaptiveEnabled.Load() || tenant == "" {
+		return
+	}
+	rdb.HIncrBy(ctx, AdaptiveStatsPrefix+tenant, field, 1)
+}
+
+// enoughAdaptiveSamples tells whether a tenant has the local_spam verdicts and ham
+// reports a step needs
+func enoughAdaptiveSamples(flagged, ham int64) bool {
+	return flagged >= atomic.LoadInt64(&adaptiveMinSamples) && ham >= atomic.LoadInt64(&adaptiveMinHam)
+}
+
+// nextThreshold returns the threshold after one controller step
+func nextThreshold(current, flagged, ham int64) int64 {
+	if !enoughAdaptiveSamples(flagged, ham) {
+		return current
+	}
+	target := atomic.LoadInt64(&adaptiveTargetPercent)
+	next := current
+	switch ratio := ham * 100; {
+	case ratio > target*flagged:
+		next = current + 1
+	case ratio*2 < target*flagged:
+		next = current - 1
+	}
+	if minTh := atomic.LoadInt64(&adaptiveMinThreshold); next < minTh {
+		next = minTh
+	}
+	if maxTh := atomic.LoadInt64(&adaptiveMaxThreshold); next > maxTh {
+		next = maxTh
+	}
+	return next
+}
+
+// adjustThresholds runs one controller step for every tenant with samples
+func adjustThresholds() {
+	current, _ := rdb.HGetAll(ctx, AdaptiveThresholdsKey).Result()
+	iter := rdb.Scan(ctx, 0, AdaptiveStatsPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		tenant := strings.TrimPrefix(key, AdaptiveStatsPrefix)
+		stats, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		flagged, _ := strconv.ParseInt(stats["flagged"], 10, 64)
+		ham, _ := strconv.ParseInt(stats["ham"], 10, 64)
+		if !enoughAdaptiveSamples(flagged, ham) {
+			// Keep accumulating until the sample is large enough
+			continue
+		}
+
+		from := atomic.LoadInt64(&localSpamThreshold)
+		if th, err := strconv.ParseInt(current[tenant], 10, 64); err == nil {
+			from = th
+		}
+		to := nextThreshold(from, flagged, ham)
+		if to != from {
+			rdb.HSet(ctx, AdaptiveThresholdsKey, tenant, to)
+			logger.Info("Adaptive threshold adjusted", "tenant", tenant, "from", from, "to", to, "flagged", flagged, "ham_reports", ham)
+		} else {
+			logger.Debug("Adaptive threshold unchanged", "tenant", tenant, "threshold", from, "flagged", flagged, "ham_reports", ham)
+		}
+		rdb.Del(ctx, key)
+	}
+}
+
+// loadAdaptiveThresholds refreshes the in-memory copy of the tenant thresholds
+func loadAdaptiveThresholds() {
+	stored, err := rdb.HGetAll(ctx, AdaptiveThresholdsKey).Result()
+	if err != nil {
+		return
+	}
+	thresholds := make(map[string]int64, len(stored))
+	minTh, maxTh := atomic.LoadInt64(&adaptiveMinThreshold), atomic.LoadInt64(&adaptiveMaxThreshold)
+	for tenant, v := range stored {
+		if th, err := strconv.ParseInt(v, 10, 64); err == nil {
+			// Bounds may have been tightened since the value was stored
+			thresholds[tenant] = max(minTh, min(th, maxTh))
+		}
+	}
+	adaptiveMu.Lock()
+	adaptiveThresholds = thresholds
+	adaptiveMu.Unlock()
+}
+
+// Adaptive threshold worker. Guardians sharing a Redis adjust once per interval
+// between them (lock key), and all pick the result up within a minute.
+func adaptiveWorker() {
+	loadAdaptiveThresholds()
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		if !adaptiveEnabled.Load() {
+			continue
+		}
+		interval := time.Duration(atomic.LoadInt64(&adaptiveIntervalHours)) * time.Hour
+		if ok, _ := rdb.SetNX(ctx, AdaptiveLockKey, nodeID, interval).Result(); ok {
+			adjustThresholds()
+		}
+		loadAdaptiveThresholds()
+	}
+}
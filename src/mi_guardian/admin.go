@@ -0,0 +1,225 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- Admin API ---
+
+// registerAdminRoutes mounts the operational endpoints, all behind adminAuth
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/conflicts", adminAuth(conflictsHandler))
+	mux.HandleFunc("/admin/conflicts/resolve", adminAuth(resolveConflictHandler))
+	mux.HandleFunc("/admin/migrate", adminAuth(migrateHandler))
+	mux.HandleFunc("/admin/replay", adminAuth(replayHandler))
+	mux.HandleFunc("/admin/dmarc", adminAuth(dmarcHandler))
+	mux.HandleFunc("/admin/purge", adminAuth(purgeHandler))
+	mux.HandleFunc("/admin/blocklist", adminAuth(blocklistHandler))
+	mux.HandleFunc("/admin/blocklist/domains", adminAuth(domainBlocklistHandler))
+	mux.HandleFunc("/admin/sync/preview", adminAuth(syncPreviewHandler))
+	mux.HandleFunc("/admin/sync/apply", adminAuth(syncApplyHandler))
+	mux.HandleFunc("/admin/block-hash", adminAuth(blockHashHandler))
+	mux.HandleFunc("/admin/unblock-hash", adminAuth(unblockHashHandler))
+	mux.HandleFunc("/admin/loglevel", adminAuth(logLevelHandler))
+	mux.HandleFunc("/admin/bands", adminAuth(bandsHandler))
+	mux.HandleFunc("/admin/lookup", adminAuth(lookupHashHandler))
+	mux.HandleFunc("/admin/campaigns", adminAuth(campaignsHandler))
+	mux.HandleFunc("/admin/calibration", adminAuth(calibrationHandler))
+	mux.HandleFunc("/admin/audit", adminAuth(auditHandler))
+	mux.HandleFunc("/admin/faults", adminAuth(faultsHandler))
+	mux.HandleFunc("/admin/digest", adminAuth(digestHandler))
+	mux.HandleFunc("/admin/stream", adminAuth(streamHandler))
+	mux.HandleFunc("/admin/selftest", adminAuth(selftestHandler))
+	mux.HandleFunc("/admin/dashboard", dashboardHandler)
+	mux.HandleFunc("/admin/dashboard/data", adminAuth(dashboardDataHandler))
+}
+
+// adminIPAllowed checks the caller against ADMIN_ALLOWED_IPS (IPs or CIDRs, empty = any)
+func adminIPAllowed(r *http.Request) bool {
+	allowed := getEnvList("ADMIN_ALLOWED_IPS")
+	if len(allowed) == 0 {
+		return true
+	}
+	ip := net.ParseIP(reportClientIP(r))
+	return ip != nil && ipInList(ip, allowed)
+}
+
+// adminTokensConfigured tells whether ADMIN_TOKEN or ADMIN_READ_TOKEN is set. The
+// admin API is closed without them.
+func adminTokensConfigured() bool {
+	return getEnv("ADMIN_TOKEN", "") != "" || getEnv("ADMIN_READ_TOKEN", "") != ""
+}
+
+// adminRole returns the role granted by the bearer token: "admin" (ADMIN_TOKEN),
+// "read" (ADMIN_READ_TOKEN, GET only), or "" when the token matches none.
+// Without configured tokens nobody gets a role.
+func adminRole(r *http.Request) string {
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	readToken := getEnv("ADMIN_READ_TOKEN", "")
+	token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if token == "" {
+		return ""
+	}
+	if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return "admin"
+	}
+	if readToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(readToken)) == 1 {
+		return "read"
+	}
+	return ""
+}
+
+// adminAuth enforces the IP allowlist and token roles, and logs the request
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("Request", "method", r.Method, "path", r.URL.Path)
+		if !adminIPAllowed(r) {
+			logger.Warn("Admin request from disallowed address", "address", reportClientIP(r), "path", r.URL.Path)
+			writeError(w, http.StatusForbidden, ErrForbidden, "Forbidden")
+			return
+		}
+		switch role := adminRole(r); {
+		case !adminTokensConfigured():
+			writeError(w, http.StatusForbidden, ErrForbidden, "Admin API disabled: set ADMIN_TOKEN")
+			return
+		case role == "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mailuminati-guardian-admin"`)
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized, "Unauthorized")
+			return
+		case role == "read" && r.Method != http.MethodGet:
+			writeError(w, http.StatusForbidden, ErrForbidden, "Forbidden: read-only token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// --- Admin Handlers ---
+
+// conflictsHandler lists hashes that received both spam and ham reports
+func conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+
+	// Forget conflicts older than the retention window
+	cutoff := time.Now().Add(-localRetentionDuration).Unix()
+	rdb.ZRemRangeByScore(ctx, ConflictSetKey, "-inf", strconv.FormatInt(cutoff, 10))
+
+	members, err := rdb.ZRevRangeWithScores(ctx, ConflictSetKey, 0, -1).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+
+	conflicts := []ConflictEntry{}
+	for _, m := range members {
+		hash, _ := m.Member.(string)
+		vals, err := rdb.HMGet(ctx, LocalCounterPrefix+hash, "spam", "ham").Result()
+		if err != nil {
+			continue
+		}
+		counts := parseFloatValues(vals)
+		if counts[0] <= 0 || counts[1] <= 0 {
+			// Counters expired or resolved meanwhile
+			rdb.ZRem(ctx, ConflictSetKey, hash)
+			continue
+		}
+		score, _ := rdb.Get(ctx, LocalScorePrefix+hash).Float64()
+		conflicts = append(conflicts, ConflictEntry{
+			Hash:      hash,
+			Spam:      counts[0],
+			Ham:       counts[1],
+			Score:     score,
+			UpdatedAt: int64(m.Score),
+		})
+	}
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"margin":    atomic.LoadInt64(&conflictMargin),
+		"conflicts": conflicts,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// resolveConflictHandler settles a conflicting hash as spam or ham
+func resolveConflictHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var reqBody struct {
+		Hash    string `json:"hash"`
+		Verdict string `json:"verdict"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Hash == "" {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+		return
+	}
+
+	// Spam: score at threshold, counters reset in favor of spam
+	// Ham: score below zero so the hash stays known as legitimate
+	var score float64
+	switch reqBody.Verdict {
+	case "spam":
+		score = float64(atomic.LoadInt64(&localSpamThreshold))
+	case "ham":
+		score = -float64(atomic.LoadInt64(&hamWeight))
+	default:
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "verdict must be spam or ham")
+		return
+	}
+
+	scoreKey := LocalScorePrefix + reqBody.Hash
+	counterKey := LocalCounterPrefix + reqBody.Hash
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, scoreKey, score, localRetentionDuration)
+	pipe.Del(ctx, counterKey)
+	if reqBody.Verdict == "spam" {
+		pipe.HSet(ctx, counterKey, "spam", score)
+		pipe.Expire(ctx, counterKey, localRetentionDuration)
+	}
+	pipe.ZRem(ctx, ConflictSetKey, reqBody.Hash)
+	if _, err := pipe.Exec(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+
+	forgetVerdicts()
+	logger.Info("Conflict resolved", "hash", reqBody.Hash, "verdict", reqBody.Verdict, "score", score)
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"status":  "resolved",
+		"hash":    reqBody.Hash,
+		"verdict": reqBody.Verdict,
+		"score":   score,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
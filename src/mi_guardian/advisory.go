@@ -0,0 +1,116 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Outbound deliverability advice ---
+//
+// Submissions (X-Guardian-Auth-User set, or X-Guardian-Direction: outbound) are
+// checked for what large mailbox providers penalize: unsigned mail, bulk mail
+// without one-click unsubscribe, missing Message-ID or Date, misaligned envelope
+// sender. Advice never changes the verdict; the MTA decides whether to sign, add
+// headers or just log.
+
+// Advice is a deliverability fix the MTA may apply before relaying a message
+type Advice struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Domain   string `json:"domain,omitempty"`
+	Selector string `json:"selector,omitempty"`
+}
+
+// isOutbound tells whether the request is an outbound submission
+func isOutbound(r *http.Request, meta EnvelopeMeta) bool {
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("X-Guardian-Direction"))) {
+	case "outbound":
+		return true
+	case "inbound":
+		return false
+	}
+	return meta.AuthUser != ""
+}
+
+// dkimSelector returns the selector OUTBOUND_DKIM_SELECTORS ("domain:selector,...")
+// assigns to domain or its parent domains
+func dkimSelector(domain string) string {
+	for _, entry := range getEnvList("OUTBOUND_DKIM_SELECTORS") {
+		d, selector, ok := strings.Cut(entry, ":")
+		if ok && selector != "" && domainMatches(domain, strings.TrimSpace(d)) {
+			return strings.TrimSpace(selector)
+		}
+	}
+	return ""
+}
+
+// outboundAdvice lists the deliverability fixes suggested for an outbound message
+func outboundAdvice(env *enmime.Envelope, meta EnvelopeMeta) []Advice {
+	var advice []Advice
+	fromDomain := addressDomain(env.GetHeader("From"))
+
+	if fromDomain != "" && !signedBy(env, fromDomain) {
+		a := Advice{Code: "dkim_sign", Message: "Sign the message with DKIM for the From domain", Domain: fromDomain}
+		if a.Selector = dkimSelector(fromDomain); a.Selector != "" {
+			a.Message = "Sign the message with DKIM selector " + a.Selector
+		}
+		advice = append(advice, a)
+	}
+
+	precedence := strings.ToLower(env.GetHeader("Precedence"))
+	bulk := precedence == "bulk" || precedence == "list" ||
+		len(meta.RcptTo) >= int(getEnvPositiveInt("OUTBOUND_BULK_RECIPIENTS", DefaultOutboundBulkRecipients))
+	if bulk {
+		if env.GetHeader("List-Unsubscribe") == "" {
+			advice = append(advice, Advice{Code: "list_unsubscribe", Message: "Add List-Unsubscribe and List-Unsubscribe-Post headers to bulk mail"})
+		} else if env.GetHeader("List-Unsubscribe-Post") == "" {
+			advice = append(advice, Advice{Code: "list_unsubscribe_post", Message: "Add List-Unsubscribe-Post: List-Unsubscribe=One-Click for one-click unsubscribe"})
+		}
+	}
+
+	if env.GetHeader("Message-ID") == "" {
+		advice = append(advice, Advice{Code: "message_id", Message: "Add a Message-ID header"})
+	}
+	if env.GetHeader("Date") == "" {
+		advice = append(advice, Advice{Code: "date", Message: "Add a Date header"})
+	}
+	// enmime fills Text from the HTML when the message has no text part of its own
+	textParts := findParts(env, func(p *enmime.Part) bool {
+		return strings.EqualFold(p.ContentType, "text/plain") && p.Disposition != "attachment"
+	})
+	if env.HTML != "" && len(textParts) == 0 {
+		advice = append(advice, Advice{Code: "text_part", Message: "Add a plain text alternative to the HTML body"})
+	}
+	if senderDomain := addressDomain(meta.MailFrom); senderDomain != "" && fromDomain != "" &&
+		!domainMatches(senderDomain, fromDomain) && !domainMatches(fromDomain, senderDomain) {
+		advice = append(advice, Advice{Code: "envelope_alignment", Message: "Use an envelope sender in the From domain so SPF aligns", Domain: fromDomain})
+	}
+	return advice
+}
+
+// signedBy tells whether a DKIM-Signature (or a verified result) covers domain
+func signedBy(env *enmime.Envelope, domain string) bool {
+	for _, d := range dkimDomains(env) {
+		if domainMatches(d, domain) || domainMatches(domain, d) {
+			return true
+		}
+	}
+	return false
+}
@@ -13,84 +13,77 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/glaslos/tlsh"
 	"github.com/jhillyerd/enmime"
 )
 
 // --- Internal TLSH logic ---
 
-func computeLocalTLSH(content string) (string, error) {
-	goHashStruct, err := tlsh.HashBytes([]byte(content))
-	if err != nil {
-		return "", err
-	}
-	// "T1" prefix + Uppercase
-	return "T1" + strings.ToUpper(goHashStruct.String()), nil
-}
-
 // computeDistance computes the distance between two hashes locally
 func computeDistance(d1, d2 string, includeLen bool, threshold int) (int, error) {
-	// Strip T1 prefix if present, as ParseStringToTlsh expects raw hex
-	d1 = strings.TrimPrefix(d1, "T1")
-	d2 = strings.TrimPrefix(d2, "T1")
-
-	t1, err := tlsh.ParseStringToTlsh(d1)
-	if err != nil {
-		return 0, err
-	}
-	t2, err := tlsh.ParseStringToTlsh(d2)
-	if err != nil {
-		return 0, err
-	}
-
-	// Note: glaslos/tlsh Diff includes length.
-	dist := t1.Diff(t2)
-
-	return dist, nil
+	return distanceBackend().Distance(d1, d2)
 }
 
-// computeDistanceBatch computes distances in batch (Batch)
+// computeDistanceBatch computes distances in batch (Batch). Candidates that cannot
+// be within ProximityDistance may be left out of the results.
 func computeDistanceBatch(ref string, digests []string, ids []string, includeLen bool) (map[string]int, error) {
 	if len(digests) != len(ids) {
 		return nil, errors.New("digests and ids length mismatch")
 	}
+	if distancePrefilterOn.Load() {
+		digests, ids = prefilterCandidates(ref, digests, ids, ProximityDistance)
+	}
 
-	ref = strings.TrimPrefix(ref, "T1")
-	tRef, err := tlsh.ParseStringToTlsh(ref)
+	dists, err := distanceBackend().Batch(ref, digests)
 	if err != nil {
 		return nil, err
 	}
 
-	results := make(map[string]int)
-	for i, digest := range digests {
-		d := strings.TrimPrefix(digest, "T1")
-		t, err := tlsh.ParseStringToTlsh(d)
-		if err != nil {
-			continue // Skip invalid hashes
+	results := make(map[string]int, len(dists))
+	for i, dist := range dists {
+		if dist >= 0 { // Skip invalid hashes
+			results[ids[i]] = dist
 		}
-
-		dist := tRef.Diff(t)
-		results[ids[i]] = dist
 	}
 	return results, nil
 }
 
+// dedupeSignatures drops exact duplicates and signatures within DuplicateSignatureDistance
+// of an earlier one (e.g. raw and normalized body of a plain text message), keeping
+// the first occurrence so the message order of parts stays the canonical order
+func dedupeSignatures(sigs []string) []string {
+	kept := make([]string, 0, len(sigs))
+	for _, sig := range sigs {
+		duplicate := false
+		for _, k := range kept {
+			if k == sig {
+				duplicate = true
+				break
+			}
+			if dist, err := computeDistance(k, sig, true, 0); err == nil && dist <= DuplicateSignatureDistance {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			kept = append(kept, sig)
+		}
+	}
+	return kept
+}
+
 var (
 	reImgSrcN   = regexp.MustCompile(`(?i)<img([^>]*?)src="[^"]*"([^>]*?)>`)
 	reHex8      = regexp.MustCompile(`[0-9a-fA-F]{8,}`)
@@ -138,18 +131,28 @@ func extractBands_6_3(sig string) []string {
 	return bands
 }
 
-func storeScanResult(env *enmime.Envelope, hashes []string) {
+// storeScanResult keeps the hashes and verdict of a scan for reports and replays,
+// for SCAN_RETENTION_DAYS. Clean scans are skipped when STORE_CLEAN_SCANS=false.
+func storeScanResult(env *enmime.Envelope, result ScanResult) {
 	msgID := env.GetHeader("Message-ID")
 	if msgID == "" {
 		return
 	}
+	if skipCleanScans.Load() && result.Action == "allow" && result.Label == "" && !result.Matched {
+		promScanStore.WithLabelValues("skipped").Inc()
+		return
+	}
 
-	hasher := sha1.New()
-	hasher.Write([]byte(msgID))
-	sha1Hash := hex.EncodeToString(hasher.Sum(nil))
+	sha1Hash := messageIDHash(msgID)
 
-	result := ScanResult{Hashes: hashes, Timestamp: time.Now().Unix()}
+	result.Timestamp = time.Now().Unix()
 	resultBytes, _ := json.Marshal(result)
+	sealed, err := sealValue(resultBytes)
+	if err != nil {
+		logger.Warn("Failed to encrypt scan result", "error", err)
+		promScanStore.WithLabelValues("error").Inc()
+		return
+	}
 
 	key := "mi:msgid:" + sha1Hash
 
@@ -158,22 +161,49 @@ func storeScanResult(env *enmime.Envelope, hashes []string) {
 	opCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	rdb.Set(opCtx, key, resultBytes, 7*24*time.Hour)
+	retention := time.Duration(atomic.LoadInt64(&scanRetentionDays)) * 24 * time.Hour
+	if err := rdb.Set(opCtx, key, sealed, retention).Err(); err != nil {
+		// Reports on this message will be rejected with "No scan data found"
+		logger.Warn("Failed to store scan result", "message_id", msgID, "error", err)
+		promScanStore.WithLabelValues("error").Inc()
+		return
+	}
+	promScanStore.WithLabelValues("stored").Inc()
+}
+
+// loadScanResult reads a stored scan result, decrypting it when needed
+func loadScanResult(key string) (ScanResult, error) {
+	var scan ScanResult
+	val, err := rdb.Get(ctx, key).Result()
+	if err != nil {
+		return scan, err
+	}
+	plain, err := openValue(val)
+	if err != nil {
+		return scan, err
+	}
+	err = json.Unmarshal(plain, &scan)
+	return scan, err
 }
 
 func callOracleDecision(sig string) AnalysisResult {
-	cacheKey := "mi:oracle_cache:" + sig
-	if cached, err := rdb.Get(ctx, cacheKey).Result(); err == nil {
+	cacheKey := OracleDecisionPrefix + sig
+	if cached, err := getOracleDecision(cacheKey); err == nil {
 		var res AnalysisResult
 		if json.Unmarshal([]byte(cached), &res) == nil {
 			if res.Action == "spam" {
 				atomic.AddInt64(&cachedPositiveCount, 1)
 				promCacheHits.WithLabelValues("positive").Inc()
-			} else {
+				return res
+			}
+			if !oracleAllowExpired(sig) {
 				atomic.AddInt64(&cachedNegativeCount, 1)
 				promCacheHits.WithLabelValues("negative").Inc()
+				return res
 			}
-			return res
+			// A signature seen this often may be a campaign the Oracle has confirmed since
+			promCacheHits.WithLabelValues("escalated").Inc()
+			logger.Debug("Cached Oracle allow decision escalated", "signature", sig)
 		}
 	}
 
@@ -182,12 +212,12 @@ func callOracleDecision(sig string) AnalysisResult {
 		"email_body_hash": sig,
 	})
 
-	client := &http.Client{Timeout: 4 * time.Second}
-	resp, err := client.Post(oracleURL+"/analyze", "application/json", bytes.NewBuffer(payload))
+	resp, err := oracleClient(4*time.Second).Post(oracleURL+"/analyze", "application/json", bytes.NewBuffer(payload))
 	if err != nil {
 		return AnalysisResult{Action: "allow", ProximityMatch: true}
 	}
 	defer resp.Body.Close()
+	atomic.StoreInt64(&oracleLastAnswer, time.Now().Unix())
 
 	var res struct {
 		Result AnalysisResult `json:"result"`
@@ -195,31 +225,43 @@ func callOracleDecision(sig string) AnalysisResult {
 	json.NewDecoder(resp.Body).Decode(&res)
 
 	if res.Result.Action != "" {
-		cacheDuration := 5 * time.Minute
 		if res.Result.Action == "spam" {
 			// For SPAM: Store exactly like local learns (LSH bands) + Exact Cache
-			cacheDuration = 1 * time.Hour
+			cacheDuration := 1 * time.Hour
 
 			// 1. Exact Cache (Fast path)
 			data, _ := json.Marshal(res.Result)
-			rdb.Set(ctx, cacheKey, data, cacheDuration)
+			setOracleDecision(cacheKey, data, cacheDuration)
 
 			// 2. LSH Bands (Proximity path)
-			bands := extractBands_6_3(sig)
-			pipe := rdb.Pipeline()
-			for _, band := range bands {
-				key := OracleCacheFragPrefix + band
-				pipe.SAdd(ctx, key, sig)
-				pipe.Expire(ctx, key, cacheDuration)
-			}
-			pipe.Exec(ctx)
+			addToBands(OracleCacheFragPrefix, extractBands_6_3(sig), sig, cacheDuration)
 		} else {
-			// For HAM/Others: Store only exact cache
+			// For HAM/Others: Store only exact cache, counting the answers it serves
 			data, _ := json.Marshal(res.Result)
-			rdb.Set(ctx, cacheKey, data, cacheDuration)
+			setOracleDecision(cacheKey, data, time.Duration(atomic.LoadInt64(&oracleAllowTTL))*time.Second)
+			rdb.Del(ctx, OracleAllowHitsPrefix+sig)
 		}
 		return res.Result
 	}
 
 	return AnalysisResult{Action: "allow", ProximityMatch: true}
 }
+
+// oracleAllowExpired counts an answer served from the cached allow decision of sig,
+// and tells when ORACLE_ALLOW_MAX_HITS were served and the Oracle should be asked
+// again. The count is shared by the Guardians on the same Redis. It is not during an
+// Oracle outage, when asking again would only lose the cached decision.
+func oracleAllowExpired(sig string) bool {
+	maxHits := atomic.LoadInt64(&oracleAllowMaxHits)
+	if maxHits <= 0 || oracleInOutage() {
+		return false
+	}
+	key := OracleAllowHitsPrefix + sig
+	pipe := rdb.Pipeline()
+	hits := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, time.Duration(atomic.LoadInt64(&oracleAllowTTL))*time.Second)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false
+	}
+	return hits.Val() > maxHits
+}
@@ -0,0 +1,404 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Post-queue asynchronous scanning ---
+//
+// Some sites would rather add no latency to SMTP than block spam before delivery.
+// With ASYNC_QUEUE=true, /enqueue accepts a message like /analyze (raw bytes or a
+// reference, envelope in X-Guardian-* headers) and answers at once. Messages wait in
+// a Redis stream, sealed like stored scans, and are analyzed by ASYNC_WORKERS in the
+// background. Spam is then moved to the Junk folder of its recipients over IMAP
+// and/or notified to a webhook. Guardians sharing the Redis share the queue, and
+// messages of a Guardian that stopped mid-scan are taken over by the others.
+
+const (
+	AsyncQueueKey          = "mi:queue"          // Stream of queued messages
+	AsyncQueueGroup        = "guardian"          // Consumer group of the scanning Guardians
+	AsyncAttemptsPrefix    = "mi:queue:attempt:" // Attempts of a queued message, against endless retries
+	AsyncMovedPrefix       = "mi:queue:moved:"   // Recipients whose copy was already moved
+	AsyncVerdictPrefix     = "mi:queue:verdict:" // Verdict of a queued spam, kept for the retries of its move
+	DefaultAsyncWorkers    = 2
+	DefaultAsyncMaxLen     = 10000 // Messages kept in the queue
+	DefaultAsyncRetry      = 60    // Seconds before a message not found in the mailbox is moved again
+	DefaultAsyncAttempts   = 5     // Attempts of a message before it is dropped
+	DefaultAsyncJunkFolder = "Junk"
+)
+
+// AsyncNotification is posted to ASYNC_WEBHOOK_URL for spam found after delivery
+type AsyncNotification struct {
+	MessageID  string   `json:"message_id,omitempty"`
+	Action     string   `json:"action"`
+	Label      string   `json:"label,omitempty"`
+	MTAAction  string   `json:"mta_action,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Moved      []string `json:"moved,omitempty"` // recipients whose copy was moved to Junk
+	QueuedAt   int64    `json:"queued_at"`
+}
+
+// asyncVerdict is the verdict of a queued spam. It is kept after the first scan, so
+// the retries of a move that failed do not analyze the message again.
+type asyncVerdict struct {
+	MessageID string `json:"message_id,omitempty"`
+	Action    string `json:"action"`
+	Label     string `json:"label,omitempty"`
+	MTAAction string `json:"mta_action,omitempty"`
+}
+
+// errAsyncNotDelivered tells that the message is not in the mailbox yet: the move
+// is retried after ASYNC_RETRY_SECONDS
+var errAsyncNotDelivered = errors.New("message not delivered yet")
+
+// asyncQueueEnabled tells whether /enqueue accepts messages and workers scan them
+func asyncQueueEnabled() bool {
+	return strings.ToLower(getEnv("ASYNC_QUEUE", "false")) == "true"
+}
+
+// asyncConsumer names this Guardian in the consumer group
+func asyncConsumer() string {
+	host, _ := os.Hostname()
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// enqueueHandler serves POST /enqueue: the message is queued for a scan after
+// delivery, and 202 Accepted is returned at once
+func enqueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+	if !asyncQueueEnabled() {
+		writeError(w, http.StatusNotFound, ErrNotFound, "Asynchronous scanning is disabled (ASYNC_QUEUE)")
+		return
+	}
+	raw, ok := readAnalyzeBody(w, r)
+	if !ok {
+		return
+	}
+	sealed, err := sealValue(raw)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrInternal, "Encryption error")
+		return
+	}
+	// The envelope and the request options are replayed with the message
+	header := http.Header{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Guardian-") || k == "Accept-Language" {
+			header[k] = v
+		}
+	}
+	headerJSON, _ := json.Marshal(header)
+
+	id, err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: AsyncQueueKey,
+		MaxLen: getEnvPositiveInt("ASYNC_QUEUE_MAXLEN", DefaultAsyncMaxLen),
+		Approx: true,
+		Values: map[string]interface{}{
+			"message":   sealed,
+			"header":    string(headerJSON),
+			"query":     r.URL.RawQuery,
+			"queued_at": time.Now().Unix(),
+		},
+	}).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+	promAsyncQueue.WithLabelValues("queued").Inc()
+
+	respBytes, _ := json.Marshal(map[string]string{"status": "queued", "id": id})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(respBytes)
+}
+
+// asyncScan analyzes a queued message and applies the post-delivery actions. An
+// error leaves the message in the queue for another attempt, which reuses the
+// verdict of the first scan.
+func asyncScan(msg redis.XMessage) error {
+	field := func(name string) string {
+		s, _ := msg.Values[name].(string)
+		return s
+	}
+	// The envelope and the options of /enqueue, read by the analysis like those of /analyze
+	req := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/analyze", RawQuery: field("query")}, Header: http.Header{}}
+	json.Unmarshal([]byte(field("header")), &req.Header)
+	meta := envelopeMeta(req)
+
+	verdictKey := AsyncVerdictPrefix + msg.ID
+	var verdict asyncVerdict
+	if kept, ok := storedAsyncVerdict(verdictKey); ok {
+		verdict = kept
+		promAsyncQueue.WithLabelValues("move_retried").Inc()
+	} else {
+		raw, err := openValue(field("message"))
+		if err != nil {
+			return err
+		}
+		a, err := analyzeMessage(req, raw)
+		if err != nil {
+			// The message will never be accepted: drop it
+			logger.Warn("Queued message rejected by the analysis", "id", msg.ID, "error", err)
+			return nil
+		}
+		actions := applyVerdict(raw, a, false)
+		promAsyncQueue.WithLabelValues("scanned").Inc()
+		if a.Out.Result.Action != "spam" {
+			return nil
+		}
+		verdict = asyncVerdict{MessageID: a.Env.GetHeader("Message-ID"), Action: a.Out.Result.Action, Label: a.Out.Result.Label,
+			MTAAction: actions.MTAAction}
+		data, _ := json.Marshal(verdict)
+		if sealed, err := sealValue(data); err == nil {
+			rdb.Set(ctx, verdictKey, sealed, 24*time.Hour)
+		}
+	}
+
+	messageID := verdict.MessageID
+	queuedAt, _ := strconv.ParseInt(field("queued_at"), 10, 64)
+	note := AsyncNotification{MessageID: messageID, Action: verdict.Action, Label: verdict.Label, MTAAction: verdict.MTAAction,
+		Recipients: meta.RcptTo, QueuedAt: queuedAt}
+
+	if getEnv("ASYNC_IMAP_ADDR", "") != "" && messageID != "" {
+		recipients := meta.RcptTo
+		if len(recipients) == 0 {
+			recipients = []string{""}
+		}
+		// Copies moved by an earlier attempt are not searched again
+		movedKey := AsyncMovedPrefix + msg.ID
+		for _, rcpt := range recipients {
+			if rdb.SIsMember(ctx, movedKey, rcpt).Val() {
+				note.Moved = append(note.Moved, rcpt)
+				continue
+			}
+			if err := moveToJunk(rcpt, messageID); err != nil {
+				return fmt.Errorf("moving to Junk for %q: %w", rcpt, err)
+			}
+			rdb.SAdd(ctx, movedKey, rcpt)
+			rdb.Expire(ctx, movedKey, 24*time.Hour)
+			note.Moved = append(note.Moved, rcpt)
+			promAsyncQueue.WithLabelValues("moved").Inc()
+		}
+		logger.Info("Spam moved to Junk after delivery", "message_id", messageID, "label", verdict.Label, "recipients", len(note.Moved))
+	}
+	if webhook := getEnv("ASYNC_WEBHOOK_URL", ""); webhook != "" {
+		if err := notifyAsyncVerdict(webhook, note); err != nil {
+			// Moving was done: the notification is not worth another attempt
+			logger.Warn("Asynchronous verdict not notified", "message_id", messageID, "error", err)
+			promAsyncQueue.WithLabelValues("notify_error").Inc()
+		} else {
+			promAsyncQueue.WithLabelValues("notified").Inc()
+		}
+	}
+	return nil
+}
+
+// storedAsyncVerdict reads the verdict kept by an earlier attempt
+func storedAsyncVerdict(key string) (asyncVerdict, bool) {
+	var verdict asyncVerdict
+	stored, err := rdb.Get(ctx, key).Result()
+	if err != nil {
+		return verdict, false
+	}
+	plain, err := openValue(stored)
+	if err != nil {
+		return verdict, false
+	}
+	return verdict, json.Unmarshal(plain, &verdict) == nil
+}
+
+// moveToJunk moves the delivered copies of a message to the Junk folder of a
+// recipient. ASYNC_IMAP_USER may hold {rcpt}, e.g. "{rcpt}*guardian" for a Dovecot
+// master user.
+func moveToJunk(rcpt, messageID string) error {
+	timeout := time.Duration(getEnvPositiveInt("ASYNC_IMAP_TIMEOUT", DefaultReferenceTimeout)) * time.Second
+	plain := strings.ToLower(getEnv("ASYNC_IMAP_TLS", "true")) == "false"
+	user := strings.ReplaceAll(getEnv("ASYNC_IMAP_USER", ""), "{rcpt}", rcpt)
+	c, err := imapLogin(getEnv("ASYNC_IMAP_ADDR", ""), plain, user, getEnv("ASYNC_IMAP_PASSWORD", ""), timeout)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	fmt.Fprintf(c.conn, "g2 SELECT %s\r\n", imapQuote(getEnv("ASYNC_IMAP_MAILBOX", DefaultReferenceMailbox)))
+	if err := c.expectOK("g2"); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.conn, "g3 UID SEARCH HEADER Message-ID %s\r\n", imapQuote(messageID))
+	var uids []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if found, ok := strings.CutPrefix(line, "* SEARCH"); ok {
+			uids = append(uids, strings.Fields(found)...)
+			continue
+		}
+		if strings.HasPrefix(line, "g3 ") {
+			if !strings.HasPrefix(line, "g3 OK") {
+				return fmt.Errorf("%w: %s", errIMAPRefused, line)
+			}
+			break
+		}
+	}
+	if len(uids) == 0 {
+		return errAsyncNotDelivered
+	}
+	fmt.Fprintf(c.conn, "g4 UID MOVE %s %s\r\n", strings.Join(uids, ","), imapQuote(getEnv("ASYNC_JUNK_MAILBOX", DefaultAsyncJunkFolder)))
+	return c.expectOK("g4")
+}
+
+// notifyAsyncVerdict posts a spam verdict found after delivery to the webhook
+func notifyAsyncVerdict(webhook string, note AsyncNotification) error {
+	payload, _ := json.Marshal(note)
+	callCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(callCtx, http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := getEnv("ASYNC_WEBHOOK_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// processAsyncBatch scans queued messages in parallel and acknowledges those done
+// with. Failed attempts stay pending, to be claimed again after ASYNC_RETRY_SECONDS,
+// until ASYNC_MAX_ATTEMPTS.
+func processAsyncBatch(messages []redis.XMessage) {
+	var wg sync.WaitGroup
+	for _, msg := range messages {
+		wg.Add(1)
+		go func(msg redis.XMessage) {
+			defer wg.Done()
+			err := asyncScan(msg)
+			if err != nil {
+				attemptKey := AsyncAttemptsPrefix + msg.ID
+				attempts, _ := rdb.Incr(ctx, attemptKey).Result()
+				rdb.Expire(ctx, attemptKey, 24*time.Hour)
+				if attempts < getEnvPositiveInt("ASYNC_MAX_ATTEMPTS", DefaultAsyncAttempts) {
+					if !errors.Is(err, errAsyncNotDelivered) {
+						logger.Warn("Queued message scan failed, will retry", "id", msg.ID, "attempt", attempts, "error", err)
+					}
+					promAsyncQueue.WithLabelValues("retried").Inc()
+					return
+				}
+				logger.Warn("Queued message dropped after repeated failures", "id", msg.ID, "attempts", attempts, "error", err)
+				promAsyncQueue.WithLabelValues("failed").Inc()
+			}
+			pipe := rdb.Pipeline()
+			pipe.XAck(ctx, AsyncQueueKey, AsyncQueueGroup, msg.ID)
+			pipe.XDel(ctx, AsyncQueueKey, msg.ID)
+			pipe.Del(ctx, AsyncAttemptsPrefix+msg.ID, AsyncMovedPrefix+msg.ID, AsyncVerdictPrefix+msg.ID)
+			pipe.Exec(ctx)
+		}(msg)
+	}
+	wg.Wait()
+}
+
+// claimStaleMessages takes over pending messages idle for minIdle: failed scans and
+// messages of stopped Guardians. XAUTOCLAIM is not used, as the Redis client cannot
+// read its Redis 7 answer.
+func claimStaleMessages(consumer string, minIdle time.Duration, count int64) []redis.XMessage {
+	pending, err := rdb.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: AsyncQueueKey, Group: AsyncQueueGroup, Idle: minIdle, Start: "-", End: "+", Count: count,
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(pending))
+	for _, p := range pending {
+		ids = append(ids, p.ID)
+	}
+	claimed, _ := rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream: AsyncQueueKey, Group: AsyncQueueGroup, Consumer: consumer, MinIdle: minIdle, Messages: ids,
+	}).Result()
+	return claimed
+}
+
+// asyncQueueWorker reads the queue while ASYNC_QUEUE is enabled: messages left
+// pending (failed scans, stopped Guardians) first, then new ones
+func asyncQueueWorker() {
+	consumer := asyncConsumer()
+	groupReady := false
+	for {
+		if !asyncQueueEnabled() {
+			time.Sleep(1 * time.Minute)
+			continue
+		}
+		if !groupReady {
+			err := rdb.XGroupCreateMkStream(ctx, AsyncQueueKey, AsyncQueueGroup, "0").Err()
+			if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+				logger.Warn("Asynchronous queue unavailable", "error", err)
+				time.Sleep(10 * time.Second)
+				continue
+			}
+			groupReady = true
+		}
+		workers := getEnvPositiveInt("ASYNC_WORKERS", DefaultAsyncWorkers)
+
+		retry := time.Duration(getEnvPositiveInt("ASYNC_RETRY_SECONDS", DefaultAsyncRetry)) * time.Second
+		if claimed := claimStaleMessages(consumer, retry, workers); len(claimed) > 0 {
+			processAsyncBatch(claimed)
+			continue
+		}
+
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: AsyncQueueGroup, Consumer: consumer, Streams: []string{AsyncQueueKey, ">"}, Count: workers, Block: 5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				groupReady = false
+			}
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for _, s := range streams {
+			processAsyncBatch(s.Messages)
+		}
+	}
+}
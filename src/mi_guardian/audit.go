@@ -0,0 +1,196 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Consistency audit of the local store ---
+//
+// Band sets (lg_f:) and score keys (lg_s:) expire separately: a band refreshed by
+// another hash outlives the score of its older members, and a partial restore may
+// bring back scores without their bands. Orphan band members cost a distance
+// computation on every lookup for nothing; scores without bands can never match.
+// The audit removes the former and adds the latter back to their bands.
+
+var (
+	auditIntervalHours int64 = DefaultAuditInterval
+	auditMu            sync.Mutex
+)
+
+// AuditReport is the result of an audit run
+type AuditReport struct {
+	DryRun          bool    `json:"dry_run"`
+	BandsScanned    int64   `json:"bands_scanned"`
+	MembersChecked  int64   `json:"members_checked"`
+	OrphanMembers   int64   `json:"orphan_members"`
+	ScoresChecked   int64   `json:"scores_checked"`
+	OrphanScores    int64   `json:"orphan_scores"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// auditLocalStore removes band members without a score key and re-indexes score
+// keys missing from all their bands. dryRun only counts them.
+func auditLocalStore(dryRun bool) (AuditReport, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	start := time.Now()
+	report := AuditReport{DryRun: dryRun}
+	scored := make(map[string]bool) // Hash -> score key exists, shared by every band
+
+	// 1. Band members whose score key expired
+	iter := rdb.Scan(ctx, 0, LocalFragPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		members, err := rdb.SMembers(ctx, key).Result()
+		if err != nil {
+			return report, err
+		}
+		report.BandsScanned++
+		report.MembersChecked += int64(len(members))
+
+		pipe := rdb.Pipeline()
+		cmds := make(map[string]*redis.IntCmd)
+		for _, m := range members {
+			if _, known := scored[m]; !known {
+				cmds[m] = pipe.Exists(ctx, LocalScorePrefix+m)
+			}
+		}
+		if len(cmds) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return report, err
+			}
+		}
+		for m, cmd := range cmds {
+			scored[m] = cmd.Val() > 0
+		}
+
+		var orphans []interface{}
+		for _, m := range members {
+			if !scored[m] {
+				orphans = append(orphans, m)
+			}
+		}
+		if len(orphans) == 0 {
+			continue
+		}
+		report.OrphanMembers += int64(len(orphans))
+		promAuditOrphans.WithLabelValues("band_member").Add(float64(len(orphans)))
+		if !dryRun {
+			rdb.SRem(ctx, key, orphans...)
+			forgetBands(LocalFragPrefix, []string{strings.TrimPrefix(key, LocalFragPrefix)})
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return report, err
+	}
+
+	// 2. Score keys absent from all their bands
+	iter = rdb.Scan(ctx, 0, LocalScorePrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		hash := strings.TrimPrefix(iter.Val(), LocalScorePrefix)
+		report.ScoresChecked++
+		bands := extractBands_6_3(hash)
+		if len(bands) == 0 {
+			continue
+		}
+
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.BoolCmd, len(bands))
+		for i, band := range bands {
+			cmds[i] = pipe.SIsMember(ctx, LocalFragPrefix+band, hash)
+		}
+		ttlCmd := pipe.PTTL(ctx, iter.Val())
+		if _, err := pipe.Exec(ctx); err != nil {
+			return report, err
+		}
+		indexed := false
+		for _, cmd := range cmds {
+			if cmd.Val() {
+				indexed = true
+				break
+			}
+		}
+		if indexed {
+			continue
+		}
+		report.OrphanScores++
+		promAuditOrphans.WithLabelValues("score").Inc()
+		if !dryRun {
+			ttl := ttlCmd.Val()
+			if ttl <= 0 {
+				ttl = localRetentionDuration
+			}
+			addToBands(LocalFragPrefix, bands, hash, ttl)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return report, err
+	}
+
+	report.DurationSeconds = time.Since(start).Seconds()
+	return report, nil
+}
+
+// Consistency audit worker (AUDIT_INTERVAL_HOURS, 0 disables it). One Guardian
+// per Redis runs it per interval.
+func auditWorker() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		hours := atomic.LoadInt64(&auditIntervalHours)
+		if hours <= 0 || !maintenanceAllowed("audit") {
+			continue
+		}
+		if ok, _ := rdb.SetNX(ctx, AuditLockKey, nodeID, time.Duration(hours)*time.Hour).Result(); !ok {
+			continue
+		}
+		report, err := auditLocalStore(false)
+		if err != nil {
+			logger.Warn("Consistency audit failed", "error", err)
+			continue
+		}
+		logger.Info("Consistency audit done", "bands", report.BandsScanned, "orphan_members", report.OrphanMembers,
+			"scores", report.ScoresChecked, "orphan_scores", report.OrphanScores, "seconds", report.DurationSeconds)
+	}
+}
+
+// auditHandler runs the consistency audit now; ?dry_run=1 only reports
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	report, err := auditLocalStore(r.URL.Query().Get("dry_run") == "1")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+
+	respBytes, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
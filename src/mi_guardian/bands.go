@@ -0,0 +1,223 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"mailuminati-guardian/internal/store"
+)
+
+// --- Hot bands ---
+//
+// Some bands are shared by a large share of the learned signatures (common
+// templates, empty-ish bodies) and their sets grow to thousands of members. Reading
+// them on every lookup makes candidate lists, and latency, unbounded. A band over
+// BAND_HOT_SIZE members still counts as a matching band, but its members are not
+// read. Band sets are trimmed to BAND_MAX_MEMBERS on write.
+
+var (
+	bandHotSize    int64 = DefaultBandHotSize
+	bandMaxMembers int64 = DefaultBandMaxMembers
+)
+
+// loadBandLimits reads BAND_HOT_SIZE and BAND_MAX_MEMBERS
+func loadBandLimits() {
+	atomic.StoreInt64(&bandHotSize, getEnvPositiveInt("BAND_HOT_SIZE", DefaultBandHotSize))
+	atomic.StoreInt64(&bandMaxMembers, getEnvPositiveInt("BAND_MAX_MEMBERS", DefaultBandMaxMembers))
+}
+
+// bandStore names the store of a band key prefix, as used in metrics and /admin/bands
+func bandStore(prefix string) string {
+	if prefix == OracleCacheFragPrefix {
+		return "oracle_cache"
+	}
+	return "local"
+}
+
+// refreshTTLScript re-expires the keys whose TTL is below ARGV[1] milliseconds
+// (or that have none) to ARGV[2], and returns how many it refreshed
+var refreshTTLScript = store.NewScript(`
+local refreshed = 0
+for _, key in ipairs(KEYS) do
+	local ttl = redis.call('PTTL', key)
+	if ttl ~= -2 and ttl < tonumber(ARGV[1]) then
+		redis.call('PEXPIRE', key, ARGV[2])
+		refreshed = refreshed + 1
+	end
+end
+return refreshed
+`)
+
+// refreshBandTTLs keeps matched band sets alive. Every lookup hit used to send an
+// EXPIRE per band; a key is now only refreshed once less than BandTTLRefreshRatio of
+// ttl remains, in one script call, so a busy band is written about once per half
+// retention instead of once per message.
+func refreshBandTTLs(keys []string, ttl time.Duration) {
+	if len(keys) == 0 || ttl <= 0 {
+		return
+	}
+	threshold := int64(float64(ttl.Milliseconds()) * BandTTLRefreshRatio)
+	refreshed, err := refreshTTLScript.Run(ctx, rdb, keys, threshold, ttl.Milliseconds()).Int()
+	if err != nil {
+		logger.Warn("Band TTL refresh failed", "error", err)
+		return
+	}
+	promBandTTLRefresh.WithLabelValues("refreshed").Add(float64(refreshed))
+	promBandTTLRefresh.WithLabelValues("skipped").Add(float64(len(keys) - refreshed))
+}
+
+// bandMembers returns the distinct members of the band sets keys, skipping hot bands.
+// A single pipeline reads at most BAND_HOT_SIZE members per band.
+func bandMembers(prefix string, keys []string) []string {
+	hotSize := atomic.LoadInt64(&bandHotSize)
+	pipe := rdb.Pipeline()
+	sizeCmds := make([]*redis.IntCmd, len(keys))
+	memberCmds := make([]*redis.StringSliceCmd, len(keys))
+	for i, key := range keys {
+		sizeCmds[i] = pipe.SCard(ctx, key)
+		memberCmds[i] = pipe.SRandMemberN(ctx, key, hotSize)
+	}
+	pipe.Exec(ctx)
+
+	var members []string
+	seen := make(map[string]struct{})
+	for i := range keys {
+		if sizeCmds[i].Val() > hotSize {
+			promHotBands.WithLabelValues(bandStore(prefix)).Inc()
+			continue
+		}
+		for _, m := range memberCmds[i].Val() {
+			if _, ok := seen[m]; !ok {
+				members = append(members, m)
+				seen[m] = struct{}{}
+			}
+		}
+	}
+	return members
+}
+
+// addToBands adds member to its band sets under prefix, refreshes their expiry and
+// trims the sets grown over BAND_MAX_MEMBERS
+func addToBands(prefix string, bands []string, member string, ttl time.Duration) {
+	pipe := rdb.Pipeline()
+	sizeCmds := make([]*redis.IntCmd, len(bands))
+	for i, band := range bands {
+		key := prefix + band
+		pipe.SAdd(ctx, key, member)
+		pipe.PExpire(ctx, key, ttl)
+		sizeCmds[i] = pipe.SCard(ctx, key)
+	}
+	pipe.Exec(ctx)
+	forgetBands(prefix, bands)
+
+	maxMembers := atomic.LoadInt64(&bandMaxMembers)
+	pipe = rdb.Pipeline()
+	trimmed := 0
+	for i, band := range bands {
+		if excess := sizeCmds[i].Val() - maxMembers; excess > 0 {
+			pipe.SPopN(ctx, prefix+band, excess)
+			trimmed++
+		}
+	}
+	if trimmed > 0 {
+		pipe.Exec(ctx)
+		promBandsTrimmed.WithLabelValues(bandStore(prefix)).Add(float64(trimmed))
+	}
+}
+
+// BandSize is the cardinality of one band set
+type BandSize struct {
+	Band    string `json:"band"`
+	Members int64  `json:"members"`
+}
+
+// BandStats describes the band sets of one store
+type BandStats struct {
+	Bands   int64      `json:"bands"`
+	Members int64      `json:"members"`
+	Hot     int64      `json:"hot"`
+	Largest []BandSize `json:"largest"`
+}
+
+// collectBandStats scans the band sets under prefix and keeps the limit largest
+func collectBandStats(prefix string, limit int) (BandStats, error) {
+	stats := BandStats{Largest: []BandSize{}}
+	hotSize := atomic.LoadInt64(&bandHotSize)
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, prefix+"*", 1000).Result()
+		if err != nil {
+			return stats, err
+		}
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.IntCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.SCard(ctx, key)
+		}
+		if len(keys) > 0 {
+			pipe.Exec(ctx)
+		}
+		for i, key := range keys {
+			size := cmds[i].Val()
+			stats.Bands++
+			stats.Members += size
+			if size > hotSize {
+				stats.Hot++
+			}
+			stats.Largest = append(stats.Largest, BandSize{Band: strings.TrimPrefix(key, prefix), Members: size})
+		}
+		sort.Slice(stats.Largest, func(i, j int) bool { return stats.Largest[i].Members > stats.Largest[j].Members })
+		if len(stats.Largest) > limit {
+			stats.Largest = stats.Largest[:limit]
+		}
+		if cursor = next; cursor == 0 {
+			return stats, nil
+		}
+	}
+}
+
+// bandsHandler reports the size of the local and Oracle cache band sets
+func bandsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"hot_size":    atomic.LoadInt64(&bandHotSize),
+		"max_members": atomic.LoadInt64(&bandMaxMembers),
+	}
+	for _, prefix := range []string{LocalFragPrefix, OracleCacheFragPrefix} {
+		stats, err := collectBandStats(prefix, MaxBandStatsListed)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+		resp[bandStore(prefix)] = stats
+	}
+
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,184 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"hash/fnv"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Bayes token model ---
+//
+// Fuzzy hashes need a first report before they catch a campaign, and miss one-off
+// spam entirely. With BAYES=true, the words of the subject and body, the From
+// domain and the link hosts of every scan are kept with it, and spam and ham reports
+// train a naive Bayes model on them. Its spam probability raises the bayes signal
+// and, multiplied by BAYES_WEIGHT, is weighed against the spam threshold. Tokens are
+// hashed into BayesBuckets buckets: no word is stored in clear and the model stays
+// bounded.
+
+const (
+	BayesBuckets           = 1 << 20 // Hash buckets of the tokens
+	MaxBayesTokens         = 400     // Distinct tokens kept per message
+	BayesInterestingTokens = 150     // Tokens furthest from 0.5 combined into the probability
+	BayesSignalScore       = 0.9     // Probability from which the bayes signal is raised
+	DefaultBayesMinTrained = 50      // Spam and ham reports each before the model is used
+	MinBayesWordLength     = 3
+	MaxBayesWordLength     = 24
+)
+
+// bayesEnabled tells whether tokens are collected and the model used
+func bayesEnabled() bool {
+	return strings.ToLower(getEnv("BAYES", "false")) == "true"
+}
+
+// bayesToken hashes a token into its bucket
+func bayesToken(token string) string {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return strconv.FormatUint(uint64(h.Sum32()&(BayesBuckets-1)), 16)
+}
+
+// bayesTokens returns the distinct tokens of a message: subject and body words,
+// From domain and link hosts, each kind with its own prefix
+func bayesTokens(env *enmime.Envelope) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if len(tokens) < MaxBayesTokens && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, bayesToken(token))
+		}
+	}
+	words := func(prefix, text string) {
+		for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			if n := len([]rune(w)); n >= MinBayesWordLength && n <= MaxBayesWordLength {
+				add(prefix + w)
+			}
+		}
+	}
+
+	words("s:", env.GetHeader("Subject"))
+	if from := addressDomain(env.GetHeader("From")); from != "" {
+		add("f:" + from)
+	}
+	for _, link := range messageLinks(env) {
+		if u, err := url.Parse(link.URL); err == nil && u.Hostname() != "" {
+			add("u:" + strings.ToLower(u.Hostname()))
+		}
+	}
+	// enmime fills Text from the HTML when the message has no text part of its own
+	words("", env.Text)
+	return tokens
+}
+
+// learnTokens trains the model with the tokens of a reported message
+func learnTokens(tokens []string, reportType string) {
+	key, counter := BayesSpamKey, "spam_messages"
+	if reportType == "ham" {
+		key, counter = BayesHamKey, "ham_messages"
+	}
+	pipe := rdb.Pipeline()
+	for _, t := range tokens {
+		pipe.HIncrBy(ctx, key, t, 1)
+	}
+	pipe.HIncrBy(ctx, BayesMetaKey, counter, 1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warn("Bayes training failed", "error", err)
+	}
+}
+
+// bayesProbability returns the spam probability of a message from its tokens, false
+// until the model was trained with BAYES_MIN_TRAINED spam and ham reports
+func bayesProbability(tokens []string) (float64, bool) {
+	if len(tokens) == 0 {
+		return 0, false
+	}
+	meta, err := rdb.HMGet(ctx, BayesMetaKey, "spam_messages", "ham_messages").Result()
+	if err != nil {
+		return 0, false
+	}
+	spamMessages, hamMessages := hashInt(meta[0]), hashInt(meta[1])
+	minTrained := getEnvPositiveInt("BAYES_MIN_TRAINED", DefaultBayesMinTrained)
+	if spamMessages < minTrained || hamMessages < minTrained {
+		return 0, false
+	}
+
+	pipe := rdb.Pipeline()
+	spamCmd := pipe.HMGet(ctx, BayesSpamKey, tokens...)
+	hamCmd := pipe.HMGet(ctx, BayesHamKey, tokens...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, false
+	}
+	spamCounts, hamCounts := spamCmd.Val(), hamCmd.Val()
+
+	// Robinson's token probabilities, pulled towards 0.5 for rarely seen tokens
+	var probs []float64
+	for i := range tokens {
+		s, h := float64(hashInt(spamCounts[i])), float64(hashInt(hamCounts[i]))
+		if s+h == 0 {
+			continue
+		}
+		ps, ph := s/float64(spamMessages), h/float64(hamMessages)
+		f := (0.5 + (s+h)*ps/(ps+ph)) / (1 + s + h)
+		if math.Abs(f-0.5) >= 0.1 {
+			probs = append(probs, f)
+		}
+	}
+	if len(probs) == 0 {
+		return 0.5, true
+	}
+	sort.Slice(probs, func(i, j int) bool { return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5) })
+	if len(probs) > BayesInterestingTokens {
+		probs = probs[:BayesInterestingTokens]
+	}
+
+	// Geometric means of the spam and ham evidence
+	var logHam, logSpam float64
+	for _, f := range probs {
+		logHam += math.Log(1 - f)
+		logSpam += math.Log(f)
+	}
+	n := float64(len(probs))
+	p := 1 - math.Exp(logHam/n)
+	q := 1 - math.Exp(logSpam/n)
+	return (1 + (p-q)/(p+q)) / 2, true
+}
+
+// bayesSpam tells whether the model rates tokens as spam enough to act on it
+func bayesSpam(tokens []string, threshold int64) (float64, bool, bool) {
+	probability, ok := bayesProbability(tokens)
+	if !ok {
+		return 0, false, false
+	}
+	weight := atomic.LoadInt64(&bayesWeight)
+	return probability, probability >= BayesSignalScore, weight > 0 && probability*float64(weight) >= float64(threshold)
+}
+
+// hashInt reads a counter returned by HMGET (nil when missing)
+func hashInt(v interface{}) int64 {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,219 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Benchmark mode (-bench) ---
+//
+// Replays a corpus of raw messages through the in-process stages of /analyze,
+// without Redis, Oracle or image downloads, and reports throughput and allocations
+// per stage. Run it on the same corpus before and after a change to catch
+// regressions in parsing, normalization, TLSH or banding:
+//
+//	mailuminati-guardian -bench /path/to/corpus -bench-iterations 5 -bench-cpuprofile cpu.out
+
+// BenchStageReport is the cost of one stage, per message
+type BenchStageReport struct {
+	Stage        string  `json:"stage"`
+	Seconds      float64 `json:"seconds"`
+	NsPerMsg     int64   `json:"ns_per_msg"`
+	AllocsPerMsg uint64  `json:"allocs_per_msg"`
+	BytesPerMsg  uint64  `json:"bytes_per_msg"`
+}
+
+// BenchReport is the result of a -bench run
+type BenchReport struct {
+	Messages   int                `json:"messages"`
+	Skipped    int                `json:"skipped,omitempty"`
+	Iterations int                `json:"iterations"`
+	Seconds    float64            `json:"seconds"`
+	MsgsPerSec float64            `json:"msgs_per_sec"`
+	Stages     []BenchStageReport `json:"stages"`
+}
+
+// benchMessage is a corpus message and what the earlier stages produced from it
+type benchMessage struct {
+	raw        []byte
+	env        *enmime.Envelope
+	signatures []string
+}
+
+// benchStages are the stages of analyzeHandler that do not leave the process, in order
+var benchStages = []struct {
+	name string
+	run  func(m *benchMessage)
+}{
+	{"parse", func(m *benchMessage) {
+		m.env, _, _ = readEnvelopeLimited(m.raw)
+	}},
+	{"normalize", func(m *benchMessage) {
+		normalizeEmailBody(m.env.Text, m.env.HTML)
+	}},
+	{"signatures", func(m *benchMessage) {
+		m.signatures = m.signatures[:0]
+		for _, part := range messageSignatures(m.env, "", logger) {
+			m.signatures = append(m.signatures, part.Signature)
+		}
+		m.signatures = dedupeSignatures(append(m.signatures, nestedSignatures(m.env, 0)...))
+	}},
+	{"banding", func(m *benchMessage) {
+		for _, sig := range m.signatures {
+			extractBands_6_3(sig)
+		}
+	}},
+	{"structure", func(m *benchMessage) {
+		mimeStructure(m.raw, m.env)
+	}},
+	{"content_checks", func(m *benchMessage) {
+		checkFilenames(m.env)
+		encryptedAttachments(m.env)
+		messageCredentialForms(m.env)
+		attachmentDigests(m.env)
+		messageQRURLs(m.env)
+	}},
+}
+
+// loadBenchCorpus reads every file of dir, recursively, as a raw message
+func loadBenchCorpus(dir string) ([]*benchMessage, error) {
+	var corpus []*benchMessage
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		raw, err := io.ReadAll(io.LimitReader(f, MaxProcessSize))
+		if err != nil {
+			return err
+		}
+		if len(raw) > 0 {
+			corpus = append(corpus, &benchMessage{raw: raw})
+		}
+		return nil
+	})
+	return corpus, err
+}
+
+// runBench replays the corpus of dir iterations times through benchStages
+func runBench(dir string, iterations int) (BenchReport, error) {
+	corpus, err := loadBenchCorpus(dir)
+	if err != nil {
+		return BenchReport{}, err
+	}
+	if len(corpus) == 0 {
+		return BenchReport{}, fmt.Errorf("no message in %s", dir)
+	}
+
+	// Messages enmime cannot parse would make every later stage meaningless
+	report := BenchReport{Iterations: iterations}
+	parsed := corpus[:0]
+	for _, m := range corpus {
+		if env, _, err := readEnvelopeLimited(m.raw); err == nil {
+			m.env = env
+			parsed = append(parsed, m)
+		} else {
+			report.Skipped++
+		}
+	}
+	corpus = parsed
+	report.Messages = len(corpus)
+	if len(corpus) == 0 {
+		return report, fmt.Errorf("no parsable message in %s", dir)
+	}
+
+	runs := uint64(len(corpus) * iterations)
+	var before, after runtime.MemStats
+	for _, stage := range benchStages {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		for i := 0; i < iterations; i++ {
+			for _, m := range corpus {
+				stage.run(m)
+			}
+		}
+		elapsed := time.Since(start)
+		runtime.ReadMemStats(&after)
+
+		report.Seconds += elapsed.Seconds()
+		report.Stages = append(report.Stages, BenchStageReport{
+			Stage:        stage.name,
+			Seconds:      elapsed.Seconds(),
+			NsPerMsg:     elapsed.Nanoseconds() / int64(runs),
+			AllocsPerMsg: (after.Mallocs - before.Mallocs) / runs,
+			BytesPerMsg:  (after.TotalAlloc - before.TotalAlloc) / runs,
+		})
+	}
+	if report.Seconds > 0 {
+		report.MsgsPerSec = float64(runs) / report.Seconds
+	}
+	return report, nil
+}
+
+// benchMain runs -bench, with optional CPU and heap profiles, and prints the report
+func benchMain(dir string, iterations int, cpuProfile, memProfile string) error {
+	if iterations < 1 {
+		iterations = 1
+	}
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	report, err := runBench(dir, iterations)
+	if err != nil {
+		return err
+	}
+
+	if memProfile != "" {
+		f, err := os.Create(memProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			return err
+		}
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,149 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Exact attachment blocklist ---
+
+var reSHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// attachmentDigests returns the SHA-256 of every attachment, inline or other non-body part
+func attachmentDigests(env *enmime.Envelope) []string {
+	var digests []string
+	seen := make(map[string]bool)
+	for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+		for _, p := range group {
+			if len(p.Content) == 0 {
+				continue
+			}
+			sum := sha256.Sum256(p.Content)
+			digest := hex.EncodeToString(sum[:])
+			if !seen[digest] {
+				seen[digest] = true
+				digests = append(digests, digest)
+			}
+		}
+	}
+	return digests
+}
+
+// blockedDigest returns the first digest found in the local or Oracle blocklist
+func blockedDigest(digests []string) (string, string) {
+	if len(digests) == 0 {
+		return "", ""
+	}
+	pipe := rdb.Pipeline()
+	localCmds := make([]*redis.BoolCmd, len(digests))
+	oracleCmds := make([]*redis.BoolCmd, len(digests))
+	for i, d := range digests {
+		localCmds[i] = pipe.SIsMember(ctx, BlocklistLocalKey, d)
+		oracleCmds[i] = pipe.SIsMember(ctx, BlocklistOracleKey, d)
+	}
+	pipe.Exec(ctx)
+	for i, d := range digests {
+		if localCmds[i].Val() {
+			return d, "local"
+		}
+		if oracleCmds[i].Val() {
+			return d, "oracle"
+		}
+	}
+	return "", ""
+}
+
+// normalizeDigests lowercases digests and drops anything that is not a SHA-256
+func normalizeDigests(in []string) (valid []string, invalid []string) {
+	for _, d := range in {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if reSHA256.MatchString(d) {
+			valid = append(valid, d)
+		} else {
+			invalid = append(invalid, d)
+		}
+	}
+	return valid, invalid
+}
+
+// blocklistHandler lists (GET) or edits (POST {"add": [...], "remove": [...]}) the local blocklist
+func blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		local, err := rdb.SMembers(ctx, BlocklistLocalKey).Result()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+		respBytes, _ := json.Marshal(map[string]interface{}{
+			"local":  local,
+			"oracle": rdb.SCard(ctx, BlocklistOracleKey).Val(),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	case http.MethodPost:
+		var reqBody struct {
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+			return
+		}
+		add, invalidAdd := normalizeDigests(reqBody.Add)
+		remove, invalidRemove := normalizeDigests(reqBody.Remove)
+		if invalid := append(invalidAdd, invalidRemove...); len(invalid) > 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid SHA-256: "+strings.Join(invalid, ", "))
+			return
+		}
+
+		pipe := rdb.Pipeline()
+		for _, d := range add {
+			pipe.SAdd(ctx, BlocklistLocalKey, d)
+		}
+		for _, d := range remove {
+			pipe.SRem(ctx, BlocklistLocalKey, d)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && len(add)+len(remove) > 0 {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+		forgetVerdicts()
+		logger.Info("Attachment blocklist updated", "added", len(add), "removed", len(remove))
+
+		respBytes, _ := json.Marshal(map[string]interface{}{
+			"added":   len(add),
+			"removed": len(remove),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+	}
+}
@@ -0,0 +1,197 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- In-process cache ---
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// lruCache is a size-bounded LRU with per-entry expiry, safe for concurrent use.
+// It absorbs hot-path Redis reads during bursts of near-identical messages.
+type lruCache[V any] struct {
+	name    string
+	mu      sync.Mutex
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newLRUCache[V any](name string, max int) *lruCache[V] {
+	return &lruCache[V]{name: name, max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache[V]) Get(key string) (V, bool) {
+	var zero V
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		promMemoryCache.WithLabelValues(c.name, "miss").Inc()
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[V])
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		promMemoryCache.WithLabelValues(c.name, "miss").Inc()
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	promMemoryCache.WithLabelValues(c.name, "hit").Inc()
+	return entry.value, true
+}
+
+func (c *lruCache[V]) Set(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.max <= 0 || ttl <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expires = time.Now().Add(ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: time.Now().Add(ttl)})
+	c.evict()
+}
+
+func (c *lruCache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (c *lruCache[V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Resize changes the capacity (0 disables caching), evicting as needed
+func (c *lruCache[V]) Resize(max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.max = max
+	c.evict()
+}
+
+// evict drops least recently used entries above capacity (lock held)
+func (c *lruCache[V]) evict() {
+	for c.order.Len() > 0 && c.order.Len() > c.max {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*lruEntry[V]).key)
+	}
+}
+
+var (
+	oracleDecisionCache = newLRUCache[string]("oracle_decision", DefaultMemoryCacheSize)
+	bandExistsCache     = newLRUCache[bool]("band_exists", DefaultMemoryCacheSize)
+	verdictCache        = newLRUCache[analysisOutcome]("verdict", DefaultMemoryCacheSize)
+)
+
+// memoryCacheTTL bounds how long a value may be served without asking Redis
+func memoryCacheTTL(redisTTL time.Duration) time.Duration {
+	ttl := time.Duration(atomic.LoadInt64(&memoryCacheTTLSeconds)) * time.Second
+	if redisTTL > 0 && redisTTL < ttl {
+		return redisTTL
+	}
+	return ttl
+}
+
+// getOracleDecision reads a cached oracle decision, memory first then Redis
+func getOracleDecision(cacheKey string) (string, error) {
+	if v, ok := oracleDecisionCache.Get(cacheKey); ok {
+		return v, nil
+	}
+	v, err := rdb.Get(ctx, cacheKey).Result()
+	if err == nil {
+		oracleDecisionCache.Set(cacheKey, v, memoryCacheTTL(0))
+	}
+	return v, err
+}
+
+// setOracleDecision stores an oracle decision in Redis and memory
+func setOracleDecision(cacheKey string, data []byte, ttl time.Duration) {
+	rdb.Set(ctx, cacheKey, data, ttl)
+	oracleDecisionCache.Set(cacheKey, string(data), memoryCacheTTL(ttl))
+}
+
+// bandsExist checks band keys, answering from memory when possible and
+// pipelining the remaining EXISTS calls to Redis
+func bandsExist(keys []string) map[string]bool {
+	result := make(map[string]bool, len(keys))
+	var missing []string
+	for _, key := range keys {
+		if exists, ok := bandExistsCache.Get(key); ok {
+			result[key] = exists
+		} else {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return result
+	}
+
+	pipe := rdb.Pipeline()
+	cmds := make(map[string]*redis.IntCmd, len(missing))
+	for _, key := range missing {
+		cmds[key] = pipe.Exists(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+
+	ttl := memoryCacheTTL(0)
+	for key, cmd := range cmds {
+		exists := cmd.Val() > 0
+		result[key] = exists
+		if err == nil {
+			bandExistsCache.Set(key, exists, ttl)
+		}
+	}
+	return result
+}
+
+// forgetBands invalidates cached existence of band keys after local writes
+func forgetBands(prefix string, bands []string) {
+	for _, band := range bands {
+		bandExistsCache.Delete(prefix + band)
+	}
+}
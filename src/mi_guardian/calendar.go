@@ -0,0 +1,141 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Calendar invites ---
+
+// calendarEvent holds the VEVENT fields carrying the spam payload
+type calendarEvent struct {
+	Summary     string
+	Description string
+	Location    string
+	Organizer   string
+	URLs        []string
+	Attendees   int
+}
+
+type calendarInvite struct {
+	Method string
+	Events []calendarEvent
+}
+
+// calendarParts returns the text/calendar parts of the MIME tree, wherever they sit
+func calendarParts(env *enmime.Envelope) []*enmime.Part {
+	return findParts(env, func(p *enmime.Part) bool {
+		ct := strings.ToLower(p.ContentType)
+		return ct == "text/calendar" || ct == "application/ics" || strings.HasSuffix(strings.ToLower(p.FileName), ".ics")
+	})
+}
+
+// icsUnescape decodes TEXT values (RFC 5545 3.3.11)
+var icsUnescape = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// parseCalendar reads the VEVENTs of an iCalendar object
+func parseCalendar(data string) calendarInvite {
+	// Unfold continuation lines
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var invite calendarInvite
+	var event *calendarEvent
+	for _, line := range strings.Split(data, "\n") {
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		// Property name without parameters (ORGANIZER;CN=x:mailto:y)
+		name := strings.ToUpper(line[:colon])
+		if semi := strings.IndexByte(name, ';'); semi >= 0 {
+			name = name[:semi]
+		}
+		value := strings.TrimSpace(line[colon+1:])
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			invite.Events = append(invite.Events, calendarEvent{})
+			event = &invite.Events[len(invite.Events)-1]
+		case name == "END" && strings.EqualFold(value, "VEVENT"):
+			event = nil
+		case name == "METHOD":
+			invite.Method = strings.ToUpper(value)
+		case event == nil:
+			continue
+		case name == "SUMMARY":
+			event.Summary = icsUnescape.Replace(value)
+		case name == "DESCRIPTION":
+			event.Description = icsUnescape.Replace(value)
+		case name == "LOCATION":
+			event.Location = icsUnescape.Replace(value)
+		case name == "ORGANIZER":
+			event.Organizer = strings.ToLower(strings.TrimPrefix(strings.ToLower(value), "mailto:"))
+		case name == "URL" || name == "ATTACH":
+			event.URLs = append(event.URLs, value)
+		case name == "ATTENDEE":
+			event.Attendees++
+		}
+	}
+	return invite
+}
+
+// calendarText concatenates the user visible content of the events for hashing
+func calendarText(invite calendarInvite) string {
+	var b strings.Builder
+	for _, ev := range invite.Events {
+		b.WriteString(ev.Summary + "\n" + ev.Description + "\n" + ev.Location + "\n")
+		for _, u := range ev.URLs {
+			b.WriteString(u + "\n")
+		}
+	}
+	return b.String()
+}
+
+// isMassInvite flags invitations sent to many attendees by an organizer whose
+// domain did not sign the message. Only the DKIM results of our MTA tell that:
+// without them, nothing is flagged.
+func isMassInvite(env *enmime.Envelope, invite calendarInvite) bool {
+	limit := atomic.LoadInt64(&calendarMaxAttendees)
+	if limit <= 0 || (invite.Method != "" && invite.Method != "REQUEST") {
+		return false
+	}
+	signers, verified := verifiedDkimDomains(env)
+	if !verified {
+		return false
+	}
+	for _, ev := range invite.Events {
+		if int64(ev.Attendees) < limit {
+			continue
+		}
+		organizerDomain := addressDomain(ev.Organizer)
+		aligned := false
+		for _, signer := range signers {
+			if organizerDomain != "" && (domainMatches(organizerDomain, signer) || domainMatches(signer, organizerDomain)) {
+				aligned = true
+			}
+		}
+		if !aligned {
+			return true
+		}
+	}
+	return false
+}
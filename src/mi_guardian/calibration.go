@@ -0,0 +1,218 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Ham baseline calibration ---
+//
+// Thresholds are tuned on someone else's traffic. HAM_SAMPLE_PERCENT keeps the
+// signatures of a share of allowed messages (nothing else: no Message-ID, sender or
+// tenant) as a baseline of legitimate mail, and CALIBRATION_INTERVAL_MINUTES
+// measures how close it lies to the learned spam. A baseline drifting towards the
+// spam store, or flagged by the current thresholds, tells admins that their
+// thresholds are too loose for their traffic mix before users complain.
+
+const (
+	CalibrationSampleKey       = "mi:calib:ham"  // Sampled ham signatures, by sampling time
+	CalibrationReportKey       = "mi:calib:last" // Last calibration report
+	CalibrationLockKey         = "mi:calibration:lock"
+	DefaultCalibrationInterval = 60   // Minutes between two calibrations
+	DefaultCalibrationSamples  = 1000 // Signatures kept in the baseline
+)
+
+// Upper distances of the buckets of the baseline. Signatures without any learned
+// hash within the last one (or sharing too few bands to be compared) count as "far".
+var calibrationBuckets = []int{30, 50, 70, 100}
+
+var (
+	hamSamplePercent    int64 // 0 = no sampling
+	calibrationInterval int64 = DefaultCalibrationInterval
+)
+
+// CalibrationReport is the distance distribution of the ham baseline to the
+// learned spam, as served by /admin/calibration
+type CalibrationReport struct {
+	Time        int64              `json:"ts"`
+	Samples     int                `json:"samples"`
+	Distances   map[string]float64 `json:"distances"`    // share of samples by distance to the nearest learned hash
+	Flagged     int                `json:"flagged"`      // samples the current thresholds would flag as spam
+	OverlapRisk float64            `json:"overlap_risk"` // flagged / samples
+	Threshold   int64              `json:"threshold"`
+}
+
+// loadCalibration reads the ham sampling rate and the calibration interval
+func loadCalibration() {
+	atomic.StoreInt64(&hamSamplePercent, getEnvInt("HAM_SAMPLE_PERCENT", 0))
+	atomic.StoreInt64(&calibrationInterval, getEnvInt("CALIBRATION_INTERVAL_MINUTES", DefaultCalibrationInterval))
+}
+
+// sampleHam keeps the signatures of an allowed message in the baseline, for
+// HAM_SAMPLE_PERCENT of them
+func sampleHam(res AnalysisResult, signatures []string) {
+	percent := atomic.LoadInt64(&hamSamplePercent)
+	if percent <= 0 || res.Action != "allow" || len(signatures) == 0 || rand.Int63n(100) >= percent {
+		return
+	}
+	now := float64(time.Now().Unix())
+	members := make([]*redis.Z, 0, len(signatures))
+	for _, sig := range signatures {
+		members = append(members, &redis.Z{Score: now, Member: sig})
+	}
+	pipe := rdb.Pipeline()
+	pipe.ZAdd(ctx, CalibrationSampleKey, members...)
+	// Only the most recent samples are kept
+	pipe.ZRemRangeByRank(ctx, CalibrationSampleKey, 0, -getEnvPositiveInt("CALIBRATION_SAMPLES", DefaultCalibrationSamples)-1)
+	pipe.Exec(ctx)
+}
+
+// calibrate measures the distance of every sampled signature to the learned
+// hashes, and how many the baseline profile would flag
+func calibrate() (CalibrationReport, error) {
+	samples, err := rdb.ZRange(ctx, CalibrationSampleKey, 0, -1).Result()
+	if err != nil {
+		return CalibrationReport{}, err
+	}
+	profile := baselineProfile()
+	report := CalibrationReport{Time: time.Now().Unix(), Samples: len(samples), Distances: map[string]float64{}, Threshold: profile.SpamThreshold}
+	counts := make(map[string]int)
+	for _, sig := range samples {
+		bucket := "far"
+		keys := make([]string, 0, 8)
+		for _, b := range extractBands_6_3(sig) {
+			keys = append(keys, LocalFragPrefix+b)
+		}
+		var found []string
+		for key, exists := range bandsExist(keys) {
+			if exists {
+				found = append(found, key)
+			}
+		}
+		if len(found) >= 4 {
+			if members := bandMembers(LocalFragPrefix, found); len(members) > 0 {
+				// Without the ProximityDistance prefilter: the far buckets must be measured too
+				dists, err := distanceBackend().Batch(sig, members)
+				if err == nil {
+					distances := make(map[string]int, len(dists))
+					for i, d := range dists {
+						if d >= 0 {
+							distances[members[i]] = d
+						}
+					}
+					nearest := -1
+					for _, d := range distances {
+						if nearest < 0 || d < nearest {
+							nearest = d
+						}
+					}
+					for _, max := range calibrationBuckets {
+						if nearest >= 0 && nearest <= max {
+							bucket = strconv.Itoa(max)
+							break
+						}
+					}
+					if _, flagged := profile.match(loadLocalCandidates(distances)); flagged {
+						report.Flagged++
+					}
+				}
+			}
+		}
+		counts[bucket]++
+	}
+	names := []string{"far"}
+	for _, max := range calibrationBuckets {
+		names = append(names, strconv.Itoa(max))
+	}
+	for _, name := range names {
+		share := 0.0
+		if len(samples) > 0 {
+			share = float64(counts[name]) / float64(len(samples))
+		}
+		report.Distances[name] = share
+		promCalibrationDistance.WithLabelValues(name).Set(share)
+	}
+	if len(samples) > 0 {
+		report.OverlapRisk = float64(report.Flagged) / float64(len(samples))
+	}
+	promCalibrationRisk.Set(report.OverlapRisk)
+	if payload, err := json.Marshal(report); err == nil {
+		rdb.Set(ctx, CalibrationReportKey, payload, 0)
+	}
+	return report, nil
+}
+
+// calibrationWorker calibrates every CALIBRATION_INTERVAL_MINUTES, on one node of
+// those sharing the Redis
+func calibrationWorker() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		minutes := atomic.LoadInt64(&calibrationInterval)
+		if minutes <= 0 || atomic.LoadInt64(&hamSamplePercent) <= 0 || !maintenanceAllowed("calibration") {
+			continue
+		}
+		if ok, _ := rdb.SetNX(ctx, CalibrationLockKey, nodeID, time.Duration(minutes)*time.Minute).Result(); !ok {
+			continue
+		}
+		report, err := calibrate()
+		if err != nil {
+			logger.Warn("Calibration failed", "error", err)
+			continue
+		}
+		logger.Info("Calibration done", "samples", report.Samples, "flagged", report.Flagged, "overlap_risk", report.OverlapRisk)
+		if report.Flagged > 0 {
+			logger.Warn("Sampled ham would be flagged as spam, thresholds may be too loose", "flagged", report.Flagged, "threshold", report.Threshold)
+		}
+	}
+}
+
+// calibrationHandler serves the last calibration report (GET), or calibrates now
+// (POST)
+func calibrationHandler(w http.ResponseWriter, r *http.Request) {
+	var report CalibrationReport
+	switch r.Method {
+	case http.MethodGet:
+		payload, err := rdb.Get(ctx, CalibrationReportKey).Bytes()
+		if err == redis.Nil {
+			writeError(w, http.StatusNotFound, ErrNotFound, "No calibration yet")
+			return
+		} else if err != nil || json.Unmarshal(payload, &report) != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+	case http.MethodPost:
+		var err error
+		if report, err = calibrate(); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+		return
+	}
+	respBytes, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
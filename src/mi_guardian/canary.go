@@ -0,0 +1,222 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Threshold profiles (canary) ---
+
+// thresholdProfile holds the knobs deciding whether a local match is spam
+type thresholdProfile struct {
+	Name           string
+	SpamThreshold  int64
+	ConflictMargin int64
+	SpamWeight     int64 // Weights reports are counted with, 0 for those they were learned with
+	HamWeight      int64
+}
+
+// localCandidate is a learned hash within distance of a scanned signature
+type localCandidate struct {
+	Hash     string
+	Distance int
+	Score    float64
+	Spam     float64
+	Ham      float64
+	Seen     HashSeen
+}
+
+func baselineProfile() thresholdProfile {
+	return thresholdProfile{
+		Name:           "baseline",
+		SpamThreshold:  atomic.LoadInt64(&localSpamThreshold),
+		ConflictMargin: atomic.LoadInt64(&conflictMargin),
+		SpamWeight:     atomic.LoadInt64(&spamWeight),
+		HamWeight:      atomic.LoadInt64(&hamWeight),
+	}
+}
+
+// canaryProfile returns the experimental profile; unset CANARY_* values fall back to the baseline.
+// ok is false when CANARY_PERCENT is 0.
+func canaryProfile() (thresholdProfile, bool) {
+	if atomic.LoadInt64(&canaryPercent) <= 0 {
+		return thresholdProfile{}, false
+	}
+	p := baselineProfile()
+	p.Name = "canary"
+	if th := atomic.LoadInt64(&canarySpamThreshold); th > 0 {
+		p.SpamThreshold = th
+	}
+	if margin := atomic.LoadInt64(&canaryConflictMargin); margin > 0 {
+		p.ConflictMargin = margin
+	}
+	if w := atomic.LoadInt64(&canarySpamWeight); w > 0 {
+		p.SpamWeight = w
+	}
+	if w := atomic.LoadInt64(&canaryHamWeight); w > 0 {
+		p.HamWeight = w
+	}
+	return p, true
+}
+
+// forSource relaxes the threshold for mailing lists and trusted forwarders
+func (p thresholdProfile) forSource(source string) thresholdProfile {
+	if source != "" {
+		if listThreshold := atomic.LoadInt64(&listSpamThreshold); listThreshold > p.SpamThreshold {
+			p.SpamThreshold = listThreshold
+		}
+	}
+	return p
+}
+
+// weigh returns the candidate as if its reports had been learned with the profile
+// weights. Stored scores and counters use SPAM_WEIGHT and HAM_WEIGHT, so they are
+// scaled by the ratio of the profile weights to those.
+func (p thresholdProfile) weigh(c localCandidate) localCandidate {
+	learnedSpam, learnedHam := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&hamWeight)
+	spam, ham := c.Spam, c.Ham
+	if p.SpamWeight > 0 && learnedSpam > 0 {
+		spam = c.Spam * float64(p.SpamWeight) / float64(learnedSpam)
+	}
+	if p.HamWeight > 0 && learnedHam > 0 {
+		ham = c.Ham * float64(p.HamWeight) / float64(learnedHam)
+	}
+	c.Score += (spam - c.Spam) - (ham - c.Ham)
+	c.Spam, c.Ham = spam, ham
+	return c
+}
+
+// accepts tells whether the profile flags a candidate as spam.
+// Conflicting hashes need spam weight to exceed ham weight by the profile margin.
+func (p thresholdProfile) accepts(c localCandidate) bool {
+	c = p.weigh(c)
+	if c.Score < float64(p.SpamThreshold) {
+		return false
+	}
+	if c.Spam > 0 && c.Ham > 0 {
+		return c.Spam-c.Ham >= float64(p.ConflictMargin)
+	}
+	return true
+}
+
+// match returns the highest scored candidate the profile flags as spam
+func (p thresholdProfile) match(candidates []localCandidate) (localCandidate, bool) {
+	for _, c := range candidates {
+		if p.accepts(c) {
+			return p.weigh(c), true
+		}
+	}
+	return localCandidate{}, false
+}
+
+// inCanary buckets a message by Message-ID so retries get the same profile
+func inCanary(messageID string) bool {
+	percent := atomic.LoadInt64(&canaryPercent)
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	if messageID == "" {
+		return rand.Int63n(100) < percent
+	}
+	h := fnv.New32a()
+	h.Write([]byte(messageID))
+	return int64(h.Sum32()%100) < percent
+}
+
+// selectProfiles returns the enforced profile and, when a canary is configured,
+// the shadow profile whose verdict is only logged and counted
+func selectProfiles(messageID, source, tenant string) (thresholdProfile, *thresholdProfile) {
+	baseline := baselineProfile().forTenant(tenant).forSource(source)
+	canary, ok := canaryProfile()
+	if !ok {
+		return baseline, nil
+	}
+	canary = canary.forSource(source)
+	if inCanary(messageID) {
+		return canary, &baseline
+	}
+	return baseline, &canary
+}
+
+// loadLocalCandidates fetches score and report counters of hashes within
+// distance, highest score first
+func loadLocalCandidates(distances map[string]int) []localCandidate {
+	pipe := rdb.Pipeline()
+	scoreCmds := make(map[string]*redis.StringCmd)
+	counterCmds := make(map[string]*redis.SliceCmd)
+	seenCmds := make(map[string]*redis.SliceCmd)
+	for hash, dist := range distances {
+		if dist <= ProximityDistance {
+			scoreCmds[hash] = pipe.Get(ctx, LocalScorePrefix+hash)
+			counterCmds[hash] = pipe.HMGet(ctx, LocalCounterPrefix+hash, "spam", "ham")
+			seenCmds[hash] = pipe.HMGet(ctx, LocalSeenPrefix+hash, "first", "last", "hits")
+		}
+	}
+	if len(scoreCmds) == 0 {
+		return nil
+	}
+	pipe.Exec(ctx)
+
+	now := time.Now()
+	candidates := make([]localCandidate, 0, len(scoreCmds))
+	for hash, cmd := range scoreCmds {
+		score, _ := strconv.ParseFloat(cmd.Val(), 64)
+		counts := parseFloatValues(counterCmds[hash].Val())
+		if len(counts) < 2 {
+			counts = []float64{0, 0}
+		}
+		// Spam hashes not seen lately weigh less; ham (negative) scores are kept
+		seen := parseSeen(seenCmds[hash].Val())
+		if score > 0 {
+			score *= recencyFactor(seen.LastSeen, now)
+		}
+		candidates = append(candidates, localCandidate{
+			Hash:     hash,
+			Distance: distances[hash],
+			Score:    score,
+			Spam:     counts[0],
+			Ham:      counts[1],
+			Seen:     seen,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Distance < candidates[j].Distance
+	})
+	return candidates
+}
+
+// recordProfileVerdict counts a local verdict per profile
+func recordProfileVerdict(p thresholdProfile, enforced, spam bool) {
+	verdict := "allow"
+	if spam {
+		verdict = "spam"
+	}
+	promProfileVerdicts.WithLabelValues(p.Name, strconv.FormatBool(enforced), verdict).Inc()
+}
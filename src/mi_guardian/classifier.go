@@ -0,0 +1,154 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- External classifier ---
+//
+// Sites with their own model plug it in without forking Guardian: the normalized
+// body and the message metadata are posted to CLASSIFIER_URL, or written to the
+// standard input of CLASSIFIER_COMMAND, which answer {"score": 0.93, "label": "..."}.
+// The score, a spam probability, is multiplied by CLASSIFIER_WEIGHT and flags the
+// message (label classifier) when the result reaches the spam threshold. A slow or
+// failing classifier is skipped: the verdict never waits more than CLASSIFIER_TIMEOUT_MS.
+
+const (
+	DefaultClassifierTimeout = 500 // Milliseconds
+	ClassifierSignalScore    = 0.5 // Score from which the classifier signal is raised
+	MaxClassifierResponse    = 64 << 10
+)
+
+// ClassifierRequest is what the external classifier is given
+type ClassifierRequest struct {
+	Body       string   `json:"body"`
+	Subject    string   `json:"subject"`
+	From       string   `json:"from"`
+	MessageID  string   `json:"message_id"`
+	Tenant     string   `json:"tenant"`
+	ClientIP   string   `json:"client_ip,omitempty"`
+	Helo       string   `json:"helo,omitempty"`
+	MailFrom   string   `json:"mail_from,omitempty"`
+	Recipients int      `json:"recipients"`
+	Signals    []string `json:"signals,omitempty"`
+	Signatures []string `json:"signatures,omitempty"`
+}
+
+// ClassifierResult is the answer of the external classifier
+type ClassifierResult struct {
+	Score float64 `json:"score"`
+	Label string  `json:"label,omitempty"`
+}
+
+// classifierEnabled tells whether an external classifier is configured
+func classifierEnabled() bool {
+	return getEnv("CLASSIFIER_URL", "") != "" || getEnv("CLASSIFIER_COMMAND", "") != ""
+}
+
+// classify asks the external classifier for the spam probability of a message
+func classify(env *enmime.Envelope, meta EnvelopeMeta, tenant string, signals, signatures []string) (ClassifierResult, error) {
+	payload, _ := json.Marshal(ClassifierRequest{
+		Body:       normalizeEmailBody(env.Text, env.HTML),
+		Subject:    env.GetHeader("Subject"),
+		From:       env.GetHeader("From"),
+		MessageID:  env.GetHeader("Message-ID"),
+		Tenant:     tenant,
+		ClientIP:   meta.ClientIP,
+		Helo:       meta.Helo,
+		MailFrom:   meta.MailFrom,
+		Recipients: len(meta.RcptTo),
+		Signals:    signals,
+		Signatures: signatures,
+	})
+	timeout := time.Duration(getEnvPositiveInt("CLASSIFIER_TIMEOUT_MS", DefaultClassifierTimeout)) * time.Millisecond
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var answer []byte
+	var err error
+	if url := getEnv("CLASSIFIER_URL", ""); url != "" {
+		answer, err = classifyWebhook(callCtx, url, payload)
+	} else {
+		answer, err = classifyCommand(callCtx, getEnv("CLASSIFIER_COMMAND", ""), payload)
+	}
+	if errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		promClassifier.WithLabelValues("timeout").Inc()
+		return ClassifierResult{}, callCtx.Err()
+	}
+	if err != nil {
+		promClassifier.WithLabelValues("error").Inc()
+		return ClassifierResult{}, err
+	}
+
+	var result ClassifierResult
+	if err := json.Unmarshal(answer, &result); err != nil || result.Score < 0 || result.Score > 1 {
+		promClassifier.WithLabelValues("error").Inc()
+		return ClassifierResult{}, errors.New("classifier answer must be {\"score\": 0..1}")
+	}
+	promClassifier.WithLabelValues("ok").Inc()
+	return result, nil
+}
+
+// classifyWebhook posts the request to the classifier webhook
+func classifyWebhook(callCtx context.Context, url string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(callCtx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := getEnv("CLASSIFIER_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier answered %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MaxClassifierResponse))
+}
+
+// classifyCommand runs the classifier command with the request on its standard
+// input. The command line is split on spaces, without a shell.
+func classifyCommand(callCtx context.Context, command string, payload []byte) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("CLASSIFIER_COMMAND is empty")
+	}
+	cmd := exec.CommandContext(callCtx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
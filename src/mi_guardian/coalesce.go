@@ -0,0 +1,185 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Coalescing of identical analyses ---
+//
+// A mailing list post reaches the MTA once per recipient, often all at once. Each
+// copy would run the whole pipeline (MIME parsing, hashing, image downloads, Oracle
+// lookup) for the same verdict. Requests with the same analysis key share a single
+// run: the first one executes analyzeHandler, the others wait for its response,
+// which is then kept ANALYZE_DEDUP_TTL seconds for late copies.
+
+// analysisResponse is a recorded /analyze response
+type analysisResponse struct {
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	expires time.Time
+}
+
+func (a *analysisResponse) Header() http.Header         { return a.header }
+func (a *analysisResponse) Write(b []byte) (int, error) { return a.body.Write(b) }
+func (a *analysisResponse) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+}
+
+// analysisCall is an analysis in progress; res is set before done is closed,
+// nil when the run failed
+type analysisCall struct {
+	done chan struct{}
+	res  *analysisResponse
+}
+
+var (
+	analysisMu        sync.Mutex
+	analysisInflight  = make(map[string]*analysisCall)
+	analysisRecent    = make(map[string]*analysisResponse)
+	analysisLastSweep time.Time
+)
+
+// analysisKey digests what the verdict and its side effects depend on: the raw
+// message, the envelope (each recipient is quarantined and counted on its own) and
+// the request options
+func analysisKey(r *http.Request, body []byte) string {
+	meta := envelopeMeta(r)
+	rcpts := make([]string, 0, len(meta.RcptTo))
+	for _, rcpt := range meta.RcptTo {
+		rcpts = append(rcpts, strings.ToLower(rcpt))
+	}
+	sort.Strings(rcpts)
+
+	h := sha256.New()
+	h.Write(body)
+	for _, part := range []string{
+		meta.ClientIP, meta.Helo, meta.MailFrom, meta.AuthUser,
+		strings.Join(rcpts, ","),
+		reasonsLanguage(r), r.Header.Get("X-Guardian-Direction"), r.Header.Get("X-Guardian-Flags"), r.URL.RawQuery,
+	} {
+		h.Write([]byte{0})
+		h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// coalescedAnalyzeHandler serves /analyze, sharing the run of identical concurrent
+// or recent requests
+func coalescedAnalyzeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || analyzeDedupOff.Load() {
+		analyzeHandler(w, r)
+		return
+	}
+
+	body, ok := readAnalyzeBody(w, r)
+	if !ok {
+		return
+	}
+	key := analysisKey(r, body)
+
+	analysisMu.Lock()
+	if res, ok := analysisRecent[key]; ok && time.Now().Before(res.expires) {
+		analysisMu.Unlock()
+		promAnalyzeDedup.WithLabelValues("cache").Inc()
+		writeAnalysisResponse(w, res)
+		return
+	}
+	if call, ok := analysisInflight[key]; ok {
+		analysisMu.Unlock()
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			return
+		}
+		if call.res != nil {
+			promAnalyzeDedup.WithLabelValues("inflight").Inc()
+			writeAnalysisResponse(w, call.res)
+			return
+		}
+		// The shared run failed: analyze this copy on its own
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		analyzeHandler(w, r)
+		return
+	}
+	call := &analysisCall{done: make(chan struct{})}
+	analysisInflight[key] = call
+	analysisMu.Unlock()
+
+	res := &analysisResponse{header: make(http.Header)}
+	defer func() {
+		analysisMu.Lock()
+		delete(analysisInflight, key)
+		if call.res != nil {
+			cacheAnalysisResponse(key, call.res)
+		}
+		analysisMu.Unlock()
+		close(call.done)
+	}()
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	analyzeHandler(res, r)
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	if res.status == http.StatusOK {
+		call.res = res
+	}
+	writeAnalysisResponse(w, res)
+}
+
+// cacheAnalysisResponse keeps a response for late copies, called with analysisMu held
+func cacheAnalysisResponse(key string, res *analysisResponse) {
+	ttl := time.Duration(atomic.LoadInt64(&analyzeDedupTTL)) * time.Second
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(analysisLastSweep) >= ttl {
+		for k, old := range analysisRecent {
+			if now.After(old.expires) {
+				delete(analysisRecent, k)
+			}
+		}
+		analysisLastSweep = now
+	}
+	if len(analysisRecent) >= MaxAnalyzeDedupEntries {
+		return
+	}
+	res.expires = now.Add(ttl)
+	analysisRecent[key] = res
+}
+
+func writeAnalysisResponse(w http.ResponseWriter, res *analysisResponse) {
+	for k, v := range res.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.status)
+	w.Write(res.body.Bytes())
+}
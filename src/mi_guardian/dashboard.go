@@ -0,0 +1,195 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Built-in dashboard ---
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+var (
+	recentSpamMu sync.Mutex
+	recentSpam   []VerdictEvent // Last DashboardRecentSpam spam verdicts, oldest first
+)
+
+// rememberVerdict keeps the latest spam verdicts for the dashboard
+func rememberVerdict(ev VerdictEvent) {
+	if ev.Action != "spam" {
+		return
+	}
+	recentSpamMu.Lock()
+	defer recentSpamMu.Unlock()
+	recentSpam = append(recentSpam, ev)
+	if len(recentSpam) > DashboardRecentSpam {
+		recentSpam = append([]VerdictEvent(nil), recentSpam[len(recentSpam)-DashboardRecentSpam:]...)
+	}
+}
+
+// forgetRecentVerdicts drops the remembered spam verdicts of a message (by
+// Message-ID hash) and returns how many there were
+func forgetRecentVerdicts(messageIDHash string, dryRun bool) int {
+	recentSpamMu.Lock()
+	defer recentSpamMu.Unlock()
+	kept := recentSpam[:0:0]
+	for _, ev := range recentSpam {
+		if ev.MessageID != messageIDHash {
+			kept = append(kept, ev)
+		}
+	}
+	forgotten := len(recentSpam) - len(kept)
+	if !dryRun {
+		recentSpam = kept
+	}
+	return forgotten
+}
+
+// recentSpamVerdicts returns the remembered spam verdicts, newest first
+func recentSpamVerdicts() []VerdictEvent {
+	recentSpamMu.Lock()
+	defer recentSpamMu.Unlock()
+	out := make([]VerdictEvent, 0, len(recentSpam))
+	for i := len(recentSpam) - 1; i >= 0; i-- {
+		out = append(out, recentSpam[i])
+	}
+	return out
+}
+
+// Campaign is a locally learned hash with its current score
+type Campaign struct {
+	Hash  string  `json:"hash"`
+	Score float64 `json:"score"`
+	HashSeen
+}
+
+// topCampaigns returns the n learned hashes with the highest local score,
+// looking at DashboardScanLimit score keys at most
+func topCampaigns(n int) []Campaign {
+	var hashes []string
+	iter := rdb.Scan(ctx, 0, LocalScorePrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) && len(hashes) < DashboardScanLimit {
+		hashes = append(hashes, strings.TrimPrefix(iter.Val(), LocalScorePrefix))
+	}
+	campaigns := []Campaign{}
+	if len(hashes) == 0 {
+		return campaigns
+	}
+	pipe := rdb.Pipeline()
+	scoreCmds := make([]*redis.StringCmd, len(hashes))
+	for i, hash := range hashes {
+		scoreCmds[i] = pipe.Get(ctx, LocalScorePrefix+hash)
+	}
+	pipe.Exec(ctx)
+	for i, cmd := range scoreCmds {
+		if score, err := cmd.Float64(); err == nil && score > 0 {
+			campaigns = append(campaigns, Campaign{Hash: hashes[i], Score: score})
+		}
+	}
+	sort.Slice(campaigns, func(i, j int) bool { return campaigns[i].Score > campaigns[j].Score })
+	if len(campaigns) > n {
+		campaigns = campaigns[:n]
+	}
+	pipe = rdb.Pipeline()
+	seenCmds := make([]*redis.SliceCmd, len(campaigns))
+	for i, c := range campaigns {
+		seenCmds[i] = pipe.HMGet(ctx, LocalSeenPrefix+c.Hash, "first", "last", "hits")
+	}
+	pipe.Exec(ctx)
+	for i, cmd := range seenCmds {
+		campaigns[i].HashSeen = parseSeen(cmd.Val())
+	}
+	return campaigns
+}
+
+// dashboardConfig summarizes the effective detection settings; secrets are never listed
+func dashboardConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"oracle_url":           oracleURL,
+		"spam_threshold":       atomic.LoadInt64(&localSpamThreshold),
+		"list_spam_threshold":  atomic.LoadInt64(&listSpamThreshold),
+		"spam_weight":          atomic.LoadInt64(&spamWeight),
+		"ham_weight":           atomic.LoadInt64(&hamWeight),
+		"conflict_margin":      atomic.LoadInt64(&conflictMargin),
+		"local_retention_days": int64(localRetentionDuration.Hours() / 24),
+		"scan_retention_days":  atomic.LoadInt64(&scanRetentionDays),
+		"sync_interval":        atomic.LoadInt64(&syncIntervalSeconds),
+		"stats_interval":       atomic.LoadInt64(&statsIntervalSeconds),
+		"image_analysis":       enableImageAnalysis,
+		"canary_percent":       atomic.LoadInt64(&canaryPercent),
+		"telemetry":            atomic.LoadInt64(&telemetryLevel),
+		"log_level":            logLevel.Level().String(),
+	}
+}
+
+// dashboardHandler serves the page. It holds no data, so it only checks
+// ADMIN_ALLOWED_IPS; the page asks for a token when the API requires one.
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+	if !adminIPAllowed(r) {
+		writeError(w, http.StatusForbidden, ErrForbidden, "Forbidden")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dashboardPage)
+}
+
+// dashboardDataHandler returns everything the dashboard shows, in one read-only call
+func dashboardDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+
+	counters := make(map[string]int64, len(statCounters))
+	for _, c := range statCounters {
+		counters[c.Name] = atomic.LoadInt64(c.Value)
+	}
+	lifetime, since := lifetimeCounters()
+	currentSeq, _ := rdb.Get(ctx, MetaVer).Int()
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"node_id":        nodeID,
+		"version":        EngineVersion,
+		"counters":       counters,
+		"lifetime":       lifetime,
+		"counters_since": since,
+		"current_seq":    currentSeq,
+		"sync":           syncStatus(),
+		"recent_spam":    recentSpamVerdicts(),
+		"top_campaigns":  topCampaigns(DashboardTopCampaigns),
+		"config":         dashboardConfig(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
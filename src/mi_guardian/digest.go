@@ -0,0 +1,238 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Report digests ---
+//
+// Small sites want to know what Guardian does without running a dashboard. With
+// DIGEST_RECIPIENTS set, a daily or weekly digest is mailed through SMTP_RELAY:
+// detections and reports over the period, top campaigns, false positive reversals
+// and sync health. Figures come from the lifetime counters persisted in Redis,
+// against a snapshot taken when the previous digest was sent, so the digest covers
+// every node sharing the Redis and survives restarts. One node sends it.
+
+const (
+	DigestSnapshotKey  = "mi:digest:snapshot" // Lifetime counters when the last digest was sent
+	DigestSentPrefix   = "mi:digest:sent:"    // Period already sent, across nodes
+	DefaultDigestHour  = 7                    // Hour (UTC) digests are sent at
+	DigestCheckPeriod  = 10 * time.Minute
+	DigestTopCampaigns = 5
+)
+
+// Report counters kept in MetaCounters next to the lifetime counters
+const (
+	CounterSpamReports    = "spam_report_count"
+	CounterHamReports     = "ham_report_count"
+	CounterFalsePositives = "false_positive_count" // Ham reports on messages flagged as spam
+)
+
+// digestCounters lists the counters a digest reports, in order, with their caption
+var digestCounters = []struct{ Name, Caption string }{
+	{"scanned_count", "Messages analyzed"},
+	{"local_spam_count", "Spam detected locally"},
+	{"spam_confirmed_count", "Spam confirmed by the Oracle"},
+	{"cached_positive_count", "Spam matched in the Oracle cache"},
+	{CounterSpamReports, "Spam reports"},
+	{CounterHamReports, "Ham reports"},
+	{CounterFalsePositives, "False positives reversed"},
+}
+
+// countReport counts a report for digests
+func countReport(reportType string, flaggedSpam bool) {
+	pipe := rdb.Pipeline()
+	if reportType == "spam" {
+		pipe.HIncrBy(ctx, MetaCounters, CounterSpamReports, 1)
+	} else {
+		pipe.HIncrBy(ctx, MetaCounters, CounterHamReports, 1)
+		if flaggedSpam {
+			pipe.HIncrBy(ctx, MetaCounters, CounterFalsePositives, 1)
+		}
+	}
+	pipe.Exec(ctx)
+}
+
+// digestTotals returns the current value of the digest counters
+func digestTotals() map[string]int64 {
+	totals, _ := lifetimeCounters()
+	reports, _ := rdb.HMGet(ctx, MetaCounters, CounterSpamReports, CounterHamReports, CounterFalsePositives).Result()
+	for i, name := range []string{CounterSpamReports, CounterHamReports, CounterFalsePositives} {
+		if i < len(reports) {
+			s, _ := reports[i].(string)
+			totals[name], _ = strconv.ParseInt(s, 10, 64)
+		}
+	}
+	return totals
+}
+
+// digestPeriod names the period a digest covers at t, "" when none is due yet:
+// the day (daily) or the ISO week starting on Monday (weekly), from DIGEST_HOUR on
+func digestPeriod(t time.Time) string {
+	t = t.UTC()
+	if int64(t.Hour()) < getEnvInt("DIGEST_HOUR", DefaultDigestHour) {
+		return ""
+	}
+	if strings.ToLower(getEnv("DIGEST_SCHEDULE", "daily")) == "weekly" {
+		if t.Weekday() != time.Monday {
+			return ""
+		}
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}
+	return t.Format("2006-01-02")
+}
+
+// buildDigest writes the digest text and returns it with the counters it was built on
+func buildDigest(now time.Time) (string, map[string]int64) {
+	totals := digestTotals()
+	snapshot, _ := rdb.HGetAll(ctx, DigestSnapshotKey).Result()
+	since, _ := strconv.ParseInt(snapshot["time"], 10, 64)
+	if since == 0 {
+		_, since = lifetimeCounters()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Mailuminati Guardian digest, node %s (version %s)\n", nodeID, EngineVersion)
+	if since > 0 {
+		fmt.Fprintf(&b, "Period: %s to %s (UTC)\n", time.Unix(since, 0).UTC().Format("2006-01-02 15:04"), now.UTC().Format("2006-01-02 15:04"))
+	}
+
+	b.WriteString("\nDetections\n")
+	for _, c := range digestCounters {
+		previous, _ := strconv.ParseInt(snapshot[c.Name], 10, 64)
+		fmt.Fprintf(&b, "  %-34s %d\n", c.Caption, max(totals[c.Name]-previous, 0))
+	}
+	if since > 0 {
+		conflicts := rdb.ZCount(ctx, ConflictSetKey, strconv.FormatInt(since, 10), "+inf").Val()
+		fmt.Fprintf(&b, "  %-34s %d\n", "Hashes with conflicting reports", conflicts)
+	}
+
+	b.WriteString("\nTop campaigns (local score)\n")
+	campaigns := topCampaigns(DigestTopCampaigns)
+	if len(campaigns) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, c := range campaigns {
+		fmt.Fprintf(&b, "  %-8g %s\n", c.Score, c.Hash)
+	}
+
+	b.WriteString("\nSync health\n")
+	status := syncStatus()
+	if last, ok := status["last_success"].(int64); ok {
+		fmt.Fprintf(&b, "  Last successful sync: %s (%s ago)\n", time.Unix(last, 0).UTC().Format("2006-01-02 15:04"),
+			(time.Duration(status["seconds_since_success"].(int64)) * time.Second).String())
+	} else {
+		b.WriteString("  Last successful sync: never\n")
+	}
+	fmt.Fprintf(&b, "  Last Oracle status: %v\n", status["last_status"])
+	if outage, _ := status["oracle_outage"].(bool); outage {
+		b.WriteString("  Oracle outage in progress: cache entries are kept alive\n")
+	}
+	return b.String(), totals
+}
+
+// sendDigest mails a digest to DIGEST_RECIPIENTS through SMTP_RELAY. The relay is
+// used with STARTTLS when it offers it, and authenticated when SMTP_USER is set.
+func sendDigest(subject, body string) error {
+	recipients := getEnvList("DIGEST_RECIPIENTS")
+	relay := getEnv("SMTP_RELAY", "")
+	if len(recipients) == 0 || relay == "" {
+		return errors.New("DIGEST_RECIPIENTS and SMTP_RELAY are required")
+	}
+	from := getEnv("SMTP_FROM", "guardian@localhost")
+	var auth smtp.Auth
+	if user := getEnv("SMTP_USER", ""); user != "" {
+		host, _, _ := net.SplitHostPort(relay)
+		auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + from + "\r\n")
+	msg.WriteString("To: " + strings.Join(recipients, ", ") + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nAuto-Submitted: auto-generated\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(relay, auth, from, recipients, []byte(msg.String()))
+}
+
+// runDigest sends the digest of the period, unless another node already did, and
+// takes the snapshot the next digest starts from
+func runDigest(now time.Time, period string) error {
+	if ok, err := rdb.SetNX(ctx, DigestSentPrefix+period, nodeID, 8*24*time.Hour).Result(); err != nil || !ok {
+		return err
+	}
+	body, totals := buildDigest(now)
+	if err := sendDigest("Mailuminati Guardian digest "+period, body); err != nil {
+		rdb.Del(ctx, DigestSentPrefix+period) // Retried at the next check
+		return err
+	}
+	snapshot := map[string]interface{}{"time": now.Unix()}
+	for name, v := range totals {
+		snapshot[name] = v
+	}
+	rdb.HSet(ctx, DigestSnapshotKey, snapshot)
+	logger.Info("Digest sent", "period", period, "recipients", len(getEnvList("DIGEST_RECIPIENTS")))
+	return nil
+}
+
+// digestWorker sends the digest once per period, when DIGEST_RECIPIENTS is set
+func digestWorker() {
+	ticker := time.NewTicker(DigestCheckPeriod)
+	for now := range ticker.C {
+		if len(getEnvList("DIGEST_RECIPIENTS")) == 0 {
+			continue
+		}
+		if period := digestPeriod(now); period != "" {
+			if err := runDigest(now, period); err != nil {
+				logger.Warn("Digest not sent", "period", period, "error", err)
+			}
+		}
+	}
+}
+
+// digestHandler previews the next digest (GET) or sends it now (POST), outside the
+// schedule and without moving its start
+func digestHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		body, _ := buildDigest(time.Now())
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(body))
+	case http.MethodPost:
+		body, _ := buildDigest(time.Now())
+		if err := sendDigest("Mailuminati Guardian digest (preview)", body); err != nil {
+			writeError(w, http.StatusBadGateway, ErrInternal, "Digest not sent: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"sent"}`))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+	}
+}
@@ -0,0 +1,84 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"mailuminati-guardian/internal/analyze"
+)
+
+// --- Distance backends ---
+//
+// Every candidate of a campaign band is scored against the message signature by
+// one of the backends of internal/analyze, selected by DISTANCE_BACKEND. The fast
+// backend spreads large batches over DISTANCE_WORKERS goroutines.
+//
+// Before either runs, candidates are pre-filtered on the header of their digest: a
+// candidate whose header alone puts it beyond ProximityDistance cannot match and is
+// dropped without scoring its code (DISTANCE_PREFILTER).
+
+var fastDistance = analyze.NewFastDistance()
+
+var distanceBackends = map[string]analyze.DistanceBackend{
+	"reference": analyze.ReferenceDistance{},
+	"fast":      fastDistance,
+}
+
+var (
+	activeDistance      atomic.Pointer[analyze.DistanceBackend]
+	distancePrefilterOn atomic.Bool
+)
+
+func init() {
+	useDistanceBackend("fast")
+	distancePrefilterOn.Store(true)
+}
+
+// loadDistanceBackend reads DISTANCE_BACKEND, DISTANCE_WORKERS and DISTANCE_PREFILTER
+func loadDistanceBackend() {
+	name := strings.ToLower(getEnv("DISTANCE_BACKEND", DefaultDistanceBackend))
+	if !useDistanceBackend(name) {
+		logger.Warn("Unknown DISTANCE_BACKEND, using default", "backend", name, "default", DefaultDistanceBackend)
+		useDistanceBackend(DefaultDistanceBackend)
+	}
+	fastDistance.SetWorkers(int(getEnvPositiveInt("DISTANCE_WORKERS", int64(runtime.GOMAXPROCS(0)))))
+	distancePrefilterOn.Store(strings.ToLower(getEnv("DISTANCE_PREFILTER", "true")) != "false")
+}
+
+// useDistanceBackend makes name the backend of computeDistance and computeDistanceBatch
+func useDistanceBackend(name string) bool {
+	backend, ok := distanceBackends[name]
+	if ok {
+		activeDistance.Store(&backend)
+	}
+	return ok
+}
+
+func distanceBackend() analyze.DistanceBackend {
+	return *activeDistance.Load()
+}
+
+// prefilterCandidates drops the candidates beyond maxDist by their header alone
+func prefilterCandidates(ref string, digests, ids []string, maxDist int) ([]string, []string) {
+	keptDigests, keptIDs := analyze.PrefilterCandidates(ref, digests, ids, maxDist)
+	if dropped := len(digests) - len(keptDigests); dropped > 0 {
+		promDistancePrefiltered.Add(float64(dropped))
+	}
+	return keptDigests, keptIDs
+}
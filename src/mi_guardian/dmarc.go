@@ -0,0 +1,254 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- DMARC aggregate reports ---
+
+// dmarcFeedback is the subset of an RFC 7489 aggregate report we use
+type dmarcFeedback struct {
+	XMLName xml.Name `xml:"feedback"`
+	Policy  struct {
+		Domain string `xml:"domain"`
+	} `xml:"policy_published"`
+	Records []struct {
+		Row struct {
+			SourceIP string `xml:"source_ip"`
+			Count    int64  `xml:"count"`
+			Policy   struct {
+				DKIM string `xml:"dkim"`
+				SPF  string `xml:"spf"`
+			} `xml:"policy_evaluated"`
+		} `xml:"row"`
+		Identifiers struct {
+			HeaderFrom string `xml:"header_from"`
+		} `xml:"identifiers"`
+	} `xml:"record"`
+}
+
+// dmarcFailures sums messages failing DMARC (neither DKIM nor SPF aligned) per From-domain
+func dmarcFailures(feedback dmarcFeedback) map[string]int64 {
+	failures := make(map[string]int64)
+	for _, rec := range feedback.Records {
+		if rec.Row.Policy.DKIM == "pass" || rec.Row.Policy.SPF == "pass" {
+			continue
+		}
+		domain := rec.Identifiers.HeaderFrom
+		if domain == "" {
+			domain = feedback.Policy.Domain
+		}
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			failures[domain] += rec.Row.Count
+		}
+	}
+	return failures
+}
+
+// parseDMARCReports extracts aggregate reports from XML, gzip, zip or an email
+// carrying them as attachments (as delivered to the rua mailbox)
+func parseDMARCReports(data []byte, depth int) []dmarcFeedback {
+	if depth > 3 {
+		return nil
+	}
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		var feedback dmarcFeedback
+		if err := xml.Unmarshal(trimmed, &feedback); err != nil {
+			logger.Debug("Invalid DMARC report", "error", err)
+			return nil
+		}
+		return []dmarcFeedback{feedback}
+
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil
+		}
+		inner, err := io.ReadAll(io.LimitReader(zr, MaxProcessSize))
+		if err != nil {
+			return nil
+		}
+		return parseDMARCReports(inner, depth+1)
+
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil
+		}
+		var reports []dmarcFeedback
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				continue
+			}
+			inner, err := io.ReadAll(io.LimitReader(rc, MaxProcessSize))
+			rc.Close()
+			if err == nil {
+				reports = append(reports, parseDMARCReports(inner, depth+1)...)
+			}
+		}
+		return reports
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var reports []dmarcFeedback
+	for _, part := range append(env.Attachments, env.Inlines...) {
+		reports = append(reports, parseDMARCReports(part.Content, depth+1)...)
+	}
+	return reports
+}
+
+// recordDMARCFailures accumulates failures over a day and puts domains reaching
+// DMARC_SPOOF_MIN_MESSAGES under scrutiny. Returns the newly flagged domains.
+func recordDMARCFailures(failures map[string]int64) []string {
+	minMessages := atomic.LoadInt64(&dmarcSpoofMinMessages)
+	scrutiny := time.Duration(atomic.LoadInt64(&dmarcScrutinyDays)) * 24 * time.Hour
+	flagged := []string{}
+	for domain, count := range failures {
+		key := DmarcFailPrefix + domain
+		total, err := rdb.IncrBy(ctx, key, count).Result()
+		if err != nil {
+			continue
+		}
+		if total == count {
+			// First failures of the window
+			rdb.Expire(ctx, key, 24*time.Hour)
+		}
+		if total >= minMessages {
+			rdb.Set(ctx, DmarcScrutinyPrefix+domain, time.Now().Unix(), scrutiny)
+			flagged = append(flagged, domain)
+			logger.Warn("Domain spoofing reported by DMARC, tightening scrutiny", "domain", domain, "failures", total, "days", scrutiny.Hours()/24)
+		}
+	}
+	return flagged
+}
+
+// underScrutiny tells whether a From-domain was recently reported as spoofed
+func underScrutiny(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	n, err := rdb.Exists(ctx, DmarcScrutinyPrefix+domain).Result()
+	return err == nil && n > 0
+}
+
+// dkimAligned tells whether the message has a verified DKIM pass aligned with domain.
+// Messages without Authentication-Results from our MTA cannot be checked and are
+// accepted: without AUTHSERV_ID, DMARC_REQUIRE_DKIM never flags anything (see
+// warnDmarcWithoutAuthserv).
+func dkimAligned(env *enmime.Envelope, domain string) bool {
+	domains, verified := verifiedDkimDomains(env)
+	if !verified {
+		return true
+	}
+	for _, d := range domains {
+		if domainMatches(d, domain) || domainMatches(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func init() {
+	dmarcRequireDkim.Store(true)
+}
+
+// warnDmarcWithoutAuthserv tells at startup that DMARC_REQUIRE_DKIM has no effect
+// while no Authentication-Results header is trusted
+func warnDmarcWithoutAuthserv() {
+	if dmarcRequireDkim.Load() && len(getEnvList("AUTHSERV_ID")) == 0 {
+		logger.Warn("DMARC_REQUIRE_DKIM has no effect without AUTHSERV_ID: DKIM results of the MTA are not trusted")
+	}
+}
+
+// tightened lowers the spam threshold for spoofed domains
+func (p thresholdProfile) tightened() thresholdProfile {
+	if th := atomic.LoadInt64(&dmarcSpamThreshold); th < p.SpamThreshold {
+		p.SpamThreshold = th
+	}
+	return p
+}
+
+// dmarcHandler ingests aggregate reports (POST) or lists domains under scrutiny (GET)
+func dmarcHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		domains := map[string]int64{}
+		iter := rdb.Scan(ctx, 0, DmarcScrutinyPrefix+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			ttl := rdb.TTL(ctx, iter.Val()).Val()
+			domains[strings.TrimPrefix(iter.Val(), DmarcScrutinyPrefix)] = int64(ttl.Seconds())
+		}
+		respBytes, _ := json.Marshal(map[string]interface{}{"scrutiny": domains})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(io.LimitReader(r.Body, MaxProcessSize))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrReadBody, "Error reading body")
+			return
+		}
+		reports := parseDMARCReports(data, 0)
+		if len(reports) == 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "No DMARC aggregate report found")
+			return
+		}
+
+		failures := make(map[string]int64)
+		records := 0
+		for _, report := range reports {
+			records += len(report.Records)
+			for domain, count := range dmarcFailures(report) {
+				failures[domain] += count
+			}
+		}
+		flagged := recordDMARCFailures(failures)
+		logger.Info("DMARC reports ingested", "reports", len(reports), "records", records, "flagged", len(flagged))
+
+		respBytes, _ := json.Marshal(map[string]interface{}{
+			"reports":  len(reports),
+			"records":  records,
+			"failures": failures,
+			"flagged":  flagged,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+	}
+}
@@ -0,0 +1,238 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Domain blocklists and MTA map exports ---
+//
+// Sender domains and link domains blocked by the admin flag messages as spam
+// (labels blocked_sender, blocked_url). The same lists are exported as Postfix and
+// Rspamd map files, so MTAs can enforce them themselves, before DATA for senders,
+// without calling Guardian for every message.
+
+const DefaultPostfixMapAction = "REJECT 5.7.1 Blocked by Mailuminati Guardian"
+
+var reDomainName = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z0-9-]{2,}$`)
+
+// Redis set of each domain blocklist
+var domainBlocklists = map[string]string{
+	"sender": BlocklistSenderKey,
+	"url":    BlocklistURLKey,
+}
+
+// normalizeDomains lowercases domains, drops a leading "@" or "*." and separates
+// what is not a domain name
+func normalizeDomains(in []string) (valid []string, invalid []string) {
+	for _, d := range in {
+		d = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+		d = strings.TrimPrefix(strings.TrimPrefix(d, "@"), "*.")
+		if reDomainName.MatchString(d) {
+			valid = append(valid, d)
+		} else {
+			invalid = append(invalid, d)
+		}
+	}
+	return valid, invalid
+}
+
+// parentDomains returns a domain and its parents: a.example.com, example.com, com
+func parentDomains(domain string) []string {
+	var domains []string
+	for d := domain; d != ""; {
+		domains = append(domains, d)
+		_, parent, ok := strings.Cut(d, ".")
+		if !ok {
+			break
+		}
+		d = parent
+	}
+	return domains
+}
+
+// blockedDomain returns the first domain of the sender or of a link found in a
+// domain blocklist, with the name of the list
+func blockedDomain(env *enmime.Envelope) (string, string) {
+	hosts := map[string][]string{}
+	if from := addressDomain(env.GetHeader("From")); from != "" {
+		hosts["sender"] = parentDomains(from)
+	}
+	for _, link := range messageLinks(env) {
+		if u, err := url.Parse(link.URL); err == nil && u.Hostname() != "" {
+			hosts["url"] = append(hosts["url"], parentDomains(strings.ToLower(u.Hostname()))...)
+		}
+	}
+	if len(hosts) == 0 {
+		return "", ""
+	}
+
+	pipe := rdb.Pipeline()
+	cmds := map[string][]*redis.BoolCmd{}
+	for _, list := range []string{"sender", "url"} {
+		for _, h := range hosts[list] {
+			cmds[list] = append(cmds[list], pipe.SIsMember(ctx, domainBlocklists[list], h))
+		}
+	}
+	pipe.Exec(ctx)
+	for _, list := range []string{"sender", "url"} {
+		for i, cmd := range cmds[list] {
+			if cmd.Val() {
+				return hosts[list][i], list
+			}
+		}
+	}
+	return "", ""
+}
+
+// domainBlocklistHandler lists (GET) or edits (POST {"list": "sender", "add": [...],
+// "remove": [...]}) the domain blocklists
+func domainBlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resp := map[string][]string{}
+		for list, key := range domainBlocklists {
+			domains, err := rdb.SMembers(ctx, key).Result()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+				return
+			}
+			sort.Strings(domains)
+			resp[list] = domains
+		}
+		respBytes, _ := json.Marshal(resp)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	case http.MethodPost:
+		var reqBody struct {
+			List   string   `json:"list"`
+			Add    []string `json:"add"`
+			Remove []string `json:"remove"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+			return
+		}
+		key, ok := domainBlocklists[reqBody.List]
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "list must be sender or url")
+			return
+		}
+		add, invalidAdd := normalizeDomains(reqBody.Add)
+		remove, invalidRemove := normalizeDomains(reqBody.Remove)
+		if invalid := append(invalidAdd, invalidRemove...); len(invalid) > 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid domain: "+strings.Join(invalid, ", "))
+			return
+		}
+
+		pipe := rdb.Pipeline()
+		for _, d := range add {
+			pipe.SAdd(ctx, key, d)
+		}
+		for _, d := range remove {
+			pipe.SRem(ctx, key, d)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && len(add)+len(remove) > 0 {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+		forgetVerdicts()
+		logger.Info("Domain blocklist updated", "list", reqBody.List, "added", len(add), "removed", len(remove))
+
+		respBytes, _ := json.Marshal(map[string]interface{}{
+			"added":   len(add),
+			"removed": len(remove),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+	}
+}
+
+// exportMap writes the domain blocklist named by ?list= (sender by default) in the
+// format built by line. Unchanged maps are answered 304 to If-None-Match.
+func exportMap(w http.ResponseWriter, r *http.Request, header string, line func(list, domain string) string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+	list := r.URL.Query().Get("list")
+	if list == "" {
+		list = "sender"
+	}
+	key, ok := domainBlocklists[list]
+	if !ok {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "list must be sender or url")
+		return
+	}
+	domains, err := rdb.SMembers(ctx, key).Result()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+	sort.Strings(domains)
+
+	var b strings.Builder
+	b.WriteString("# Mailuminati Guardian " + list + " domain blocklist, " + header + "\n")
+	for _, d := range domains {
+		b.WriteString(line(list, d) + "\n")
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
+
+// postfixMapHandler exports a domain blocklist for Postfix: an access(5) table for
+// check_sender_access (list=sender), or pcre body_checks (list=url)
+func postfixMapHandler(w http.ResponseWriter, r *http.Request) {
+	action := getEnv("EXPORT_POSTFIX_ACTION", DefaultPostfixMapAction)
+	exportMap(w, r, "Postfix format", func(list, domain string) string {
+		if list == "url" {
+			return `/(^|[^a-z0-9.-])(.+\.)?` + regexp.QuoteMeta(domain) + `([^a-z0-9.-]|$)/i` + "\t" + action
+		}
+		return domain + "\t" + action
+	})
+}
+
+// rspamdMapHandler exports a domain blocklist as an Rspamd multimap: one domain per line
+func rspamdMapHandler(w http.ResponseWriter, r *http.Request) {
+	exportMap(w, r, "Rspamd multimap format", func(list, domain string) string {
+		return domain
+	})
+}
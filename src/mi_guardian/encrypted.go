@@ -0,0 +1,98 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"archive/zip"
+	"bytes"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Encrypted attachments ---
+
+var (
+	magicPDF   = []byte("%PDF-")
+	magicZip   = []byte("PK\x03\x04")
+	magicRar4  = []byte("Rar!\x1a\x07\x00")
+	magicRar5  = []byte("Rar!\x1a\x07\x01\x00")
+	magic7z    = []byte("7z\xbc\xaf\x27\x1c")
+	magicOLE   = []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+	coder7zAES = []byte{0x06, 0xf1, 0x07, 0x01}
+	// "EncryptedPackage" stream name of protected OOXML documents (UTF-16LE)
+	oleEncryptedPackage = []byte("E\x00n\x00c\x00r\x00y\x00p\x00t\x00e\x00d\x00P\x00a\x00c\x00k\x00a\x00g\x00e\x00")
+)
+
+// encryptedKind returns the container type when data is password protected, "" otherwise.
+// Their content cannot be hashed, which is why malware droppers use them.
+func encryptedKind(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, magicZip):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return ""
+		}
+		for _, f := range zr.File {
+			if f.Flags&0x1 != 0 { // General purpose bit 0: encrypted
+				return "zip"
+			}
+		}
+	case bytes.HasPrefix(data, magicPDF):
+		if bytes.Contains(data, []byte("/Encrypt")) {
+			return "pdf"
+		}
+	case bytes.HasPrefix(data, magicRar5):
+		// Archive encryption header (type 4) right after the signature: CRC32, vint size, vint type
+		if len(data) > 14 && data[13] == 0x04 {
+			return "rar"
+		}
+	case bytes.HasPrefix(data, magicRar4):
+		// Main header flag MHD_PASSWORD
+		if len(data) > 11 && data[9] == 0x73 && data[10]&0x80 != 0 {
+			return "rar"
+		}
+	case bytes.HasPrefix(data, magic7z):
+		if bytes.Contains(data, coder7zAES) {
+			return "7z"
+		}
+	case bytes.HasPrefix(data, magicOLE):
+		if bytes.Contains(data, oleEncryptedPackage) {
+			return "office"
+		}
+	}
+	return ""
+}
+
+// encryptedAttachments lists the password protected parts of a message
+func encryptedAttachments(env *enmime.Envelope) []string {
+	var found []string
+	for _, p := range findParts(env, func(p *enmime.Part) bool { return p.FirstChild == nil && len(p.Content) > 0 }) {
+		if kind := encryptedKind(p.Content); kind != "" {
+			found = append(found, kind+":"+p.FileName)
+		}
+	}
+	return found
+}
+
+// hasSignal tells whether signal was raised for the message
+func hasSignal(signals []string, signal string) bool {
+	for _, s := range signals {
+		if s == signal {
+			return true
+		}
+	}
+	return false
+}
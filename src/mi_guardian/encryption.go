@@ -0,0 +1,143 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// --- Encryption at rest ---
+
+const sealedPrefix = "enc:v1:"
+
+type storageKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	storageKeysMu sync.RWMutex
+	storageKeys   []storageKey // First key encrypts, all keys decrypt (rotation)
+)
+
+// parseStorageKey accepts a 256-bit key as 64 hex characters or base64
+func parseStorageKey(s string) (storageKey, error) {
+	s = strings.TrimSpace(s)
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != 32 {
+		raw, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(raw) != 32 {
+		return storageKey{}, errors.New("storage key must be 32 bytes, hex or base64 encoded")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return storageKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return storageKey{}, err
+	}
+	sum := sha256.Sum256(raw)
+	return storageKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// loadStorageKeys reads STORAGE_KEY_FILE (one key per line) or STORAGE_KEY (comma separated).
+// The first key is the active one; keep former keys listed after it while old values expire.
+func loadStorageKeys() error {
+	var lines []string
+	if path := getEnv("STORAGE_KEY_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		lines = strings.Split(string(data), "\n")
+	} else {
+		lines = strings.Split(getEnv("STORAGE_KEY", ""), ",")
+	}
+
+	var keys []storageKey
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseStorageKey(line)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	storageKeysMu.Lock()
+	storageKeys = keys
+	storageKeysMu.Unlock()
+	return nil
+}
+
+// sealValue encrypts a value for Redis with the active key (plaintext when no key is configured)
+func sealValue(plain []byte) (string, error) {
+	storageKeysMu.RLock()
+	defer storageKeysMu.RUnlock()
+	if len(storageKeys) == 0 {
+		return string(plain), nil
+	}
+	key := storageKeys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := key.aead.Seal(nonce, nonce, plain, []byte(key.id))
+	return sealedPrefix + key.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue decrypts a value written by sealValue; values stored in clear are returned as is
+func openValue(stored string) ([]byte, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return []byte(stored), nil
+	}
+	id, payload, ok := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if !ok {
+		return nil, errors.New("malformed sealed value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	storageKeysMu.RLock()
+	defer storageKeysMu.RUnlock()
+	for _, key := range storageKeys {
+		if key.id != id {
+			continue
+		}
+		if len(sealed) < key.aead.NonceSize() {
+			return nil, errors.New("malformed sealed value")
+		}
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		return key.aead.Open(nil, nonce, ciphertext, []byte(id))
+	}
+	return nil, fmt.Errorf("unknown storage key %s", id)
+}
@@ -0,0 +1,145 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"mailuminati-guardian/internal/store"
+)
+
+// --- Embedding ---
+//
+// Other Go mail software (an LMTP server, a milter) can run the analysis in its
+// own process instead of calling the daemon over HTTP. Settings, caches and
+// metrics are process-wide, so a process runs a single Engine.
+
+// Store holds the learned data, scans and counters: the Redis commands the engine
+// uses, which *redis.Client and *redis.ClusterClient implement
+type Store = store.Store
+
+// Oracle carries the requests sent to the Oracle (/analyze, /report, /sync, /stats,
+// /register, /image-hash). Any http.RoundTripper fits, e.g. to reach it through a
+// proxy, or an in-process fake in tests.
+type Oracle interface {
+	RoundTrip(*http.Request) (*http.Response, error)
+}
+
+// Options configure an embedded Engine. Settings are read from ConfigFile and the
+// environment like in the daemon (ORACLE_URL, SPAM_THRESHOLD...).
+type Options struct {
+	Store      Store  // Required
+	Oracle     Oracle // Nil for the default HTTP transport
+	ConfigFile string // Optional guardian.conf
+	Workers    bool   // Run the background tasks of the daemon (Oracle sync, stats, maintenance...)
+}
+
+// Result is the verdict of a message, as returned by /analyze
+type Result = AnalysisResult
+
+// Engine analyzes messages and learns from reports without the HTTP daemon
+type Engine struct{}
+
+// engineCreated makes the Engine a singleton: the store, the Oracle transport, the
+// settings and the workers are package globals shared with the daemon, so a second
+// Engine would silently take them over from the first. It is set for the life of
+// the process (an Engine cannot be closed) and only cleared when NewEngine fails.
+var (
+	engineCreated    atomic.Bool
+	errEngineRunning = errors.New("an Engine already runs in this process")
+)
+
+// NewEngine loads the settings, connects the store and prepares the node
+// identity. It fails when the store is unreachable or an Engine already runs.
+func NewEngine(opts Options) (*Engine, error) {
+	if opts.Store == nil {
+		return nil, errors.New("a Store is required")
+	}
+	if !engineCreated.CompareAndSwap(false, true) {
+		return nil, errEngineRunning
+	}
+	if opts.ConfigFile != "" {
+		if err := loadConfigFile(opts.ConfigFile); err != nil {
+			engineCreated.Store(false)
+			return nil, fmt.Errorf("config file: %w", err)
+		}
+	}
+	initLogger()
+	oracleURL = getEnv("ORACLE_URL", DefaultOracle)
+	oracleTransport = opts.Oracle
+	if err := loadStorageKeys(); err != nil {
+		engineCreated.Store(false)
+		return nil, fmt.Errorf("storage key: %w", err)
+	}
+	refreshLogicConfig()
+
+	rdb = opts.Store
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		engineCreated.Store(false)
+		return nil, fmt.Errorf("store: %w", err)
+	}
+
+	verifyState()
+	nodeID = initNode()
+	if err := initNodeKey(); err != nil {
+		logger.Error("Node key unavailable, Oracle requests will not be signed", "error", err)
+	}
+	loadStoredOracleSettings()
+	refreshLogicConfig()
+	warnDmarcWithoutAuthserv()
+	logger.Info("Engine started", "version", EngineVersion, "node_id", nodeID, "embedded", true)
+
+	if opts.Workers {
+		connectPropagation()
+		startWorkers()
+	}
+	return &Engine{}, nil
+}
+
+// Analyze reads a raw message and returns its verdict. The scan is stored before it
+// returns and the verdict applied (quarantine, stream, counters) as for /analyze, so
+// the message can be reported by its Message-ID as soon as Analyze returns.
+func (e *Engine) Analyze(r io.Reader) (Result, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, MaxProcessSize))
+	if err != nil {
+		return Result{}, err
+	}
+	req := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/analyze"}, Header: http.Header{}}
+	a, err := analyzeMessage(req, raw)
+	if err != nil {
+		return Result{}, err
+	}
+	applyVerdict(raw, a, true)
+	return a.Out.Result, nil
+}
+
+// Report learns from a spam or ham report on an analyzed message and forwards it to
+// the Oracle. reporter identifies the user for its trust and quota, as the reporter
+// field of /report.
+func (e *Engine) Report(messageID, reportType, reporter string) (ReportSummary, error) {
+	if reportType != "spam" && reportType != "ham" {
+		return ReportSummary{}, fmt.Errorf("unknown report type %q", reportType)
+	}
+	if reservedReporter(reporter) {
+		return ReportSummary{}, errors.New("reserved reporter identity")
+	}
+	return submitReport(reportRequest{MessageID: messageID, ReportType: reportType, Reporter: reporter}, reporter, reporter)
+}
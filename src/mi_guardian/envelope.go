@@ -0,0 +1,83 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// --- SMTP envelope passed by the MTA ---
+
+// EnvelopeMeta is the SMTP transaction of the analyzed message, sent by the MTA
+// as X-Guardian-* request headers. Every field is optional: plugins that do not
+// send them get the header based behavior.
+type EnvelopeMeta struct {
+	ClientIP string   // X-Guardian-Client-IP: connecting SMTP client
+	Helo     string   // X-Guardian-Helo: HELO/EHLO name
+	MailFrom string   // X-Guardian-Mail-From: envelope sender ("" for bounces)
+	RcptTo   []string // X-Guardian-Rcpt-To: envelope recipients, comma separated or repeated
+	AuthUser string   // X-Guardian-Auth-User: SMTP AUTH login of submissions
+}
+
+// envelopeMeta reads the X-Guardian-* headers of an /analyze request
+func envelopeMeta(r *http.Request) EnvelopeMeta {
+	meta := EnvelopeMeta{
+		Helo:     strings.TrimSpace(r.Header.Get("X-Guardian-Helo")),
+		MailFrom: envelopeAddress(r.Header.Get("X-Guardian-Mail-From")),
+		AuthUser: strings.TrimSpace(r.Header.Get("X-Guardian-Auth-User")),
+	}
+	// Ignored unless it is an IP: it is compared with TRUSTED_FORWARDERS
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Guardian-Client-IP"))); ip != nil {
+		meta.ClientIP = ip.String()
+	}
+	for _, value := range r.Header.Values("X-Guardian-Rcpt-To") {
+		for _, rcpt := range strings.Split(value, ",") {
+			if addr := envelopeAddress(rcpt); addr != "" {
+				meta.RcptTo = append(meta.RcptTo, addr)
+			}
+		}
+	}
+	return meta
+}
+
+// envelopeAddress strips the spaces and angle brackets of an SMTP path
+func envelopeAddress(s string) string {
+	return strings.TrimSpace(strings.Trim(strings.TrimSpace(s), "<>"))
+}
+
+// logAttrs returns the fields sent by the MTA, with the same keys in every log line.
+// They identify people and are dropped when LOG_MESSAGE_METADATA is off.
+func (m EnvelopeMeta) logAttrs() []any {
+	var attrs []any
+	if m.ClientIP != "" {
+		attrs = append(attrs, "client_ip", m.ClientIP)
+	}
+	if m.Helo != "" {
+		attrs = append(attrs, "helo", m.Helo)
+	}
+	if m.MailFrom != "" {
+		attrs = append(attrs, "mail_from", m.MailFrom)
+	}
+	if len(m.RcptTo) > 0 {
+		attrs = append(attrs, "rcpt_to", m.RcptTo)
+	}
+	if m.AuthUser != "" {
+		attrs = append(attrs, "auth_user", m.AuthUser)
+	}
+	return attrs
+}
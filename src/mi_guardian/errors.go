@@ -0,0 +1,67 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// --- Error responses ---
+//
+// Every handler answers errors with the same JSON envelope, so MTA glue can tell
+// a message Guardian will never accept (invalid_mime: accept it unscanned) from
+// an outage worth a retry (store_unavailable: tempfail).
+
+// Error codes of the error envelope
+const (
+	ErrMethodNotAllowed  = "method_not_allowed"
+	ErrInvalidRequest    = "invalid_request"
+	ErrInvalidJSON       = "invalid_json"
+	ErrInvalidMIME       = "invalid_mime"
+	ErrMimeLimits        = "mime_limits"
+	ErrReadBody          = "read_error"
+	ErrUnauthorized      = "unauthorized"
+	ErrForbidden         = "forbidden"
+	ErrNotFound          = "not_found"
+	ErrDuplicate         = "duplicate"
+	ErrQuotaExceeded     = "quota_exceeded"
+	ErrStoreUnavailable  = "store_unavailable"
+	ErrOracleUnavailable = "oracle_unavailable"
+	ErrFetchFailed       = "fetch_failed"
+	ErrInternal          = "internal_error"
+)
+
+// APIError is the body of every error response
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"` // the same request may succeed later
+}
+
+// writeError writes the error envelope. Server side failures and rate limits are
+// retryable, client errors are not.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	respBytes, _ := json.Marshal(APIError{
+		Code:      code,
+		Message:   message,
+		Retryable: status >= http.StatusInternalServerError || status == http.StatusTooManyRequests,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(respBytes)
+}
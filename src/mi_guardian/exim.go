@@ -0,0 +1,84 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strconv"
+	"strings"
+)
+
+// --- Exim ACL output ---
+//
+// Exim string expansions cannot parse JSON, but ${extract{key}{...}} reads
+// `key=value key2="quoted value"` lists. /analyze?format=exim answers with one such
+// line, whose action is already an ACL verb (accept, warn, deny, defer, discard).
+
+// eximVerb maps the MTA action configured for a verdict to an Exim ACL verb.
+// Without a configured action, spam is only tagged (warn).
+func eximVerb(verdict, mtaActionName string) string {
+	switch strings.ToLower(mtaActionName) {
+	case "reject", "deny":
+		return "deny"
+	case "defer", "tempfail":
+		return "defer"
+	case "discard":
+		return "discard"
+	case "accept", "allow":
+		return "accept"
+	}
+	if verdict == "spam" {
+		return "warn"
+	}
+	return "accept"
+}
+
+// eximQuote quotes a value for ${extract}: backslash escapes, no line breaks
+func eximQuote(s string) string {
+	s = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r", " ", "\n", " ").Replace(s)
+	return "\"" + s + "\""
+}
+
+// eximLine renders an analysis response as an Exim ${extract} list
+func eximLine(res AnalysisResult, mtaActionName, smtpResponse string, delaySeconds int, advice []Advice) string {
+	fields := []string{
+		"action=" + eximVerb(res.Action, mtaActionName),
+		"verdict=" + res.Action,
+	}
+	if res.Label != "" {
+		fields = append(fields, "label="+res.Label)
+	}
+	if mtaActionName != "" {
+		fields = append(fields, "mta_action="+mtaActionName)
+	}
+	fields = append(fields, "proximity_match="+strconv.FormatBool(res.ProximityMatch))
+	if res.Distance != 0 {
+		fields = append(fields, "distance="+strconv.Itoa(res.Distance))
+	}
+	if delaySeconds > 0 {
+		fields = append(fields, "delay="+strconv.Itoa(delaySeconds))
+	}
+	if len(advice) > 0 {
+		codes := make([]string, len(advice))
+		for i, a := range advice {
+			codes[i] = a.Code
+		}
+		fields = append(fields, "advisories="+strings.Join(codes, ","))
+	}
+	if smtpResponse != "" {
+		fields = append(fields, "message="+eximQuote(smtpResponse))
+	}
+	return strings.Join(fields, " ") + "\n"
+}
@@ -0,0 +1,90 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Sampled decision explanations ---
+
+// A sample of verdicts is logged at INFO with the evidence that led to them,
+// without turning on DEBUG for all traffic. Rates are per million messages.
+var (
+	explainSpamRate  int64
+	explainAllowRate int64
+)
+
+// loadExplainConfig reads EXPLAIN_SAMPLE_SPAM / EXPLAIN_SAMPLE_ALLOW, in percent (decimals allowed)
+func loadExplainConfig() {
+	atomic.StoreInt64(&explainSpamRate, percentToRate(getEnv("EXPLAIN_SAMPLE_SPAM", "0")))
+	atomic.StoreInt64(&explainAllowRate, percentToRate(getEnv("EXPLAIN_SAMPLE_ALLOW", "0")))
+}
+
+func percentToRate(s string) int64 {
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int64(min(p, 100) * 10000)
+}
+
+// decisionTrail collects the evidence of one analysis. A nil trail records nothing,
+// so analyses pay nothing when sampling is off.
+type decisionTrail struct {
+	steps []string
+}
+
+// newDecisionTrail returns a trail when some verdicts may be sampled, nil otherwise
+func newDecisionTrail() *decisionTrail {
+	if atomic.LoadInt64(&explainSpamRate) == 0 && atomic.LoadInt64(&explainAllowRate) == 0 {
+		return nil
+	}
+	return &decisionTrail{}
+}
+
+// note records a step with key/value details
+func (t *decisionTrail) note(step string, kv ...any) {
+	if t == nil {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(step)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	t.steps = append(t.steps, b.String())
+}
+
+// log writes the trail when the verdict is sampled
+func (t *decisionTrail) log(l *slog.Logger, res AnalysisResult) {
+	if t == nil {
+		return
+	}
+	rate := atomic.LoadInt64(&explainAllowRate)
+	if res.Action == "spam" {
+		rate = atomic.LoadInt64(&explainSpamRate)
+	}
+	if rate <= 0 || rand.Int63n(1000000) >= rate {
+		return
+	}
+	l.Info("Decision explained", "action", res.Action, "label", res.Label, "distance", res.Distance, "evidence", t.steps)
+}
@@ -0,0 +1,191 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Fault injection ---
+//
+// Operators and CI check that fail-open and fail-closed policies behave as
+// configured by making dependencies fail on purpose: /admin/faults drops or delays
+// a share of the Redis commands and of the Oracle requests of this node. The layer
+// only exists when FAULT_INJECTION=true at startup, and faults expire on their own
+// so a forgotten experiment does not outlive its window.
+
+const (
+	DefaultFaultDuration = 300  // Seconds a fault set stays active
+	MaxFaultDuration     = 3600 // Longest fault window accepted
+)
+
+var (
+	errInjectedFault = errors.New("injected fault")
+
+	faultsEnabled atomic.Bool
+	activeFaults  atomic.Pointer[faultConfig]
+)
+
+// faultConfig is the set of failures injected into the dependencies
+type faultConfig struct {
+	RedisDropPercent  int   `json:"redis_drop_percent"`
+	RedisDelayMs      int   `json:"redis_delay_ms"`
+	OracleFailPercent int   `json:"oracle_fail_percent"`
+	OracleDelayMs     int   `json:"oracle_delay_ms"`
+	Expires           int64 `json:"expires"`
+}
+
+// currentFaults returns the active fault set, nil when none is or it expired
+func currentFaults() *faultConfig {
+	f := activeFaults.Load()
+	if f == nil || time.Now().Unix() >= f.Expires {
+		return nil
+	}
+	return f
+}
+
+// injectFault waits the configured delay, then fails percent% of the time
+func injectFault(reqCtx context.Context, dependency string, delayMs, percent int) error {
+	if delayMs > 0 {
+		select {
+		case <-time.After(time.Duration(delayMs) * time.Millisecond):
+		case <-reqCtx.Done():
+			return reqCtx.Err()
+		}
+	}
+	if percent > 0 && rand.Intn(100) < percent {
+		promFaultsInjected.WithLabelValues(dependency).Inc()
+		return errInjectedFault
+	}
+	return nil
+}
+
+// faultHook fails Redis commands; a pipeline fails as a whole
+type faultHook struct{}
+
+func (faultHook) BeforeProcess(c context.Context, cmd redis.Cmder) (context.Context, error) {
+	if f := currentFaults(); f != nil {
+		return c, injectFault(c, "redis", f.RedisDelayMs, f.RedisDropPercent)
+	}
+	return c, nil
+}
+
+func (faultHook) AfterProcess(c context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (faultHook) BeforeProcessPipeline(c context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if f := currentFaults(); f != nil {
+		return c, injectFault(c, "redis", f.RedisDelayMs, f.RedisDropPercent)
+	}
+	return c, nil
+}
+
+func (faultHook) AfterProcessPipeline(c context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// faultTransport fails requests to the Oracle host, other hosts (image downloads,
+// quarantine) are left alone
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if f := currentFaults(); f != nil {
+		if oracle, err := url.Parse(oracleURL); err == nil && strings.EqualFold(req.URL.Host, oracle.Host) {
+			if err := injectFault(req.Context(), "oracle", f.OracleDelayMs, f.OracleFailPercent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// enableFaultInjection installs the fault layer when FAULT_INJECTION=true
+func enableFaultInjection(client *redis.Client) {
+	if strings.ToLower(getEnv("FAULT_INJECTION", "false")) != "true" {
+		return
+	}
+	client.AddHook(faultHook{})
+	http.DefaultTransport = &faultTransport{next: http.DefaultTransport}
+	faultsEnabled.Store(true)
+	logger.Warn("Fault injection enabled, do not run this node in production", "endpoint", "/admin/faults")
+}
+
+// faultsHandler shows (GET), sets (POST) or clears (DELETE) the injected faults
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !faultsEnabled.Load() {
+		writeError(w, http.StatusForbidden, ErrForbidden, "Fault injection disabled (FAULT_INJECTION)")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var reqBody struct {
+			faultConfig
+			DurationSeconds int64 `json:"duration_seconds"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+			return
+		}
+		f := reqBody.faultConfig
+		for _, p := range []int{f.RedisDropPercent, f.OracleFailPercent} {
+			if p < 0 || p > 100 {
+				writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Percentages must be between 0 and 100")
+				return
+			}
+		}
+		if f.RedisDelayMs < 0 || f.OracleDelayMs < 0 {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Delays must be positive")
+			return
+		}
+		duration := reqBody.DurationSeconds
+		if duration <= 0 {
+			duration = DefaultFaultDuration
+		}
+		f.Expires = time.Now().Unix() + min(duration, MaxFaultDuration)
+		activeFaults.Store(&f)
+		logger.Warn("Faults injected", "redis_drop_percent", f.RedisDropPercent, "redis_delay_ms", f.RedisDelayMs,
+			"oracle_fail_percent", f.OracleFailPercent, "oracle_delay_ms", f.OracleDelayMs, "expires", f.Expires)
+	case http.MethodDelete:
+		activeFaults.Store(nil)
+		logger.Warn("Faults cleared")
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET, POST or DELETE required")
+		return
+	}
+
+	resp := map[string]interface{}{"active": false}
+	if f := currentFaults(); f != nil {
+		resp = map[string]interface{}{"active": true, "faults": f}
+	}
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
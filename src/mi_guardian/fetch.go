@@ -0,0 +1,282 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"mailuminati-guardian/internal/oracle"
+)
+
+// --- Image fetch politeness ---
+//
+// A spam wave points thousands of messages at the same image host. Without limits
+// Guardian would download from it as fast as mail arrives, looking like a scraper,
+// or be used by the sender to hammer a third-party host. Downloads identify
+// themselves (MI_IMAGE_USER_AGENT), are capped per host and minute across the
+// cluster (MI_IMAGE_HOST_RATE) and share a slot pool across all in-flight analyses
+// of this instance (MI_IMAGE_GLOBAL_CONCURRENCY).
+
+var (
+	errHostRateLimited    = errors.New("host rate limit reached")
+	errImageTooLarge      = errors.New("image too large")
+	errImageTooManyPixels = errors.New("image has too many pixels")
+
+	// Download slots shared by all analyses; replaced when the limit changes,
+	// in-flight downloads release their slot into the pool they took it from
+	fetchSlots atomic.Pointer[chan struct{}]
+)
+
+func init() {
+	resizeFetchSlots(DefaultImageGlobalConcurrency)
+}
+
+// resizeFetchSlots sets the number of concurrent image downloads of the instance
+func resizeFetchSlots(n int) {
+	if current := fetchSlots.Load(); current != nil && cap(*current) == n {
+		return
+	}
+	slots := make(chan struct{}, n)
+	fetchSlots.Store(&slots)
+}
+
+// acquireFetchSlot waits for a download slot until fetchCtx expires, and returns
+// the function releasing it
+func acquireFetchSlot(fetchCtx context.Context) (func(), error) {
+	slots := *fetchSlots.Load()
+	atomic.AddInt64(&fetchWaiting, 1)
+	defer atomic.AddInt64(&fetchWaiting, -1)
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-fetchCtx.Done():
+		promImageThrottled.WithLabelValues("global_cap").Inc()
+		return nil, fetchCtx.Err()
+	}
+}
+
+// allowHostFetch counts a download from the host of rawURL and tells whether it
+// stays within MI_IMAGE_HOST_RATE. Fails open when Redis is unavailable.
+func allowHostFetch(rawURL string) bool {
+	limit := atomic.LoadInt64(&imageHostRate)
+	if limit <= 0 {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return true
+	}
+	minute := time.Now().UTC().Format("200601021504")
+	key := ImageFetchRatePrefix + strings.ToLower(u.Hostname()) + ":" + minute
+	pipe := rdb.Pipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, 2*time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warn("Image host rate check failed", "component", "img_analysis", "host", u.Hostname(), "error", err)
+		return true
+	}
+	if incr.Val() > limit {
+		promImageThrottled.WithLabelValues("host_rate").Inc()
+		return false
+	}
+	return true
+}
+
+// --- Image host addresses ---
+//
+// Image URLs come from the messages, so a sender could point them at the services
+// of the internal network (metadata endpoints, admin interfaces) and use the
+// signatures to probe them. Every connection of an image download is checked
+// against the address it actually dials, after DNS resolution and after each
+// redirect: private, loopback, link-local and other special-purpose ranges are
+// refused, unless listed in MI_IMAGE_ALLOWED_NETS (IPs or CIDRs).
+
+const MaxImageRedirects = 5
+
+var (
+	errImageAddress = errors.New("image host address not allowed")
+
+	// Special-purpose ranges the net.IP predicates do not cover
+	reservedImageNets = parseNets("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "192.0.2.0/24", "198.18.0.0/15",
+		"198.51.100.0/24", "203.0.113.0/24", "240.0.0.0/4", "64:ff9b::/96", "2001:db8::/32")
+
+	imageClientOnce sync.Once
+	imageTransport  *http.Transport
+)
+
+// parseNets parses CIDRs known to be valid
+func parseNets(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		nets = append(nets, network)
+	}
+	return nets
+}
+
+// publicAddress tells whether an image may be downloaded from ip
+func publicAddress(ip net.IP) bool {
+	if ipInList(ip, getEnvList("MI_IMAGE_ALLOWED_NETS")) {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range reservedImageNets {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkImageAddress is the dialer Control of image downloads: it sees the resolved
+// address of every connection, redirects included
+func checkImageAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		promImageThrottled.WithLabelValues("address").Inc()
+		return fmt.Errorf("%w: %s", errImageAddress, host)
+	}
+	return nil
+}
+
+// imageClient returns the HTTP client of direct image downloads. It never goes
+// through an environment proxy, which would dial the image host in our place.
+func imageClient(timeout time.Duration) *http.Client {
+	imageClientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: 5 * time.Second, Control: checkImageAddress}
+		imageTransport = &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConnsPerHost:   2,
+			IdleConnTimeout:       30 * time.Second,
+			TLSHandshakeTimeout:   5 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Second,
+		}
+	})
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: imageTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= MaxImageRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s not allowed", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// --- Privacy mode (hash-by-oracle) ---
+//
+// Downloading a tracking pixel confirms to the spammer that the address is live and
+// reveals the IP of the server. With IMAGE_FETCH_MODE=oracle or proxy, Guardian
+// never contacts the image host: it sends the URL to the Oracle or to the fetch
+// proxy of IMAGE_FETCH_PROXY_URL, which downloads and hashes the image the same way
+// and returns its signature. Failures are not retried directly, which would defeat
+// the purpose.
+
+// imageFetchMode returns direct, oracle or proxy (IMAGE_FETCH_MODE)
+func imageFetchMode() string {
+	switch mode := strings.ToLower(getEnv("IMAGE_FETCH_MODE", "direct")); mode {
+	case "oracle", "proxy":
+		return mode
+	default:
+		return "direct"
+	}
+}
+
+// remoteImageHash has the image of imageURL hashed by the Oracle or the fetch proxy,
+// and returns its signature and size
+func remoteImageHash(fetchCtx context.Context, mode, imageURL string) (string, int, error) {
+	timeout := time.Duration(atomic.LoadInt64(&imageFetchTimeout)) * time.Second
+	if deadline, ok := fetchCtx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if timeout <= 0 {
+		return "", 0, context.DeadlineExceeded
+	}
+	var resp *http.Response
+	var err error
+	if mode == "oracle" {
+		resp, err = oraclePost(oracleClient(timeout), "/image-hash", map[string]interface{}{
+			"node_id": nodeID,
+			"url":     imageURL,
+		})
+	} else {
+		proxyURL := getEnv("IMAGE_FETCH_PROXY_URL", "")
+		if proxyURL == "" {
+			return "", 0, errors.New("IMAGE_FETCH_PROXY_URL is not set")
+		}
+		body, _ := json.Marshal(map[string]string{"url": imageURL})
+		req, reqErr := http.NewRequestWithContext(fetchCtx, http.MethodPost, proxyURL, bytes.NewReader(body))
+		if reqErr != nil {
+			return "", 0, reqErr
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token := getEnv("IMAGE_FETCH_PROXY_TOKEN", ""); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		client := &http.Client{Timeout: timeout}
+		resp, err = client.Do(req)
+	}
+	if err != nil {
+		logger.Warn("Remote image hashing failed", "component", "img_analysis", "mode", mode, "url", imageURL, "error", err)
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		logger.Warn("Remote image hashing failed", "component", "img_analysis", "mode", mode, "url", imageURL, "status", resp.StatusCode)
+		return "", 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := oracle.ResponseJSON(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	var result struct {
+		Hash string `json:"hash"`
+		Size int    `json:"size"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", 0, err
+	}
+	if result.Hash == "" {
+		return "", result.Size, errors.New("no hash returned")
+	}
+	if result.Size < MinExternalImageSize {
+		return "", result.Size, fmt.Errorf("too small")
+	}
+	return result.Hash, result.Size, nil
+}
@@ -0,0 +1,143 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Attachment filename rules ---
+
+// Extensions that run code when opened, flagged when they hide behind another one (invoice.pdf.exe)
+var executableExtensions = map[string]bool{
+	"exe": true, "scr": true, "com": true, "pif": true, "bat": true, "cmd": true, "cpl": true,
+	"js": true, "jse": true, "vbs": true, "vbe": true, "wsf": true, "hta": true, "ps1": true,
+	"jar": true, "msi": true, "lnk": true, "iso": true, "img": true,
+}
+
+// filenameRule is a glob ("*.iso") or, between slashes, a regular expression ("/^invoice.*\.zip$/")
+type filenameRule struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func (r filenameRule) match(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+	ok, _ := path.Match(r.glob, strings.ToLower(name))
+	return ok
+}
+
+var (
+	filenameRulesMu sync.RWMutex
+	filenameBlock   []filenameRule // FILENAME_BLOCK: label blocked_filename
+	filenameFlag    []filenameRule // FILENAME_FLAG: signal suspicious_filename
+)
+
+// parseFilenameRules reads a comma separated list of globs and /regexps/ (case-insensitive).
+// Invalid expressions are logged and skipped.
+func parseFilenameRules(key string) []filenameRule {
+	var rules []filenameRule
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+			re, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+			if err != nil {
+				logger.Warn("Invalid filename rule", "setting", key, "rule", entry, "error", err)
+				continue
+			}
+			rules = append(rules, filenameRule{re: re})
+		default:
+			if _, err := path.Match(entry, ""); err != nil {
+				logger.Warn("Invalid filename rule", "setting", key, "rule", entry, "error", err)
+				continue
+			}
+			rules = append(rules, filenameRule{glob: strings.ToLower(entry)})
+		}
+	}
+	return rules
+}
+
+// loadFilenameRules compiles FILENAME_BLOCK and FILENAME_FLAG
+func loadFilenameRules() {
+	block, flag := parseFilenameRules("FILENAME_BLOCK"), parseFilenameRules("FILENAME_FLAG")
+	filenameRulesMu.Lock()
+	filenameBlock, filenameFlag = block, flag
+	filenameRulesMu.Unlock()
+}
+
+// doubleExtension tells whether an executable extension follows another one, e.g. "scan.pdf.exe"
+func doubleExtension(name string) bool {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(name)), ".")
+	if len(parts) < 3 {
+		return false
+	}
+	prev := parts[len(parts)-2]
+	return executableExtensions[parts[len(parts)-1]] && len(prev) >= 2 && len(prev) <= 4
+}
+
+// FilenameVerdict is the outcome of the filename rules on the attachments of a message
+type FilenameVerdict struct {
+	Blocked string   // First attachment name matching FILENAME_BLOCK
+	Signals []string // suspicious_filename, double_extension
+}
+
+// checkFilenames applies the filename rules to the named parts of a message
+func checkFilenames(env *enmime.Envelope) FilenameVerdict {
+	filenameRulesMu.RLock()
+	block, flag := filenameBlock, filenameFlag
+	filenameRulesMu.RUnlock()
+
+	var v FilenameVerdict
+	suspicious, double := false, false
+	for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+		for _, p := range group {
+			if p.FileName == "" {
+				continue
+			}
+			// Only the last path element counts (C:\tmp\scan.pdf.exe)
+			name := path.Base(strings.ReplaceAll(p.FileName, "\\", "/"))
+			for _, rule := range block {
+				if v.Blocked == "" && rule.match(name) {
+					v.Blocked = name
+				}
+			}
+			for _, rule := range flag {
+				if rule.match(name) {
+					suspicious = true
+				}
+			}
+			if doubleExtension(name) {
+				double = true
+			}
+		}
+	}
+	if suspicious {
+		v.Signals = append(v.Signals, "suspicious_filename")
+	}
+	if double {
+		v.Signals = append(v.Signals, "double_extension")
+	}
+	return v
+}
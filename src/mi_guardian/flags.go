@@ -0,0 +1,87 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// --- Per-request pipeline flags ---
+//
+// Mail flows sharing one Guardian may need different pipelines, e.g. no Oracle
+// queries for mailing list traffic. Callers set flags with ?<flag>=1 or the
+// X-Guardian-Flags header ("skip_oracle, want_evidence"); only the flags listed in
+// ANALYZE_FLAGS_ALLOWED are honored.
+
+// analyzeFlags are the stage overrides of one /analyze request
+type analyzeFlags struct {
+	SkipImages   bool // skip_image_analysis: no image fetching or QR decoding
+	SkipOracle   bool // skip_oracle: no Oracle queries
+	LocalOnly    bool // local_only: local store and rules only, no Oracle cache either
+	WantEvidence bool // want_evidence: return the decision trail as "evidence"
+}
+
+var analyzeFlagNames = []string{"skip_image_analysis", "skip_oracle", "local_only", "want_evidence"}
+
+// requestFlags reads the flags of a request and returns those ANALYZE_FLAGS_ALLOWED
+// permits, with the names of the ones it refused
+func requestFlags(r *http.Request) (analyzeFlags, []string) {
+	var requested []string
+	for _, name := range analyzeFlagNames {
+		if v := strings.ToLower(r.URL.Query().Get(name)); v == "1" || v == "true" {
+			requested = append(requested, name)
+		}
+	}
+	for _, name := range strings.Split(r.Header.Get("X-Guardian-Flags"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !slices.Contains(requested, name) {
+			requested = append(requested, name)
+		}
+	}
+
+	var flags analyzeFlags
+	var denied []string
+	allowed := getEnvList("ANALYZE_FLAGS_ALLOWED")
+	for _, name := range requested {
+		if !slices.Contains(analyzeFlagNames, name) || !slices.Contains(allowed, name) {
+			denied = append(denied, name)
+			continue
+		}
+		switch name {
+		case "skip_image_analysis":
+			flags.SkipImages = true
+		case "skip_oracle":
+			flags.SkipOracle = true
+		case "local_only":
+			flags.LocalOnly, flags.SkipOracle, flags.SkipImages = true, true, true
+		case "want_evidence":
+			flags.WantEvidence = true
+		}
+	}
+	return flags, denied
+}
+
+// String lists the flags set, for cache keys
+func (f analyzeFlags) String() string {
+	var set []string
+	for i, on := range []bool{f.SkipImages, f.SkipOracle, f.LocalOnly, f.WantEvidence} {
+		if on {
+			set = append(set, analyzeFlagNames[i])
+		}
+	}
+	return strings.Join(set, ",")
+}
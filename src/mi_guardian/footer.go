@@ -0,0 +1,98 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"regexp"
+	"strings"
+)
+
+// --- Footer stripping ---
+//
+// Emailing services append the same legal and unsubscribe boilerplate to every
+// newsletter they send. On short messages it weighs enough in the body signature for
+// unrelated newsletters to cluster, so a spam report on one lowers the others. With
+// STRIP_FOOTERS=true the footer is cut before the body is normalized and hashed.
+// This changes body signatures: hashes learned before, and those of nodes or Oracles
+// hashing full bodies, no longer match the same messages.
+
+const (
+	FooterZone         = 0.4  // Share of the end of a body searched for a footer
+	MinFooterKeptBody  = 200  // Bytes a body keeps at least, or its footer is left in place
+	MaxFooterBlockSpan = 2000 // Bytes an HTML footer block may start before its marker
+)
+
+var (
+	// Unsubscribe links and the usual sentences of emailing service footers
+	reFooterMarker = regexp.MustCompile(`(?i)unsubscribe|se d[ée]sinscrire|d[ée]sabonner|d[ée]sinscription|abmelden|darse de baja|opt[ -]out|` +
+		`(manage|update) (your )?(e-?mail |subscription )?preferences|view (it |this e-?mail )?in (your|a) browser|` +
+		`you (are )?receiv(ed|ing) this (e-?mail|message|newsletter)|this (e-?mail|message) was sent to|` +
+		`all rights reserved|tous droits r[ée]serv[ée]s|©|&copy;|\(c\) (19|20)\d\d`)
+	// Openings of the HTML blocks a footer is laid out in
+	reFooterBlock = regexp.MustCompile(`(?i)<(footer|table|tr|td|div|p|hr)[\s>/]`)
+)
+
+// footerStart returns the offset of the first footer marker within the last
+// FooterZone of body, -1 when there is none or cutting would leave too little
+func footerStart(body string) int {
+	zone := int(float64(len(body)) * (1 - FooterZone))
+	loc := reFooterMarker.FindStringIndex(body[zone:])
+	if loc == nil || zone+loc[0] < MinFooterKeptBody {
+		return -1
+	}
+	return zone + loc[0]
+}
+
+// stripTextFooter cuts a text body at the line holding its footer marker, or at the
+// signature delimiter ("-- ") just above it
+func stripTextFooter(text string) string {
+	at := footerStart(text)
+	if at < 0 {
+		return text
+	}
+	cut := strings.LastIndexByte(text[:at], '\n') + 1
+	if sig := strings.LastIndex(text[:cut], "\n-- \n"); sig >= 0 && cut-sig < MaxFooterBlockSpan && sig >= MinFooterKeptBody {
+		cut = sig + 1
+	}
+	return text[:cut]
+}
+
+// stripHTMLFooter cuts an HTML body at the start of the last block opened before its
+// footer marker. Unclosed tags do not matter, the result is only hashed.
+func stripHTMLFooter(html string) string {
+	at := footerStart(html)
+	if at < 0 {
+		return html
+	}
+	from := max(0, at-MaxFooterBlockSpan)
+	cut := at
+	if blocks := reFooterBlock.FindAllStringIndex(html[from:at], -1); len(blocks) > 0 {
+		cut = from + blocks[len(blocks)-1][0]
+	}
+	if cut < MinFooterKeptBody {
+		return html
+	}
+	return html[:cut]
+}
+
+// hashableBody returns the normalized body the body signature is computed from,
+// without its footer when STRIP_FOOTERS is enabled
+func hashableBody(text, html string) string {
+	if strings.ToLower(getEnv("STRIP_FOOTERS", "false")) == "true" {
+		text, html = stripTextFooter(text), stripHTMLFooter(html)
+	}
+	return normalizeEmailBody(text, html)
+}
@@ -0,0 +1,98 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+)
+
+// --- Credential harvesting forms ---
+
+// messageCredentialForms checks the HTML body and the HTML attachments of a message
+func messageCredentialForms(env *enmime.Envelope) []string {
+	sender := addressDomain(env.GetHeader("From"))
+	found := credentialForm(env.HTML, sender)
+	for _, att := range env.Attachments {
+		if strings.HasPrefix(att.ContentType, "text/html") {
+			found = append(found, credentialForm(string(att.Content), sender)...)
+		}
+	}
+	return found
+}
+
+// credentialForm looks for what phishing kits embed in the message itself: a password
+// field, or a form posting to a domain other than the sender's. Fuzzy hashes miss
+// them because the surrounding text changes with every wave. Returns the reasons found
+// ("password_input", "external_form:<host>").
+func credentialForm(body, senderDomain string) []string {
+	lower := strings.ToLower(body)
+	if !strings.Contains(lower, "<form") && !strings.Contains(lower, "password") {
+		return nil
+	}
+	var found []string
+	seen := make(map[string]bool)
+	add := func(reason string) {
+		if !seen[reason] {
+			seen[reason] = true
+			found = append(found, reason)
+		}
+	}
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return found
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tok := z.Token()
+		switch tok.Data {
+		case "input":
+			if strings.EqualFold(tagAttr(tok, "type"), "password") {
+				add("password_input")
+			}
+		case "form":
+			if !strings.EqualFold(tagAttr(tok, "method"), "post") {
+				// GET forms are search boxes and surveys far more often than phishing
+				continue
+			}
+			u, err := url.Parse(strings.TrimSpace(tagAttr(tok, "action")))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			if host != "" && (senderDomain == "" || !domainMatches(host, senderDomain)) {
+				add("external_form:" + host)
+			}
+		}
+	}
+}
+
+// tagAttr returns the value of an attribute of an HTML tag, or ""
+func tagAttr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -13,37 +13,176 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
 	"context"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // --- Mailuminati engine configuration ---
 const (
-	EngineVersion         = "0.7.6"
-	FragKeyPrefix         = "mi_f:"
-	LocalFragPrefix       = "lg_f:"
-	OracleCacheFragPrefix = "oc_f:"
-	LocalScorePrefix      = "lg_s:"
-	MetaNodeID            = "mi_meta:id"
-	MetaVer               = "mi_meta:v"
-	DefaultOracle         = "https://oracle.mailuminati.com"
-	MaxProcessSize        = 15 * 1024 * 1024 // 15 MB max
-	MinVisualSize         = 50 * 1024        // Ignore small logos/trackers (internal attachments)
-	MinExternalImageSize  = 40 * 1024        // Ignore small external images (visual analysis)
-	DefaultLocalRetention = 15               // Days to keep local learning data
+	EngineVersion          = "0.7.6"
+	FragKeyPrefix          = "mi_f:"
+	LocalFragPrefix        = "lg_f:"
+	OracleCacheFragPrefix  = "oc_f:"
+	LocalScorePrefix       = "lg_s:"
+	LocalReporterPrefix    = "lg_r:"
+	LocalCounterPrefix     = "lg_c:"
+	LocalSeenPrefix        = "lg_t:" // First/last seen and hits of a learned hash
+	LocalStructurePrefix   = "lg_m:"
+	LocalSubjectPrefix     = "lg_u:"  // Score of a learned subject signature
+	LocalSubjectFragPrefix = "lg_uf:" // Bands of the learned subject signatures
+	ConflictSetKey         = "mi:conflicts"
+	ReporterTrustPrefix    = "mi:trust:"
+	ReportQuotaPrefix      = "mi:quota:"
+	ImageFetchRatePrefix   = "mi:fetch:"
+	VerdictCachePrefix     = "mi:verdict:"
+	DmarcFailPrefix        = "mi:dmarc:fail:"
+	DmarcScrutinyPrefix    = "mi:dmarc:scrutiny:"
+	KillHashPrefix         = "mi:kill:"            // Hashes blocked by /admin/block-hash
+	KillBandPrefix         = "mi:kill_f:"          // Bands of the blocked hashes
+	AdaptiveStatsPrefix    = "mi:adapt:stats:"     // Per tenant local_spam verdicts and ham reports on them
+	AdaptiveThresholdsKey  = "mi:adapt:thresholds" // Tenant -> adjusted local threshold
+	AdaptiveLockKey        = "mi:adapt:lock"
+	AuditLockKey           = "mi:audit:lock"
+	OracleDecisionPrefix   = "mi:oracle_cache:"
+	OracleAllowHitsPrefix  = "mi:oc_hits:"    // Times a cached Oracle allow decision was served
+	OracleExtendedKey      = "mi:oc_extended" // Oracle cache keys kept alive during an outage
+	OracleOutageLockKey    = "mi:oc_outage:lock"
+	BlocklistLocalKey      = "mi:blk:local"  // SHA-256 of attachments blocked by the admin
+	BlocklistOracleKey     = "mi:blk:oracle" // SHA-256 of attachments synced from the Oracle
+	BlocklistSenderKey     = "mi:blk:sender" // Sender domains blocked by the admin
+	BlocklistURLKey        = "mi:blk:url"    // Link domains blocked by the admin
+	BayesSpamKey           = "mi:bayes:spam" // Token bucket -> spam reports
+	BayesHamKey            = "mi:bayes:ham"  // Token bucket -> ham reports
+	BayesMetaKey           = "mi:bayes:meta" // Reports the model was trained with
+	MetaNodeID             = "mi_meta:id"
+	MetaNodeKey            = "mi_meta:key"     // Ed25519 seed of the node key, kept in Redis before NODE_KEY_FILE
+	MetaNodePublicKey      = "mi_meta:key_pub" // Public key of the node key
+	MetaVer                = "mi_meta:v"
+	MetaSchema             = "mi_meta:schema"
+	MetaCounters           = "mi_meta:counters"
+	MetaBandGeometry       = "mi_meta:bands"
+	MetaOracleSettings     = "mi_meta:oracle_settings" // Settings recommended at registration
+	BandGeometry           = "6_3"                     // Window/stride of extractBands_6_3, change with it: stored indexes are rebuilt
+	DefaultOracle          = "https://oracle.mailuminati.com"
+	MaxProcessSize         = 15 * 1024 * 1024 // 15 MB max
+	MinVisualSize          = 50 * 1024        // Ignore small logos/trackers (internal attachments)
+	MinExternalImageSize   = 40 * 1024        // Ignore small external images (visual analysis)
+	MaxExternalImageSize   = 10 * 1024 * 1024 // Larger external images are skipped, not truncated
+	MaxImagePixels         = 40000000         // Images declaring more pixels are not decoded (decompression bombs)
+	MaxNestedDepth         = 3                // Levels of attached messages analyzed (forward of a forward...)
+	ImageCanonicalSize     = 64               // Width/height of normalized images before hashing
+	DefaultLocalRetention  = 15               // Days to keep local learning data
+	DefaultScanRetention   = 7                // Days to keep scan results (hashes and verdict) for reports
+	DefaultListThreshold   = 3                // Local spam threshold for mailing lists/trusted forwarders
+	DefaultAdminWeight     = 3                // Multiplier applied to reports sent with ADMIN_TOKEN
+	DefaultConflictMargin  = 2                // Spam minus ham weight required to act on conflicting hashes
+	DefaultStructureLimit  = 0                // Local score required to act on a MIME structure fingerprint (0 = learned only)
+	DefaultMaxAttendees    = 0                // Attendees of an unsigned invite flagged as mass calendar spam (0 = off)
+
+	ReporterTrustRetention = 90 * 24 * time.Hour // Keep reporter accuracy counters for 90 days
+	CounterPersistInterval = 1 * time.Minute     // Flush of lifetime counters to Redis
+
+	DefaultMaxExternalImages = 10 // External image candidates per message
+	DefaultImageConcurrency  = 5  // Concurrent image downloads per message
+	DefaultImageTimeout      = 5  // Seconds allowed for all image fetching of a message
+
+	DefaultMimeMaxParts = 1000 // MIME parts analyzed per message
+	DefaultMimeMaxDepth = 20   // Nested multipart levels analyzed
+
+	DefaultAnalyzeDedupTTL = 5     // Seconds an /analyze response is reused for identical requests
+	MaxAnalyzeDedupEntries = 10000 // Responses kept for reuse
+
+	DefaultImageGlobalConcurrency = 20  // Concurrent image downloads across all analyses
+	DefaultImageGuardInFlight     = 200 // Analyses in flight from which image analysis is paused
+	DefaultImageGuardRedisMs      = 50  // Redis round trip (ms) from which image analysis is paused
+	DefaultImageGuardQueue        = 100 // Analyses waiting for a download slot from which image analysis is paused
+	DefaultImageUserAgent         = "Mailuminati-Guardian/" + EngineVersion + " (+https://mailuminati.com)"
+
+	DefaultOutboundBulkRecipients = 20 // Envelope recipients from which an outbound message is bulk mail
+
+	DefaultVerdictCacheTTL = 30 // Seconds the outcome of an analysis is reused for the same content
+
+	DefaultAuditInterval = 24 // Hours between two consistency audits of the local store
+
+	DefaultOracleOutage  = 300              // Seconds without an Oracle answer before its cache is kept alive
+	OracleOutageTTLFloor = 10 * time.Minute // TTL Oracle cache entries are kept at during an outage
+	OracleRecoveryWindow = 5 * time.Minute  // Spread of the expiry of kept entries once the Oracle is back
+
+	DefaultOracleAllowTTL  = 300 // Seconds an Oracle allow decision is cached
+	DefaultOracleAllowHits = 20  // Cached allow answers before the Oracle is asked again (0 = until expiry)
+
+	DefaultBandHotSize    = 500  // Members of a band set over which lookups skip it
+	DefaultBandMaxMembers = 5000 // Members a band set is trimmed to on write
+	MaxBandStatsListed    = 20   // Largest band sets listed by /admin/bands
+	BandTTLRefreshRatio   = 0.5  // Share of the retention left below which a matched band set is re-expired
+
+	DefaultDistanceBackend = "fast" // TLSH distance implementation (DISTANCE_BACKEND)
+
+	DefaultSyncInterval  = 60  // Seconds between two Oracle syncs
+	DefaultStatsInterval = 600 // Seconds between two stats reports (0 disables them)
+	DefaultWorkerJitter  = 10  // Random spread of worker intervals, in percent
+	MinSyncInterval      = 10
+	RegistrationInterval = 6 * time.Hour // Refresh of the Oracle registration and its settings
+
+	DefaultTextfileInterval = 60 // Seconds between two writes of METRICS_TEXTFILE
+
+	DefaultLogFile        = "/var/log/mailuminati-guardian/guardian.log"
+	DefaultNodeKeyFile    = "/var/lib/mailuminati-guardian/node.key"
+	DefaultLogFileSizeMB  = 100 // Size of the log file before rotation (LOG_OUTPUT=file)
+	DefaultLogFileBackups = 5   // Rotated log files kept
+
+	DefaultMemoryCacheSize = 10000 // Entries per in-process cache (0 disables)
+	DefaultMemoryCacheTTL  = 10    // Seconds a value is served from memory before asking Redis again
+
+	// Guardian test pattern (like GTUBE): any message containing it is flagged spam with label "test"
+	TestSpamPattern = "MAILUMINATI-GUARDIAN-TEST-PATTERN-5D8E1F0B-SPAM-THIS-MESSAGE"
+
+	DefaultDmarcSpoofMin  = 10 // DMARC failures per day before a From-domain is under scrutiny
+	DefaultDmarcScrutiny  = 7  // Days a spoofed domain stays under scrutiny
+	DefaultDmarcThreshold = 1  // Local spam threshold for spoofed domains
+
+	DefaultAdaptiveMax      = 10 // Upper bound of adjusted local thresholds
+	DefaultAdaptiveTarget   = 2  // Ham reports per 100 local_spam verdicts tolerated
+	DefaultAdaptiveSamples  = 50 // local_spam verdicts needed before a step
+	DefaultAdaptiveHam      = 5  // Ham reports needed before a step
+	DefaultAdaptiveInterval = 24 // Hours between steps
+
+	DefaultKillSwitchHours = 24      // Expiry of a kill switch entry without ttl_hours
+	MaxKillSwitchHours     = 30 * 24 // Upper bound for ttl_hours
+
+	DuplicateSignatureDistance = 5 // Signatures of a message this close to another one are looked up and learned once
+
+	ProximityDistance = 70 // Signatures this close are treated as the same content
+
+	StreamBufferSize = 256 // Verdict events queued per /admin/stream client before some are dropped
+
+	DashboardRecentSpam   = 50    // Spam verdicts listed by the dashboard
+	DashboardTopCampaigns = 10    // Learned hashes with the highest score listed by the dashboard
+	DashboardScanLimit    = 10000 // Local score keys read to find them
+
+	MaxQRImagePixels      = 4000000 // Larger images are not searched for QR codes
+	MaxQRImagesPerMessage = 5       // Attached and inline images of a message searched for QR codes
+	MaxQRDecodes          = 4       // QR decodes running at the same time across the instance
+
+	MaxSyncSamples = 10 // Bands listed per operation by /admin/sync/preview
+
+	DefaultReplayHours = 24    // Age of stored scans replayed by /admin/replay
+	DefaultReplayLimit = 1000  // Scans replayed per call
+	MaxReplayLimit     = 10000 // Upper bound for ?limit=
+	MaxReplaySamples   = 20    // Changed verdicts listed in the replay report
 )
 
 var (
 	ctx                    = context.Background()
-	rdb                    *redis.Client
+	rdb                    Store
 	oracleURL              string
 	nodeID                 string
 	scanCount              int64
@@ -55,34 +194,271 @@ var (
 	spamWeight             int64
 	hamWeight              int64
 	localSpamThreshold     int64
+	listSpamThreshold      int64
 	localRetentionDuration time.Duration
 
+	// Stored scan results
+	scanRetentionDays int64 = DefaultScanRetention
+	skipCleanScans    atomic.Bool
+
+	// Coalescing of identical /analyze requests
+	analyzeDedupOff atomic.Bool
+	analyzeDedupTTL int64 = DefaultAnalyzeDedupTTL
+
+	// Daily report quotas (0 = unlimited)
+	reportQuotaReporter int64
+	reportQuotaDomain   int64
+	reportQuotaGlobal   int64
+	adminReportWeight   int64
+	conflictMargin      int64
+
+	// MIME structure fingerprint (0 disables detection)
+	structureSpamThreshold int64 = DefaultStructureLimit
+
+	// Subject signature (0 disables detection)
+	subjectSpamThreshold int64 = DefaultSubjectLimit
+
+	// Calendar invites (0 disables mass invite detection)
+	calendarMaxAttendees int64 = DefaultMaxAttendees
+
+	// Score of a message with a password protected attachment (0 = signal only)
+	encryptedAttachmentScore int64
+
+	// Score of a message embedding a credential harvesting form (0 = signal only)
+	credentialFormScore int64
+
+	// Score of a message with emoji, zero-width or mixed-script anomalies (0 = signal only)
+	textAnomalyScore int64
+
+	// Weight of the Bayes spam probability (0 = signal only)
+	bayesWeight int64
+
+	// Weight of the external classifier score, a 0..1 probability (0 = signal only)
+	classifierWeight int64
+
+	// DMARC driven scrutiny of spoofed From-domains
+	dmarcSpoofMinMessages int64 = DefaultDmarcSpoofMin
+	dmarcScrutinyDays     int64 = DefaultDmarcScrutiny
+	dmarcSpamThreshold    int64 = DefaultDmarcThreshold
+
+	dmarcRequireDkim atomic.Bool // DMARC_REQUIRE_DKIM, true by default (see dmarc.go init)
+
+	// Canary threshold profile (CANARY_PERCENT = 0 disables it)
+	canaryPercent        int64
+	canarySpamThreshold  int64
+	canaryConflictMargin int64
+	canarySpamWeight     int64
+	canaryHamWeight      int64
+
+	// Worker intervals (seconds)
+	syncIntervalSeconds  int64 = DefaultSyncInterval
+	statsIntervalSeconds int64 = DefaultStatsInterval
+	workerJitterPercent  int64 = DefaultWorkerJitter
+
+	// Oracle sync health (since start)
+	syncLastSuccess  int64 // Unix time of the last successful sync
+	syncLastStatus   int64 // HTTP status of the last sync (0 = request error)
+	syncBandsAdded   int64
+	syncBandsRemoved int64
+	oracleLastAnswer int64 // Unix time of the last Oracle answer to a decision query
+
 	// Logging
 	logger *slog.Logger
 
 	// Image Analysis
-	enableImageAnalysis bool = true
-	maxExternalImages   int  = 10
+	enableImageAnalysis bool  = true
+	maxExternalImages   int64 = DefaultMaxExternalImages
+	imageConcurrency    int64 = DefaultImageConcurrency
+	imageFetchTimeout   int64 = DefaultImageTimeout // Seconds
+	imageHostRate       int64                       // Downloads per host and minute (0 = unlimited)
+
+	// In-process cache
+	memoryCacheTTLSeconds int64 = DefaultMemoryCacheTTL
+
+	// Cached Oracle allow decisions
+	oracleAllowTTL     int64 = DefaultOracleAllowTTL // Seconds
+	oracleAllowMaxHits int64 = DefaultOracleAllowHits
 
 	// Config
 	configMap   map[string]string = make(map[string]string)
 	configMutex sync.RWMutex
 
 	// Prometheus metrics
-	promScanned = prometheus.NewCounter(prometheus.CounterOpts{
+	promScanned = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mailuminati_guardian_scanned_total",
 		Help: "Total number of emails scanned",
-	})
-	promLocalMatch = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"tenant"})
+	promLocalMatch = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mailuminati_guardian_local_match_total",
 		Help: "Total number of emails matched locally",
-	})
+	}, []string{"tenant"})
 	promOracleMatch = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mailuminati_guardian_oracle_match_total",
 		Help: "Total number of emails matched via oracle",
-	}, []string{"type"})
+	}, []string{"type", "tenant"})
+	promPrecheck = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_precheck_total",
+		Help: "Header-only pre-checks by verdict label",
+	}, []string{"label"})
+	promAnalyzeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mailuminati_guardian_analyze_duration_seconds",
+		Help:    "Duration of /analyze requests by message size tier",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"tier"})
+	promPropagation = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_propagation_total",
+		Help: "Reports propagated between nodes by result",
+	}, []string{"result"})
+	promGossip = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_gossip_total",
+		Help: "Gossip messages exchanged with peers by result",
+	}, []string{"result"})
+	promCalibrationDistance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_calibration_ham_distance_ratio",
+		Help: "Share of sampled ham signatures by distance bucket to the nearest learned hash",
+	}, []string{"bucket"})
+	promCalibrationRisk = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_calibration_overlap_risk",
+		Help: "Share of sampled ham signatures the current thresholds would flag as spam",
+	})
+	promMaintenanceDeferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_maintenance_deferred_total",
+		Help: "Heavy background tasks deferred, by task and reason (window, scan_rate)",
+	}, []string{"task", "reason"})
+	promAsyncQueue = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_async_queue_total",
+		Help: "Messages of the asynchronous scanning queue by result",
+	}, []string{"result"})
 	promCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mailuminati_guardian_cache_hits_total",
 		Help: "Total number of cache hits",
 	}, []string{"result"})
+	promMemoryCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_memory_cache_lookups_total",
+		Help: "Total number of in-process cache lookups",
+	}, []string{"cache", "result"})
+	promSignals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_signals_total",
+		Help: "Total number of emails carrying a content signal",
+	}, []string{"signal", "tenant"})
+	promSyncBands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_sync_bands_total",
+		Help: "Total number of Oracle bands applied by sync, by operation",
+	}, []string{"op"})
+	promSyncResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_sync_responses_total",
+		Help: "Total number of Oracle sync responses, by status code",
+	}, []string{"code"})
+	promSyncSeq = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_sync_seq",
+		Help: "Current local sequence of the Oracle band index",
+	})
+	promSyncLastSuccess = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful Oracle sync (0 = none since start)",
+	}, func() float64 { return float64(atomic.LoadInt64(&syncLastSuccess)) })
+	promScanStore = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_scan_store_total",
+		Help: "Total number of scan results stored for reports, by result (stored, skipped, error)",
+	}, []string{"result"})
+	promImageThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_image_fetch_throttled_total",
+		Help: "Total number of external image downloads skipped, by reason (host_rate, global_cap)",
+	}, []string{"reason"})
+	promMimeLimits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_mime_limits_total",
+		Help: "Total number of messages over a MIME limit, by limit (parts, depth, part_size)",
+	}, []string{"limit"})
+	promBandTTLRefresh = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_band_ttl_refresh_total",
+		Help: "Total number of matched local band sets whose TTL was refreshed or left alone (still above half the retention), by result",
+	}, []string{"result"})
+	promHotBands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_hot_bands_skipped_total",
+		Help: "Total number of band sets left out of a lookup for exceeding BAND_HOT_SIZE, by store (local, oracle_cache)",
+	}, []string{"store"})
+	promBandsTrimmed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_bands_trimmed_total",
+		Help: "Total number of band sets trimmed to BAND_MAX_MEMBERS on write, by store (local, oracle_cache)",
+	}, []string{"store"})
+	promAuditOrphans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_audit_orphans_total",
+		Help: "Total number of inconsistencies found by the consistency audit, by kind (band_member, score)",
+	}, []string{"kind"})
+	promVerdictCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_verdict_cache_hits_total",
+		Help: "Total number of /analyze requests answered from the verdict cache, by level (memory, redis)",
+	}, []string{"level"})
+	promLogTailEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_log_tail_events_total",
+		Help: "Learning events read from LOG_TAIL_FILES, by report type and result (learned, unknown)",
+	}, []string{"type", "result"})
+	promQuarantine = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_quarantine_total",
+		Help: "Messages delivered to the quarantine mailbox, by method (imap, jmap) and result (delivered, error)",
+	}, []string{"method", "result"})
+	promTarpit = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_tarpit_delayed_total",
+		Help: "Total number of messages given a tarpit delay (TARPIT_MAX_SECONDS)",
+	})
+	promTarpitSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_tarpit_delay_seconds_total",
+		Help: "Total tarpit delay recommended to MTAs, in seconds",
+	})
+	promImageRawHashed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_image_raw_hashed_total",
+		Help: "Total number of images hashed on their raw bytes because they could not be decoded",
+	})
+	promImageGuard = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_image_analysis_paused",
+		Help: "1 while image analysis is paused by the load guard (IMAGE_GUARD_*)",
+	})
+	promImageGuardTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_image_guard_trips_total",
+		Help: "Total number of times the load guard paused image analysis, by reason (inflight, redis_latency, queue)",
+	}, []string{"reason"})
+	promFaultsInjected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_faults_injected_total",
+		Help: "Total number of failures injected through /admin/faults, by dependency (redis, oracle)",
+	}, []string{"dependency"})
+	promOracleOutage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_oracle_outage",
+		Help: "1 while the Oracle has not answered for ORACLE_OUTAGE_SECONDS and its cache entries are kept alive",
+	})
+	promClassifier = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_classifier_calls_total",
+		Help: "Total number of external classifier calls, by result (ok, error, timeout)",
+	}, []string{"result"})
+	promUpdateAvailable = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mailuminati_guardian_update_available",
+		Help: "1 when the signed release manifest of UPDATE_CHECK_URL offers a newer engine for this platform",
+	})
+	promUpdateCheck = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_update_checks_total",
+		Help: "Total number of release manifest checks, by result (ok, error)",
+	}, []string{"result"})
+	promOracleCacheExtended = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_oracle_cache_extended_total",
+		Help: "Total number of Oracle cache entries whose TTL was extended during an Oracle outage",
+	})
+	promACLDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_acl_denied_total",
+		Help: "Total number of requests refused by GUARDIAN_ALLOWED_CIDRS",
+	})
+	promDistancePrefiltered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_distance_prefiltered_total",
+		Help: "Total number of proximity candidates discarded by their TLSH header before a full distance computation",
+	})
+	promAnalyzeDedup = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_analyze_dedup_total",
+		Help: "Total number of /analyze requests answered with the result of an identical request, by source (inflight, cache)",
+	}, []string{"source"})
+	promStreamDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_stream_dropped_total",
+		Help: "Total number of verdict events not delivered to slow /admin/stream clients",
+	})
+	promProfileVerdicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mailuminati_guardian_profile_verdicts_total",
+		Help: "Local match verdicts per threshold profile while a canary is configured",
+	}, []string{"profile", "enforced", "verdict"})
 )
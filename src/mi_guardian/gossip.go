@@ -0,0 +1,254 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Peer-to-peer gossip ---
+//
+// Guardians of one organization can exchange the spam they learned from reports
+// directly, without the Oracle and without a shared Redis. Each node lists its
+// peers in GOSSIP_PEERS; spam signatures learned locally are batched and posted to
+// their /gossip endpoint every GOSSIP_INTERVAL seconds, signed with the secret the
+// two nodes share (GOSSIP_PEER_<NAME>_SECRET), which authenticates the sender.
+// Receivers learn them with the weight of the sending peer and forward them to
+// their own peers: message IDs, the origin node and a hop limit stop loops.
+
+const (
+	GossipSeenPrefix      = "mi:gossip_seen:" // Gossip message IDs already handled
+	GossipReporterPrefix  = "peer:"           // Reporter of the spam learned from a peer
+	GossipPeerHeader      = "X-Guardian-Gossip-Peer"
+	GossipSignatureHeader = "X-Guardian-Gossip-Signature"
+	DefaultGossipInterval = 10  // Seconds between two batches
+	DefaultGossipMaxHops  = 3   // Relays before a gossip message is dropped
+	DefaultGossipWeight   = 100 // Percent of the spam weight a peer report is learned with
+	GossipMaxClockSkew    = 5 * time.Minute
+	GossipSeenTTL         = time.Hour
+	MaxGossipSize         = 1 << 20
+)
+
+// GossipMessage is the body of POST /gossip
+type GossipMessage struct {
+	ID     string            `json:"id"`     // unique per batch, kept by relays
+	Origin string            `json:"origin"` // node ID of the node that learned the hashes
+	Hops   int               `json:"hops"`
+	Time   int64             `json:"ts"`
+	Hashes []string          `json:"hashes"`
+	Kinds  map[string]string `json:"kinds,omitempty"` // signature -> attachment or image (body otherwise)
+}
+
+var (
+	gossipMu      sync.Mutex
+	gossipPending []string          // Spam signatures learned since the last batch
+	gossipKinds   map[string]string // Kinds of the pending attachment and image signatures
+)
+
+// gossipPeers returns the names of GOSSIP_PEERS that have a secret
+func gossipPeers() []string {
+	var peers []string
+	for _, peer := range getEnvList("GOSSIP_PEERS") {
+		if gossipPeerSetting(peer, "SECRET", "") != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// gossipPeerSetting reads GOSSIP_PEER_<NAME>_<SETTING>
+func gossipPeerSetting(peer, setting, fallback string) string {
+	return getEnv("GOSSIP_PEER_"+strings.ToUpper(peer)+"_"+setting, fallback)
+}
+
+// gossipPeerWeight returns the share of the spam weight (GOSSIP_PEER_<NAME>_WEIGHT
+// percent) the reports of a peer are learned with, 0 for unknown peers
+func gossipPeerWeight(peer string) float64 {
+	if !isGossipPeer(peer) {
+		return 0
+	}
+	var percent int64 = DefaultGossipWeight
+	fmt.Sscan(gossipPeerSetting(peer, "WEIGHT", ""), &percent)
+	return float64(percent) / 100
+}
+
+// isRelayedReporter tells whether a report came from another node (propagation or
+// gossip), and so must not be shared again
+func isRelayedReporter(reporter string) bool {
+	return strings.HasPrefix(reporter, PeerReporterPrefix) || strings.HasPrefix(reporter, GossipReporterPrefix)
+}
+
+// gossipSignature is the hex HMAC-SHA256 of a body with the secret shared with a peer
+func gossipSignature(peer string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(gossipPeerSetting(peer, "SECRET", "")))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueGossip adds the signatures of a spam learned locally to the next batch
+func queueGossip(scanData ScanResult, reportType, reporter string) {
+	if reportType != "spam" || isRelayedReporter(reporter) || len(gossipPeers()) == 0 {
+		return
+	}
+	gossipMu.Lock()
+	gossipPending = append(gossipPending, scanData.Hashes...)
+	for _, hash := range scanData.Hashes {
+		if kind := scanData.Kinds[hash]; kind != "" {
+			if gossipKinds == nil {
+				gossipKinds = map[string]string{}
+			}
+			gossipKinds[hash] = kind
+		}
+	}
+	gossipMu.Unlock()
+}
+
+// sendGossip posts a gossip message to the peers, except the one it came from
+func sendGossip(msg GossipMessage, except string) {
+	body, _ := json.Marshal(msg)
+	self := strings.ToLower(getEnv("GOSSIP_NAME", nodeID))
+	for _, peer := range gossipPeers() {
+		url := gossipPeerSetting(peer, "URL", "")
+		if peer == except || url == "" {
+			continue
+		}
+		callCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		req, err := http.NewRequestWithContext(callCtx, http.MethodPost, strings.TrimRight(url, "/")+"/gossip", bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(GossipPeerHeader, self)
+			req.Header.Set(GossipSignatureHeader, gossipSignature(peer, body))
+			var resp *http.Response
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode/100 != 2 {
+					err = fmt.Errorf("peer answered %d", resp.StatusCode)
+				}
+			}
+		}
+		cancel()
+		if err != nil {
+			logger.Warn("Gossip not delivered", "peer", peer, "error", err)
+			promGossip.WithLabelValues("send_error").Inc()
+			continue
+		}
+		promGossip.WithLabelValues("sent").Inc()
+	}
+}
+
+// flushGossip sends the signatures learned since the last batch
+func flushGossip() {
+	gossipMu.Lock()
+	hashes, kinds := gossipPending, gossipKinds
+	gossipPending, gossipKinds = nil, nil
+	gossipMu.Unlock()
+	if len(hashes) == 0 {
+		return
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	msg := GossipMessage{ID: hex.EncodeToString(id), Origin: nodeID, Time: time.Now().Unix(), Hashes: dedupeSignatures(hashes), Kinds: kinds}
+	// Our own batch is not learned again if a peer sends it back
+	rdb.Set(ctx, GossipSeenPrefix+msg.ID, "1", GossipSeenTTL)
+	sendGossip(msg, "")
+}
+
+// gossipWorker sends the pending batch every GOSSIP_INTERVAL seconds
+func gossipWorker() {
+	if len(gossipPeers()) == 0 {
+		return
+	}
+	for {
+		time.Sleep(time.Duration(getEnvPositiveInt("GOSSIP_INTERVAL", DefaultGossipInterval)) * time.Second)
+		flushGossip()
+	}
+}
+
+// gossipHandler serves POST /gossip: spam signatures learned by a peer, signed with
+// the secret shared with it. 404 when gossip is not configured.
+func gossipHandler(w http.ResponseWriter, r *http.Request) {
+	if len(gossipPeers()) == 0 {
+		writeError(w, http.StatusNotFound, ErrNotFound, "Gossip is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxGossipSize))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrReadBody, "Error reading body")
+		return
+	}
+	peer := strings.ToLower(r.Header.Get(GossipPeerHeader))
+	if !isGossipPeer(peer) || !hmac.Equal([]byte(gossipSignature(peer, body)), []byte(strings.ToLower(r.Header.Get(GossipSignatureHeader)))) {
+		promGossip.WithLabelValues("rejected").Inc()
+		writeError(w, http.StatusUnauthorized, ErrUnauthorized, "Unknown peer or invalid signature")
+		return
+	}
+	var msg GossipMessage
+	if err := json.Unmarshal(body, &msg); err != nil || msg.ID == "" || msg.Origin == "" {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid gossip message")
+		return
+	}
+	// Replayed messages are refused once their ID has been forgotten
+	if skew := time.Since(time.Unix(msg.Time, 0)); skew > GossipMaxClockSkew || skew < -GossipMaxClockSkew {
+		promGossip.WithLabelValues("rejected").Inc()
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Gossip message too old")
+		return
+	}
+	if added, err := rdb.SetNX(ctx, GossipSeenPrefix+msg.ID, "1", GossipSeenTTL).Result(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, ErrStoreUnavailable, "Store unavailable")
+		return
+	} else if !added || msg.Origin == nodeID {
+		promGossip.WithLabelValues("duplicate").Inc()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	promGossip.WithLabelValues("received").Inc()
+	if gossipPeerWeight(peer) > 0 {
+		learnFromReport(ScanResult{Hashes: dedupeSignatures(msg.Hashes), Kinds: msg.Kinds}, "spam", GossipReporterPrefix+peer, "")
+	}
+	if int64(msg.Hops)+1 < getEnvPositiveInt("GOSSIP_MAX_HOPS", DefaultGossipMaxHops) {
+		msg.Hops++
+		go sendGossip(msg, peer)
+		promGossip.WithLabelValues("forwarded").Inc()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isGossipPeer tells whether a name is one of GOSSIP_PEERS
+func isGossipPeer(peer string) bool {
+	for _, p := range gossipPeers() {
+		if p == peer {
+			return true
+		}
+	}
+	return false
+}
@@ -13,16 +13,14 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
-	"io"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,66 +33,197 @@ import (
 // --- Handlers ---
 
 func analyzeHandler(w http.ResponseWriter, r *http.Request) {
-	atomic.AddInt64(&scanCount, 1)
-	promScanned.Inc()
-
 	if r.Method != http.MethodPost {
-		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
 		return
 	}
 
-	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, MaxProcessSize))
-	if err != nil {
-		http.Error(w, "Error reading body", http.StatusInternalServerError)
+	bodyBytes, ok := readAnalyzeBody(w, r)
+	if !ok {
 		return
 	}
-
-	env, err := enmime.ReadEnvelope(bytes.NewReader(bodyBytes))
-	if err != nil {
-		http.Error(w, "Invalid MIME", http.StatusBadRequest)
+	a, err := analyzeMessage(r, bodyBytes)
+	if err == errMimeLimits {
+		writeError(w, http.StatusUnprocessableEntity, ErrMimeLimits, "Message exceeds MIME limits")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidMIME, "Invalid MIME")
 		return
 	}
+	respondAnalysis(w, r, bodyBytes, a)
+}
+
+// analysis is what the pipeline concluded about a message, with the envelope it
+// was read with
+type analysis struct {
+	Env    *enmime.Envelope
+	Meta   EnvelopeMeta
+	Tenant string
+	Out    analysisOutcome
+}
+
+// analyzeMessage runs the analysis pipeline on a raw message. r carries the envelope
+// (X-Guardian-* headers) and the flags of the analysis; its body is not read.
+// Fails with errMimeLimits or a MIME parsing error.
+func analyzeMessage(r *http.Request, bodyBytes []byte) (analysis, error) {
+	atomic.AddInt64(&scanCount, 1)
+	atomic.AddInt64(&analyzeInFlight, 1)
+	defer atomic.AddInt64(&analyzeInFlight, -1)
+	tenant := TenantUnknown
+	defer func() { promScanned.WithLabelValues(tenant).Inc() }()
+	started := time.Now()
+	tier := sizeTier(len(bodyBytes))
+	defer func() { promAnalyzeDuration.WithLabelValues(tier).Observe(time.Since(started).Seconds()) }()
+
+	env, mimeLimit, err := readEnvelopeLimited(bodyBytes)
+	if err == errMimeLimits {
+		logger.Warn("Message rejected", "reason", "mime_limits", "limit", mimeLimit)
+		return analysis{}, err
+	} else if err != nil {
+		return analysis{}, err
+	}
 
 	signatures := []string{}
+	kinds := map[string]string{}
+	meta := envelopeMeta(r)
+	tenant = tenantOf(env, meta)
 
 	// get the message-id and subject for logging
 	messageID := env.GetHeader("Message-ID")
 	subject := env.GetHeader("Subject")
 
-	reqLogger := logger.With("message_id", messageID)
+	reqLogger := logger.With(append([]any{"message_id", messageID}, meta.logAttrs()...)...)
 
-	// 1. Analyze text body (Standard strategy)
-	combinedBody := normalizeEmailBody(env.Text, env.HTML)
-	if len(combinedBody) > 100 {
-		if sig, err := computeLocalTLSH(combinedBody); err == nil {
-			signatures = append(signatures, sig)
-		} else {
-			reqLogger.Warn("Failed to compute TLSH for body", "error", err)
+	// Stage overrides asked by the caller, within ANALYZE_FLAGS_ALLOWED
+	flags, denied := requestFlags(r)
+	if len(denied) > 0 {
+		reqLogger.Warn("Analysis flags not allowed, ignored", "flags", denied)
+	}
+
+	// Mailing lists and trusted forwarders get relaxed local thresholds
+	source := classifyTrustedSource(env, meta)
+	profile, shadow := selectProfiles(messageID, source, tenant)
+	if source != "" {
+		reqLogger.Debug("Trusted source detected", "source", source, "threshold", profile.SpamThreshold)
+	}
+
+	// From-domains spoofed according to DMARC reports get a lower threshold and need DKIM
+	spoofed := false
+	if fromDomain := addressDomain(env.GetHeader("From")); underScrutiny(fromDomain) {
+		profile = profile.tightened()
+		if shadow != nil {
+			tightened := shadow.tightened()
+			shadow = &tightened
 		}
+		spoofed = dmarcRequireDkim.Load() && !dkimAligned(env, fromDomain)
+		reqLogger.Debug("From-domain under DMARC scrutiny", "domain", fromDomain, "threshold", profile.SpamThreshold, "dkim_aligned", !spoofed)
+	}
+
+	// Partners signing with a TRUSTED_DKIM_DOMAINS domain bypass lookups and local actions
+	trustedSender := trustedDkimDomain(env)
+
+	// Attachment names matched against FILENAME_BLOCK / FILENAME_FLAG, before any hashing
+	names := checkFilenames(env)
+
+	// Generator fingerprint, matched exactly after the similarity search
+	structure := mimeStructure(bodyBytes, env)
+	subjectSig := subjectSignature(subject)
+
+	// Emoji, zero-width and mixed-script statistics of the subject and body
+	textStats := messageTextStats(env)
+	textAnomalies := textSignals(textStats)
+
+	// Tokens of the Bayes model, kept with the scan for reports
+	var tokens []string
+	if bayesEnabled() {
+		tokens = bayesTokens(env)
 	}
 
-	// 2. Extra Hash: Raw Body (HTML + Text concatenated, no normalization)
-	rawBody := env.Text + env.HTML
-	if len(rawBody) > 100 {
-		if sig, err := computeLocalTLSH(rawBody); err == nil {
+	// Sender and link domains of the blocklists. Checked before the verdict cache: the
+	// same content from another sender must not reuse its verdict.
+	domain, domainList := blockedDomain(env)
+
+	// Retried deliveries and copies for other recipients reuse a recent verdict
+	// Verdicts reached without images while the load guard pauses them are not reused afterwards
+	imagesPaused := imageGuardPaused.Load()
+	// The profile name is not enough: DMARC scrutiny and adaptive thresholds change it in place
+	verdictKey := verdictCacheKey(env, tenant, source, profile.Name, strconv.FormatInt(profile.SpamThreshold, 10), trustedSender, strconv.FormatBool(spoofed), structure, subjectSig, strings.Join(textAnomalies, ","), mimeLimit, flags.String(),
+		strconv.FormatBool(imagesPaused), domainList+":"+domain)
+	if out, level, ok := cachedVerdict(verdictKey); ok && !flags.WantEvidence {
+		reqLogger.Debug("Verdict cache hit", "level", level, "action", out.Result.Action, "label", out.Result.Label)
+		promVerdictCache.WithLabelValues(level).Inc()
+		return analysis{Env: env, Meta: meta, Tenant: tenant, Out: out}, nil
+	}
+
+	// 1-4c. Body, raw body, attachments, calendar invites and contact cards
+	for _, ms := range messageSignatures(env, source, reqLogger) {
+		signatures = append(signatures, ms.Signature)
+		if ms.Kind == KindAttachment {
+			kinds[ms.Signature] = attachmentKind(ms.ContentType)
+		}
+	}
+
+	// Mass calendar invites from senders not aligned with the organizer
+	massInvite := false
+	for _, part := range calendarParts(env) {
+		if isMassInvite(env, parseCalendar(string(part.Content))) {
+			massInvite = true
+		}
+	}
+
+	// 4d. Attached messages (forwarded spam, bounce originals), reported separately
+	nested := make(map[string]bool)
+	seenSigs := make(map[string]bool, len(signatures))
+	for _, sig := range signatures {
+		seenSigs[sig] = true
+	}
+	for _, sig := range nestedSignatures(env, 0) {
+		if !seenSigs[sig] {
+			seenSigs[sig] = true
+			nested[sig] = true
 			signatures = append(signatures, sig)
 		}
 	}
 
-	// 4. Analyze significant attachments
-	for _, att := range env.Attachments {
-		isImg := strings.HasPrefix(att.ContentType, "image/")
-		if (isImg && len(att.Content) > MinVisualSize) || (!isImg && len(att.Content) > 128) {
-			if sig, err := computeLocalTLSH(string(att.Content)); err == nil {
-				signatures = append(signatures, sig)
-			} else {
-				reqLogger.Warn("Failed to compute TLSH for attachment", "filename", att.FileName, "error", err)
-			}
+	// 4e. Password protected attachments cannot be hashed: surface them as a signal
+	var signals []string
+	if mimeLimit != "" {
+		reqLogger.Info("Message over MIME limits, partially analyzed", "limit", mimeLimit, "subject", subject)
+		signals = append(signals, "mime_truncated")
+		promSignals.WithLabelValues("mime_truncated", tenant).Inc()
+	}
+	if encrypted := encryptedAttachments(env); len(encrypted) > 0 {
+		reqLogger.Info("Encrypted attachment", "attachments", encrypted, "subject", subject)
+		signals = append(signals, "encrypted_attachment")
+		promSignals.WithLabelValues("encrypted_attachment", tenant).Inc()
+	}
+	if evidence := messageCredentialForms(env); len(evidence) > 0 {
+		reqLogger.Info("Credential form", "evidence", evidence, "subject", subject)
+		signals = append(signals, "credential_form")
+		promSignals.WithLabelValues("credential_form", tenant).Inc()
+	}
+	if len(textAnomalies) > 0 {
+		reqLogger.Info("Text anomaly", "signals", textAnomalies, "emoji_ratio", textStats.EmojiRatio, "zero_width", textStats.ZeroWidth,
+			"mixed_ratio", textStats.MixedRatio, "subject", subject)
+		for _, signal := range textAnomalies {
+			signals = append(signals, signal)
+			promSignals.WithLabelValues(signal, tenant).Inc()
 		}
 	}
+	for _, signal := range names.Signals {
+		reqLogger.Info("Suspicious attachment name", "signal", signal, "subject", subject)
+		signals = append(signals, signal)
+		promSignals.WithLabelValues(signal, tenant).Inc()
+	}
 
 	// 5. Image Analysis (Optional)
-	if enableImageAnalysis && shouldAnalyzeImages(env.HTML) {
+	// QR codes of attached and fetched images: the quishing URL the text does not show
+	var qrURLs []string
+	imageAnalysis := enableImageAnalysis && !flags.SkipImages && !imagesPaused
+	if imageAnalysis {
+		qrURLs = messageQRURLs(env)
+	}
+	if imageAnalysis && shouldAnalyzeImages(env.HTML) {
 		urls := extractImageURLs(env.HTML)
 		if len(urls) > 0 {
 			reqLogger.Debug("Image Analysis Triggered", "candidate_count", len(urls))
@@ -108,10 +237,11 @@ func analyzeHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			var wg sync.WaitGroup
-			// Limit concurrent downloads to 5 to avoid resource exhaustion
-			sem := make(chan struct{}, 5)
-			// Global timeout for all image fetching
-			ctxTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+			// Limit concurrent downloads (MI_IMAGE_CONCURRENCY) to avoid resource exhaustion
+			sem := make(chan struct{}, atomic.LoadInt64(&imageConcurrency))
+			// Global timeout for all image fetching (MI_IMAGE_TIMEOUT)
+			timeout := time.Duration(atomic.LoadInt64(&imageFetchTimeout)) * time.Second
+			ctxTimeout, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
 			for _, url := range urls {
@@ -127,7 +257,7 @@ func analyzeHandler(w http.ResponseWriter, r *http.Request) {
 						return
 					}
 
-					data, hash, size, _, err := fetchImageForAnalysis(u)
+					data, hash, size, _, err := fetchImageForAnalysis(ctxTimeout, u)
 					if err != nil {
 						return
 					}
@@ -151,219 +281,304 @@ func analyzeHandler(w http.ResponseWriter, r *http.Request) {
 
 				if bestMatch.Hash != "" {
 					finalHash = bestMatch.Hash
+					if qr := cachedQRURL(bestMatch.URL); qr != "" {
+						qrURLs = append(qrURLs, qr)
+					}
 				} else if len(bestMatch.Data) > 0 {
 					// We have data but no hash (fresh download), compute now
 					finalHash, err = computeAndCacheImageHash(bestMatch.URL, bestMatch.Data)
+					if qr := qrURL(bestMatch.Data); qr != "" {
+						cacheQRURL(bestMatch.URL, qr)
+						qrURLs = append(qrURLs, qr)
+					}
 				}
 
 				if err == nil && finalHash != "" {
 					reqLogger.Debug("Selected BEST image", "url", bestMatch.URL, "size", bestMatch.Size)
 					signatures = append(signatures, finalHash)
+					kinds[finalHash] = KindImage
 				}
 			}
 		}
 	}
 
-	go storeScanResult(env, signatures)
-
-	var finalResult AnalysisResult = AnalysisResult{Action: "allow", ProximityMatch: false}
+	var firstQRURL string
+	if len(qrURLs) > 0 {
+		firstQRURL = qrURLs[0]
+		reqLogger.Info("QR code URL", "urls", qrURLs, "subject", subject)
+		signals = append(signals, "qr_url")
+		promSignals.WithLabelValues("qr_url", tenant).Inc()
+	}
 
-	// 3. Collision search
-	for _, sig := range signatures {
-		// Step 1: Check oracle decision cache
-		cacheKey := "mi:oracle_cache:" + sig
-		if cached, err := rdb.Get(ctx, cacheKey).Result(); err == nil {
-			var res AnalysisResult
-			if json.Unmarshal([]byte(cached), &res) == nil && res.Action == "spam" {
-				finalResult = res
-				atomic.AddInt64(&cachedPositiveCount, 1)
-				promCacheHits.WithLabelValues("positive").Inc()
-				goto endAnalysis
+	// Identical or near-identical signatures would be looked up and learned twice
+	if deduped := dedupeSignatures(signatures); len(deduped) < len(signatures) {
+		reqLogger.Debug("Duplicate signatures dropped", "before", len(signatures), "after", len(deduped))
+		kept := make(map[string]bool, len(deduped))
+		for _, sig := range deduped {
+			kept[sig] = true
+		}
+		for sig := range nested {
+			if !kept[sig] {
+				delete(nested, sig)
 			}
 		}
+		signatures = deduped
+	}
 
-		bands := extractBands_6_3(sig)
-		var pipe redis.Pipeliner
-
-		// Declare here to avoid "goto jumps over declaration"
-		var matchCount int
-		var oracleCmds []*redis.IntCmd
+	// Exact digests of attachments, checked against the blocklists
+	digests := attachmentDigests(env)
 
-		// Step 1.5: Oracle Cache Proximity Lookup (Spam variations from recent queries)
-		oracleCacheBandsKeys := []string{}
-		pipe = rdb.Pipeline()
-		ocCmds := make(map[string]*redis.IntCmd)
-		for _, b := range bands {
-			key := OracleCacheFragPrefix + b
-			ocCmds[key] = pipe.Exists(ctx, key)
-		}
-		pipe.Exec(ctx)
+	// Evidence for sampled explanations (nil when EXPLAIN_SAMPLE_* are off)
+	trail := newDecisionTrail()
+	if flags.WantEvidence && trail == nil {
+		trail = &decisionTrail{}
+	}
+	trail.note("context", "source", source, "tenant", tenant, "profile", profile.Name, "threshold", profile.SpamThreshold,
+		"signatures", len(signatures), "nested", len(nested), "trusted_sender", trustedSender, "spoofed", spoofed, "signals", signals)
+
+	// 3. Collision search. matched: some signature shared bands with a known hash,
+	// even without a verdict
+	finalResult, matchedSig, matched := lookupSignatures(signatureLookup{
+		Signatures:    signatures,
+		Kinds:         kinds,
+		Digests:       digests,
+		BlockedName:   names.Blocked,
+		BlockedDomain: domain,
+		BlockedList:   domainList,
+		TrustedSender: trustedSender,
+		Profile:       profile,
+		Shadow:        shadow,
+		Tenant:        tenant,
+		Subject:       subject,
+		MessageID:     messageID,
+		Log:           reqLogger,
+		Trail:         trail,
+		SkipOracle:    flags.SkipOracle,
+		LocalOnly:     flags.LocalOnly,
+	})
 
-		for key, cmd := range ocCmds {
-			if cmd.Val() > 0 {
-				oracleCacheBandsKeys = append(oracleCacheBandsKeys, key)
+	nestedMatch := finalResult.Action == "spam" && nested[matchedSig]
+	if nestedMatch {
+		reqLogger.Info("Spam found in attached message", "label", finalResult.Label, "subject", subject)
+	}
+	if trustedSender == "" {
+		if finalResult.Action != "spam" {
+			if score, ok := structureSpam(structure); ok {
+				reqLogger.Info("MIME structure match", "structure", structure, "score", score, "subject", subject)
+				trail.note("structure_match", "structure", structure, "score", score)
+				finalResult = AnalysisResult{Action: "spam", Label: "structure_match", ProximityMatch: true}
+				atomic.AddInt64(&localSpamCount, 1)
+				promLocalMatch.WithLabelValues(tenant).Inc()
 			}
 		}
-
-		if len(oracleCacheBandsKeys) >= 4 {
-			var ocHashes []string
-			pipe = rdb.Pipeline()
-			hashCmds := make(map[string]*redis.StringSliceCmd)
-			for _, key := range oracleCacheBandsKeys {
-				hashCmds[key] = pipe.SMembers(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			seenHashes := make(map[string]struct{})
-			for _, cmd := range hashCmds {
-				for _, hash := range cmd.Val() {
-					if _, seen := seenHashes[hash]; !seen {
-						ocHashes = append(ocHashes, hash)
-						seenHashes[hash] = struct{}{}
-					}
-				}
-			}
-
-			if len(ocHashes) > 0 {
-				distances, err := computeDistanceBatch(sig, ocHashes, ocHashes, false)
-				if err == nil {
-					for hash, dist := range distances {
-						if dist <= 70 {
-							reqLogger.Info("Oracle Cache Proximity Match", "match_hash", hash, "distance", dist, "subject", subject, "message_id", messageID)
-							finalResult = AnalysisResult{Action: "spam", Label: "oracle_cache_match", ProximityMatch: true, Distance: dist}
-							atomic.AddInt64(&cachedPositiveCount, 1)
-							promCacheHits.WithLabelValues("positive").Inc()
-							goto endAnalysis
-						}
-					}
-				}
+		if finalResult.Action != "spam" {
+			if score, similarity, ok := subjectSpam(subjectSig); ok {
+				reqLogger.Info("Subject signature match", "subject_signature", subjectSig, "score", score, "similarity", similarity, "subject", subject)
+				trail.note("subject_match", "subject_signature", subjectSig, "score", score, "similarity", similarity)
+				finalResult = AnalysisResult{Action: "spam", Label: "subject_match", ProximityMatch: true}
+				atomic.AddInt64(&localSpamCount, 1)
+				promLocalMatch.WithLabelValues(tenant).Inc()
 			}
 		}
-
-		// Step 2: Local learning lookup
-		localMatchBandsKeys := []string{}
-		pipe = rdb.Pipeline()
-		localCmds := make(map[string]*redis.IntCmd)
-		for _, b := range bands {
-			key := LocalFragPrefix + b
-			localCmds[key] = pipe.Exists(ctx, key)
+		if score := atomic.LoadInt64(&encryptedAttachmentScore); score > 0 && score >= profile.SpamThreshold &&
+			finalResult.Action != "spam" && hasSignal(signals, "encrypted_attachment") {
+			finalResult = AnalysisResult{Action: "spam", Label: "encrypted_attachment"}
+			trail.note("encrypted_attachment", "score", score)
 		}
-		pipe.Exec(ctx)
-
-		for key, cmd := range localCmds {
-			if cmd.Val() > 0 {
-				localMatchBandsKeys = append(localMatchBandsKeys, key)
-			}
+		if score := atomic.LoadInt64(&credentialFormScore); score > 0 && score >= profile.SpamThreshold &&
+			finalResult.Action != "spam" && hasSignal(signals, "credential_form") {
+			finalResult = AnalysisResult{Action: "spam", Label: "credential_form"}
+			trail.note("credential_form", "score", score)
 		}
-
-		if len(localMatchBandsKeys) >= 4 {
-			pipe = rdb.Pipeline()
-			for _, key := range localMatchBandsKeys {
-				pipe.Expire(ctx, key, localRetentionDuration)
-			}
-			pipe.Exec(ctx)
-
-			var localHashes []string
-			pipe = rdb.Pipeline()
-			hashCmds := make(map[string]*redis.StringSliceCmd)
-			for _, key := range localMatchBandsKeys {
-				hashCmds[key] = pipe.SMembers(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			seenHashes := make(map[string]struct{})
-			for _, cmd := range hashCmds {
-				for _, hash := range cmd.Val() {
-					if _, seen := seenHashes[hash]; !seen {
-						localHashes = append(localHashes, hash)
-						seenHashes[hash] = struct{}{}
-					}
+		if score := atomic.LoadInt64(&textAnomalyScore); score > 0 && score >= profile.SpamThreshold &&
+			finalResult.Action != "spam" && len(textAnomalies) > 0 {
+			finalResult = AnalysisResult{Action: "spam", Label: "text_anomaly"}
+			trail.note("text_anomaly", "score", score, "signals", strings.Join(textAnomalies, ","))
+		}
+		if finalResult.Action != "spam" {
+			if probability, signal, ok := bayesSpam(tokens, profile.SpamThreshold); signal || ok {
+				trail.note("bayes", "probability", probability)
+				signals = append(signals, "bayes")
+				promSignals.WithLabelValues("bayes", tenant).Inc()
+				if ok {
+					reqLogger.Info("Bayes match", "probability", probability, "subject", subject)
+					finalResult = AnalysisResult{Action: "spam", Label: "bayes"}
 				}
 			}
-
-			if len(localHashes) > 0 {
-				distances, err := computeDistanceBatch(sig, localHashes, localHashes, false)
-				if err == nil {
-					isLocalSpam := false
-					for hash, dist := range distances {
-						if dist <= 70 {
-							// Check score
-							scoreKey := LocalScorePrefix + hash
-							scoreVal, _ := rdb.Get(ctx, scoreKey).Int64()
-
-							if scoreVal >= atomic.LoadInt64(&localSpamThreshold) {
-								reqLogger.Info("Local spam detected", "match_hash", hash, "score", scoreVal, "subject", subject, "message_id", messageID)
-								finalResult = AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, Distance: dist}
-								atomic.AddInt64(&localSpamCount, 1)
-								promLocalMatch.Inc()
-								isLocalSpam = true
-								break
-							}
-						}
-					}
-					if isLocalSpam {
-						goto nextSignature
-					}
+		}
+		// The external classifier is only asked about messages not flagged yet
+		if classifierEnabled() && finalResult.Action != "spam" {
+			if result, err := classify(env, meta, tenant, signals, signatures); err != nil {
+				reqLogger.Warn("External classifier skipped", "error", err)
+			} else {
+				trail.note("classifier", "score", result.Score, "label", result.Label)
+				if result.Score >= ClassifierSignalScore {
+					signals = append(signals, "classifier")
+					promSignals.WithLabelValues("classifier", tenant).Inc()
+				}
+				if weight := atomic.LoadInt64(&classifierWeight); weight > 0 && result.Score*float64(weight) >= float64(profile.SpamThreshold) {
+					reqLogger.Info("External classifier match", "score", result.Score, "classifier_label", result.Label, "subject", subject)
+					finalResult = AnalysisResult{Action: "spam", Label: "classifier"}
 				}
 			}
-			// If we reach here, distances were > 70
-			finalResult.ProximityMatch = true
-			goto nextSignature
 		}
-
-		// Step 3: Band-based collision search (Oracle LSH)
-		matchCount = 0
-		pipe = rdb.Pipeline()
-		oracleCmds = make([]*redis.IntCmd, len(bands))
-		for i, b := range bands {
-			oracleCmds[i] = pipe.Exists(ctx, FragKeyPrefix+b)
+		if massInvite && finalResult.Action != "spam" {
+			reqLogger.Info("Mass calendar invite", "subject", subject)
+			finalResult = AnalysisResult{Action: "spam", Label: "calendar_mass_invite"}
+			trail.note("calendar_mass_invite")
 		}
-		pipe.Exec(ctx)
-
-		for _, cmd := range oracleCmds {
-			if cmd.Val() > 0 {
-				matchCount++
-			}
+		if spoofed && finalResult.Action != "spam" {
+			reqLogger.Info("Unauthenticated mail from spoofed domain", "from", env.GetHeader("From"), "subject", subject)
+			finalResult = AnalysisResult{Action: "spam", Label: "dmarc_spoof"}
+			trail.note("dmarc_spoof")
 		}
+	}
+	// The test pattern runs the whole pipeline above, then forces a known verdict
+	if isTestMessage(env) {
+		reqLogger.Info("Test pattern detected", "subject", subject)
+		finalResult = AnalysisResult{Action: "spam", Label: "test"}
+		trail.note("test_pattern")
+	}
+	trail.log(reqLogger, finalResult)
+
+	out := analysisOutcome{
+		Result:      finalResult,
+		Signatures:  signatures,
+		Nested:      nested,
+		NestedMatch: nestedMatch,
+		Signals:     signals,
+		Digests:     digests,
+		Structure:   structure,
+		Subject:     subjectSig,
+		Source:      source,
+		Matched:     matched,
+		QRURL:       firstQRURL,
+		Links:       linkVerdicts(env, finalResult),
+		Tokens:      tokens,
+		Kinds:       kinds,
+	}
+	if flags.WantEvidence {
+		out.Evidence = trail.steps
+	}
+	cacheVerdict(verdictKey, out)
+	return analysis{Env: env, Meta: meta, Tenant: tenant, Out: out}, nil
+}
 
-		if matchCount >= 4 {
-			oracleVerdict := callOracleDecision(sig)
-			if oracleVerdict.Action == "spam" {
-				reqLogger.Info("Oracle spam detected", "signature", sig, "subject", subject, "message_id", messageID)
-				finalResult = oracleVerdict
-				atomic.AddInt64(&spamConfirmedCount, 1)
-				promOracleMatch.WithLabelValues("complete").Inc()
-				break
-			} else {
-				reqLogger.Info("Oracle partial match", "signature", sig, "subject", subject, "message_id", messageID)
-				finalResult.ProximityMatch = true
-				atomic.AddInt64(&partialMatchCount, 1)
-				promOracleMatch.WithLabelValues("partial").Inc()
-			}
-		}
+// verdictActions is what the MTA is asked to do with an analyzed message
+type verdictActions struct {
+	MTAAction    string
+	SMTPResponse string
+	Quarantined  bool
+	DelaySeconds int
+}
 
-	nextSignature:
-		if finalResult.Action == "spam" {
-			break
-		}
+// applyVerdict stores the scan, publishes the verdict and quarantines the message,
+// and returns the MTA actions of the verdict. The scan is stored in the background
+// unless syncStore is set, for callers that may report the message right away.
+func applyVerdict(raw []byte, a analysis, syncStore bool) verdictActions {
+	env, meta, tenant, out := a.Env, a.Meta, a.Tenant, a.Out
+	finalResult := out.Result
+	scan := ScanResult{
+		Hashes:    out.Signatures,
+		Action:    finalResult.Action,
+		Label:     finalResult.Label,
+		Source:    out.Source,
+		Structure: out.Structure,
+		Subject:   out.Subject,
+		Tenant:    tenant,
+		Tokens:    out.Tokens,
+		Kinds:     out.Kinds,
+		Matched:   out.Matched || finalResult.ProximityMatch,
+	}
+	if syncStore {
+		storeScanResult(env, scan)
+	} else {
+		go storeScanResult(env, scan)
+	}
+	if finalResult.Label == "local_spam" {
+		go recordAdaptiveSample(tenant, "flagged")
 	}
+	go sampleHam(finalResult, out.Signatures)
+	publishVerdict(VerdictEvent{
+		Time:      time.Now().Unix(),
+		MessageID: messageIDHash(env.GetHeader("Message-ID")),
+		Action:    finalResult.Action,
+		Label:     finalResult.Label,
+		Distance:  finalResult.Distance,
+		Tenant:    tenant,
+	})
+
+	mtaActionName, smtpResponse := mtaAction(finalResult, len(meta.RcptTo))
+	quarantined := mtaActionName == "quarantine" && quarantine(raw, env.GetHeader("Message-ID"), finalResult, meta)
+	// Borderline senders without a configured action are slowed down
+	delaySeconds := tarpitDelay(meta.ClientIP, finalResult, out.Source)
+	if delaySeconds > 0 && mtaActionName == "" && finalResult.Action != "spam" {
+		mtaActionName = "delay"
+	}
+	return verdictActions{MTAAction: mtaActionName, SMTPResponse: smtpResponse, Quarantined: quarantined, DelaySeconds: delaySeconds}
+}
+
+// respondAnalysis applies the verdict and writes the /analyze response
+func respondAnalysis(w http.ResponseWriter, r *http.Request, raw []byte, a analysis) {
+	env, meta, out := a.Env, a.Meta, a.Out
+	finalResult := out.Result
+	actions := applyVerdict(raw, a, false)
+	mtaActionName, smtpResponse, delaySeconds := actions.MTAAction, actions.SMTPResponse, actions.DelaySeconds
 
-endAnalysis:
 	w.Header().Set("Content-Type", "application/json")
 	response := struct {
-		Action         string   `json:"action"`
-		Label          string   `json:"label,omitempty"`
-		ProximityMatch bool     `json:"proximity_match"`
-		Distance       int      `json:"distance,omitempty"`
-		Hashes         []string `json:"hashes,omitempty"`
+		Action         string        `json:"action"`
+		Label          string        `json:"label,omitempty"`
+		ProximityMatch bool          `json:"proximity_match"`
+		Distance       int           `json:"distance,omitempty"`
+		Hashes         []string      `json:"hashes,omitempty"`
+		NestedHashes   []string      `json:"nested_hashes,omitempty"`
+		NestedMatch    bool          `json:"nested_match,omitempty"`
+		Signals        []string      `json:"signals,omitempty"`
+		Attachments    []string      `json:"attachment_sha256,omitempty"`
+		MTAAction      string        `json:"mta_action,omitempty"`
+		SMTPResponse   string        `json:"smtp_response,omitempty"`
+		Quarantined    bool          `json:"quarantined,omitempty"`
+		DelaySeconds   int           `json:"delay_seconds,omitempty"`
+		Recipients     int           `json:"recipients,omitempty"`
+		MultiRecipient bool          `json:"multi_recipient,omitempty"`
+		Reasons        []string      `json:"reasons,omitempty"`
+		QRURL          string        `json:"qr_url,omitempty"`
+		Advisories     []Advice      `json:"advisories,omitempty"`
+		Evidence       []string      `json:"evidence,omitempty"`
+		Links          []LinkVerdict `json:"links,omitempty"`
 	}{
 		Action:         finalResult.Action,
 		Label:          finalResult.Label,
 		ProximityMatch: finalResult.ProximityMatch,
 		Distance:       finalResult.Distance,
-		Hashes:         signatures,
+		Hashes:         out.Signatures,
+		NestedHashes:   nestedHashes(out.Signatures, out.Nested),
+		NestedMatch:    out.NestedMatch,
+		Signals:        out.Signals,
+		Attachments:    out.Digests,
+		MTAAction:      mtaActionName,
+		SMTPResponse:   smtpResponse,
+		Quarantined:    actions.Quarantined,
+		DelaySeconds:   delaySeconds,
+		Recipients:     len(meta.RcptTo),
+		MultiRecipient: multiRecipient(len(meta.RcptTo)),
+		Reasons:        verdictReasons(finalResult, out.Signals, out.NestedMatch, reasonsLanguage(r)),
+		QRURL:          out.QRURL,
+		Evidence:       out.Evidence,
+		Links:          out.Links,
+	}
+	// Deliverability advice for submissions, apart from the verdict
+	if isOutbound(r, meta) && strings.ToLower(getEnv("OUTBOUND_ADVICE", "true")) != "false" {
+		response.Advisories = outboundAdvice(env, meta)
 	}
 
+	if r.URL.Query().Get("format") == "exim" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(eximLine(finalResult, mtaActionName, smtpResponse, delaySeconds, response.Advisories)))
+		return
+	}
 	respBytes, _ := json.Marshal(response)
 	w.WriteHeader(http.StatusOK)
 	w.Write(respBytes)
@@ -371,199 +586,68 @@ endAnalysis:
 
 func reportHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
 		return
 	}
 
-	var reqBody struct {
-		MessageID  string `json:"message-id"`
-		ReportType string `json:"report_type"`
-	}
-
+	var reqBody reportRequest
 	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
 		return
 	}
 
-	// Silently fix missing brackets in Message-ID
-	if len(reqBody.MessageID) > 0 {
-		if !strings.HasPrefix(reqBody.MessageID, "<") {
-			reqBody.MessageID = "<" + reqBody.MessageID
-		}
-		if !strings.HasSuffix(reqBody.MessageID, ">") {
-			reqBody.MessageID = reqBody.MessageID + ">"
-		}
-	}
-
-	hasher := sha1.New()
-	hasher.Write([]byte(reqBody.MessageID))
-	sha1Hash := hex.EncodeToString(hasher.Sum(nil))
-
-	// Prevent duplicate reports for the same type
-	reportKey := "mi:rpt:" + sha1Hash + ":" + reqBody.ReportType
-	if added, err := rdb.SetNX(ctx, reportKey, "1", 24*time.Hour).Result(); err != nil {
-		http.Error(w, "Redis error", http.StatusInternalServerError)
-		return
-	} else if !added {
-		logger.Warn("Duplicate report ignored", "type", reqBody.ReportType, "message_id", reqBody.MessageID)
-		w.WriteHeader(http.StatusConflict)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status":"duplicate","message":"Already reported"}`))
+	if reservedReporter(reqBody.Reporter) || reservedReporter(reqBody.Recipient) {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Reserved reporter identity")
 		return
 	}
 
-	key := "mi:msgid:" + sha1Hash
-
-	val, err := rdb.Get(ctx, key).Result()
-	if err == redis.Nil {
-		http.Error(w, "No scan data found", http.StatusNotFound)
-		return
+	// Reporter identity: explicit reporter, else the recipient
+	reporter := reqBody.Reporter
+	if reporter == "" {
+		reporter = reqBody.Recipient
 	}
-
-	var scanData ScanResult
-	json.Unmarshal([]byte(val), &scanData)
-
-	// Check if we have hashes to report, else return error
-	if len(scanData.Hashes) == 0 {
-		http.Error(w, "No hashes to report", http.StatusBadRequest)
-		return
+	// The admin role comes from the token, never from the body
+	if adminIPAllowed(r) && adminRole(r) == "admin" {
+		reporter = AdminReporterPrefix + reporter
 	}
 
-	// --- Local learning ---
-	skipOracleReport := false
-
-	if reqBody.ReportType == "spam" || reqBody.ReportType == "ham" {
-		logger.Info("Processing report", "type", reqBody.ReportType, "message_id", reqBody.MessageID)
-
-		for _, hash := range scanData.Hashes {
-			bands := extractBands_6_3(hash)
-
-			// 1. Identify candidates using LSH
-			pipe := rdb.Pipeline()
-			localCmds := make(map[string]*redis.IntCmd)
-			for _, b := range bands {
-				key := LocalFragPrefix + b
-				localCmds[key] = pipe.Exists(ctx, key)
-			}
-			pipe.Exec(ctx)
-
-			matchingBandsKeys := []string{}
-			for key, cmd := range localCmds {
-				if cmd.Val() > 0 {
-					matchingBandsKeys = append(matchingBandsKeys, key)
-				}
-			}
-
-			var bestMatchHash string
-			var bestMatchDist int = 9999
-
-			if len(matchingBandsKeys) >= 4 {
-				// Get candidates
-				pipe = rdb.Pipeline()
-				hashCmds := make(map[string]*redis.StringSliceCmd)
-				for _, key := range matchingBandsKeys {
-					hashCmds[key] = pipe.SMembers(ctx, key)
-				}
-				pipe.Exec(ctx)
-
-				candidates := make(map[string]struct{})
-				for _, cmd := range hashCmds {
-					for _, h := range cmd.Val() {
-						candidates[h] = struct{}{}
-					}
-				}
-
-				candidateList := []string{}
-				for h := range candidates {
-					candidateList = append(candidateList, h)
-				}
-
-				if len(candidateList) > 0 {
-					// Compute distances
-					distances, err := computeDistanceBatch(hash, candidateList, candidateList, false)
-					if err == nil {
-						for h, dist := range distances {
-							if dist < bestMatchDist {
-								bestMatchDist = dist
-								bestMatchHash = h
-							}
-						}
-					}
-				}
-			}
-
-			// Decision Logic
-			targetHash := hash // Default: the reported hash itself
-			if bestMatchDist <= 70 {
-				targetHash = bestMatchHash
-			}
-
-			scoreKey := LocalScorePrefix + targetHash
-
-			if reqBody.ReportType == "spam" {
-				if bestMatchDist <= 70 {
-					// Already known locally
-					skipOracleReport = true
-				}
-
-				// Increment score
-				// Use atomic load for safe concurrent access during reload
-				currentSpamWeight := atomic.LoadInt64(&spamWeight)
-				newScore, _ := rdb.IncrBy(ctx, scoreKey, currentSpamWeight).Result()
-
-				// Refresh/Add bands
-				pipe := rdb.Pipeline()
-				targetBands := extractBands_6_3(targetHash)
-				for _, band := range targetBands {
-					key := LocalFragPrefix + band
-					pipe.SAdd(ctx, key, targetHash)
-					pipe.Expire(ctx, key, localRetentionDuration)
-				}
-				pipe.Expire(ctx, scoreKey, localRetentionDuration)
-				pipe.Exec(ctx)
-				logger.Info("Learned spam hash", "hash", targetHash, "score", newScore)
-
-			} else if reqBody.ReportType == "ham" {
-				if bestMatchDist <= 70 {
-					// Found a corresponding spam entry to punish
-					currentHamWeight := atomic.LoadInt64(&hamWeight)
-					newScore, _ := rdb.DecrBy(ctx, scoreKey, currentHamWeight).Result()
-					logger.Info("Ham report", "hash", targetHash, "score", newScore)
-
-					// Refresh TTL (keep it alive even if negative)
-					rdb.Expire(ctx, scoreKey, localRetentionDuration)
-				}
-			}
-		}
+	// The reporter given in the body is free text: callers are told apart by IP,
+	// or by the admin token.
+	quotaID := reportClientIP(r)
+	if isAdminReporter(reporter) {
+		quotaID = AdminReporterPrefix
 	}
-	// --- End local learning ---
 
-	if reqBody.ReportType == "spam" && skipOracleReport {
-		logger.Info("Skip Oracle report (Already known)", "message_id", reqBody.MessageID)
+	summary, err := submitReport(reqBody, reporter, quotaID)
+	var quotaErr *reportQuotaError
+	switch {
+	case err == errDuplicateReport:
+		// "status" predates the error envelope and is kept for existing callers
+		respBytes, _ := json.Marshal(struct {
+			APIError
+			Status string `json:"status"`
+		}{APIError{Code: ErrDuplicate, Message: "Already reported"}, "duplicate"})
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status":"skipped_oracle","reason":"known_locally"}`))
-		return
-	}
-
-	payload, _ := json.Marshal(map[string]interface{}{
-		"node_id":     nodeID,
-		"signatures":  scanData.Hashes,
-		"report_type": reqBody.ReportType,
-	})
-
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Post(oracleURL+"/report", "application/json", bytes.NewBuffer(payload))
-	if err != nil {
-		http.Error(w, "Oracle unreachable", http.StatusServiceUnavailable)
-		return
+		w.WriteHeader(http.StatusConflict)
+		w.Write(respBytes)
+	case errors.As(err, &quotaErr):
+		respBytes, _ := json.Marshal(struct {
+			APIError
+			Status string `json:"status"`
+			Scope  string `json:"scope"`
+		}{APIError{Code: ErrQuotaExceeded, Message: "Report quota exceeded", Retryable: true}, "quota_exceeded", quotaErr.Scope})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write(respBytes)
+	case err == errNoScanData:
+		writeError(w, http.StatusNotFound, ErrNotFound, "No scan data found")
+	case err == errNoHashes:
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "No hashes to report")
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+	default:
+		writeReportSummary(w, summary)
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -574,7 +658,7 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 
 	currentSeq, err := rdb.Get(ctx, MetaVer).Int()
 	if err != nil && err != redis.Nil {
-		http.Error(w, "Redis unavailable", http.StatusServiceUnavailable)
+		writeError(w, http.StatusServiceUnavailable, ErrStoreUnavailable, "Redis unavailable")
 		return
 	}
 	if err == redis.Nil {
@@ -585,6 +669,11 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		"node_id":     nodeID,
 		"current_seq": currentSeq,
 		"version":     EngineVersion,
+		"public_key":  nodePublicKey(),
+		"sync":        syncStatus(),
+	}
+	if update := currentUpdateStatus(); update != nil {
+		resp["update"] = update
 	}
 	respBytes, _ := json.Marshal(resp)
 
@@ -594,6 +683,21 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(respBytes)
 }
 
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	// Lifetime counters across restarts (persisted in Redis every minute)
+	counters, since := lifetimeCounters()
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"node_id":        nodeID,
+		"counters":       counters,
+		"counters_since": since,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
 func logRequestHandler(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Info("Request", "method", r.Method, "path", r.URL.Path)
@@ -0,0 +1,206 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+
+	"mailuminati-guardian/internal/analyze"
+)
+
+// --- Signature computation ---
+
+// messageSignatures computes the top-level signatures of a message (steps 1 to 4c of
+// the analysis), in the order /analyze looks them up. Attached messages and external
+// images are handled separately.
+func messageSignatures(env *enmime.Envelope, source string, log *slog.Logger) []HashedPart {
+	var sigs []HashedPart
+
+	// 1. Analyze text body (Standard strategy)
+	combinedBody := hashableBody(env.Text, env.HTML)
+	if len(combinedBody) > 100 {
+		if sig, err := analyze.TLSH(combinedBody); err == nil {
+			sigs = append(sigs, HashedPart{Kind: "body", Signature: sig})
+		} else {
+			log.Warn("Failed to compute TLSH for body", "error", err)
+		}
+	}
+
+	// 2. Extra Hash: Raw Body (HTML + Text concatenated, no normalization)
+	// Skipped for lists/forwarders: their added footers make raw bodies cluster together,
+	// and for bodies over RAW_HASH_MAX_KB, already covered by the first signature
+	rawBody := env.Text + env.HTML
+	if source == "" && len(rawBody) > 100 && hashRawBody(len(rawBody)) {
+		if sig, err := analyze.TLSH(rawBody); err == nil {
+			sigs = append(sigs, HashedPart{Kind: "raw", Signature: sig})
+		}
+	}
+
+	// 4. Analyze significant attachments
+	for _, att := range env.Attachments {
+		isImg := strings.HasPrefix(att.ContentType, "image/")
+		if (isImg && len(att.Content) > MinVisualSize) || (!isImg && len(att.Content) > 128) {
+			if sig, err := analyze.TLSH(attachmentSample(att.Content)); err == nil {
+				sigs = append(sigs, HashedPart{Kind: "attachment", Name: att.FileName, ContentType: att.ContentType, Signature: sig})
+			} else {
+				log.Warn("Failed to compute TLSH for attachment", "filename", att.FileName, "error", err)
+			}
+		}
+	}
+
+	// 4b. Calendar invites: the payload sits in the ICS part, hash its visible fields
+	for _, part := range calendarParts(env) {
+		invite := parseCalendar(string(part.Content))
+		if text := normalizeEmailBody(calendarText(invite), ""); len(text) > 100 {
+			if sig, err := analyze.TLSH(text); err == nil {
+				sigs = append(sigs, HashedPart{Kind: "calendar", Name: part.FileName, ContentType: part.ContentType, Signature: sig})
+			}
+		}
+	}
+
+	// 4c. Contact cards: hash their free text fields
+	for _, part := range findParts(env, isVCard) {
+		if text := normalizeEmailBody(vcardText(string(part.Content)), ""); len(text) > 100 {
+			if sig, err := analyze.TLSH(text); err == nil {
+				sigs = append(sigs, HashedPart{Kind: "vcard", Name: part.FileName, ContentType: part.ContentType, Signature: sig})
+			}
+		}
+	}
+
+	return sigs
+}
+
+// hashHandler returns every signature Guardian would compute for the posted content,
+// without reading or writing any store. The body is parsed as a message (.eml) unless
+// ?raw=1, in which case it is hashed as a single text. External images are only
+// fetched with ?images=1.
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	bodyBytes, err := io.ReadAll(io.LimitReader(r.Body, MaxProcessSize))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrReadBody, "Error reading body")
+		return
+	}
+
+	resp := HashResponse{Signatures: []string{}}
+	if r.URL.Query().Get("raw") == "1" {
+		sum := sha256.Sum256(bodyBytes)
+		resp.Parts = append(resp.Parts, HashedPart{Kind: "raw", Size: len(bodyBytes), SHA256: hex.EncodeToString(sum[:])})
+		if text := normalizeEmailBody(string(bodyBytes), ""); len(text) > 100 {
+			if sig, err := analyze.TLSH(text); err == nil {
+				resp.Parts[0].Signature = sig
+				resp.Signatures = append(resp.Signatures, sig)
+			}
+		}
+	} else {
+		env, _, err := readEnvelopeLimited(bodyBytes)
+		if err == errMimeLimits {
+			writeError(w, http.StatusUnprocessableEntity, ErrMimeLimits, "Message exceeds MIME limits")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidMIME, "Invalid MIME")
+			return
+		}
+
+		source := classifyTrustedSource(env, envelopeMeta(r))
+		resp.Source = source
+		resp.Parts = messageSignatures(env, source, logger)
+		seen := make(map[string]bool)
+		for _, p := range resp.Parts {
+			if !seen[p.Signature] {
+				seen[p.Signature] = true
+				resp.Signatures = append(resp.Signatures, p.Signature)
+			}
+		}
+		for _, sig := range nestedSignatures(env, 0) {
+			if !seen[sig] {
+				seen[sig] = true
+				resp.Nested = append(resp.Nested, sig)
+				resp.Signatures = append(resp.Signatures, sig)
+			}
+		}
+		for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+			for _, p := range group {
+				if len(p.Content) == 0 {
+					continue
+				}
+				sum := sha256.Sum256(p.Content)
+				resp.Files = append(resp.Files, HashedPart{Kind: "file", Name: p.FileName, ContentType: p.ContentType, Size: len(p.Content), SHA256: hex.EncodeToString(sum[:])})
+			}
+		}
+		resp.Structure = mimeStructure(bodyBytes, env)
+
+		if r.URL.Query().Get("images") == "1" {
+			resp.Images = hashExternalImages(r, env.HTML)
+		}
+	}
+
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// hashExternalImages downloads and hashes every candidate image of the HTML body,
+// bypassing the image cache. /analyze only keeps the largest one, when the message
+// has little text.
+func hashExternalImages(r *http.Request, html string) []HashedPart {
+	timeout := time.Duration(atomic.LoadInt64(&imageFetchTimeout)) * time.Second
+	var images []HashedPart
+	mode := imageFetchMode()
+	for _, url := range extractImageURLs(html) {
+		fetchCtx, cancel := context.WithTimeout(r.Context(), timeout)
+		if mode != "direct" {
+			sig, size, err := remoteImageHash(fetchCtx, mode, url)
+			cancel()
+			img := HashedPart{Kind: "image", Name: url, Size: size, Signature: sig}
+			if err != nil {
+				img.Error = err.Error()
+			}
+			images = append(images, img)
+			continue
+		}
+		data, err := downloadImage(fetchCtx, url)
+		cancel()
+		if err != nil {
+			images = append(images, HashedPart{Kind: "image", Name: url, Error: err.Error()})
+			continue
+		}
+		img := HashedPart{Kind: "image", Name: url, Size: len(data)}
+		if sig, err := imageSignature(url, data); err == nil {
+			img.Signature = sig
+		} else {
+			img.Error = err.Error()
+		}
+		images = append(images, img)
+	}
+	return images
+}
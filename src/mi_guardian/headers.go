@@ -0,0 +1,187 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Header heuristics ---
+
+const (
+	SourceMailingList      = "mailing_list"
+	SourceTrustedForwarder = "trusted_forwarder"
+)
+
+var (
+	reARAuthservID  = regexp.MustCompile(`^\s*([^\s;]+)`)
+	reARDkimPass    = regexp.MustCompile(`(?i)\bdkim=pass\b[^;]*?\bheader\.d=([a-z0-9.-]+)`)
+	reDkimSigDomain = regexp.MustCompile(`(?i)(?:^|;)\s*d=([a-z0-9.-]+)`)
+	reUnsubDomain   = regexp.MustCompile(`(?i)<(?:mailto:[^@>]+@|https?://)([a-z0-9.-]+)`)
+	reReceivedRDNS  = regexp.MustCompile(`(?i)\(([a-z0-9.-]+)\s*\[`)
+	reReceivedIP    = regexp.MustCompile(`\[(?:IPv6:)?([0-9a-fA-F:.]+)\]`)
+	reFoldedSpaces  = regexp.MustCompile(`\s+`)
+)
+
+// getEnvList reads a comma separated setting as a lowercase list
+func getEnvList(k string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(k, ""), ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// domainMatches reports whether host is domain or one of its subdomains
+func domainMatches(host, domain string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// dkimDomains returns the signing domains of the message.
+// Verified results (Authentication-Results dkim=pass) are preferred; raw
+// DKIM-Signature d= tags are only used when the MTA added no verification result.
+func dkimDomains(env *enmime.Envelope) []string {
+	if domains, verified := verifiedDkimDomains(env); verified {
+		return domains
+	}
+
+	var domains []string
+	for _, sig := range env.GetHeaderValues("DKIM-Signature") {
+		sig = reFoldedSpaces.ReplaceAllString(sig, " ")
+		if m := reDkimSigDomain.FindStringSubmatch(sig); m != nil {
+			domains = append(domains, strings.ToLower(m[1]))
+		}
+	}
+	return domains
+}
+
+// localAuthResults returns the Authentication-Results header added by our MTA: the
+// topmost one, when its authserv-id is listed in AUTHSERV_ID. Any other was added
+// upstream or by the sender and proves nothing.
+func localAuthResults(env *enmime.Envelope) (string, bool) {
+	ids := getEnvList("AUTHSERV_ID")
+	results := env.GetHeaderValues("Authentication-Results")
+	if len(ids) == 0 || len(results) == 0 {
+		return "", false
+	}
+	m := reARAuthservID.FindStringSubmatch(results[0])
+	if m == nil {
+		return "", false
+	}
+	for _, id := range ids {
+		if strings.EqualFold(m[1], id) {
+			return results[0], true
+		}
+	}
+	return "", false
+}
+
+// verifiedDkimDomains returns the dkim=pass domains of the Authentication-Results
+// header of our MTA. verified is false without one (see localAuthResults).
+func verifiedDkimDomains(env *enmime.Envelope) (domains []string, verified bool) {
+	ar, ok := localAuthResults(env)
+	if !ok {
+		return nil, false
+	}
+	for _, m := range reARDkimPass.FindAllStringSubmatch(ar, -1) {
+		domains = append(domains, strings.ToLower(m[1]))
+	}
+	return domains, true
+}
+
+// isMailingList checks for List-Id plus a List-Unsubscribe target aligned with a
+// verified DKIM signing domain
+func isMailingList(env *enmime.Envelope) bool {
+	if env.GetHeader("List-Id") == "" {
+		return false
+	}
+	signers, _ := verifiedDkimDomains(env)
+	if len(signers) == 0 {
+		return false
+	}
+	for _, m := range reUnsubDomain.FindAllStringSubmatch(env.GetHeader("List-Unsubscribe"), -1) {
+		for _, signer := range signers {
+			if domainMatches(m[1], signer) || domainMatches(signer, m[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTrustedForwarder checks the SMTP client against TRUSTED_FORWARDERS (hostnames,
+// domains or IPs). Only the client IP the MTA passes is trusted, and the reverse DNS
+// name our MTA verified for it in its Received hop. HELO names are chosen by the
+// client, and the hops below were written by the previous servers or the sender.
+func isTrustedForwarder(env *enmime.Envelope, meta EnvelopeMeta) bool {
+	forwarders := getEnvList("TRUSTED_FORWARDERS")
+	if len(forwarders) == 0 || meta.ClientIP == "" {
+		return false
+	}
+	var rdns string
+	if received := env.GetHeaderValues("Received"); len(received) > 0 {
+		ownHop := false
+		for _, m := range reReceivedIP.FindAllStringSubmatch(received[0], -1) {
+			ownHop = ownHop || strings.EqualFold(m[1], meta.ClientIP)
+		}
+		if m := reReceivedRDNS.FindStringSubmatch(received[0]); ownHop && m != nil {
+			rdns = m[1]
+		}
+	}
+	for _, f := range forwarders {
+		if strings.EqualFold(meta.ClientIP, f) || (rdns != "" && domainMatches(rdns, f)) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyTrustedSource returns SourceMailingList, SourceTrustedForwarder or "" for regular mail
+func classifyTrustedSource(env *enmime.Envelope, meta EnvelopeMeta) string {
+	if isMailingList(env) {
+		return SourceMailingList
+	}
+	if isTrustedForwarder(env, meta) {
+		return SourceTrustedForwarder
+	}
+	return ""
+}
+
+// trustedDkimDomain returns the TRUSTED_DKIM_DOMAINS entry that verifiably signed the
+// message, or "". Only the Authentication-Results of our MTA are considered: an
+// unverified DKIM-Signature header can be forged by anyone.
+func trustedDkimDomain(env *enmime.Envelope) string {
+	trusted := getEnvList("TRUSTED_DKIM_DOMAINS")
+	if len(trusted) == 0 {
+		return ""
+	}
+	signers, _ := verifiedDkimDomains(env)
+	for _, signer := range signers {
+		for _, domain := range trusted {
+			if domainMatches(signer, domain) {
+				return domain
+			}
+		}
+	}
+	return ""
+}
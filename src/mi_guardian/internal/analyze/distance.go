@@ -0,0 +1,333 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package analyze holds the signature computations of the analysis: TLSH digests
+// and their distances. The pipeline, its settings and what is learned stay in the
+// engine.
+package analyze
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/glaslos/tlsh"
+)
+
+// --- TLSH signatures and distance backends ---
+//
+// The reference backend parses both digests with glaslos/tlsh for each pair, which
+// allocates a full hashing state per candidate. The fast backend keeps parsed
+// digests in memory, scores the 32 code bytes with a byte-pair lookup table and
+// spreads large batches over several goroutines. Both return the same distances.
+//
+// The header part of the distance (checksum, length and quartile ratios) is a lower
+// bound of the full distance, so PrefilterCandidates can drop candidates that
+// cannot match without scoring their code.
+
+const (
+	ParallelMin     = 512    // Candidates of a batch before it is spread over workers
+	maxCacheEntries = 200000 // Parsed digests kept by the fast backend
+)
+
+// TLSH returns the signature of content: "T1" and the uppercase TLSH digest
+func TLSH(content string) (string, error) {
+	h, err := tlsh.HashBytes([]byte(content))
+	if err != nil {
+		return "", err
+	}
+	return "T1" + strings.ToUpper(h.String()), nil
+}
+
+// DistanceBackend scores TLSH signatures (with or without the "T1" prefix)
+type DistanceBackend interface {
+	Name() string
+	Distance(d1, d2 string) (int, error)
+	// Batch returns the distance of each digest to ref, -1 for invalid digests
+	Batch(ref string, digests []string) ([]int, error)
+}
+
+// ErrInvalidDigest is returned for a string that is not a TLSH digest
+var ErrInvalidDigest = errors.New("invalid TLSH digest")
+
+// ReferenceDistance is the plain glaslos/tlsh implementation
+type ReferenceDistance struct{}
+
+func (ReferenceDistance) Name() string { return "reference" }
+
+func (ReferenceDistance) parse(d string) (*tlsh.TLSH, error) {
+	// ParseStringToTlsh expects raw hex and indexes it without checking the length
+	d = strings.TrimPrefix(d, "T1")
+	if len(d) != 2*tlshDigestSize {
+		return nil, ErrInvalidDigest
+	}
+	return tlsh.ParseStringToTlsh(d)
+}
+
+func (b ReferenceDistance) Distance(d1, d2 string) (int, error) {
+	t1, err := b.parse(d1)
+	if err != nil {
+		return 0, err
+	}
+	t2, err := b.parse(d2)
+	if err != nil {
+		return 0, err
+	}
+	// Note: glaslos/tlsh Diff includes length.
+	return t1.Diff(t2), nil
+}
+
+func (b ReferenceDistance) Batch(ref string, digests []string) ([]int, error) {
+	tRef, err := b.parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	dists := make([]int, len(digests))
+	for i, d := range digests {
+		if t, err := b.parse(d); err == nil {
+			dists[i] = tRef.Diff(t)
+		} else {
+			dists[i] = -1
+		}
+	}
+	return dists, nil
+}
+
+// tlshDigestSize is the size of a decoded digest: checksum, length, ratios and code
+const tlshDigestSize = 3 + 32
+
+// tlshDigest is a parsed digest, as compared by the TLSH distance
+type tlshDigest struct {
+	checksum byte
+	lValue   byte
+	q1Ratio  byte
+	q2Ratio  byte
+	code     [32]byte
+}
+
+// bitPairsDiff[x][y] is the distance between the four 2-bit quartile codes of x and y
+var bitPairsDiff [256][256]uint8
+
+func init() {
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			d := 0
+			for shift := 0; shift < 8; shift += 2 {
+				diff := (x>>shift)&3 - (y>>shift)&3
+				if diff < 0 {
+					diff = -diff
+				}
+				if diff == 3 {
+					diff = 6 // Opposite quartiles weigh more
+				}
+				d += diff
+			}
+			bitPairsDiff[x][y] = uint8(d)
+		}
+	}
+}
+
+// swapNibbles undoes the nibble swap of the checksum and length bytes in the hex form
+func swapNibbles(b byte) byte {
+	return b<<4 | b>>4
+}
+
+func parseTLSHDigest(d string) (*tlshDigest, error) {
+	var raw [tlshDigestSize]byte
+	d = strings.TrimPrefix(d, "T1")
+	if len(d) != 2*tlshDigestSize {
+		return nil, ErrInvalidDigest
+	}
+	if _, err := hex.Decode(raw[:], []byte(d)); err != nil {
+		return nil, err
+	}
+	t := &tlshDigest{}
+	t.setHeader(raw[0], raw[1], raw[2])
+	copy(t.code[:], raw[3:])
+	return t, nil
+}
+
+// parseTLSHHeader only decodes the header bytes of d, false when d is not a digest
+func parseTLSHHeader(d string) (tlshDigest, bool) {
+	var raw [3]byte
+	var t tlshDigest
+	d = strings.TrimPrefix(d, "T1")
+	if len(d) != 2*tlshDigestSize {
+		return t, false
+	}
+	if _, err := hex.Decode(raw[:], []byte(d[:6])); err != nil {
+		return t, false
+	}
+	t.setHeader(raw[0], raw[1], raw[2])
+	return t, true
+}
+
+func (t *tlshDigest) setHeader(checksum, lValue, qRatio byte) {
+	t.checksum = swapNibbles(checksum)
+	t.lValue = swapNibbles(lValue)
+	t.q1Ratio = qRatio >> 4
+	t.q2Ratio = qRatio & 0xF
+}
+
+// circularDiff is the number of steps from x to y in a circular range of size r
+func circularDiff(x, y byte, r int) int {
+	d := int(x) - int(y)
+	if d < 0 {
+		d = -d
+	}
+	return min(d, r-d)
+}
+
+// headerDiff is the part of the distance due to the header: length, quartile
+// ratios and checksum
+func (a *tlshDigest) headerDiff(b *tlshDigest) int {
+	d := 0
+	switch l := circularDiff(a.lValue, b.lValue, 256); {
+	case l <= 1:
+		d = l
+	default:
+		d = l * 12
+	}
+	for _, q := range [2]int{circularDiff(a.q1Ratio, b.q1Ratio, 16), circularDiff(a.q2Ratio, b.q2Ratio, 16)} {
+		if q <= 1 {
+			d += q
+		} else {
+			d += (q - 1) * 12
+		}
+	}
+	if a.checksum != b.checksum {
+		d++
+	}
+	return d
+}
+
+// diff matches (*tlsh.TLSH).Diff, length included
+func (a *tlshDigest) diff(b *tlshDigest) int {
+	d := a.headerDiff(b)
+	for i := range a.code {
+		d += int(bitPairsDiff[a.code[i]][b.code[i]])
+	}
+	return d
+}
+
+// PrefilterCandidates drops the digests (and their ids) whose header is already
+// farther than maxDist from ref. Unparsable digests are kept for the backend to skip.
+func PrefilterCandidates(ref string, digests, ids []string, maxDist int) ([]string, []string) {
+	tRef, ok := parseTLSHHeader(ref)
+	if !ok {
+		return digests, ids
+	}
+	keptDigests := make([]string, 0, len(digests))
+	keptIDs := make([]string, 0, len(ids))
+	for i, d := range digests {
+		if t, ok := parseTLSHHeader(d); ok && tRef.headerDiff(&t) > maxDist {
+			continue
+		}
+		keptDigests = append(keptDigests, d)
+		keptIDs = append(keptIDs, ids[i])
+	}
+	return keptDigests, keptIDs
+}
+
+// FastDistance caches parsed digests and parallelizes large batches
+type FastDistance struct {
+	mu      sync.RWMutex
+	cache   map[string]*tlshDigest
+	workers atomic.Int64
+}
+
+// NewFastDistance returns a fast backend scoring batches on a single goroutine
+func NewFastDistance() *FastDistance {
+	b := &FastDistance{cache: make(map[string]*tlshDigest)}
+	b.workers.Store(1)
+	return b
+}
+
+// SetWorkers sets the goroutines large batches are spread over
+func (b *FastDistance) SetWorkers(n int) {
+	b.workers.Store(int64(max(n, 1)))
+}
+
+func (*FastDistance) Name() string { return "fast" }
+
+// digest returns the parsed form of d, from the cache when possible. The cache is
+// emptied when full: campaign candidates come back together, so it refills quickly.
+func (b *FastDistance) digest(d string) (*tlshDigest, error) {
+	b.mu.RLock()
+	t, ok := b.cache[d]
+	b.mu.RUnlock()
+	if ok {
+		return t, nil
+	}
+	t, err := parseTLSHDigest(d)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	if len(b.cache) >= maxCacheEntries {
+		clear(b.cache)
+	}
+	b.cache[d] = t
+	b.mu.Unlock()
+	return t, nil
+}
+
+func (b *FastDistance) Distance(d1, d2 string) (int, error) {
+	t1, err := b.digest(d1)
+	if err != nil {
+		return 0, err
+	}
+	t2, err := b.digest(d2)
+	if err != nil {
+		return 0, err
+	}
+	return t1.diff(t2), nil
+}
+
+func (b *FastDistance) Batch(ref string, digests []string) ([]int, error) {
+	tRef, err := b.digest(ref)
+	if err != nil {
+		return nil, err
+	}
+	dists := make([]int, len(digests))
+	score := func(from, to int) {
+		for i := from; i < to; i++ {
+			if t, err := b.digest(digests[i]); err == nil {
+				dists[i] = tRef.diff(t)
+			} else {
+				dists[i] = -1
+			}
+		}
+	}
+
+	workers := int(b.workers.Load())
+	if workers <= 1 || len(digests) < ParallelMin {
+		score(0, len(digests))
+		return dists, nil
+	}
+	chunk := (len(digests) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for from := 0; from < len(digests); from += chunk {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			score(from, to)
+		}(from, min(from+chunk, len(digests)))
+	}
+	wg.Wait()
+	return dists, nil
+}
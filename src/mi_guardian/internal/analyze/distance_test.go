@@ -0,0 +1,63 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package analyze
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDistanceBackends(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 40; i++ {
+		text := fmt.Sprintf("Offer %d: claim your reward at shop-%d.example before %d pm, %s", i, i%7, i%12, strings.Repeat("limited stock ", 10+i))
+		sig, err := TLSH(text)
+		if err != nil {
+			t.Fatalf("TLSH() error: %v", err)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	ref, fast := ReferenceDistance{}, NewFastDistance()
+	for _, a := range sigs {
+		for _, b := range sigs {
+			want, _ := ref.Distance(a, b)
+			if got, err := fast.Distance(a, strings.TrimPrefix(b, "T1")); err != nil || got != want {
+				t.Fatalf("fast.Distance() = %d, %v, want %d", got, err, want)
+			}
+		}
+	}
+
+	// Invalid digests are reported as -1, and large batches are spread over workers
+	candidates := []string{"T1", "zz", sigs[0][:20]}
+	for len(candidates) < 2*ParallelMin {
+		candidates = append(candidates, sigs...)
+	}
+	fast.SetWorkers(4)
+	want, _ := ref.Batch(sigs[1], candidates)
+	got, err := fast.Batch(sigs[1], candidates)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("fast.Batch() differs from the reference backend (error %v)", err)
+	}
+	if got[0] != -1 || got[1] != -1 || got[2] != -1 {
+		t.Errorf("Batch() = %v for invalid digests, want -1", got[:3])
+	}
+	if _, err := fast.Batch("T1", candidates); err == nil {
+		t.Error("Batch() with an invalid reference should fail")
+	}
+}
@@ -0,0 +1,82 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package oracle
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// --- CBOR (RFC 8949) for Oracle traffic ---
+
+// Only the JSON data model is supported: payloads are converted from and to JSON,
+// so the struct tags used for JSON apply unchanged.
+
+const cborMaxDepth = 64
+
+var (
+	cborEnc, _ = cbor.EncOptions{Sort: cbor.SortCoreDeterministic, ShortestFloat: cbor.ShortestFloat16}.EncMode()
+	cborDec, _ = cbor.DecOptions{MaxNestedLevels: cborMaxDepth, DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+)
+
+// JSONToCBOR encodes a JSON document as CBOR
+func JSONToCBOR(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(cborNumbers(v))
+}
+
+// CBORToJSON decodes a CBOR item into a JSON document
+func CBORToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := cborDec.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// cborNumbers turns json.Number values into integers where they fit, so they are
+// sent as CBOR integers rather than floats
+func cborNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = cborNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = cborNumbers(v[k])
+		}
+	}
+	return v
+}
@@ -0,0 +1,57 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package oracle
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCBOR(t *testing.T) {
+	// RFC 8949 Appendix A: {"a": 1, "b": [2, 3]}
+	got, err := JSONToCBOR([]byte(`{"b":[2,3],"a":1}`))
+	if err != nil || hex.EncodeToString(got) != "a26161016162820203" {
+		t.Errorf("JSONToCBOR() = %x, %v", got, err)
+	}
+
+	tests := []struct {
+		cbor string
+		want string
+	}{
+		{"a26161016162820203", `{"a":1,"b":[2,3]}`},
+		{"f93c00", `1`},                               // half precision
+		{"fb3ff199999999999a", `1.1`},                 // double
+		{"3903e7", `-1000`},                           // negative integer
+		{"9f0102ff", `[1,2]`},                         // indefinite array
+		{"7f657374726561646d696e67ff", `"streaming"`}, // indefinite text
+		{"c074323031332d30332d32315432303a30343a30305a", `"2013-03-21T20:04:00Z"`}, // tagged date
+		{"f6", `null`},
+	}
+	for _, tt := range tests {
+		data, _ := hex.DecodeString(tt.cbor)
+		got, err := CBORToJSON(data)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("CBORToJSON(%s) = %s, %v, want %s", tt.cbor, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "a2616101", "5bffffffffffffffff", "ff"} {
+		data, _ := hex.DecodeString(bad)
+		if _, err := CBORToJSON(data); err == nil {
+			t.Errorf("CBORToJSON(%s) accepted invalid data", bad)
+		}
+	}
+}
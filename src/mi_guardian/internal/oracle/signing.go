@@ -0,0 +1,44 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package oracle
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Request signing ---
+
+// SigningString is what the signature covers: method, path, timestamp and body digest
+func SigningString(method, path, timestamp string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:]))
+}
+
+// Sign adds the node ID, timestamp and signature headers to an Oracle request.
+// body is the payload as sent.
+func Sign(req *http.Request, body []byte, nodeID string, key ed25519.PrivateKey) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := ed25519.Sign(key, SigningString(req.Method, req.URL.Path, timestamp, body))
+	req.Header.Set("X-Mailuminati-Node", nodeID)
+	req.Header.Set("X-Mailuminati-Timestamp", timestamp)
+	req.Header.Set("X-Mailuminati-Signature", base64.StdEncoding.EncodeToString(sig))
+}
@@ -0,0 +1,87 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package oracle holds the protocol of the Mailuminati Oracle: payload encodings
+// (JSON, CBOR, gzip) and request signing. Which encoding to use, the node key and
+// the Oracle URL are the engine's settings.
+package oracle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Wire is the encoding of a request payload: JSON, or CBOR, optionally gzip compressed
+type Wire struct {
+	CBOR bool
+	Gzip bool
+}
+
+// Encode marshals a payload with the given wire settings
+func Encode(payload interface{}, wire Wire) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if wire.CBOR {
+		if body, err = JSONToCBOR(body); err != nil {
+			return nil, err
+		}
+	}
+	if wire.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
+
+// NewRequest builds a POST of an encoded body, with the content headers of wire
+func NewRequest(url string, body []byte, wire Wire) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wire.CBOR {
+		req.Header.Set("Content-Type", "application/cbor")
+		req.Header.Set("Accept", "application/cbor, application/json;q=0.9")
+	}
+	if wire.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return req, nil
+}
+
+// ResponseJSON reads an Oracle response body as JSON, converting CBOR bodies.
+// Gzip responses are decompressed by the HTTP client.
+func ResponseJSON(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/cbor" {
+		return CBORToJSON(body)
+	}
+	return body, nil
+}
@@ -0,0 +1,186 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Secondary Redis (migration) ---
+
+// Commands mirrored to the secondary instance
+var mirroredWrites = map[string]bool{
+	"set": true, "setnx": true, "del": true, "unlink": true, "rename": true,
+	"expire": true, "pexpire": true, "persist": true,
+	"incr": true, "incrby": true, "incrbyfloat": true, "decrby": true,
+	"sadd": true, "srem": true, "sunionstore": true,
+	"hset": true, "hsetnx": true, "hincrby": true, "hincrbyfloat": true,
+	"hdel": true, "spop": true,
+	"zadd": true, "zrem": true, "zremrangebyscore": true, "zremrangebyrank": true,
+	"xadd": true, "xack": true, "xdel": true,
+	"eval": true, "evalsha": true,
+}
+
+// Commands answered by the secondary instance when the primary misses
+var readThroughCommands = map[string]bool{
+	"get": true, "exists": true, "smembers": true, "sismember": true, "scard": true,
+	"hget": true, "hexists": true, "hmget": true, "hgetall": true,
+	"ttl": true, "pttl": true,
+}
+
+// Sources of the Lua scripts by SHA1, so that EVALSHA is mirrored as EVAL: the
+// secondary may not have the script cached
+var mirroredScripts = map[string]string{}
+
+// NewScript creates a Lua script whose EVALSHA calls can be mirrored
+func NewScript(src string) *redis.Script {
+	script := redis.NewScript(src)
+	mirroredScripts[script.Hash()] = src
+	return script
+}
+
+// mirrorHook dual-writes to a secondary Redis and falls back to it on read misses.
+// It lets operators move to a new Redis (the primary) while the old one (the
+// secondary) still serves data learned before the switch.
+type mirrorHook struct {
+	secondary *redis.Client
+	logger    *slog.Logger
+}
+
+// NewMirrorHook returns the hook to add to the primary client. Failed secondary
+// writes are logged at debug level.
+func NewMirrorHook(secondary *redis.Client, logger *slog.Logger) redis.Hook {
+	return &mirrorHook{secondary: secondary, logger: logger}
+}
+
+// isMissedRead tells whether a read-through command found nothing (or failed) on the primary
+func isMissedRead(cmd redis.Cmder) bool {
+	if !readThroughCommands[cmd.Name()] {
+		return false
+	}
+	if cmd.Err() != nil {
+		// redis.Nil or primary failure
+		return true
+	}
+	switch c := cmd.(type) {
+	case *redis.IntCmd:
+		return c.Val() == 0
+	case *redis.DurationCmd:
+		// -2: no such key
+		return c.Val() == -2
+	case *redis.BoolCmd:
+		return !c.Val()
+	case *redis.StringSliceCmd:
+		return len(c.Val()) == 0
+	case *redis.StringStringMapCmd:
+		return len(c.Val()) == 0
+	case *redis.SliceCmd:
+		for _, v := range c.Val() {
+			if v != nil {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// copyWrite builds an independent command so the secondary reply never overwrites the
+// primary one. Commands whose effect the secondary would not reproduce are rewritten:
+// SPOP removes the members popped on the primary, XADD reuses the primary entry ID
+// and EVALSHA sends the script source.
+func copyWrite(ctx context.Context, cmd redis.Cmder) (redis.Cmder, bool) {
+	if !mirroredWrites[cmd.Name()] || cmd.Err() != nil {
+		return nil, false
+	}
+	args := append([]interface{}{}, cmd.Args()...)
+	switch c := cmd.(type) {
+	case *redis.StringSliceCmd:
+		if cmd.Name() == "spop" {
+			if len(c.Val()) == 0 {
+				return nil, false
+			}
+			args = []interface{}{"srem", args[1]}
+			for _, member := range c.Val() {
+				args = append(args, member)
+			}
+		}
+	case *redis.StringCmd:
+		if cmd.Name() == "xadd" {
+			for i := 2; i < len(args); i++ {
+				if args[i] == "*" {
+					args[i] = c.Val()
+					break
+				}
+			}
+		}
+	}
+	if cmd.Name() == "evalsha" {
+		sha, _ := args[1].(string)
+		src, ok := mirroredScripts[strings.ToLower(sha)]
+		if !ok {
+			return nil, false
+		}
+		args[0], args[1] = "eval", src
+	}
+	return redis.NewCmd(ctx, args...), true
+}
+
+func (h *mirrorHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *mirrorHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if mirror, ok := copyWrite(ctx, cmd); ok {
+		if err := h.secondary.Process(ctx, mirror); err != nil && err != redis.Nil {
+			h.logger.Debug("Secondary Redis write failed", "command", cmd.Name(), "error", err)
+		}
+		return nil
+	}
+	if isMissedRead(cmd) {
+		// Re-run the same command on the secondary: its reply replaces the miss
+		h.secondary.Process(ctx, cmd)
+	}
+	return nil
+}
+
+func (h *mirrorHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *mirrorHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	pipe := h.secondary.Pipeline()
+	queued := 0
+	for _, cmd := range cmds {
+		if mirror, ok := copyWrite(ctx, cmd); ok {
+			pipe.Process(ctx, mirror)
+			queued++
+		} else if isMissedRead(cmd) {
+			pipe.Process(ctx, cmd)
+			queued++
+		}
+	}
+	if queued > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			h.logger.Debug("Secondary Redis pipeline failed", "commands", queued, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// TestIsMissedRead checks which primary replies trigger a secondary read-through
+func TestIsMissedRead(t *testing.T) {
+	bg := context.Background()
+
+	exists := redis.NewIntCmd(bg, "exists", "k")
+	exists.SetVal(0)
+	if !isMissedRead(exists) {
+		t.Errorf("EXISTS returning 0 should be a miss")
+	}
+	exists.SetVal(1)
+	if isMissedRead(exists) {
+		t.Errorf("EXISTS returning 1 should not be a miss")
+	}
+
+	get := redis.NewStringCmd(bg, "get", "k")
+	get.SetErr(redis.Nil)
+	if !isMissedRead(get) {
+		t.Errorf("GET returning nil should be a miss")
+	}
+
+	hmget := redis.NewSliceCmd(bg, "hmget", "k", "a", "b")
+	hmget.SetVal([]interface{}{nil, "1"})
+	if isMissedRead(hmget) {
+		t.Errorf("HMGET with a value should not be a miss")
+	}
+
+	incr := redis.NewIntCmd(bg, "incr", "k")
+	incr.SetVal(0)
+	if isMissedRead(incr) {
+		t.Errorf("Write commands are never read-through")
+	}
+	if _, ok := copyWrite(bg, incr); !ok {
+		t.Errorf("INCR should be mirrored")
+	}
+}
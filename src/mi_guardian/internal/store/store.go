@@ -0,0 +1,105 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package store holds the Redis side of the engine: the commands it needs from a
+// client, the in-memory server of REDIS_MODE=memory and the mirror used while
+// migrating to another Redis instance.
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// Store holds the learned data, scans and counters. It is the part of a go-redis
+// client the engine uses: *redis.Client, *redis.ClusterClient or *redis.Ring fit,
+// and so does a wrapper of a Redis compatible server.
+type Store interface {
+	redis.Scripter
+	Pipeline() redis.Pipeliner
+	TxPipeline() redis.Pipeliner
+	Ping(ctx context.Context) *redis.StatusCmd
+
+	// Keys
+	Get(ctx context.Context, key string) *redis.StringCmd
+	Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	Unlink(ctx context.Context, keys ...string) *redis.IntCmd
+	Exists(ctx context.Context, keys ...string) *redis.IntCmd
+	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
+	Type(ctx context.Context, key string) *redis.StatusCmd
+	Rename(ctx context.Context, key, newkey string) *redis.StatusCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+	Incr(ctx context.Context, key string) *redis.IntCmd
+	IncrBy(ctx context.Context, key string, value int64) *redis.IntCmd
+	IncrByFloat(ctx context.Context, key string, value float64) *redis.FloatCmd
+
+	// Hashes and sets
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd
+	HMGet(ctx context.Context, key string, fields ...string) *redis.SliceCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HSetNX(ctx context.Context, key, field string, value interface{}) *redis.BoolCmd
+	HExists(ctx context.Context, key, field string) *redis.BoolCmd
+	HIncrBy(ctx context.Context, key, field string, incr int64) *redis.IntCmd
+	HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd
+	SAdd(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	SMembers(ctx context.Context, key string) *redis.StringSliceCmd
+	SIsMember(ctx context.Context, key string, member interface{}) *redis.BoolCmd
+	SCard(ctx context.Context, key string) *redis.IntCmd
+
+	// Sorted sets
+	ZAdd(ctx context.Context, key string, members ...*redis.Z) *redis.IntCmd
+	ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd
+	ZRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd
+	ZRemRangeByScore(ctx context.Context, key, min, max string) *redis.IntCmd
+	ZCount(ctx context.Context, key, min, max string) *redis.IntCmd
+
+	// Streams (asynchronous queue)
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XRange(ctx context.Context, stream, start, stop string) *redis.XMessageSliceCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XPendingExt(ctx context.Context, a *redis.XPendingExtArgs) *redis.XPendingExtCmd
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XClaim(ctx context.Context, a *redis.XClaimArgs) *redis.XMessageSliceCmd
+}
+
+var (
+	_ Store = (*redis.Client)(nil)
+	_ Store = (*redis.ClusterClient)(nil)
+)
+
+// --- In-memory store (REDIS_MODE=memory) ---
+//
+// An embedded server speaking the Redis protocol, for evaluating Guardian without
+// installing Redis and for running the test suite hermetically. Everything is
+// kept in the process memory and lost on restart, so it does not suit production.
+
+// NewMemory starts an in-memory store and returns it with a client connected to it
+func NewMemory() (*miniredis.Miniredis, *redis.Client, error) {
+	server, err := miniredis.Run()
+	if err != nil {
+		return nil, nil, err
+	}
+	return server, redis.NewClient(&redis.Options{Addr: server.Addr()}), nil
+}
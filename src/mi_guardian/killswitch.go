@@ -0,0 +1,209 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Campaign kill switch ---
+
+// Hashes blocked by an admin during an active wave. They are checked before any
+// other step, trusted senders included, and expire on their own.
+
+type killEntry struct {
+	Hash    string `json:"hash"`
+	Comment string `json:"comment,omitempty"`
+	Created int64  `json:"created"`
+	TTL     int64  `json:"ttl_seconds,omitempty"`
+}
+
+// validTLSH reports whether sig is a "T1" TLSH digest Guardian can compare
+func validTLSH(sig string) bool {
+	if !strings.HasPrefix(sig, "T1") {
+		return false
+	}
+	_, err := computeDistance(sig, sig, false, 0)
+	return err == nil && len(extractBands_6_3(sig)) > 0
+}
+
+// blockHash adds a hash and its bands to the kill switch for ttl
+func blockHash(hash, comment string, ttl time.Duration) error {
+	entry, _ := json.Marshal(killEntry{Hash: hash, Comment: comment, Created: time.Now().Unix()})
+	bands := extractBands_6_3(hash)
+
+	// Band sets are shared: only ever extend their expiry
+	pipe := rdb.Pipeline()
+	ttlCmds := make([]*redis.DurationCmd, len(bands))
+	for i, b := range bands {
+		ttlCmds[i] = pipe.TTL(ctx, KillBandPrefix+b)
+	}
+	pipe.Exec(ctx)
+
+	pipe = rdb.Pipeline()
+	pipe.Set(ctx, KillHashPrefix+hash, entry, ttl)
+	for i, b := range bands {
+		pipe.SAdd(ctx, KillBandPrefix+b, hash)
+		if ttlCmds[i].Val() < ttl {
+			pipe.Expire(ctx, KillBandPrefix+b, ttl)
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// unblockHash removes a hash from the kill switch; false when it was not blocked
+func unblockHash(hash string) (bool, error) {
+	pipe := rdb.Pipeline()
+	delCmd := pipe.Del(ctx, KillHashPrefix+hash)
+	for _, b := range extractBands_6_3(hash) {
+		pipe.SRem(ctx, KillBandPrefix+b, hash)
+	}
+	_, err := pipe.Exec(ctx)
+	return delCmd.Val() > 0, err
+}
+
+// killSwitchMatch returns the first signature within distance of a blocked hash
+func killSwitchMatch(signatures []string) (string, string, int) {
+	for _, sig := range signatures {
+		bands := extractBands_6_3(sig)
+		pipe := rdb.Pipeline()
+		cmds := make([]*redis.StringSliceCmd, len(bands))
+		for i, b := range bands {
+			cmds[i] = pipe.SMembers(ctx, KillBandPrefix+b)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			continue
+		}
+
+		// Same LSH rule as the regular lookups: 4 shared bands make a candidate
+		shared := make(map[string]int)
+		for _, cmd := range cmds {
+			for _, h := range cmd.Val() {
+				shared[h]++
+			}
+		}
+		for h, n := range shared {
+			if n < 4 {
+				continue
+			}
+			if rdb.Exists(ctx, KillHashPrefix+h).Val() == 0 {
+				// Expired entry whose band sets outlive it
+				continue
+			}
+			if dist, err := computeDistance(sig, h, false, ProximityDistance); err == nil && dist <= ProximityDistance {
+				return sig, h, dist
+			}
+		}
+	}
+	return "", "", 0
+}
+
+// blockHashHandler lists the blocked hashes (GET) or blocks one (POST {"hash", "ttl_hours", "comment"})
+func blockHashHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []killEntry{}
+		iter := rdb.Scan(ctx, 0, KillHashPrefix+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			var entry killEntry
+			if json.Unmarshal([]byte(rdb.Get(ctx, iter.Val()).Val()), &entry) == nil {
+				entry.TTL = int64(rdb.TTL(ctx, iter.Val()).Val().Seconds())
+				entries = append(entries, entry)
+			}
+		}
+		respBytes, _ := json.Marshal(map[string]interface{}{"blocked": entries})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBytes)
+
+	case http.MethodPost:
+		var reqBody struct {
+			Hash     string `json:"hash"`
+			TTLHours int64  `json:"ttl_hours"`
+			Comment  string `json:"comment"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+			return
+		}
+		reqBody.Hash = strings.ToUpper(strings.TrimSpace(reqBody.Hash))
+		if !validTLSH(reqBody.Hash) {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "hash must be a T1 TLSH signature")
+			return
+		}
+		if reqBody.TTLHours <= 0 {
+			reqBody.TTLHours = DefaultKillSwitchHours
+		}
+		if reqBody.TTLHours > MaxKillSwitchHours {
+			reqBody.TTLHours = MaxKillSwitchHours
+		}
+		ttl := time.Duration(reqBody.TTLHours) * time.Hour
+
+		if err := blockHash(reqBody.Hash, reqBody.Comment, ttl); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+		forgetVerdicts()
+		logger.Warn("Hash blocked by kill switch", "hash", reqBody.Hash, "ttl_hours", reqBody.TTLHours, "comment", reqBody.Comment)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"blocked","hash":"` + reqBody.Hash + `","ttl_seconds":` + strconv.FormatInt(int64(ttl.Seconds()), 10) + `}`))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+	}
+}
+
+// unblockHashHandler removes a hash from the kill switch (POST {"hash"})
+func unblockHashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var reqBody struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || reqBody.Hash == "" {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+		return
+	}
+	reqBody.Hash = strings.ToUpper(strings.TrimSpace(reqBody.Hash))
+
+	removed, err := unblockHash(reqBody.Hash)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, ErrNotFound, "Hash not blocked")
+		return
+	}
+	forgetVerdicts()
+	logger.Info("Hash unblocked from kill switch", "hash", reqBody.Hash)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"unblocked","hash":"` + reqBody.Hash + `"}`))
+}
@@ -0,0 +1,99 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// --- Attachment and image learning ---
+//
+// A spam body is rarely sent by anyone else, but the same PDF (an invoice template)
+// or logo travels in legitimate mail too. Signatures of attachments and images can
+// therefore be learned with their own weights (ATTACHMENT_SPAM_WEIGHT, IMAGE_*) and
+// need their own, higher, threshold to flag a message. Unset values follow the body.
+
+const (
+	KindAttachment = "attachment"
+	KindImage      = "image"
+)
+
+var (
+	attachmentSpamWeight    int64 // 0 = SPAM_WEIGHT
+	attachmentHamWeight     int64 // 0 = HAM_WEIGHT
+	attachmentSpamThreshold int64 // 0 = SPAM_THRESHOLD
+	imageSpamWeight         int64
+	imageHamWeight          int64
+	imageSpamThreshold      int64
+)
+
+// loadKindWeights reads the learning weights and thresholds of attachments and images
+func loadKindWeights() {
+	atomic.StoreInt64(&attachmentSpamWeight, getEnvInt("ATTACHMENT_SPAM_WEIGHT", 0))
+	atomic.StoreInt64(&attachmentHamWeight, getEnvInt("ATTACHMENT_HAM_WEIGHT", 0))
+	atomic.StoreInt64(&attachmentSpamThreshold, getEnvInt("ATTACHMENT_SPAM_THRESHOLD", 0))
+	atomic.StoreInt64(&imageSpamWeight, getEnvInt("IMAGE_SPAM_WEIGHT", 0))
+	atomic.StoreInt64(&imageHamWeight, getEnvInt("IMAGE_HAM_WEIGHT", 0))
+	atomic.StoreInt64(&imageSpamThreshold, getEnvInt("IMAGE_SPAM_THRESHOLD", 0))
+}
+
+// attachmentKind returns the kind of an attachment signature: image for pictures
+func attachmentKind(contentType string) string {
+	if strings.HasPrefix(contentType, "image/") {
+		return KindImage
+	}
+	return KindAttachment
+}
+
+// kindWeight returns the base weight a report of that type adds to a signature of
+// that kind ("" for body signatures)
+func kindWeight(kind, reportType string) int64 {
+	var w int64
+	switch {
+	case kind == KindAttachment && reportType == "spam":
+		w = atomic.LoadInt64(&attachmentSpamWeight)
+	case kind == KindAttachment:
+		w = atomic.LoadInt64(&attachmentHamWeight)
+	case kind == KindImage && reportType == "spam":
+		w = atomic.LoadInt64(&imageSpamWeight)
+	case kind == KindImage:
+		w = atomic.LoadInt64(&imageHamWeight)
+	}
+	if w > 0 {
+		return w
+	}
+	if reportType == "spam" {
+		return atomic.LoadInt64(&spamWeight)
+	}
+	return atomic.LoadInt64(&hamWeight)
+}
+
+// forKind raises the threshold for attachment and image signatures. Higher profile
+// thresholds (mailing lists) are kept.
+func (p thresholdProfile) forKind(kind string) thresholdProfile {
+	var th int64
+	switch kind {
+	case KindAttachment:
+		th = atomic.LoadInt64(&attachmentSpamThreshold)
+	case KindImage:
+		th = atomic.LoadInt64(&imageSpamThreshold)
+	}
+	if th > p.SpamThreshold {
+		p.SpamThreshold = th
+	}
+	return p
+}
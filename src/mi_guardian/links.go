@@ -0,0 +1,205 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/net/html"
+)
+
+// --- Link rewriting suggestions ---
+//
+// Gateways that rewrite links need per-URL verdicts, not only the message action.
+// With LINK_SUGGESTIONS=true, /analyze scores every link of the message and lists the
+// suspicious ones under "links", with a defanged form (hxxp://example[.]com) and the
+// suggested treatment: "warn" (wrap behind a warning page) or "defang".
+
+const (
+	DefaultLinkSuspiciousScore = 40 // Score from which a link is listed
+	DefaultLinkDefangScore     = 80 // Score from which a link should be defanged rather than wrapped
+	MaxMessageLinks            = 100
+)
+
+// Default LINK_SHORTENERS
+var defaultLinkShorteners = []string{"bit.ly", "tinyurl.com", "t.co", "goo.gl", "ow.ly", "is.gd", "buff.ly", "rebrand.ly", "cutt.ly", "rb.gy"}
+
+var (
+	reTextURL  = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"']+`)
+	reLinkHost = regexp.MustCompile(`(?i)^(?:https?://)?([a-z0-9-]+(?:\.[a-z0-9-]+)+)(?:[/:?#]|$)`)
+)
+
+// Link weights, per reason
+var linkReasonScores = map[string]int{
+	"text_mismatch": 50, // Anchor text shows another domain than the target
+	"ip_host":       40,
+	"userinfo":      40, // http://bank.com@evil.example/
+	"punycode":      30,
+	"spam_message":  30, // Link of a message with a spam verdict
+	"shortener":     20,
+	"insecure":      10,
+}
+
+// LinkVerdict is the verdict of one link of the "links" section
+type LinkVerdict struct {
+	URL        string   `json:"url"`
+	Host       string   `json:"host"`
+	Score      int      `json:"score"`
+	Verdict    string   `json:"verdict"`    // suspicious or malicious
+	Suggestion string   `json:"suggestion"` // warn or defang
+	Rewrite    string   `json:"rewrite"`    // defanged URL
+	Reasons    []string `json:"reasons"`
+}
+
+// messageLink is a link found in a message, with the text it is shown with
+type messageLink struct {
+	URL  string
+	Text string
+}
+
+// messageLinks returns the links of the HTML anchors and the bare URLs of the text
+// body, at most MaxMessageLinks
+func messageLinks(env *enmime.Envelope) []messageLink {
+	var links []messageLink
+	seen := make(map[string]bool)
+	add := func(rawURL, text string) {
+		rawURL = strings.TrimSpace(rawURL)
+		lower := strings.ToLower(rawURL)
+		if seen[rawURL] || len(links) >= MaxMessageLinks || (!strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://")) {
+			return
+		}
+		seen[rawURL] = true
+		links = append(links, messageLink{URL: rawURL, Text: strings.TrimSpace(text)})
+	}
+
+	z := html.NewTokenizer(strings.NewReader(env.HTML))
+	href, inAnchor := "", false
+	var text strings.Builder
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		switch tt {
+		case html.StartTagToken:
+			if tok := z.Token(); tok.Data == "a" {
+				href, inAnchor = tagAttr(tok, "href"), true
+				text.Reset()
+			}
+		case html.TextToken:
+			if inAnchor {
+				text.Write(z.Text())
+			}
+		case html.EndTagToken:
+			if tok := z.Token(); tok.Data == "a" && inAnchor {
+				add(href, text.String())
+				inAnchor = false
+			}
+		}
+	}
+	for _, u := range reTextURL.FindAllString(env.Text, -1) {
+		add(strings.TrimRight(u, ".,;:!?)]"), "")
+	}
+	return links
+}
+
+// defangURL rewrites a URL so it is neither clickable nor auto-linked:
+// https://evil.example/x -> hxxps://evil[.]example/x
+func defangURL(rawURL string) string {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return rawURL
+	}
+	host, path := rest, ""
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	scheme = strings.Replace(strings.ToLower(scheme), "tt", "xx", 1)
+	return scheme + "://" + strings.ReplaceAll(host, ".", "[.]") + path
+}
+
+// scoreLink scores a link and returns its reasons
+func scoreLink(link messageLink, spam bool, shorteners []string) (string, int, []string) {
+	u, err := url.Parse(link.URL)
+	if err != nil || u.Hostname() == "" {
+		return "", 0, nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	var reasons []string
+	if net.ParseIP(host) != nil {
+		reasons = append(reasons, "ip_host")
+	}
+	if u.User != nil {
+		reasons = append(reasons, "userinfo")
+	}
+	if strings.HasPrefix(host, "xn--") || strings.Contains(host, ".xn--") {
+		reasons = append(reasons, "punycode")
+	}
+	if m := reLinkHost.FindStringSubmatch(link.Text); m != nil {
+		shown := strings.ToLower(m[1])
+		if !domainMatches(host, shown) && !domainMatches(shown, host) {
+			reasons = append(reasons, "text_mismatch")
+		}
+	}
+	if slices.ContainsFunc(shorteners, func(d string) bool { return domainMatches(host, d) }) {
+		reasons = append(reasons, "shortener")
+	}
+	if strings.EqualFold(u.Scheme, "http") {
+		reasons = append(reasons, "insecure")
+	}
+	if spam {
+		reasons = append(reasons, "spam_message")
+	}
+	score := 0
+	for _, r := range reasons {
+		score += linkReasonScores[r]
+	}
+	return host, score, reasons
+}
+
+// linkVerdicts lists the suspicious links of a message, or nil unless LINK_SUGGESTIONS
+// is enabled. Links to the sender's domain are left out.
+func linkVerdicts(env *enmime.Envelope, res AnalysisResult) []LinkVerdict {
+	if strings.ToLower(getEnv("LINK_SUGGESTIONS", "false")) != "true" {
+		return nil
+	}
+	suspicious := int(getEnvPositiveInt("LINK_SUSPICIOUS_SCORE", DefaultLinkSuspiciousScore))
+	defang := int(getEnvPositiveInt("LINK_DEFANG_SCORE", DefaultLinkDefangScore))
+	shorteners := getEnvList("LINK_SHORTENERS")
+	if len(shorteners) == 0 {
+		shorteners = defaultLinkShorteners
+	}
+	sender := addressDomain(env.GetHeader("From"))
+
+	var verdicts []LinkVerdict
+	for _, link := range messageLinks(env) {
+		host, score, reasons := scoreLink(link, res.Action == "spam", shorteners)
+		if host == "" || score < suspicious || (sender != "" && domainMatches(host, sender) && !slices.Contains(reasons, "userinfo")) {
+			continue
+		}
+		v := LinkVerdict{URL: link.URL, Host: host, Score: score, Verdict: "suspicious", Suggestion: "warn", Rewrite: defangURL(link.URL), Reasons: reasons}
+		if score >= defang {
+			v.Verdict, v.Suggestion = "malicious", "defang"
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
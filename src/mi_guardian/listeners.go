@@ -0,0 +1,148 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// --- MTA listeners ---
+//
+// By default the MTA bridge listens on every GUARDIAN_BIND_ADDR address (comma
+// separated, IPv4 or IPv6) at PORT. LISTENERS names listeners with their own
+// settings instead, e.g. LISTENERS=local,lan with:
+//   LISTENER_LOCAL_ADDR=127.0.0.1,::1
+//   LISTENER_LAN_ADDR=10.0.0.5:12422
+//   LISTENER_LAN_TLS_CERT=/etc/guardian/lan.crt, LISTENER_LAN_TLS_KEY=/etc/guardian/lan.key
+//   LISTENER_LAN_TOKEN=<bearer token required from LAN clients>
+
+var errNoListener = errors.New("no listener configured")
+
+// listenerConfig is one named listener, bound to one or more addresses
+type listenerConfig struct {
+	Name     string
+	Addrs    []string // host:port
+	CertFile string
+	KeyFile  string
+	Token    string
+}
+
+// listenAddr adds the default port to an address without one. IPv6 addresses
+// with a port need brackets: [::1]:12421.
+func listenAddr(addr, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+}
+
+// splitAddrs splits a comma separated address list, adding the default port
+func splitAddrs(list, defaultPort string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, listenAddr(addr, defaultPort))
+		}
+	}
+	return addrs
+}
+
+// listenerConfigs returns the configured listeners: those named in LISTENERS, else
+// a single one on GUARDIAN_BIND_ADDR and PORT
+func listenerConfigs() []listenerConfig {
+	port := getEnv("PORT", "12421")
+	names := getEnvList("LISTENERS")
+	if len(names) == 0 {
+		return []listenerConfig{{Name: "default", Addrs: splitAddrs(getEnv("GUARDIAN_BIND_ADDR", "127.0.0.1"), port)}}
+	}
+
+	var listeners []listenerConfig
+	for _, name := range names {
+		prefix := "LISTENER_" + strings.ToUpper(name) + "_"
+		l := listenerConfig{
+			Name:     name,
+			Addrs:    splitAddrs(getEnv(prefix+"ADDR", ""), port),
+			CertFile: getEnv(prefix+"TLS_CERT", ""),
+			KeyFile:  getEnv(prefix+"TLS_KEY", ""),
+			Token:    getEnv(prefix+"TOKEN", ""),
+		}
+		if len(l.Addrs) == 0 {
+			logger.Warn("Listener without address, skipped", "listener", name, "setting", prefix+"ADDR")
+			continue
+		}
+		if (l.CertFile == "") != (l.KeyFile == "") {
+			logger.Warn("Listener needs both TLS_CERT and TLS_KEY, serving plain HTTP", "listener", name)
+			l.CertFile, l.KeyFile = "", ""
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+// listenerAuth requires the listener token as a bearer token. /admin/ paths keep
+// their own tokens (adminAuth).
+func listenerAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		given := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mailuminati-guardian"`)
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveListeners serves handler on every configured address and returns the
+// first listener error
+func serveListeners(handler http.Handler) error {
+	listeners := listenerConfigs()
+	if len(listeners) == 0 {
+		return errNoListener
+	}
+	errs := make(chan error, 1)
+	for _, l := range listeners {
+		h := handler
+		if l.Token != "" {
+			h = listenerAuth(l.Token, h)
+		}
+		h = connACL(h)
+		for _, addr := range l.Addrs {
+			logger.Info("MTA bridge ready", "listener", l.Name, "address", addr, "tls", l.CertFile != "", "token", l.Token != "")
+			go func(l listenerConfig, srv *http.Server) {
+				var err error
+				if l.CertFile != "" {
+					err = srv.ListenAndServeTLS(l.CertFile, l.KeyFile)
+				} else {
+					err = srv.ListenAndServe()
+				}
+				select {
+				case errs <- err:
+				default:
+				}
+			}(l, &http.Server{Addr: addr, Handler: h})
+		}
+	}
+	return <-errs
+}
@@ -0,0 +1,103 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// --- Image analysis load guard ---
+//
+// Image fetches are the most expensive optional stage. Under load they make every
+// analysis slower, which adds in-flight analyses, which queue for more downloads.
+// The guard pauses image analysis while in-flight analyses, Redis latency or the
+// download queue exceed their IMAGE_GUARD_* limits, and resumes it once all are back
+// below half their limit for ImageGuardHold.
+
+const ImageGuardHold = 30 * time.Second // Calm period before image analysis resumes
+
+var (
+	analyzeInFlight   int64 // Analyses running
+	fetchWaiting      int64 // Analyses waiting for a download slot
+	redisLatencyMicro int64 // Last PING round trip, in microseconds
+
+	imageGuardPaused atomic.Bool
+	imageGuardCalm   time.Time // Start of the calm period, while paused
+)
+
+// imageGuardLoad returns the load figures the guard watches
+func imageGuardLoad() (inFlight, queued int64, redisLatency time.Duration) {
+	return atomic.LoadInt64(&analyzeInFlight), atomic.LoadInt64(&fetchWaiting),
+		time.Duration(atomic.LoadInt64(&redisLatencyMicro)) * time.Microsecond
+}
+
+// imageGuardOverload tells whether a load figure exceeds its limit, or half of it
+// (recovery); the reason names the first one found
+func imageGuardOverload(fraction float64) (bool, string) {
+	inFlight, queued, latency := imageGuardLoad()
+	over := func(value, limit int64) bool {
+		return limit > 0 && float64(value) > float64(limit)*fraction
+	}
+	switch {
+	case over(inFlight, getEnvInt("IMAGE_GUARD_INFLIGHT", DefaultImageGuardInFlight)):
+		return true, "inflight"
+	case over(latency.Milliseconds(), getEnvInt("IMAGE_GUARD_REDIS_MS", DefaultImageGuardRedisMs)):
+		return true, "redis_latency"
+	case over(queued, getEnvInt("IMAGE_GUARD_QUEUE", DefaultImageGuardQueue)):
+		return true, "queue"
+	}
+	return false, ""
+}
+
+// checkImageGuard pauses or resumes image analysis from the current load
+func checkImageGuard(now time.Time) {
+	if !imageGuardPaused.Load() {
+		if over, reason := imageGuardOverload(1); over {
+			inFlight, queued, latency := imageGuardLoad()
+			logger.Warn("Image analysis paused under load", "reason", reason, "inflight", inFlight, "queue", queued, "redis_latency", latency)
+			imageGuardPaused.Store(true)
+			imageGuardCalm = time.Time{}
+			promImageGuard.Set(1)
+			promImageGuardTrips.WithLabelValues(reason).Inc()
+		}
+		return
+	}
+	if over, _ := imageGuardOverload(0.5); over {
+		imageGuardCalm = time.Time{}
+		return
+	}
+	if imageGuardCalm.IsZero() {
+		imageGuardCalm = now
+	}
+	if now.Sub(imageGuardCalm) >= ImageGuardHold {
+		logger.Info("Image analysis resumed")
+		imageGuardPaused.Store(false)
+		promImageGuard.Set(0)
+	}
+}
+
+// imageGuardWorker measures Redis latency and updates the guard every second
+func imageGuardWorker() {
+	ticker := time.NewTicker(1 * time.Second)
+	for now := range ticker.C {
+		start := time.Now()
+		if err := rdb.Ping(ctx).Err(); err == nil {
+			atomic.StoreInt64(&redisLatencyMicro, time.Since(start).Microseconds())
+		}
+		checkImageGuard(now)
+	}
+}
@@ -0,0 +1,94 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Runtime log level ---
+
+var (
+	logLevel          slog.LevelVar // Level of the logger, changed by /admin/loglevel and SIGUSR1
+	configuredLogRank int64         // LOG_LEVEL at startup, restored when SIGUSR1 leaves DEBUG
+)
+
+// parseLogLevel maps LOG_LEVEL names to slog levels
+func parseLogLevel(s string) (slog.Level, bool) {
+	switch strings.ToUpper(strings.TrimSpace(s)) {
+	case "DEBUG":
+		return slog.LevelDebug, true
+	case "INFO":
+		return slog.LevelInfo, true
+	case "WARN", "WARNING":
+		return slog.LevelWarn, true
+	case "ERROR":
+		return slog.LevelError, true
+	}
+	return slog.LevelInfo, false
+}
+
+// toggleDebug switches between DEBUG and the configured level (INFO if it is DEBUG itself)
+func toggleDebug() slog.Level {
+	next := slog.LevelDebug
+	if logLevel.Level() == slog.LevelDebug {
+		next = slog.Level(atomic.LoadInt64(&configuredLogRank))
+		if next == slog.LevelDebug {
+			next = slog.LevelInfo
+		}
+	}
+	logLevel.Set(next)
+	return next
+}
+
+// logLevelHandler shows (GET) or changes (POST {"level": "DEBUG"}) the log level until restart
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var reqBody struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+			writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+			return
+		}
+		level, ok := parseLogLevel(reqBody.Level)
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "level must be DEBUG, INFO, WARN or ERROR")
+			return
+		}
+		previous := logLevel.Level()
+		logLevel.Set(level)
+		// Logged at WARN so the change is visible whatever the new level
+		logger.Warn("Log level changed", "from", previous.String(), "to", level.String())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+		return
+	}
+
+	respBytes, _ := json.Marshal(map[string]string{
+		"level":      logLevel.Level().String(),
+		"configured": slog.Level(atomic.LoadInt64(&configuredLogRank)).String(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,162 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Log outputs (LOG_OUTPUT) ---
+
+var (
+	logOutput io.Writer     // Current sink of the logger
+	logFile   *rotatingFile // Set when LOG_OUTPUT=file, reopened on SIGHUP
+)
+
+// openLogOutput returns the sink selected by LOG_OUTPUT: stdout, a rotated file or syslog
+func openLogOutput() (io.Writer, error) {
+	switch strings.ToLower(getEnv("LOG_OUTPUT", "stdout")) {
+	case "file":
+		maxAge := time.Duration(getEnvInt("LOG_FILE_MAX_AGE_HOURS", 0)) * time.Hour
+		maxSize := getEnvInt("LOG_FILE_MAX_SIZE_MB", DefaultLogFileSizeMB) * 1024 * 1024
+		return newRotatingFile(getEnv("LOG_FILE", DefaultLogFile), maxSize, maxAge, int(getEnvInt("LOG_FILE_BACKUPS", DefaultLogFileBackups)))
+	case "syslog", "journald":
+		// An empty address is the local syslog socket, also read by journald
+		network, addr := "", getEnv("LOG_SYSLOG_ADDR", "")
+		if addr != "" {
+			network = "udp"
+			if n, a, ok := strings.Cut(addr, "://"); ok {
+				network, addr = n, a
+			}
+		}
+		return syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_MAIL, getEnv("LOG_SYSLOG_TAG", "mailuminati-guardian"))
+	case "stdout", "":
+		return os.Stdout, nil
+	default:
+		return os.Stdout, fmt.Errorf("unknown LOG_OUTPUT %q", getEnv("LOG_OUTPUT", ""))
+	}
+}
+
+// reopenLogFile lets external tools (logrotate...) move the log file away before a SIGHUP
+func reopenLogFile() {
+	if logFile == nil {
+		return
+	}
+	if err := logFile.Reopen(); err != nil {
+		logger.Error("Failed to reopen log file", "path", logFile.path, "error", err)
+	}
+}
+
+// rotatingFile is an append-only log file rotated by size and age.
+// Rotated files are kept as path.1 (newest) to path.N.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64         // 0 = no size limit
+	maxAge  time.Duration // 0 = no age limit
+	backups int           // Rotated files kept (0 = none)
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, backups: max(backups, 0)}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && f.size > 0 && time.Since(f.opened) > f.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.1..path.N-1 by one, moves the current file to path.1 and starts a new one
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	if f.backups == 0 {
+		os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+// Reopen closes and reopens the file at its path
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
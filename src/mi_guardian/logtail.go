@@ -0,0 +1,269 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --- Learning from MTA logs ---
+//
+// Sites that cannot make their webmail or MUA call /report can still learn from
+// what users and filters already log: LOG_TAIL_FILES are followed like tail -F, and
+// lines matching LOG_TAIL_SPAM_PATTERN or LOG_TAIL_HAM_PATTERN become local spam or
+// ham reports. Patterns name the message with a (?P<msgid>...) group, or with a
+// (?P<qid>...) queue ID resolved through the Postfix cleanup lines matched by
+// LOG_TAIL_MSGID_PATTERN. Nothing is sent to the Oracle.
+
+const (
+	DefaultLogTailMsgIDPattern = `\b(?P<qid>[0-9A-Za-z]+): message-id=(?P<msgid>\S+)`
+	LogTailReporter            = "logtail" // Reporter of learning events, for trust and provenance
+)
+
+// logQueueIDs maps Postfix queue IDs to the Message-ID logged by cleanup
+var logQueueIDs = newLRUCache[string]("log_queue_ids", 10000)
+
+// tailedFile follows one log file across rotations
+type tailedFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	partial string
+}
+
+// logTailRules are the compiled patterns of the tailer
+type logTailRules struct {
+	source string // Patterns compiled, to recompile after a reload
+	spam   *regexp.Regexp
+	ham    *regexp.Regexp
+	msgID  *regexp.Regexp
+}
+
+// logTailRulesSource returns the configured patterns
+func logTailRulesSource() string {
+	return getEnv("LOG_TAIL_SPAM_PATTERN", "") + "\n" + getEnv("LOG_TAIL_HAM_PATTERN", "") + "\n" +
+		getEnv("LOG_TAIL_MSGID_PATTERN", DefaultLogTailMsgIDPattern)
+}
+
+// compileLogTailRules compiles the configured patterns. Invalid ones are logged and
+// disabled.
+func compileLogTailRules() logTailRules {
+	compile := func(setting, fallback string) *regexp.Regexp {
+		pattern := getEnv(setting, fallback)
+		if pattern == "" {
+			return nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			logger.Warn("Invalid log tail pattern, ignored", "setting", setting, "error", err)
+			return nil
+		}
+		if re.SubexpIndex("msgid") < 0 && re.SubexpIndex("qid") < 0 {
+			logger.Warn("Log tail pattern needs a msgid or qid group, ignored", "setting", setting)
+			return nil
+		}
+		return re
+	}
+	return logTailRules{
+		source: logTailRulesSource(),
+		spam:   compile("LOG_TAIL_SPAM_PATTERN", ""),
+		ham:    compile("LOG_TAIL_HAM_PATTERN", ""),
+		msgID:  compile("LOG_TAIL_MSGID_PATTERN", DefaultLogTailMsgIDPattern),
+	}
+}
+
+// logTailFiles returns the files to follow
+func logTailFiles() []string {
+	var paths []string
+	for _, path := range strings.Split(getEnv("LOG_TAIL_FILES", ""), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// submatch returns the named group of a match, or ""
+func submatch(re *regexp.Regexp, match []string, name string) string {
+	if i := re.SubexpIndex(name); i >= 0 && i < len(match) {
+		return match[i]
+	}
+	return ""
+}
+
+// messageOfLine returns the Message-ID a rule names in a line, or ""
+func messageOfLine(re *regexp.Regexp, line string) string {
+	match := re.FindStringSubmatch(line)
+	if match == nil {
+		return ""
+	}
+	if id := submatch(re, match, "msgid"); id != "" {
+		return id
+	}
+	if qid := submatch(re, match, "qid"); qid != "" {
+		id, _ := logQueueIDs.Get(qid)
+		return id
+	}
+	return ""
+}
+
+// handleLogLine records the queue IDs of cleanup lines and turns the lines matching
+// a rule into a learning event
+func handleLogLine(rules logTailRules, line string) {
+	if rules.msgID != nil {
+		if match := rules.msgID.FindStringSubmatch(line); match != nil {
+			if qid, id := submatch(rules.msgID, match, "qid"), submatch(rules.msgID, match, "msgid"); qid != "" && id != "" {
+				logQueueIDs.Set(qid, id, time.Hour)
+			}
+		}
+	}
+	for reportType, re := range map[string]*regexp.Regexp{"spam": rules.spam, "ham": rules.ham} {
+		if re == nil {
+			continue
+		}
+		if id := messageOfLine(re, line); id != "" {
+			learnFromLog(id, reportType)
+		}
+	}
+}
+
+// learnFromLog applies a spam or ham report from the logs to the local store. Like
+// /report, a message is learned once per report type.
+func learnFromLog(messageID, reportType string) {
+	messageID = normalizeMessageID(messageID)
+	sha1Hash := messageIDHash(messageID)
+	if added, err := rdb.SetNX(ctx, "mi:rpt:"+sha1Hash+":"+reportType, "1", 24*time.Hour).Result(); err != nil || !added {
+		return
+	}
+	scanData, err := loadScanResult("mi:msgid:" + sha1Hash)
+	if err != nil || len(scanData.Hashes) == 0 {
+		// Not scanned by this Guardian, or scan data expired
+		promLogTailEvents.WithLabelValues(reportType, "unknown").Inc()
+		return
+	}
+	if reportType == "ham" && scanData.Label == "local_spam" {
+		recordAdaptiveSample(scanData.Tenant, "ham")
+	}
+	scanData.Hashes = dedupeSignatures(scanData.Hashes)
+	learnFromReport(scanData, reportType, LogTailReporter, messageID)
+	promLogTailEvents.WithLabelValues(reportType, "learned").Inc()
+}
+
+// open (re)opens the file. atEnd skips what it already holds, for the first open.
+func (t *tailedFile) open(atEnd bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if atEnd {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	t.close()
+	t.file, t.info, t.reader = f, info, bufio.NewReader(f)
+	return nil
+}
+
+func (t *tailedFile) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	t.partial = ""
+}
+
+// poll reads the lines appended since the last poll, then follows a rotation
+// (new file at the path) or a truncation from its start
+func (t *tailedFile) poll(rules logTailRules) {
+	if t.file == nil {
+		if err := t.open(true); err != nil {
+			return
+		}
+	}
+	t.readLines(rules)
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		// Rotated away, the new file is not there yet
+		return
+	}
+	pos, _ := t.file.Seek(0, io.SeekCurrent)
+	if !os.SameFile(info, t.info) || info.Size() < pos {
+		if err := t.open(false); err == nil {
+			t.readLines(rules)
+		}
+	}
+}
+
+func (t *tailedFile) readLines(rules logTailRules) {
+	for {
+		chunk, err := t.reader.ReadString('\n')
+		if err != nil {
+			// Incomplete last line, completed by the next poll
+			t.partial += chunk
+			return
+		}
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		t.partial = ""
+		handleLogLine(rules, line)
+	}
+}
+
+func logTailWorker() {
+	files := make(map[string]*tailedFile)
+	var rules logTailRules
+	for {
+		paths := logTailFiles()
+		// Follow the reloaded configuration
+		for path, t := range files {
+			if !slices.Contains(paths, path) {
+				t.close()
+				delete(files, path)
+			}
+		}
+		if len(paths) == 0 {
+			time.Sleep(1 * time.Minute)
+			continue
+		}
+		if logTailRulesSource() != rules.source {
+			rules = compileLogTailRules()
+		}
+		for _, path := range paths {
+			t, ok := files[path]
+			if !ok {
+				t = &tailedFile{path: path}
+				files[path] = t
+				logger.Info("Following log file", "path", path)
+			}
+			t.poll(rules)
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
@@ -0,0 +1,240 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync/atomic"
+)
+
+// --- Signature lookups ---
+
+// signatureLookup is what the collision search needs besides the signatures: the
+// context /analyze (or /v1/verdict) derived from the message
+type signatureLookup struct {
+	Signatures    []string
+	Kinds         map[string]string // attachment or image signatures, learned with their own threshold
+	Digests       []string          // SHA-256 of the attachments, for the blocklists
+	BlockedName   string            // attachment name matched by FILENAME_BLOCK
+	BlockedDomain string            // sender or link domain in a domain blocklist
+	BlockedList   string            // domain blocklist of BlockedDomain: sender or url
+	TrustedSender string            // TRUSTED_DKIM_DOMAINS domain signing the message
+	Profile       thresholdProfile
+	Shadow        *thresholdProfile
+	Tenant        string
+	Subject       string
+	MessageID     string
+	Log           *slog.Logger
+	Trail         *decisionTrail
+	SkipOracle    bool // no Oracle queries
+	LocalOnly     bool // no Oracle cache lookups either
+}
+
+// lookupSignatures runs the collision search: kill switch and blocklists, then for
+// each signature the Oracle cache, the local store and the Oracle bands. It returns
+// the verdict, the signature it was reached on, and whether some signature shared
+// bands with a known hash.
+func lookupSignatures(lk signatureLookup) (res AnalysisResult, matchedSig string, matched bool) {
+	res = AnalysisResult{Action: "allow", ProximityMatch: false}
+	if sig, blocked, dist := killSwitchMatch(lk.Signatures); sig != "" {
+		// Emergency block set by an admin: wins over every other step
+		lk.Log.Info("Kill switch match", "hash", blocked, "distance", dist, "subject", lk.Subject)
+		lk.Trail.note("kill_switch", "signature", sig, "blocked_hash", blocked, "distance", dist)
+		matchedSig = sig
+		res = AnalysisResult{Action: "spam", Label: "kill_switch", ProximityMatch: true, Distance: dist}
+		atomic.AddInt64(&localSpamCount, 1)
+		promLocalMatch.WithLabelValues(lk.Tenant).Inc()
+		return
+	}
+	if digest, list := blockedDigest(lk.Digests); digest != "" {
+		// Known malicious file: no similarity search needed
+		lk.Log.Info("Blocked attachment", "sha256", digest, "list", list, "subject", lk.Subject)
+		lk.Trail.note("blocked_attachment", "sha256", digest, "list", list)
+		res = AnalysisResult{Action: "spam", Label: "blocked_attachment"}
+		atomic.AddInt64(&localSpamCount, 1)
+		promLocalMatch.WithLabelValues(lk.Tenant).Inc()
+		return
+	}
+	if lk.BlockedName != "" {
+		lk.Log.Info("Blocked attachment name", "filename", lk.BlockedName, "subject", lk.Subject)
+		lk.Trail.note("blocked_filename")
+		res = AnalysisResult{Action: "spam", Label: "blocked_filename"}
+		atomic.AddInt64(&localSpamCount, 1)
+		promLocalMatch.WithLabelValues(lk.Tenant).Inc()
+		return
+	}
+	if lk.BlockedDomain != "" {
+		lk.Log.Info("Blocked domain", "domain", lk.BlockedDomain, "list", lk.BlockedList, "subject", lk.Subject)
+		lk.Trail.note("blocked_"+lk.BlockedList, "domain", lk.BlockedDomain)
+		res = AnalysisResult{Action: "spam", Label: "blocked_" + lk.BlockedList}
+		atomic.AddInt64(&localSpamCount, 1)
+		promLocalMatch.WithLabelValues(lk.Tenant).Inc()
+		return
+	}
+	if lk.TrustedSender != "" {
+		// Hashes are still computed and stored, for stats and reports
+		lk.Log.Debug("Trusted DKIM sender, skipping lookups", "domain", lk.TrustedSender)
+		lk.Trail.note("trusted_sender", "domain", lk.TrustedSender)
+		res.Label = "trusted_sender"
+		return
+	}
+	for _, sig := range lk.Signatures {
+		matchedSig = sig
+		bands := extractBands_6_3(sig)
+
+		// Oracle cache lookups, skipped for local_only requests
+		if !lk.LocalOnly {
+			// Step 1: Check oracle decision cache
+			cacheKey := OracleDecisionPrefix + sig
+			if cached, err := getOracleDecision(cacheKey); err == nil {
+				var cachedRes AnalysisResult
+				if json.Unmarshal([]byte(cached), &cachedRes) == nil && cachedRes.Action == "spam" {
+					res = cachedRes
+					lk.Trail.note("oracle_cache", "signature", sig, "label", res.Label)
+					atomic.AddInt64(&cachedPositiveCount, 1)
+					promCacheHits.WithLabelValues("positive").Inc()
+					return
+				}
+			}
+
+			// Step 1.5: Oracle Cache Proximity Lookup (Spam variations from recent queries)
+			oracleCacheBandsKeys := []string{}
+			ocKeys := make([]string, 0, len(bands))
+			for _, b := range bands {
+				ocKeys = append(ocKeys, OracleCacheFragPrefix+b)
+			}
+			for key, exists := range bandsExist(ocKeys) {
+				if exists {
+					oracleCacheBandsKeys = append(oracleCacheBandsKeys, key)
+				}
+			}
+
+			if len(oracleCacheBandsKeys) >= 4 {
+				ocHashes := bandMembers(OracleCacheFragPrefix, oracleCacheBandsKeys)
+				if len(ocHashes) > 0 {
+					distances, err := computeDistanceBatch(sig, ocHashes, ocHashes, false)
+					if err == nil {
+						for hash, dist := range distances {
+							if dist <= ProximityDistance {
+								lk.Log.Info("Oracle Cache Proximity Match", "match_hash", hash, "distance", dist, "subject", lk.Subject, "message_id", lk.MessageID)
+								lk.Trail.note("oracle_cache_proximity", "signature", sig, "match_hash", hash, "distance", dist, "bands", len(oracleCacheBandsKeys))
+								res = AnalysisResult{Action: "spam", Label: "oracle_cache_match", ProximityMatch: true, Distance: dist}
+								atomic.AddInt64(&cachedPositiveCount, 1)
+								promCacheHits.WithLabelValues("positive").Inc()
+								return
+							}
+						}
+					}
+				}
+			}
+		}
+
+		// Step 2: Local learning lookup
+		localMatchBandsKeys := []string{}
+		localKeys := make([]string, 0, len(bands))
+		for _, b := range bands {
+			localKeys = append(localKeys, LocalFragPrefix+b)
+		}
+		for key, exists := range bandsExist(localKeys) {
+			if exists {
+				localMatchBandsKeys = append(localMatchBandsKeys, key)
+			}
+		}
+
+		if len(localMatchBandsKeys) >= 4 {
+			refreshBandTTLs(localMatchBandsKeys, localRetentionDuration)
+
+			localHashes := bandMembers(LocalFragPrefix, localMatchBandsKeys)
+			if len(localHashes) > 0 {
+				distances, err := computeDistanceBatch(sig, localHashes, localHashes, false)
+				if err == nil {
+					candidates := loadLocalCandidates(distances)
+					profile := lk.Profile.forKind(lk.Kinds[sig])
+					match, isLocalSpam := profile.match(candidates)
+					if len(candidates) > 0 {
+						matched = true
+						best := candidates[0]
+						if isLocalSpam {
+							markSeen(match.Hash, true)
+						} else {
+							markSeen(best.Hash, true)
+						}
+						lk.Trail.note("local_lookup", "signature", sig, "bands", len(localMatchBandsKeys), "candidates", len(candidates),
+							"best_hash", best.Hash, "best_score", best.Score, "best_distance", best.Distance, "spam", best.Spam, "ham", best.Ham, "match", isLocalSpam)
+					} else {
+						lk.Trail.note("local_lookup", "signature", sig, "bands", len(localMatchBandsKeys), "candidates", 0)
+					}
+					if lk.Shadow != nil {
+						// Canary experiment: count both verdicts, log when they disagree
+						_, shadowSpam := lk.Shadow.forKind(lk.Kinds[sig]).match(candidates)
+						recordProfileVerdict(lk.Profile, true, isLocalSpam)
+						recordProfileVerdict(*lk.Shadow, false, shadowSpam)
+						if shadowSpam != isLocalSpam {
+							lk.Log.Info("Canary verdict differs", "enforced_profile", lk.Profile.Name, "enforced_spam", isLocalSpam,
+								"shadow_profile", lk.Shadow.Name, "shadow_spam", shadowSpam, "subject", lk.Subject)
+						}
+					}
+					if isLocalSpam {
+						lk.Log.Info("Local spam detected", "match_hash", match.Hash, "score", match.Score, "profile", lk.Profile.Name, "kind", lk.Kinds[sig], "subject", lk.Subject, "message_id", lk.MessageID)
+						res = AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, Distance: match.Distance}
+						atomic.AddInt64(&localSpamCount, 1)
+						promLocalMatch.WithLabelValues(lk.Tenant).Inc()
+						return
+					}
+				}
+			}
+			// If we reach here, distances were > ProximityDistance
+			res.ProximityMatch = true
+			continue
+		}
+
+		// Step 3: Band-based collision search (Oracle LSH), unless the caller skips the Oracle
+		if lk.SkipOracle {
+			continue
+		}
+		matchCount := 0
+		oracleKeys := make([]string, 0, len(bands))
+		for _, b := range bands {
+			oracleKeys = append(oracleKeys, FragKeyPrefix+b)
+		}
+		for _, exists := range bandsExist(oracleKeys) {
+			if exists {
+				matchCount++
+			}
+		}
+
+		if matchCount >= 4 {
+			matched = true
+			oracleVerdict := callOracleDecision(sig)
+			lk.Trail.note("oracle_query", "signature", sig, "bands", matchCount, "action", oracleVerdict.Action, "label", oracleVerdict.Label, "distance", oracleVerdict.Distance)
+			if oracleVerdict.Action == "spam" {
+				lk.Log.Info("Oracle spam detected", "signature", sig, "subject", lk.Subject, "message_id", lk.MessageID)
+				res = oracleVerdict
+				atomic.AddInt64(&spamConfirmedCount, 1)
+				promOracleMatch.WithLabelValues("complete", lk.Tenant).Inc()
+				return
+			} else {
+				lk.Log.Info("Oracle partial match", "signature", sig, "subject", lk.Subject, "message_id", lk.MessageID)
+				res.ProximityMatch = true
+				atomic.AddInt64(&partialMatchCount, 1)
+				promOracleMatch.WithLabelValues("partial", lk.Tenant).Inc()
+			}
+		}
+	}
+	return
+
+}
@@ -13,9 +13,10 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
@@ -31,14 +32,25 @@ import (
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"mailuminati-guardian/internal/store"
 )
 
 func init() {
-	prometheus.MustRegister(promScanned, promLocalMatch, promOracleMatch, promCacheHits)
+	prometheus.MustRegister(promScanned, promLocalMatch, promOracleMatch, promCacheHits, promMemoryCache, promProfileVerdicts, promSignals)
+	prometheus.MustRegister(promSyncBands, promSyncResponses, promSyncSeq, promSyncLastSuccess)
+	prometheus.MustRegister(promScanStore, promStreamDropped, promImageThrottled, promAnalyzeDedup, promMimeLimits, promDistancePrefiltered, promHotBands, promBandTTLRefresh, promBandsTrimmed, promAuditOrphans, promVerdictCache, promACLDenied, promOracleOutage, promOracleCacheExtended, promUpdateAvailable, promUpdateCheck, promClassifier, promLogTailEvents, promQuarantine, promTarpit, promTarpitSeconds, promImageGuard, promImageGuardTrips, promImageRawHashed, promFaultsInjected, promPrecheck, promAnalyzeDuration, promAsyncQueue, promPropagation, promGossip, promCalibrationDistance, promCalibrationRisk, promMaintenanceDeferred)
 }
 
-func main() {
+// Main runs the Guardian daemon (or the -migrate and -bench modes) according to
+// the command line flags, and only returns when it exits
+func Main() {
 	configPath := flag.String("config", "/etc/mailuminati-guardian/guardian.conf", "Path to configuration file")
+	migrate := flag.Bool("migrate", false, "Run Redis keyspace migrations and exit")
+	dryRun := flag.Bool("dry-run", false, "With -migrate, report changes without applying them")
+	benchDir := flag.String("bench", "", "Replay the messages of this directory through the analysis pipeline, report throughput and exit")
+	benchIterations := flag.Int("bench-iterations", 3, "With -bench, passes over the corpus")
+	benchCPUProfile := flag.String("bench-cpuprofile", "", "With -bench, write a CPU profile to this file")
+	benchMemProfile := flag.String("bench-memprofile", "", "With -bench, write a heap profile to this file")
 	flag.Parse()
 
 	// Initialize Logger
@@ -48,6 +60,8 @@ func main() {
 	if err := loadConfigFile(*configPath); err != nil {
 		logger.Warn("Config file error (using defaults/env)", "error", err)
 	}
+	// Logging settings may come from the config file (LOG_OUTPUT...)
+	initLogger()
 
 	// Configuration
 	oracleURL = getEnv("ORACLE_URL", DefaultOracle)
@@ -56,14 +70,30 @@ func main() {
 	redisPort := getEnv("REDIS_PORT", "6379")
 	redisAddr := fmt.Sprintf("%s:%s", redisHost, redisPort)
 
+	// Previous storage keys are only kept on reload: there are none at startup
+	if err := loadStorageKeys(); err != nil {
+		logger.Error("Invalid storage key", "error", err)
+		os.Exit(1)
+	}
+
 	// Load weights & retention
 	refreshLogicConfig()
 
+	// Benchmark mode: in-process only, no Redis needed
+	if *benchDir != "" {
+		if err := benchMain(*benchDir, *benchIterations, *benchCPUProfile, *benchMemProfile); err != nil {
+			logger.Error("Benchmark failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Signal handling for Reload (SIGHUP)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 	go func() {
 		for range c {
+			reopenLogFile()
 			logger.Info("Received SIGHUP, reloading configuration...")
 			if err := loadConfigFile(*configPath); err != nil {
 				logger.Error("Error reloading config", "error", err)
@@ -77,37 +107,161 @@ func main() {
 		}
 	}()
 
-	rdb = redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
+	// SIGUSR1 toggles DEBUG logging, e.g. during an incident
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			level := toggleDebug()
+			logger.Warn("Received SIGUSR1, log level changed", "level", level.String())
+		}
+	}()
+
+	// Hooks are added to the client itself: Store does not expose them
+	var client *redis.Client
+	if strings.ToLower(getEnv("REDIS_MODE", "server")) == "memory" {
+		var err error
+		if _, client, err = store.NewMemory(); err != nil {
+			logger.Error("Critical in-memory store error", "error", err)
+			os.Exit(1)
+		}
+		logger.Warn("In-memory store enabled: learned data is lost on restart, for evaluation only")
+	} else {
+		client = redis.NewClient(&redis.Options{
+			Addr: redisAddr,
+		})
+	}
+	rdb = client
 
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		logger.Error("Critical Redis error", "error", err)
 		os.Exit(1)
 	}
 
+	// Optional secondary Redis: dual-write and read-through while migrating instances
+	if secondaryHost := getEnv("REDIS_SECONDARY_HOST", ""); secondaryHost != "" {
+		secondaryAddr := fmt.Sprintf("%s:%s", secondaryHost, getEnv("REDIS_SECONDARY_PORT", "6379"))
+		secondary := redis.NewClient(&redis.Options{
+			Addr: secondaryAddr,
+		})
+		if err := secondary.Ping(ctx).Err(); err != nil {
+			logger.Warn("Secondary Redis unreachable, dual-write disabled", "address", secondaryAddr, "error", err)
+		} else {
+			client.AddHook(store.NewMirrorHook(secondary, logger))
+			logger.Info("Secondary Redis enabled (dual-write, read-through)", "address", secondaryAddr)
+		}
+	}
+
+	// Optional Redis shared with the other nodes, to propagate reports
+	connectPropagation()
+
+	// Failure injection for resilience tests (FAULT_INJECTION=true only)
+	enableFaultInjection(client)
+
+	if *migrate {
+		report, err := runMigrations(*dryRun)
+		if err != nil {
+			logger.Error("Keyspace migration failed", "error", err, "renamed", report.RenamedKeys, "merged", report.MergedKeys,
+				"converted", report.ConvertedKeys)
+			os.Exit(1)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	// Repair node ID / sequence / index mismatches (e.g. partial backup restore)
+	verifyState()
+
 	nodeID = initNode()
-	logger.Info("Engine started", "version", EngineVersion, "node_id", nodeID)
+	if err := initNodeKey(); err != nil {
+		logger.Error("Node key unavailable, Oracle requests will not be signed", "error", err)
+	}
+	logger.Info("Engine started", "version", EngineVersion, "node_id", nodeID, "public_key", nodePublicKey())
+	if keyspaceOutdated() {
+		logger.Warn("Redis keyspace predates this engine, run with -migrate or POST /admin/migrate",
+			"schema", currentKeyspaceVersion(), "band_geometry", BandGeometry)
+	}
 
-	// Workers
-	go syncWorker()
-	go statsWorker()
+	// Settings recommended by the Oracle at the last registration, until it answers again
+	loadStoredOracleSettings()
+	refreshLogicConfig()
+	warnDmarcWithoutAuthserv()
+
+	startWorkers()
+
+	// Flush counters on shutdown so lifetime totals survive restarts
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-stop
+		persistCounters()
+		logger.Info("Engine stopped")
+		os.Exit(0)
+	}()
 
 	// Endpoints
 	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/analyze", analyzeHandler)
+	http.HandleFunc("/analyze", coalescedAnalyzeHandler)
 	http.HandleFunc("/report", logRequestHandler(reportHandler))
 	http.HandleFunc("/status", logRequestHandler(statusHandler))
+	http.HandleFunc("/stats", logRequestHandler(statsHandler))
+	http.HandleFunc("/hash", logRequestHandler(hashHandler))
+	http.HandleFunc("/v1/verdict", logRequestHandler(verdictHandler))
+	http.HandleFunc("/precheck", logRequestHandler(precheckHandler))
+	http.HandleFunc("/enqueue", logRequestHandler(enqueueHandler))
+	http.HandleFunc("/gossip", logRequestHandler(gossipHandler))
+	http.HandleFunc("/match", logRequestHandler(matchHandler))
+	http.HandleFunc("/export/postfix-map", logRequestHandler(postfixMapHandler))
+	http.HandleFunc("/export/rspamd-map", logRequestHandler(rspamdMapHandler))
+
+	// Admin endpoints: on their own listener when ADMIN_PORT is set, so they can be firewalled apart
+	adminMux := http.NewServeMux()
+	registerAdminRoutes(adminMux)
+	if adminPort := getEnv("ADMIN_PORT", ""); adminPort != "" {
+		adminAddr := listenAddr(getEnv("ADMIN_BIND_ADDR", "127.0.0.1"), adminPort)
+		logger.Info("Admin API ready", "address", adminAddr)
+		go func() {
+			if err := http.ListenAndServe(adminAddr, connACL(adminMux)); err != nil {
+				logger.Error("Admin server failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	} else {
+		http.Handle("/admin/", adminMux)
+	}
+	if !adminTokensConfigured() {
+		logger.Warn("Admin API disabled until ADMIN_TOKEN or ADMIN_READ_TOKEN is set")
+	}
 
-	port := getEnv("PORT", "12421")
-	bindAddr := getEnv("GUARDIAN_BIND_ADDR", "127.0.0.1")
-	logger.Info("MTA bridge ready", "address", bindAddr, "port", port)
-	if err := http.ListenAndServe(bindAddr+":"+port, nil); err != nil {
+	if err := serveListeners(http.DefaultServeMux); err != nil {
 		logger.Error("Server failed", "error", err)
 		os.Exit(1)
 	}
 }
 
+// startWorkers starts the background tasks: Oracle registration and sync, stats,
+// counters, audits, queues and the optional features
+func startWorkers() {
+	go registrationWorker()
+	go syncWorker()
+	go statsWorker()
+	go counterPersistWorker()
+	go adaptiveWorker()
+	go textfileWorker()
+	go auditWorker()
+	go oracleOutageWorker()
+	go logTailWorker()
+	go imageGuardWorker()
+	go digestWorker()
+	go updateWorker()
+	go asyncQueueWorker()
+	go propagationWorker()
+	go gossipWorker()
+	go calibrationWorker()
+	go maintenanceWorker()
+}
+
 func refreshLogicConfig() {
 	// Load weights from env/config
 	swStr := getEnv("SPAM_WEIGHT", "1")
@@ -137,6 +291,9 @@ func refreshLogicConfig() {
 	}
 	atomic.StoreInt64(&localSpamThreshold, threshold)
 
+	// Relaxed threshold for mailing lists and trusted forwarders (never below SPAM_THRESHOLD)
+	atomic.StoreInt64(&listSpamThreshold, getEnvPositiveInt("LIST_SPAM_THRESHOLD", DefaultListThreshold))
+
 	// Load retention duration from env/config
 	retentionStr := getEnv("LOCAL_RETENTION_DAYS", strconv.Itoa(DefaultLocalRetention))
 	if days, err := strconv.Atoi(retentionStr); err == nil && days > 0 {
@@ -145,9 +302,148 @@ func refreshLogicConfig() {
 		localRetentionDuration = time.Duration(DefaultLocalRetention) * 24 * time.Hour
 	}
 
+	// Load retention of scan results (STORE_CLEAN_SCANS=false skips allowed messages without match)
+	atomic.StoreInt64(&scanRetentionDays, getEnvPositiveInt("SCAN_RETENTION_DAYS", DefaultScanRetention))
+	skipCleanScans.Store(strings.ToLower(getEnv("STORE_CLEAN_SCANS", "true")) == "false")
+
+	// Load limits of the MIME structure analyzed
+	loadMimeLimits()
+
+	// Load coalescing of identical analyses (ANALYZE_DEDUP_TTL=0 only shares in-flight runs)
+	analyzeDedupOff.Store(strings.ToLower(getEnv("ANALYZE_DEDUP", "true")) == "false")
+	atomic.StoreInt64(&analyzeDedupTTL, getEnvInt("ANALYZE_DEDUP_TTL", DefaultAnalyzeDedupTTL))
+
+	// Load the consistency audit interval (AUDIT_INTERVAL_HOURS=0 disables it)
+	atomic.StoreInt64(&auditIntervalHours, getEnvInt("AUDIT_INTERVAL_HOURS", DefaultAuditInterval))
+
+	// Load the Oracle outage delay (ORACLE_OUTAGE_SECONDS=0 never extends its cache)
+	atomic.StoreInt64(&oracleOutageSeconds, getEnvInt("ORACLE_OUTAGE_SECONDS", DefaultOracleOutage))
+
+	// Load the size limits of band sets
+	loadBandLimits()
+
+	// Load the TLSH distance implementation
+	loadDistanceBackend()
+
+	// Load the caching of Oracle allow decisions
+	atomic.StoreInt64(&oracleAllowTTL, getEnvPositiveInt("ORACLE_ALLOW_CACHE_TTL", DefaultOracleAllowTTL))
+	atomic.StoreInt64(&oracleAllowMaxHits, getEnvInt("ORACLE_ALLOW_MAX_HITS", DefaultOracleAllowHits))
+
+	// Load the hashing limits of large messages
+	loadSizeTiers()
+
+	// Load the learning weights and thresholds of attachments and images
+	loadKindWeights()
+
+	// Load the decay of the scores of hashes not seen lately
+	loadRecency()
+
+	// Load the ham sampling of the calibration baseline (HAM_SAMPLE_PERCENT=0 disables it)
+	loadCalibration()
+
+	// Load the maintenance windows of heavy background tasks
+	loadMaintenance()
+
+	// Load the verdict cache (VERDICT_CACHE_TTL=0 disables it)
+	atomic.StoreInt64(&verdictCacheTTL, getEnvInt("VERDICT_CACHE_TTL", DefaultVerdictCacheTTL))
+
+	// Load admin report multiplier
+	atomic.StoreInt64(&adminReportWeight, getEnvPositiveInt("ADMIN_REPORT_WEIGHT", DefaultAdminWeight))
+
+	// Load conflict margin for hashes with both spam and ham reports
+	atomic.StoreInt64(&conflictMargin, getEnvPositiveInt("CONFLICT_MARGIN", DefaultConflictMargin))
+
+	// Load worker intervals (STATS_INTERVAL=0 disables stats reports)
+	atomic.StoreInt64(&syncIntervalSeconds, max(getEnvPositiveInt("SYNC_INTERVAL", DefaultSyncInterval), MinSyncInterval))
+	atomic.StoreInt64(&statsIntervalSeconds, getEnvInt("STATS_INTERVAL", DefaultStatsInterval))
+	atomic.StoreInt64(&workerJitterPercent, min(getEnvInt("WORKER_JITTER_PERCENT", DefaultWorkerJitter), 50))
+
+	// Load attachment filename rules
+	loadFilenameRules()
+
+	// Load sampling of decision explanations (0 = never logged)
+	loadExplainConfig()
+
+	// Load Oracle payload encoding (json/cbor/auto) and compression (none/gzip/auto)
+	loadOracleWireConfig()
+
+	// Load adaptive threshold controller (ADAPTIVE_THRESHOLD=false disables it)
+	loadAdaptiveConfig()
+
+	// Load canary profile, applied to CANARY_PERCENT of messages (0 = unset, same as baseline)
+	percent := getEnvInt("CANARY_PERCENT", 0)
+	if percent > 100 {
+		percent = 100
+	}
+	atomic.StoreInt64(&canaryPercent, percent)
+	atomic.StoreInt64(&canarySpamThreshold, getEnvInt("CANARY_SPAM_THRESHOLD", 0))
+	atomic.StoreInt64(&canaryConflictMargin, getEnvInt("CANARY_CONFLICT_MARGIN", 0))
+	atomic.StoreInt64(&canarySpamWeight, getEnvInt("CANARY_SPAM_WEIGHT", 0))
+	atomic.StoreInt64(&canaryHamWeight, getEnvInt("CANARY_HAM_WEIGHT", 0))
+
+	// Load DMARC scrutiny of spoofed From-domains
+	atomic.StoreInt64(&dmarcSpoofMinMessages, getEnvPositiveInt("DMARC_SPOOF_MIN_MESSAGES", DefaultDmarcSpoofMin))
+	atomic.StoreInt64(&dmarcScrutinyDays, getEnvPositiveInt("DMARC_SCRUTINY_DAYS", DefaultDmarcScrutiny))
+	atomic.StoreInt64(&dmarcSpamThreshold, getEnvPositiveInt("DMARC_SPAM_THRESHOLD", DefaultDmarcThreshold))
+	dmarcRequireDkim.Store(strings.ToLower(getEnv("DMARC_REQUIRE_DKIM", "true")) == "true")
+
+	// Load MIME structure threshold (0 = fingerprints are learned but never acted upon)
+	atomic.StoreInt64(&structureSpamThreshold, getEnvInt("STRUCTURE_SPAM_THRESHOLD", DefaultStructureLimit))
+
+	// Load subject signature threshold (0 = subjects are learned but never acted upon)
+	atomic.StoreInt64(&subjectSpamThreshold, getEnvInt("SUBJECT_SPAM_THRESHOLD", DefaultSubjectLimit))
+
+	// Load mass calendar invite limit (0 disables)
+	atomic.StoreInt64(&calendarMaxAttendees, getEnvInt("CALENDAR_MAX_ATTENDEES", DefaultMaxAttendees))
+
+	// Load encrypted attachment score (0 = reported as a signal only)
+	atomic.StoreInt64(&encryptedAttachmentScore, getEnvInt("ENCRYPTED_ATTACHMENT_SCORE", 0))
+
+	// Load credential form score (0 = reported as a signal only)
+	atomic.StoreInt64(&credentialFormScore, getEnvInt("CREDENTIAL_FORM_SCORE", 0))
+
+	// Load text anomaly score (0 = reported as signals only)
+	atomic.StoreInt64(&textAnomalyScore, getEnvInt("TEXT_ANOMALY_SCORE", 0))
+
+	// Load Bayes model weight (0 = reported as a signal only)
+	atomic.StoreInt64(&bayesWeight, getEnvInt("BAYES_WEIGHT", 0))
+
+	// Load external classifier weight (0 = reported as a signal only)
+	atomic.StoreInt64(&classifierWeight, getEnvInt("CLASSIFIER_WEIGHT", 0))
+
+	// Load privacy controls (PRIVACY_MODE overrides TELEMETRY, LOG_MESSAGE_METADATA, ORACLE_HASH_ONLY)
+	loadPrivacyConfig()
+
+	// Load encryption keys of stored scan results (none = stored in clear)
+	if err := loadStorageKeys(); err != nil {
+		logger.Error("Invalid storage key, keeping previous keys", "error", err)
+	}
+
+	// Load the catalog of reasons returned for MUA banners
+	if err := loadReasonsCatalog(); err != nil {
+		logger.Error("Invalid reasons catalog, keeping previous one", "error", err)
+	}
+
+	// Load daily report quotas (0 = unlimited)
+	atomic.StoreInt64(&reportQuotaReporter, getEnvInt("REPORT_QUOTA_REPORTER", 0))
+	atomic.StoreInt64(&reportQuotaDomain, getEnvInt("REPORT_QUOTA_DOMAIN", 0))
+	atomic.StoreInt64(&reportQuotaGlobal, getEnvInt("REPORT_QUOTA_GLOBAL", 0))
+
+	// Load in-process cache config (MEMORY_CACHE_SIZE=0 disables it)
+	cacheSize := int(getEnvInt("MEMORY_CACHE_SIZE", DefaultMemoryCacheSize))
+	oracleDecisionCache.Resize(cacheSize)
+	bandExistsCache.Resize(cacheSize)
+	verdictCache.Resize(cacheSize)
+	atomic.StoreInt64(&memoryCacheTTLSeconds, getEnvInt("MEMORY_CACHE_TTL", DefaultMemoryCacheTTL))
+
 	// Load Image Analysis config
 	imgAnalysisStr := getEnv("MI_ENABLE_IMAGE_ANALYSIS", "true")
 	enableImageAnalysis = strings.ToLower(imgAnalysisStr) == "true"
+	atomic.StoreInt64(&maxExternalImages, getEnvPositiveInt("MI_MAX_EXTERNAL_IMAGES", DefaultMaxExternalImages))
+	atomic.StoreInt64(&imageConcurrency, getEnvPositiveInt("MI_IMAGE_CONCURRENCY", DefaultImageConcurrency))
+	atomic.StoreInt64(&imageFetchTimeout, getEnvPositiveInt("MI_IMAGE_TIMEOUT", DefaultImageTimeout))
+	atomic.StoreInt64(&imageHostRate, getEnvInt("MI_IMAGE_HOST_RATE", 0))
+	resizeFetchSlots(int(getEnvPositiveInt("MI_IMAGE_GLOBAL_CONCURRENCY", DefaultImageGlobalConcurrency)))
 }
 
 func initNode() string {
@@ -156,6 +452,7 @@ func initNode() string {
 		id = uuid.New().String()
 		rdb.Set(ctx, MetaNodeID, id, 0)
 		rdb.Set(ctx, MetaVer, 0, 0)
+		markKeyspaceCurrent()
 	}
 	return id
 }
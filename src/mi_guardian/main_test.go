@@ -13,24 +13,75 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/jhillyerd/enmime"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/websocket"
+	"mailuminati-guardian/internal/analyze"
+	"mailuminati-guardian/internal/oracle"
+	"mailuminati-guardian/internal/store"
 )
 
 func init() {
 	initLogger()
 }
 
+// TestMain runs the suite against an in-memory store instead of a live Redis
+func TestMain(m *testing.M) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "in-memory store:", err)
+		os.Exit(1)
+	}
+	rdb = client
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
 // TestComputeLocalTLSH checks that the generated hash is valid and properly formatted (T1 + Uppercase)
 func TestComputeLocalTLSH(t *testing.T) {
 	// TLSH requires a minimum amount of data (usually > 50 bytes)
@@ -39,7 +90,7 @@ func TestComputeLocalTLSH(t *testing.T) {
 		"Let's repeat the text to be sure we have enough material. " +
 		"This is a sufficiently long test text to generate a valid TLSH hash."
 
-	hash, err := computeLocalTLSH(input)
+	hash, err := analyze.TLSH(input)
 	if err != nil {
 		t.Fatalf("computeLocalTLSH returned an error: %v", err)
 	}
@@ -67,11 +118,11 @@ func TestComputeDistance(t *testing.T) {
 	longText1 := strings.Repeat(text1, 5)
 	longText2 := strings.Repeat(text2, 5)
 
-	h1, err := computeLocalTLSH(longText1)
+	h1, err := analyze.TLSH(longText1)
 	if err != nil {
 		t.Fatalf("Error generating h1: %v", err)
 	}
-	h2, err := computeLocalTLSH(longText2)
+	h2, err := analyze.TLSH(longText2)
 	if err != nil {
 		t.Fatalf("Error generating h2: %v", err)
 	}
@@ -98,13 +149,67 @@ func TestComputeDistance(t *testing.T) {
 	}
 }
 
+func TestDistanceBackendSelection(t *testing.T) {
+	var sigs []string
+	for i := 0; i < 2; i++ {
+		sig, err := analyze.TLSH(fmt.Sprintf("Offer %d: claim your reward at shop-%d.example before %d pm, %s", i, i%7, i%12, strings.Repeat("limited stock ", 10+i)))
+		if err != nil {
+			t.Fatalf("analyze.TLSH() error: %v", err)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	if useDistanceBackend("cosine") {
+		t.Error("useDistanceBackend() accepted an unknown backend")
+	}
+	distances, _ := computeDistanceBatch(sigs[1], []string{sigs[1], "bad"}, []string{"a", "b"}, false)
+	if len(distances) != 1 || distances["a"] != 0 {
+		t.Errorf("computeDistanceBatch() = %v, want only a at distance 0", distances)
+	}
+}
+
+func TestPrefilterCandidates(t *testing.T) {
+	// Lengths from a few hundred bytes to tens of kilobytes give distant length headers
+	var sigs []string
+	for i := 1; i <= 30; i++ {
+		sig, err := analyze.TLSH(strings.Repeat(fmt.Sprintf("Order %d shipped to warehouse %d. ", i, i*i), i*i*3))
+		if err != nil {
+			t.Fatalf("analyze.TLSH() error: %v", err)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	before := testutil.ToFloat64(promDistancePrefiltered)
+	kept, ids := prefilterCandidates(sigs[0], append(sigs, "bad"), append(sigs, "bad"), ProximityDistance)
+	if len(kept) != len(ids) || len(kept) == len(sigs)+1 {
+		t.Fatalf("prefilterCandidates() kept %d of %d candidates, want some dropped", len(kept), len(sigs)+1)
+	}
+	if kept[len(kept)-1] != "bad" {
+		t.Error("prefilterCandidates() should leave unparsable digests to the backend")
+	}
+	if dropped := testutil.ToFloat64(promDistancePrefiltered) - before; int(dropped) != len(sigs)+1-len(kept) {
+		t.Errorf("promDistancePrefiltered increased by %v, want %d", dropped, len(sigs)+1-len(kept))
+	}
+
+	// No candidate within ProximityDistance may be dropped
+	isKept := make(map[string]bool)
+	for _, k := range kept {
+		isKept[k] = true
+	}
+	for _, sig := range sigs {
+		if dist, _ := computeDistance(sigs[0], sig, true, 0); dist <= ProximityDistance && !isKept[sig] {
+			t.Errorf("prefilterCandidates() dropped a candidate at distance %d", dist)
+		}
+	}
+}
+
 // TestStableHash verifies that a specific text always produces the same hash
 func TestStableHash(t *testing.T) {
 	input := "This is a static text to verify that the TLSH hash generation is deterministic and stable across versions."
 	input = strings.Repeat(input, 10)
 	expectedHash := "T130111215FBC5E333C7858A138AB9223BF73E83F80320F876400D8442AA0B4E70376A94"
 
-	hash, err := computeLocalTLSH(input)
+	hash, err := analyze.TLSH(input)
 	if err != nil {
 		t.Fatalf("computeLocalTLSH error: %v", err)
 	}
@@ -195,14 +300,7 @@ func TestExtractBands(t *testing.T) {
 
 // TestStatusHandler checks the /status endpoint
 func TestStatusHandler(t *testing.T) {
-	// Initialize Redis client (even if connection fails, the client object is needed)
-	if rdb == nil {
-		rdb = redis.NewClient(&redis.Options{
-			Addr: "localhost:6379",
-		})
-	}
-
-	// Set a dummy nodeID to avoid initNode() trying to write to Redis if it's not available
+	// Set a known nodeID to find it in the response
 	originalNodeID := nodeID
 	nodeID = "test-node-id"
 	defer func() { nodeID = originalNodeID }()
@@ -217,25 +315,19 @@ func TestStatusHandler(t *testing.T) {
 
 	handler.ServeHTTP(rr, req)
 
-	// We expect 200 OK if Redis is up, or 503 Service Unavailable if Redis is down.
-	// Both mean the handler logic executed correctly up to the Redis call.
-	if status := rr.Code; status != http.StatusOK && status != http.StatusServiceUnavailable {
-		t.Errorf("handler returned wrong status code: got %v, want %v or %v",
-			status, http.StatusOK, http.StatusServiceUnavailable)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	// If we got 200 OK, check the body
-	if rr.Code == http.StatusOK {
-		expectedContentType := "application/json"
-		if contentType := rr.Header().Get("Content-Type"); contentType != expectedContentType {
-			t.Errorf("handler returned wrong content type: got %v, want %v",
-				contentType, expectedContentType)
-		}
+	expectedContentType := "application/json"
+	if contentType := rr.Header().Get("Content-Type"); contentType != expectedContentType {
+		t.Errorf("handler returned wrong content type: got %v, want %v",
+			contentType, expectedContentType)
+	}
 
-		body := rr.Body.String()
-		if !strings.Contains(body, "test-node-id") {
-			t.Errorf("handler returned unexpected body: got %v", body)
-		}
+	body := rr.Body.String()
+	if !strings.Contains(body, "test-node-id") {
+		t.Errorf("handler returned unexpected body: got %v", body)
 	}
 }
 
@@ -293,15 +385,6 @@ func TestAnalyzeHandler(t *testing.T) {
 	oracleURL = ts.URL
 	defer func() { oracleURL = originalOracleURL }()
 
-	// Save original Redis
-	originalRDB := rdb
-	// Use a failing redis client if not available, or assume main_test.go's init sets it up?
-	// The existing TestStatusHandler initializes rdb. We should do the same.
-	if rdb == nil {
-		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
-	}
-	defer func() { rdb = originalRDB }()
-
 	// 1. Test Method Not Allowed
 	req, _ := http.NewRequest("GET", "/analyze", nil)
 	rr := httptest.NewRecorder()
@@ -327,14 +410,7 @@ func TestAnalyzeHandler(t *testing.T) {
 	rr = httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
 
-	// Even if Redis fails (connection refused), the handler should probably return something or 500.
-	// In the code:
-	// ...
-	// pipe = rdb.Pipeline() ... pipe.Exec(ctx) -> this will error if redis is down.
-	// But the handler does not explicitly check all redis errors.
-	// If redis is down, `computeDistanceBatch` or others might simply be skipped or error out.
-
-	if status := rr.Code; status != http.StatusOK && status != http.StatusInternalServerError {
+	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("POST /analyze returned unexpected status: %d", status)
 	}
 }
@@ -348,9 +424,6 @@ func TestReportHandler(t *testing.T) {
 	oracleURL = ts.URL
 	defer func() { oracleURL = originalOracleURL }()
 
-	if rdb == nil {
-		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
-	}
 	// Need a nodeID
 	originalNodeID := nodeID
 	nodeID = "test-node-id"
@@ -373,18 +446,16 @@ func TestReportHandler(t *testing.T) {
 		t.Errorf("Invalid JSON should return 400")
 	}
 
-	// 3. Test Valid Report but missing local scan data (Redis miss)
+	// 3. Test Valid Report but missing local scan data
 	uniqueID := fmt.Sprintf("<missing-%d@test.com>", time.Now().UnixNano())
 	validJSON := fmt.Sprintf(`{"message-id": "%s", "report_type": "spam"}`, uniqueID)
 	req, _ = http.NewRequest("POST", "/report", strings.NewReader(validJSON))
 	rr = httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
 
-	// Without Redis or without previous scan key, it should probably return 404
-	// "No scan data found" -> 404
-	// Or 500 if redis connection fails.
-	if rr.Code != http.StatusNotFound && rr.Code != http.StatusInternalServerError {
-		t.Errorf("Report for missing message should return 404 or 500, got %d", rr.Code)
+	// No previous scan key: "No scan data found"
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Report for missing message should return 404, got %d", rr.Code)
 	}
 }
 
@@ -397,10 +468,6 @@ func TestDoSync(t *testing.T) {
 	oracleURL = ts.URL
 	defer func() { oracleURL = originalOracleURL }()
 
-	if rdb == nil {
-		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
-	}
-
 	// Simply call doSync and ensure it doesn't crash
 	doSync()
 }
@@ -442,9 +509,6 @@ func TestExtractImageURLs(t *testing.T) {
 // It uses a local test server to simulate the remote image hosting
 func TestFetchImageForAnalysis(t *testing.T) {
 	// Initialize rdb if nil to avoid panic on cache check
-	if rdb == nil {
-		rdb = redis.NewClient(&redis.Options{Addr: "localhost:6379"})
-	}
 
 	// Mock server returning a valid image (large enough)
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -459,15 +523,24 @@ func TestFetchImageForAnalysis(t *testing.T) {
 	}))
 	defer ts.Close()
 
+	configMutex.Lock()
+	configMap["MI_IMAGE_ALLOWED_NETS"] = "127.0.0.1"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "MI_IMAGE_ALLOWED_NETS")
+		configMutex.Unlock()
+	}()
+
 	// Use the test server URL which simulates "https://guardian.mailuminati.com/imgs/test1.png"
-	data, _, size, fromCache, err := fetchImageForAnalysis(ts.URL)
+	data, _, size, fromCache, err := fetchImageForAnalysis(context.Background(), ts.URL)
 
 	if err != nil {
 		t.Fatalf("Failed to fetch image: %v", err)
 	}
 
 	if fromCache {
-		t.Logf("Image returned from cache (Redis might be running)")
+		t.Errorf("Image returned from cache before it was hashed")
 	}
 
 	if size < 40*1024 {
@@ -478,3 +551,5474 @@ func TestFetchImageForAnalysis(t *testing.T) {
 		t.Errorf("Data buffer length %d != Reported size %d", len(data), size)
 	}
 }
+
+// TestOversizedImagesSkipped verifies that external images above MaxExternalImageSize
+// or declaring more than MaxImagePixels are skipped without failing the analysis
+func TestOversizedImagesSkipped(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	// A real image, smaller than the others: the only one left to hash
+	noise := image.NewGray(image.Rect(0, 0, 256, 256))
+	seed := uint32(2463534242)
+	for i := range noise.Pix {
+		seed ^= seed << 13
+		seed ^= seed >> 17
+		seed ^= seed << 5
+		noise.Pix[i] = uint8(seed)
+	}
+	var normal bytes.Buffer
+	if err := png.Encode(&normal, noise); err != nil {
+		t.Fatal(err)
+	}
+	if normal.Len() < MinExternalImageSize {
+		t.Fatalf("test image of %d bytes is below MinExternalImageSize", normal.Len())
+	}
+
+	// A small PNG whose header declares 20000x20000 pixels (decompression bomb)
+	var bomb bytes.Buffer
+	png.Encode(&bomb, image.NewGray(image.Rect(0, 0, 1, 1)))
+	header := bomb.Bytes()
+	binary.BigEndian.PutUint32(header[16:], 20000)
+	binary.BigEndian.PutUint32(header[20:], 20000)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	bombData := append(header, make([]byte, normal.Len()+1)...)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/normal.png":
+			w.Write(normal.Bytes())
+		case "/bomb.png":
+			w.Write(bombData)
+		case "/large.png":
+			w.Header().Set("Content-Length", strconv.Itoa(MaxExternalImageSize+1))
+			w.Write(make([]byte, MaxExternalImageSize+1))
+		case "/stream.png":
+			// No Content-Length: the limit applies while reading
+			w.(http.Flusher).Flush()
+			w.Write(make([]byte, MaxExternalImageSize+1))
+		}
+	}))
+	defer ts.Close()
+
+	configMutex.Lock()
+	configMap["MI_IMAGE_ALLOWED_NETS"] = "127.0.0.1"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "MI_IMAGE_ALLOWED_NETS")
+		configMutex.Unlock()
+	}()
+
+	for path, want := range map[string]error{"/large.png": errImageTooLarge, "/stream.png": errImageTooLarge, "/bomb.png": errImageTooManyPixels} {
+		if _, _, _, _, err := fetchImageForAnalysis(context.Background(), ts.URL+path); !errors.Is(err, want) {
+			t.Errorf("fetch %s: error = %v, want %v", path, err, want)
+		}
+	}
+	if _, err := normalizeImage(bombData); !errors.Is(err, errImageTooManyPixels) {
+		t.Errorf("normalizeImage() of the bomb: error = %v, want %v", err, errImageTooManyPixels)
+	}
+
+	// The analysis goes on with the image left
+	raw := "From: promo@sender.example\r\nTo: user@example.com\r\nSubject: Offer\r\nMessage-ID: <oversized-images@test>\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n\r\n" +
+		`<html><body><img src="` + ts.URL + `/large.png"><img src="` + ts.URL + `/bomb.png">` +
+		`<img src="` + ts.URL + `/stream.png"><img src="` + ts.URL + `/normal.png"></body></html>` + "\r\n"
+	req := httptest.NewRequest(http.MethodPost, "/analyze", nil)
+	a, err := analyzeMessage(req, []byte(raw))
+	if err != nil {
+		t.Fatalf("analyzeMessage() error: %v", err)
+	}
+	want, err := imageSignature(ts.URL+"/normal.png", normal.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var images []string
+	for _, sig := range a.Out.Signatures {
+		if a.Out.Kinds[sig] == KindImage {
+			images = append(images, sig)
+		}
+	}
+	if len(images) != 1 || images[0] != want {
+		t.Errorf("image signatures = %v, want [%s]", images, want)
+	}
+}
+
+// TestNormalizeImage verifies that the same visual encoded in different formats
+// normalizes to identical canonical grayscale pixels
+func TestNormalizeImage(t *testing.T) {
+	// Build a simple gradient using only palette colors so GIF encoding is lossless
+	img := image.NewPaletted(image.Rect(0, 0, 200, 120), palette.WebSafe)
+	for y := 0; y < 120; y++ {
+		for x := 0; x < 200; x++ {
+			img.SetColorIndex(x, y, uint8((x/20+y/20)%len(palette.WebSafe)))
+		}
+	}
+
+	var pngBuf, gifBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("png encode: %v", err)
+	}
+	// Animated GIF: only the first frame should be considered
+	black := image.NewPaletted(img.Bounds(), palette.WebSafe)
+	for i := range black.Pix {
+		black.Pix[i] = uint8(black.Palette.Index(color.Black))
+	}
+	anim := &gif.GIF{Image: []*image.Paletted{img, black}, Delay: []int{10, 10}}
+	if err := gif.EncodeAll(&gifBuf, anim); err != nil {
+		t.Fatalf("gif encode: %v", err)
+	}
+
+	fromPNG, err := normalizeImage(pngBuf.Bytes())
+	if err != nil {
+		t.Fatalf("normalizeImage(png) error: %v", err)
+	}
+	fromGIF, err := normalizeImage(gifBuf.Bytes())
+	if err != nil {
+		t.Fatalf("normalizeImage(gif) error: %v", err)
+	}
+
+	if len(fromPNG) != ImageCanonicalSize*ImageCanonicalSize {
+		t.Errorf("Expected %d normalized bytes, got %d", ImageCanonicalSize*ImageCanonicalSize, len(fromPNG))
+	}
+	if !bytes.Equal(fromPNG, fromGIF) {
+		t.Errorf("PNG and GIF encodings of the same visual should normalize identically")
+	}
+
+	if _, err := normalizeImage([]byte("not an image")); err == nil {
+		t.Errorf("normalizeImage should fail on undecodable data")
+	}
+
+	// Animated WebP (lossless): a square moving right, then the same first frame as PNG
+	animated, _ := base64.StdEncoding.DecodeString(
+		"UklGRnYDAABXRUJQVlA4WAoAAAACAAAAHwAAHwAAQU5JTQYAAAD/////AABBTk1GoAEAAAAAAAAAAB8AAB8AAGQAAABWUDhMiAEA" +
+			"AC8fwAcATRAgkFwAAQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAMAgIj+1yDCeW7gQkCAaQQAAAAAAAAAAAAAAAAAADgA" +
+			"OAAAAAAAAAAAAAAAAAAAIHQyaQEMAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAACAAwAAAAAAAAAAAAAAAAAAAAABAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAgIgwQDCNP6CcLwAA4GIwlno4/IICjkE9" +
+			"DXp2AuEFOD7SItu+AR+OqfQQQU5NRqIBAAAAAAAAAAAfAAAfAABkAAAAVlA4TIoBAAAvH8AHAE0YIJjmG8AAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAACABwAAEf0vAX3PKXAhIMA0AgAAAAAAAAAAAAAAAAAABAAOAAAAAAAAAAAAAAAAAAA4OpnXAhgAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAHAAAA" +
+			"AAAAAAAAAAAAAAAAAA4AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" +
+			"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAIsIAwTTeAT3aAQDAFpOxtAIuF6jgGayCwn/mgWoBvI7VR9Se9INtuhoE")
+	first := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.NRGBA{255, 255, 255, 255}
+			if x >= 4 && x < 20 && y >= 4 && y < 20 {
+				c = color.NRGBA{0, 0, 0, 255}
+			}
+			if (x-7)*(x-7)+(y-26)*(y-26) < 16 {
+				c = color.NRGBA{120, 120, 120, 255}
+			}
+			first.Set(x, y, c)
+		}
+	}
+	pngBuf.Reset()
+	png.Encode(&pngBuf, first)
+	fromPNG, _ = normalizeImage(pngBuf.Bytes())
+	fromWebP, err := normalizeImage(animated)
+	if err != nil || !bytes.Equal(fromPNG, fromWebP) {
+		t.Errorf("normalizeImage(animated webp) = %v, want the pixels of its first frame", err)
+	}
+
+	// Undecodable images fall back to their raw bytes, and are counted
+	before := testutil.ToFloat64(promImageRawHashed)
+	imageSignature("https://img.example/a.webp", animated)
+	if got := testutil.ToFloat64(promImageRawHashed); got != before {
+		t.Errorf("animated webp hashed on its raw bytes")
+	}
+	imageSignature("https://img.example/b.bin", bytes.Repeat([]byte("not an image, "), 20))
+	if got := testutil.ToFloat64(promImageRawHashed); got != before+1 {
+		t.Errorf("image_raw_hashed_total = %v, want %v", got, before+1)
+	}
+}
+
+// TestClassifyTrustedSource checks mailing list and trusted forwarder detection
+func TestClassifyTrustedSource(t *testing.T) {
+	configMutex.Lock()
+	configMap["TRUSTED_FORWARDERS"] = "relay.example.org, 192.0.2.10"
+	configMap["AUTHSERV_ID"] = "mx.local"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "TRUSTED_FORWARDERS")
+		delete(configMap, "AUTHSERV_ID")
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name     string
+		headers  string
+		meta     EnvelopeMeta
+		expected string
+	}{
+		{
+			name: "Aligned mailing list",
+			headers: "List-Id: <news.lists.example.com>\r\n" +
+				"List-Unsubscribe: <mailto:leave@lists.example.com>, <https://lists.example.com/u>\r\n" +
+				"Authentication-Results: mx.local; dkim=pass header.d=example.com header.s=sel\r\n",
+			expected: SourceMailingList,
+		},
+		{
+			name: "List with unaligned DKIM",
+			headers: "List-Id: <news.lists.example.com>\r\n" +
+				"List-Unsubscribe: <https://tracker.example.net/u>\r\n" +
+				"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; b=abc\r\n",
+			expected: "",
+		},
+		{
+			name: "Failed DKIM ignores raw signature",
+			headers: "List-Id: <news.lists.example.com>\r\n" +
+				"List-Unsubscribe: <https://lists.example.com/u>\r\n" +
+				"Authentication-Results: mx.local; dkim=fail header.d=example.com\r\n" +
+				"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; b=abc\r\n",
+			expected: "",
+		},
+		{
+			name: "Unverified DKIM only",
+			headers: "List-Id: <news.lists.example.com>\r\n" +
+				"List-Unsubscribe: <https://lists.example.com/u>\r\n" +
+				"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; b=abc\r\n",
+			expected: "",
+		},
+		{
+			name:     "Trusted forwarder by host",
+			headers:  "Received: from helo.invalid (mx1.relay.example.org [198.51.100.4]) by mx.local\r\n",
+			meta:     EnvelopeMeta{ClientIP: "198.51.100.4"},
+			expected: SourceTrustedForwarder,
+		},
+		{
+			name:     "Trusted forwarder by IP",
+			meta:     EnvelopeMeta{ClientIP: "192.0.2.10"},
+			expected: SourceTrustedForwarder,
+		},
+		{
+			name:     "Forwarder HELO claimed by the client",
+			headers:  "Received: from mx1.relay.example.org (unknown [203.0.113.9]) by mx.local\r\n",
+			meta:     EnvelopeMeta{ClientIP: "203.0.113.9", Helo: "mx1.relay.example.org"},
+			expected: "",
+		},
+		{
+			name:     "Received hop of another client",
+			headers:  "Received: from mx1.relay.example.org (mx1.relay.example.org [198.51.100.4]) by mx.local\r\n",
+			meta:     EnvelopeMeta{ClientIP: "203.0.113.9"},
+			expected: "",
+		},
+		{
+			name: "Forwarder named below our hop",
+			headers: "Received: from mail.other.example (mail.other.example [203.0.113.9]) by mx.local\r\n" +
+				"Received: from mx1.relay.example.org (mx1.relay.example.org [192.0.2.10]) by mail.other.example\r\n",
+			meta:     EnvelopeMeta{ClientIP: "203.0.113.9"},
+			expected: "",
+		},
+		{
+			name:     "Received without client IP",
+			headers:  "Received: from mx1.relay.example.org (mx1.relay.example.org [198.51.100.4]) by mx.local\r\n",
+			expected: "",
+		},
+		{
+			name:     "Regular mail",
+			headers:  "Received: from mail.other.example (mail.other.example [203.0.113.9]) by mx.local\r\n",
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tt.headers + "Subject: Test\r\n\r\nBody\r\n"
+			env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+			if err != nil {
+				t.Fatalf("ReadEnvelope error: %v", err)
+			}
+			if got := classifyTrustedSource(env, tt.meta); got != tt.expected {
+				t.Errorf("classifyTrustedSource() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+// TestResolveConflictHandler checks request validation of the conflict resolution endpoint
+func TestResolveConflictHandler(t *testing.T) {
+	handler := http.HandlerFunc(resolveConflictHandler)
+
+	req, _ := http.NewRequest("GET", "/admin/conflicts/resolve", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET should return 405, got %d", rr.Code)
+	}
+
+	for _, body := range []string{`{invalid`, `{"verdict":"spam"}`, `{"hash":"T1ABC","verdict":"maybe"}`} {
+		req, _ = http.NewRequest("POST", "/admin/conflicts/resolve", strings.NewReader(body))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Body %s should return 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+// TestLRUCache checks eviction order, expiry and resizing of the in-process cache
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache[int]("test", 2)
+	c.Set("a", 1, time.Minute)
+	c.Set("b", 2, time.Minute)
+	c.Get("a") // "a" becomes most recently used
+	c.Set("c", 3, time.Minute)
+
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Least recently used entry should have been evicted")
+	}
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf("Expected a=1, got %v (found=%v)", v, ok)
+	}
+
+	c.Set("d", 4, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("Expired entry should not be returned")
+	}
+
+	c.Resize(0)
+	c.Set("e", 5, time.Minute)
+	if _, ok := c.Get("e"); ok {
+		t.Errorf("Cache with size 0 should be disabled")
+	}
+}
+
+// TestCounterDeltas checks that workers only ship the increase since their snapshot
+func TestCounterDeltas(t *testing.T) {
+	snapshot := make(map[string]int64)
+	for _, c := range statCounters {
+		snapshot[c.Name] = atomic.LoadInt64(c.Value)
+	}
+	if _, changed := counterDeltas(snapshot); changed {
+		t.Fatalf("No change expected right after snapshot")
+	}
+
+	atomic.AddInt64(&localSpamCount, 3)
+	deltas, changed := counterDeltas(snapshot)
+	if !changed || deltas["local_spam_count"] != 3 || deltas["scanned_count"] != 0 {
+		t.Errorf("Unexpected deltas: %v", deltas)
+	}
+}
+
+func TestThresholdProfile(t *testing.T) {
+	profile := thresholdProfile{Name: "canary", SpamThreshold: 2, ConflictMargin: 2}
+	candidates := []localCandidate{
+		{Hash: "conflicting", Score: 3, Spam: 4, Ham: 3},
+		{Hash: "learned", Score: 2, Spam: 2},
+		{Hash: "weak", Score: 1, Spam: 1},
+	}
+
+	match, ok := profile.match(candidates)
+	if !ok || match.Hash != "learned" {
+		t.Errorf("Expected 'learned' to match, got %q (ok=%v)", match.Hash, ok)
+	}
+	profile.SpamThreshold = 5
+	if _, ok := profile.match(candidates); ok {
+		t.Errorf("No candidate should reach threshold 5")
+	}
+
+	// Reports learned with weights 1/2, counted by the profile with spam weight 3
+	oldSpam, oldHam := atomic.SwapInt64(&spamWeight, 1), atomic.SwapInt64(&hamWeight, 2)
+	defer func() {
+		atomic.StoreInt64(&spamWeight, oldSpam)
+		atomic.StoreInt64(&hamWeight, oldHam)
+	}()
+	profile.SpamWeight, profile.HamWeight = 3, 2
+	match, ok = profile.match(candidates)
+	if !ok || match.Hash != "conflicting" || match.Score != 11 || match.Spam != 12 {
+		t.Errorf("match() with spam weight 3 = %+v (ok=%v), want 'conflicting' scored 11", match, ok)
+	}
+	profile.SpamWeight, profile.HamWeight = 1, 8
+	if _, ok := profile.match(candidates[:1]); ok {
+		t.Errorf("ham weight 8 should outweigh the spam reports of 'conflicting'")
+	}
+
+	atomic.StoreInt64(&canaryPercent, 0)
+	if inCanary("<id@example.com>") {
+		t.Errorf("Canary disabled, message must not be bucketed")
+	}
+	atomic.StoreInt64(&canaryPercent, 50)
+	defer atomic.StoreInt64(&canaryPercent, 0)
+	first := inCanary("<id@example.com>")
+	for i := 0; i < 10; i++ {
+		if inCanary("<id@example.com>") != first {
+			t.Fatalf("Bucketing must be stable for a Message-ID")
+		}
+	}
+}
+
+func TestReplayHandler(t *testing.T) {
+	handler := http.HandlerFunc(replayHandler)
+
+	req, _ := http.NewRequest("GET", "/admin/replay", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/replay returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/replay", strings.NewReader("{bad"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid JSON returned wrong status: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	atomic.StoreInt64(&canaryPercent, 0)
+	req, _ = http.NewRequest("POST", "/admin/replay?profile=canary", strings.NewReader(""))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Canary replay without canary returned wrong status: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSelftestHandler(t *testing.T) {
+	// It writes to Redis: admin only
+	mux := http.NewServeMux()
+	registerAdminRoutes(mux)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest("GET", "/admin/selftest", nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("GET /admin/selftest without ADMIN_TOKEN = %d, want 403", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	selftestHandler(rr, httptest.NewRequest("GET", "/admin/selftest", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("selftest status = %d, want 200: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", got)
+	}
+
+	var resp map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	if resp["status"] != "ok" || resp["action"] != "spam" || resp["label"] != "test" || resp["redis"] != "ok" {
+		t.Errorf("unexpected selftest response: %v", resp)
+	}
+	if hashes, _ := resp["hashes"].(float64); hashes < 1 {
+		t.Errorf("hashes = %v, want at least 1", resp["hashes"])
+	}
+	if _, ok := resp["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms missing: %v", resp)
+	}
+
+	// An unreachable store fails the self test
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	server.Close()
+
+	rr = httptest.NewRecorder()
+	selftestHandler(rr, httptest.NewRequest("GET", "/admin/selftest", nil))
+	resp = nil
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON response: %v", err)
+	}
+	if rr.Code != http.StatusServiceUnavailable || resp["status"] != "fail" || resp["redis"] == "ok" {
+		t.Errorf("selftest with Redis down = %d %v, want 503 and status fail", rr.Code, resp)
+	}
+}
+
+// oracleFunc is an in-process Oracle for embedded engines
+type oracleFunc func(*http.Request) (*http.Response, error)
+
+func (f oracleFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestEngine(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("memory store: %v", err)
+	}
+	defer server.Close()
+	oldRdb, oldOracleURL := rdb, oracleURL
+	defer func() {
+		rdb, oracleURL, oracleTransport = oldRdb, oldOracleURL, nil
+		engineCreated.Store(false)
+	}()
+
+	var paths []string
+	oracle := oracleFunc(func(r *http.Request) (*http.Response, error) {
+		paths = append(paths, r.URL.Path)
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/json")
+		rec.WriteString(`{"result": {"action": "allow"}}`)
+		return rec.Result(), nil
+	})
+
+	if _, err := NewEngine(Options{Oracle: oracle}); err == nil {
+		t.Error("NewEngine() without a Store succeeded")
+	}
+	configMutex.Lock()
+	configMap["STORAGE_KEY"] = "not-a-key"
+	configMutex.Unlock()
+	_, err = NewEngine(Options{Store: client, Oracle: oracle})
+	configMutex.Lock()
+	delete(configMap, "STORAGE_KEY")
+	configMutex.Unlock()
+	if err == nil {
+		t.Error("NewEngine() with an invalid STORAGE_KEY succeeded")
+	}
+	configMutex.Lock()
+	configMap["NODE_KEY_FILE"] = filepath.Join(t.TempDir(), "node.key")
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "NODE_KEY_FILE")
+		configMutex.Unlock()
+		setNodeKey(nil)
+	}()
+	engine, err := NewEngine(Options{Store: client, Oracle: oracle})
+	if err != nil {
+		t.Fatalf("NewEngine() = %v", err)
+	}
+	if _, err := NewEngine(Options{Store: client, Oracle: oracle}); err != errEngineRunning {
+		t.Errorf("second NewEngine() = %v, want %v", err, errEngineRunning)
+	}
+	localRetentionDuration = time.Hour
+
+	res, err := engine.Analyze(strings.NewReader(selftestMessage()))
+	if err != nil || res.Action != "spam" || res.Label != "test" {
+		t.Errorf("Analyze(test pattern) = %+v, %v", res, err)
+	}
+
+	msg := "From: a@sender.example\r\nTo: b@acme.com\r\nMessage-ID: <embedded@sender.example>\r\nSubject: Offer\r\n\r\n" +
+		strings.Repeat("Limited offer on premium watches, reply today to get your discount code. ", 6)
+	if res, err = engine.Analyze(strings.NewReader(msg)); err != nil || res.Action != "allow" {
+		t.Fatalf("Analyze() = %+v, %v", res, err)
+	}
+	// The scan is stored before Analyze returns
+	if client.Exists(ctx, "mi:msgid:"+messageIDHash("<embedded@sender.example>")).Val() != 1 {
+		t.Error("Scan result not stored when Analyze() returned")
+	}
+
+	summary, err := engine.Report("embedded@sender.example", "spam", "b@acme.com")
+	if err != nil || len(summary.Learned) == 0 || !summary.OracleNotified {
+		t.Errorf("Report() = %+v, %v", summary, err)
+	}
+	if !slices.Contains(paths, "/report") {
+		t.Errorf("Oracle requests = %v, want the report sent through the Oracle transport", paths)
+	}
+	if _, err := engine.Report("embedded@sender.example", "spam", "b@acme.com"); err != errDuplicateReport {
+		t.Errorf("duplicate Report() = %v, want %v", err, errDuplicateReport)
+	}
+	if _, err := engine.Report("unknown@sender.example", "spam", "b@acme.com"); err != errNoScanData {
+		t.Errorf("Report() of an unknown message = %v, want %v", err, errNoScanData)
+	}
+	if _, err := engine.Report("embedded@sender.example", "phishing", "b@acme.com"); err == nil {
+		t.Error("Report() accepted an unknown report type")
+	}
+}
+
+func TestMTAAction(t *testing.T) {
+	configMutex.Lock()
+	configMap["ACTION_SPAM"] = "quarantine"
+	configMap["ACTION_ORACLE_CACHE_MATCH"] = "reject 554 5.7.1 Message rejected as spam"
+	configMap["ACTION_SPAM_MULTI_RCPT"] = "tag"
+	configMap["MULTI_RCPT_MIN"] = "10"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ACTION_SPAM")
+		delete(configMap, "ACTION_ORACLE_CACHE_MATCH")
+		delete(configMap, "ACTION_SPAM_MULTI_RCPT")
+		delete(configMap, "MULTI_RCPT_MIN")
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		result     AnalysisResult
+		recipients int
+		action     string
+		response   string
+	}{
+		{AnalysisResult{Action: "spam", Label: "oracle_cache_match"}, 1, "reject", "554 5.7.1 Message rejected as spam"},
+		{AnalysisResult{Action: "spam", Label: "local_spam"}, 0, "quarantine", ""},
+		{AnalysisResult{Action: "allow"}, 1, "", ""},
+		// Many recipients: tagged instead of rejected
+		{AnalysisResult{Action: "spam", Label: "oracle_cache_match"}, 25, "tag", ""},
+		{AnalysisResult{Action: "allow"}, 25, "", ""},
+	}
+	for _, tt := range tests {
+		action, response := mtaAction(tt.result, tt.recipients)
+		if action != tt.action || response != tt.response {
+			t.Errorf("mtaAction(%v, %d) = %q, %q; want %q, %q", tt.result, tt.recipients, action, response, tt.action, tt.response)
+		}
+	}
+}
+
+func TestParseDMARCReports(t *testing.T) {
+	report := `<?xml version="1.0" encoding="UTF-8"?>
+<feedback>
+  <policy_published><domain>example.com</domain></policy_published>
+  <record>
+    <row><source_ip>203.0.113.5</source_ip><count>40</count>
+      <policy_evaluated><disposition>none</disposition><dkim>fail</dkim><spf>fail</spf></policy_evaluated></row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+  </record>
+  <record>
+    <row><source_ip>198.51.100.1</source_ip><count>100</count>
+      <policy_evaluated><disposition>none</disposition><dkim>pass</dkim><spf>fail</spf></policy_evaluated></row>
+    <identifiers><header_from>example.com</header_from></identifiers>
+  </record>
+</feedback>`
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(report))
+	zw.Close()
+
+	for name, data := range map[string][]byte{"xml": []byte(report), "gzip": gz.Bytes()} {
+		reports := parseDMARCReports(data, 0)
+		if len(reports) != 1 {
+			t.Fatalf("%s: expected 1 report, got %d", name, len(reports))
+		}
+		failures := dmarcFailures(reports[0])
+		if failures["example.com"] != 40 {
+			t.Errorf("%s: expected 40 failures for example.com, got %v", name, failures)
+		}
+	}
+
+	if reports := parseDMARCReports([]byte("not a report"), 0); len(reports) != 0 {
+		t.Errorf("Expected no report from garbage input, got %d", len(reports))
+	}
+}
+
+func TestDkimAligned(t *testing.T) {
+	configMutex.Lock()
+	configMap["AUTHSERV_ID"] = "mx.local"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "AUTHSERV_ID")
+		configMutex.Unlock()
+	}()
+	read := func(raw string) *enmime.Envelope {
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Failed to parse message: %v", err)
+		}
+		return env
+	}
+
+	signed := read("Authentication-Results: mx.local; dkim=pass header.d=mail.example.com\r\nFrom: a@example.com\r\n\r\nbody")
+	if !dkimAligned(signed, "example.com") {
+		t.Errorf("Subdomain DKIM pass should align with example.com")
+	}
+	forged := read("Authentication-Results: mx.local; dkim=pass header.d=attacker.test\r\nFrom: a@example.com\r\n\r\nbody")
+	if dkimAligned(forged, "example.com") {
+		t.Errorf("Foreign DKIM domain must not align with example.com")
+	}
+}
+
+func TestMimeStructure(t *testing.T) {
+	message := func(boundary, text string) string {
+		return "Received: from mx.example.net\r\n" +
+			"From: promo@example.com\r\nSubject: " + text + "\r\nX-Mailer: BulkMailer 4.2\r\n" +
+			"MIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n" +
+			"--" + boundary + "\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n" + text + "\r\n" +
+			"--" + boundary + "\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<p>" + text + "</p>\r\n" +
+			"--" + boundary + "--\r\n"
+	}
+	fingerprint := func(raw string) string {
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Failed to parse message: %v", err)
+		}
+		return mimeStructure([]byte(raw), env)
+	}
+
+	a := fingerprint(message("----=_Part_1234_5678.90", "Cheap watches"))
+	b := fingerprint(message("----=_Part_9876_5432.10", "Discount pills"))
+	c := fingerprint(message("b1_a3f9e2c4d5", "Cheap watches"))
+
+	if !strings.HasPrefix(a, "S1") || a != b {
+		t.Errorf("Same generator with different text should share a fingerprint: %s vs %s", a, b)
+	}
+	if a == c {
+		t.Errorf("Different boundary style should change the fingerprint")
+	}
+
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	originalSpam, originalThreshold, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&structureSpamThreshold), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 2)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&structureSpamThreshold, originalThreshold)
+		localRetentionDuration = originalRetention
+	}()
+
+	// Common mail clients share structures: by default they are learned, not acted on
+	learnStructure(a, "spam", "")
+	learnStructure(a, "spam", "")
+	atomic.StoreInt64(&structureSpamThreshold, DefaultStructureLimit)
+	if score, ok := structureSpam(a); ok {
+		t.Errorf("structureSpam() = %v, flagged with the default threshold", score)
+	}
+	atomic.StoreInt64(&structureSpamThreshold, 3)
+	if score, ok := structureSpam(b); !ok || score != 4 {
+		t.Errorf("structureSpam() = %v, %v, want flagged with score 4", score, ok)
+	}
+}
+
+func TestParseCalendar(t *testing.T) {
+	var attendees strings.Builder
+	for i := 0; i < 60; i++ {
+		fmt.Fprintf(&attendees, "ATTENDEE;RSVP=TRUE:mailto:user%d@victim.test\r\n", i)
+	}
+	ics := "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nBEGIN:VEVENT\r\n" +
+		"SUMMARY:You won a prize\\, claim now\r\n" +
+		"DESCRIPTION:Visit our site to claim\\nyour reward before it expires and\r\n  enjoy the gift\r\n" +
+		"ORGANIZER;CN=Promo:mailto:promo@spam.test\r\n" +
+		"URL:https://spam.test/claim\r\n" +
+		attendees.String() +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	invite := parseCalendar(ics)
+	if invite.Method != "REQUEST" || len(invite.Events) != 1 {
+		t.Fatalf("Unexpected invite: %+v", invite)
+	}
+	ev := invite.Events[0]
+	if ev.Summary != "You won a prize, claim now" || ev.Attendees != 60 || ev.Organizer != "promo@spam.test" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	if !strings.Contains(ev.Description, "expires and enjoy") {
+		t.Errorf("Folded description not unfolded: %q", ev.Description)
+	}
+
+	configMutex.Lock()
+	configMap["AUTHSERV_ID"] = "mx.example.org"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "AUTHSERV_ID")
+		configMutex.Unlock()
+		atomic.StoreInt64(&calendarMaxAttendees, DefaultMaxAttendees)
+	}()
+	massInvite := func(headers string) bool {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(headers + "From: promo@spam.test\r\n\r\nbody"))
+		return isMassInvite(env, invite)
+	}
+	verified := "Authentication-Results: mx.example.org; dkim=pass header.d=bulk.test\r\n"
+	if massInvite(verified) {
+		t.Errorf("Mass invites flagged without CALENDAR_MAX_ATTENDEES")
+	}
+	atomic.StoreInt64(&calendarMaxAttendees, 50)
+	if !massInvite(verified) {
+		t.Errorf("Invite to 60 attendees not signed by its organizer should be a mass invite")
+	}
+	if massInvite("Authentication-Results: mx.example.org; dkim=pass header.d=spam.test\r\n") {
+		t.Errorf("Invite signed by its organizer flagged")
+	}
+	// A forged DKIM-Signature or Authentication-Results is not a signature
+	if !massInvite(verified + "DKIM-Signature: v=1; d=spam.test; s=x\r\n") {
+		t.Errorf("Unverified DKIM-Signature trusted")
+	}
+	if massInvite("Authentication-Results: upstream.example; dkim=pass header.d=bulk.test\r\n") {
+		t.Errorf("Invite flagged without DKIM results from our MTA")
+	}
+}
+
+func TestNestedSignatures(t *testing.T) {
+	innerBody := strings.Repeat("Limited offer: buy cheap replica watches today at our online store. ", 5)
+	inner := "From: spammer@spam.test\r\nSubject: Cheap watches\r\nMessage-ID: <inner@spam.test>\r\n\r\n" + innerBody + "\r\n"
+	outer := "From: user@example.com\r\nSubject: FWD: look at this spam\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\n\r\nSee below.\r\n" +
+		"--outer\r\nContent-Type: message/rfc822\r\n\r\n" + inner +
+		"--outer--\r\n"
+
+	env, err := enmime.ReadEnvelope(strings.NewReader(outer))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	sigs := nestedSignatures(env, 0)
+	if len(sigs) == 0 {
+		t.Fatalf("Expected a signature from the attached message")
+	}
+	want, _ := analyze.TLSH(normalizeEmailBody(innerBody+"\r\n", ""))
+	if dist, err := computeDistance(sigs[0], want, false, 0); err != nil || dist > 70 {
+		t.Errorf("Nested signature too far from the inner body: %d (%v)", dist, err)
+	}
+}
+
+func TestEncryptedKind(t *testing.T) {
+	makeZip := func(flags uint16) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.CreateHeader(&zip.FileHeader{Name: "invoice.exe", Method: zip.Store, Flags: flags})
+		w.Write([]byte("payload"))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"encrypted zip", makeZip(0x1), "zip"},
+		{"plain zip", makeZip(0), ""},
+		{"encrypted pdf", []byte("%PDF-1.7\n1 0 obj\ntrailer << /Root 1 0 R /Encrypt 5 0 R >>"), "pdf"},
+		{"plain pdf", []byte("%PDF-1.7\n1 0 obj\ntrailer << /Root 1 0 R >>"), ""},
+		{"text", []byte("hello"), ""},
+	}
+	for _, tt := range tests {
+		if got := encryptedKind(tt.data); got != tt.want {
+			t.Errorf("%s: encryptedKind() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrivacyHandler(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(newPrivacyHandler(slog.NewJSONHandler(&buf, nil))).With("message_id", "<secret@example.com>")
+	defer logMessageMetadata.Store(true)
+
+	logMessageMetadata.Store(false)
+	l.Info("Local spam detected", "subject", "Private matter", "score", 3)
+	if out := buf.String(); strings.Contains(out, "secret@example.com") || strings.Contains(out, "Private matter") || !strings.Contains(out, `"score":3`) {
+		t.Errorf("Metadata not filtered: %s", out)
+	}
+
+	buf.Reset()
+	logMessageMetadata.Store(true)
+	l.Info("Local spam detected", "subject", "Private matter")
+	if out := buf.String(); !strings.Contains(out, "secret@example.com") || !strings.Contains(out, "Private matter") {
+		t.Errorf("Metadata should be logged when enabled: %s", out)
+	}
+}
+
+func TestPurgeHandler(t *testing.T) {
+	if got := normalizeMessageID("abc@example.com"); got != "<abc@example.com>" {
+		t.Errorf("normalizeMessageID() = %q", got)
+	}
+
+	handler := http.HandlerFunc(purgeHandler)
+	req, _ := http.NewRequest("GET", "/admin/purge", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/purge returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/purge", strings.NewReader(`{}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Empty purge returned wrong status: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Queued messages and dashboard entries are erased too
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	configMutex.Lock()
+	configMap["ASYNC_QUEUE"] = "true"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ASYNC_QUEUE")
+		configMutex.Unlock()
+	}()
+	enqueue := func(messageID, rcpt string) string {
+		req := httptest.NewRequest(http.MethodPost, "/enqueue", strings.NewReader("From: a@example.com\r\nMessage-ID: "+messageID+"\r\n\r\nHello\r\n"))
+		req.Header.Set("X-Guardian-Rcpt-To", rcpt)
+		rr := httptest.NewRecorder()
+		enqueueHandler(rr, req)
+		var resp struct{ ID string }
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.ID
+	}
+	first := enqueue("<erase-1@example.com>", "carol@example.org")
+	second := enqueue("<erase-2@example.com>", "Dave@example.org")
+	client.Set(ctx, AsyncAttemptsPrefix+first, 1, time.Hour)
+	rememberVerdict(VerdictEvent{Action: "spam", MessageID: messageIDHash("<erase-1@example.com>")})
+
+	if removed := purgeMessageID("erase-1@example.com", true); len(removed) != 2 || removed[0] != AsyncQueueKey+"#"+first || client.XLen(ctx, AsyncQueueKey).Val() != 2 {
+		t.Errorf("dry run purgeMessageID() = %v", removed)
+	}
+	removed := purgeMessageID("erase-1@example.com", false)
+	if len(removed) != 2 || removed[1] != "recent_spam#"+messageIDHash("<erase-1@example.com>") {
+		t.Errorf("purgeMessageID() = %v, want the queued message and the dashboard entry", removed)
+	}
+	if client.Exists(ctx, AsyncAttemptsPrefix+first).Val() != 0 || len(recentSpamVerdicts()) > 0 && recentSpamVerdicts()[0].MessageID == messageIDHash("<erase-1@example.com>") {
+		t.Errorf("records of the queued message left")
+	}
+	if removed := purgeRecipient("dave@example.org", false); len(removed) != 1 || removed[0] != AsyncQueueKey+"#"+second {
+		t.Errorf("purgeRecipient() = %v, want the queued message", removed)
+	}
+	if n := client.XLen(ctx, AsyncQueueKey).Val(); n != 0 {
+		t.Errorf("%d messages left in the queue", n)
+	}
+}
+
+func TestMirrorHook(t *testing.T) {
+	primaryServer, primary, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer primaryServer.Close()
+	secondaryServer, secondary, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer secondaryServer.Close()
+	primary.AddHook(store.NewMirrorHook(secondary, logger))
+	originalRDB := rdb
+	rdb = primary
+	defer func() { rdb = originalRDB }()
+	configMutex.Lock()
+	configMap["ASYNC_QUEUE"] = "true"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ASYNC_QUEUE")
+		configMutex.Unlock()
+	}()
+
+	// Queued messages keep their entry ID on the secondary, so a purge removes them there too
+	req := httptest.NewRequest(http.MethodPost, "/enqueue", strings.NewReader("From: a@example.com\r\nMessage-ID: <mirror@example.com>\r\n\r\nHello\r\n"))
+	req.Header.Set("X-Guardian-Rcpt-To", "erin@example.org")
+	enqueueHandler(httptest.NewRecorder(), req)
+	queued := secondary.XRange(ctx, AsyncQueueKey, "-", "+").Val()
+	if len(queued) != 1 || queued[0].ID != primary.XRange(ctx, AsyncQueueKey, "-", "+").Val()[0].ID {
+		t.Fatalf("secondary queue = %v, want the primary entry", queued)
+	}
+	primary.HSet(ctx, QuarantinedPrefix+"mirror", "erin@example.org", "1", "frank@example.org", "1")
+	if removed := purgeRecipient("erin@example.org", false); len(removed) != 2 {
+		t.Errorf("purgeRecipient() = %v, want the quarantine record and the queued message", removed)
+	}
+	if n := secondary.XLen(ctx, AsyncQueueKey).Val(); n != 0 {
+		t.Errorf("%d messages left in the secondary queue", n)
+	}
+	if secondary.HExists(ctx, QuarantinedPrefix+"mirror", "erin@example.org").Val() || !secondary.HExists(ctx, QuarantinedPrefix+"mirror", "frank@example.org").Val() {
+		t.Error("HDEL was not mirrored")
+	}
+
+	// Trimmed bands lose the same members on both sides
+	atomic.StoreInt64(&bandMaxMembers, 2)
+	defer loadBandLimits()
+	for i := 0; i < 4; i++ {
+		addToBands(LocalFragPrefix, []string{"mirror"}, fmt.Sprintf("T1MIRROR%d", i), time.Hour)
+	}
+	primaryMembers := primary.SMembers(ctx, LocalFragPrefix+"mirror").Val()
+	secondaryMembers := secondary.SMembers(ctx, LocalFragPrefix+"mirror").Val()
+	sort.Strings(primaryMembers)
+	sort.Strings(secondaryMembers)
+	if len(primaryMembers) != 2 || !reflect.DeepEqual(primaryMembers, secondaryMembers) {
+		t.Errorf("band members = %v on the primary, %v on the secondary", primaryMembers, secondaryMembers)
+	}
+
+	// Band TTL refreshes run the script source on the secondary
+	secondary.Expire(ctx, LocalFragPrefix+"mirror", time.Minute)
+	primary.Expire(ctx, LocalFragPrefix+"mirror", time.Minute)
+	refreshBandTTLs([]string{LocalFragPrefix + "mirror"}, time.Hour)
+	if ttl := secondary.TTL(ctx, LocalFragPrefix+"mirror").Val(); ttl <= time.Minute {
+		t.Errorf("secondary TTL = %v, want the band refreshed", ttl)
+	}
+
+	// Reads missing on the primary fall back to the secondary
+	secondary.HSet(ctx, LocalCounterPrefix+"old", "spam", "3")
+	secondary.Set(ctx, LocalScorePrefix+"old", "5", time.Hour)
+	if got := primary.HGet(ctx, LocalCounterPrefix+"old", "spam").Val(); got != "3" {
+		t.Errorf("HGET through the mirror = %q, want 3", got)
+	}
+	if !primary.HExists(ctx, LocalCounterPrefix+"old", "spam").Val() {
+		t.Error("HEXISTS through the mirror = false, want true")
+	}
+	if ttl := primary.TTL(ctx, LocalScorePrefix+"old").Val(); ttl <= 0 {
+		t.Errorf("TTL through the mirror = %v, want the secondary expiry", ttl)
+	}
+}
+
+func TestBandLimits(t *testing.T) {
+	atomic.StoreInt64(&bandHotSize, 3)
+	atomic.StoreInt64(&bandMaxMembers, 5)
+	defer loadBandLimits()
+	defer rdb.Del(ctx, LocalFragPrefix+"test-hot", LocalFragPrefix+"test-cold")
+
+	trimmedBefore := testutil.ToFloat64(promBandsTrimmed.WithLabelValues("local"))
+	for i := 0; i < 7; i++ {
+		addToBands(LocalFragPrefix, []string{"test-hot"}, fmt.Sprintf("T1HOT%d", i), time.Hour)
+	}
+	addToBands(LocalFragPrefix, []string{"test-cold"}, "T1COLD", time.Hour)
+	if size := rdb.SCard(ctx, LocalFragPrefix+"test-hot").Val(); size != 5 {
+		t.Errorf("Band set holds %d members, want it trimmed to 5", size)
+	}
+	if ttl := rdb.TTL(ctx, LocalFragPrefix+"test-cold").Val(); ttl <= 0 {
+		t.Errorf("addToBands() did not set an expiry, TTL = %v", ttl)
+	}
+	if trimmed := testutil.ToFloat64(promBandsTrimmed.WithLabelValues("local")) - trimmedBefore; trimmed != 2 {
+		t.Errorf("promBandsTrimmed increased by %v, want 2", trimmed)
+	}
+
+	hotBefore := testutil.ToFloat64(promHotBands.WithLabelValues("local"))
+	members := bandMembers(LocalFragPrefix, []string{LocalFragPrefix + "test-hot", LocalFragPrefix + "test-cold", LocalFragPrefix + "test-cold"})
+	if !reflect.DeepEqual(members, []string{"T1COLD"}) {
+		t.Errorf("bandMembers() = %v, want only the members of the cold band", members)
+	}
+	if hot := testutil.ToFloat64(promHotBands.WithLabelValues("local")) - hotBefore; hot != 1 {
+		t.Errorf("promHotBands increased by %v, want 1", hot)
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/bands", nil)
+	rr := httptest.NewRecorder()
+	bandsHandler(rr, req)
+	var resp struct {
+		Local BandStats `json:"local"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("/admin/bands returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if resp.Local.Hot < 1 || len(resp.Local.Largest) == 0 || resp.Local.Largest[0].Members < 5 {
+		t.Errorf("/admin/bands local stats = %+v, want the trimmed hot band first", resp.Local)
+	}
+}
+
+func TestAuditLocalStore(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	learned, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	expired, _ := analyze.TLSH(strings.Repeat("Congratulations, you won a gift card from our partners! ", 6))
+	unindexed, _ := analyze.TLSH(strings.Repeat("Invoice 4471 attached, payment overdue since last month. ", 6))
+
+	// learned is consistent, expired lost its score, unindexed lost its bands
+	rdb.Set(ctx, LocalScorePrefix+learned, 3, time.Hour)
+	addToBands(LocalFragPrefix, extractBands_6_3(learned), learned, time.Hour)
+	addToBands(LocalFragPrefix, extractBands_6_3(expired), expired, time.Hour)
+	rdb.Set(ctx, LocalScorePrefix+unindexed, 2, time.Hour)
+
+	report, err := auditLocalStore(true)
+	if err != nil {
+		t.Fatalf("auditLocalStore() error: %v", err)
+	}
+	if report.OrphanMembers != int64(len(extractBands_6_3(expired))) || report.OrphanScores != 1 || report.ScoresChecked != 2 {
+		t.Errorf("auditLocalStore(dry run) = %+v", report)
+	}
+	if !rdb.SIsMember(ctx, LocalFragPrefix+extractBands_6_3(expired)[0], expired).Val() {
+		t.Fatal("Dry run removed an orphan member")
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/audit", nil)
+	rr := httptest.NewRecorder()
+	auditHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/admin/audit returned %d", rr.Code)
+	}
+	for _, band := range extractBands_6_3(expired) {
+		if rdb.SIsMember(ctx, LocalFragPrefix+band, expired).Val() {
+			t.Errorf("Orphan member left in band %s", band)
+		}
+	}
+	if !rdb.SIsMember(ctx, LocalFragPrefix+extractBands_6_3(unindexed)[0], unindexed).Val() {
+		t.Error("Score without bands was not indexed again")
+	}
+	if !rdb.SIsMember(ctx, LocalFragPrefix+extractBands_6_3(learned)[0], learned).Val() {
+		t.Error("Consistent hash was removed from its bands")
+	}
+
+	if report, _ := auditLocalStore(true); report.OrphanMembers != 0 || report.OrphanScores != 0 {
+		t.Errorf("Second audit found %+v, want a consistent store", report)
+	}
+}
+
+func TestSealValue(t *testing.T) {
+	defer func() { storageKeys = nil }()
+	oldKey, _ := parseStorageKey(strings.Repeat("11", 32))
+	newKey, err := parseStorageKey(strings.Repeat("22", 32))
+	if err != nil {
+		t.Fatalf("parseStorageKey() error: %v", err)
+	}
+	if _, err := parseStorageKey("short"); err == nil {
+		t.Errorf("Short key should be rejected")
+	}
+
+	storageKeys = []storageKey{oldKey}
+	sealedOld, _ := sealValue([]byte(`{"hashes":["T1AA"]}`))
+	if !strings.HasPrefix(sealedOld, sealedPrefix) || strings.Contains(sealedOld, "T1AA") {
+		t.Fatalf("Value not encrypted: %s", sealedOld)
+	}
+
+	// Rotation: new key active, old key still decrypts
+	storageKeys = []storageKey{newKey, oldKey}
+	if plain, err := openValue(sealedOld); err != nil || string(plain) != `{"hashes":["T1AA"]}` {
+		t.Errorf("openValue() after rotation = %q, %v", plain, err)
+	}
+	if plain, err := openValue(`{"hashes":[]}`); err != nil || string(plain) != `{"hashes":[]}` {
+		t.Errorf("Clear values should pass through: %q, %v", plain, err)
+	}
+
+	storageKeys = []storageKey{newKey}
+	if _, err := openValue(sealedOld); err == nil {
+		t.Errorf("Value sealed with a removed key should not decrypt")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	configMutex.Lock()
+	configMap["ADMIN_TOKEN"] = "admin-secret"
+	configMap["ADMIN_READ_TOKEN"] = "read-secret"
+	configMap["ADMIN_ALLOWED_IPS"] = "10.0.0.0/8, 192.0.2.7"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ADMIN_TOKEN")
+		delete(configMap, "ADMIN_READ_TOKEN")
+		delete(configMap, "ADMIN_ALLOWED_IPS")
+		configMutex.Unlock()
+	}()
+
+	handler := adminAuth(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name   string
+		method string
+		addr   string
+		token  string
+		want   int
+	}{
+		{"admin token", "POST", "10.1.2.3:4000", "admin-secret", http.StatusOK},
+		{"read token GET", "GET", "192.0.2.7:4000", "read-secret", http.StatusOK},
+		{"read token POST", "POST", "10.1.2.3:4000", "read-secret", http.StatusForbidden},
+		{"bad token", "GET", "10.1.2.3:4000", "guess", http.StatusUnauthorized},
+		{"disallowed IP", "GET", "203.0.113.1:4000", "admin-secret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/admin/conflicts", nil)
+		req.RemoteAddr = tt.addr
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, rr.Code, tt.want)
+		}
+	}
+
+	// Without tokens the admin API is closed, whatever the caller sends
+	configMutex.Lock()
+	delete(configMap, "ADMIN_TOKEN")
+	delete(configMap, "ADMIN_READ_TOKEN")
+	configMutex.Unlock()
+	req := httptest.NewRequest(http.MethodPost, "/admin/purge", nil)
+	req.RemoteAddr = "10.1.2.3:4000"
+	req.Header.Set("Authorization", "Bearer ")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusForbidden || adminRole(req) != "" {
+		t.Errorf("no token configured: got status %d, role %q", rr.Code, adminRole(req))
+	}
+}
+
+func TestTrustedDkimDomain(t *testing.T) {
+	configMutex.Lock()
+	configMap["TRUSTED_DKIM_DOMAINS"] = "partner.example"
+	configMap["AUTHSERV_ID"] = "mx.local"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "TRUSTED_DKIM_DOMAINS")
+		delete(configMap, "AUTHSERV_ID")
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name    string
+		headers string
+		want    string
+	}{
+		{"verified subdomain", "Authentication-Results: mx.local; dkim=pass header.d=mail.partner.example\r\n", "partner.example"},
+		{"failed signature", "Authentication-Results: mx.local; dkim=fail header.d=partner.example\r\n", ""},
+		{"unverified header only", "DKIM-Signature: v=1; a=rsa-sha256; d=partner.example; s=s1; b=abc\r\n", ""},
+		{"foreign authserv-id", "Authentication-Results: mx.partner.example; dkim=pass header.d=partner.example\r\n", ""},
+		{"forged below ours", "Authentication-Results: mx.local 1; dkim=none\r\nAuthentication-Results: mx.local; dkim=pass header.d=partner.example\r\n", ""},
+	}
+	for _, tt := range tests {
+		env, err := enmime.ReadEnvelope(strings.NewReader(tt.headers + "From: a@partner.example\r\n\r\nbody"))
+		if err != nil {
+			t.Fatalf("%s: failed to parse message: %v", tt.name, err)
+		}
+		if got := trustedDkimDomain(env); got != tt.want {
+			t.Errorf("%s: trustedDkimDomain() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// Without AUTHSERV_ID no Authentication-Results header can be told from a forged one
+	configMutex.Lock()
+	delete(configMap, "AUTHSERV_ID")
+	configMutex.Unlock()
+	env, _ := enmime.ReadEnvelope(strings.NewReader(tests[0].headers + "From: a@partner.example\r\n\r\nbody"))
+	if got := trustedDkimDomain(env); got != "" {
+		t.Errorf("trustedDkimDomain() without AUTHSERV_ID = %q", got)
+	}
+}
+
+func TestBlocklistHandler(t *testing.T) {
+	valid, invalid := normalizeDigests([]string{" 9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08 ", "abc"})
+	if len(valid) != 1 || valid[0] != "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08" {
+		t.Errorf("normalizeDigests() valid = %v", valid)
+	}
+	if len(invalid) != 1 || invalid[0] != "abc" {
+		t.Errorf("normalizeDigests() invalid = %v", invalid)
+	}
+
+	handler := http.HandlerFunc(blocklistHandler)
+	req, _ := http.NewRequest("POST", "/admin/blocklist", strings.NewReader(`{"add":["not-a-hash"]}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid digest returned wrong status: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/admin/blocklist", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /admin/blocklist returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestHashHandler(t *testing.T) {
+	handler := http.HandlerFunc(hashHandler)
+	req, _ := http.NewRequest("GET", "/hash", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /hash returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	body := strings.Repeat("Limited offer on premium watches, reply now to claim your discount. ", 5)
+	email := "Subject: Test\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\n" + body +
+		"\r\n--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"a.bin\"\r\n\r\n" + strings.Repeat("binary payload 0123456789 ", 10) + "\r\n--b--\r\n"
+	req, _ = http.NewRequest("POST", "/hash", strings.NewReader(email))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("POST /hash returned wrong status: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp HashResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	kinds := make(map[string]bool)
+	for _, p := range resp.Parts {
+		kinds[p.Kind] = true
+	}
+	if !kinds["body"] || !kinds["raw"] || !kinds["attachment"] {
+		t.Errorf("Missing signatures, got parts %+v", resp.Parts)
+	}
+	if len(resp.Files) != 1 || len(resp.Files[0].SHA256) != 64 || resp.Structure == "" {
+		t.Errorf("Missing file digest or structure: %+v", resp)
+	}
+
+	req, _ = http.NewRequest("POST", "/hash?raw=1", strings.NewReader(body))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	resp = HashResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if len(resp.Signatures) != 1 || len(resp.Parts) != 1 || resp.Parts[0].Kind != "raw" {
+		t.Errorf("Raw hashing returned %+v", resp)
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	parse := func(headers string) *enmime.Envelope {
+		env, err := enmime.ReadEnvelope(strings.NewReader(headers + "Subject: Test\r\n\r\nBody"))
+		if err != nil {
+			t.Fatalf("ReadEnvelope: %v", err)
+		}
+		return env
+	}
+
+	if got := tenantOf(parse("To: user@acme.com\r\n"), EnvelopeMeta{}); got != TenantDefault {
+		t.Errorf("tenantOf() without map = %q, want %q", got, TenantDefault)
+	}
+
+	configMutex.Lock()
+	configMap["TENANT_MAP"] = "acme.com:acme, beta.io:beta"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "TENANT_MAP")
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		headers string
+		want    string
+	}{
+		{"To: User <user@acme.com>, other@beta.io\r\n", "acme"},
+		{"X-Original-To: box@mail.beta.io\r\nTo: list@acme.com\r\n", "beta"},
+		{"To: someone@example.net\r\n", TenantOther},
+		{"", TenantOther},
+	}
+	for _, tt := range tests {
+		if got := tenantOf(parse(tt.headers), EnvelopeMeta{}); got != tt.want {
+			t.Errorf("tenantOf(%q) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestVerdictReasons(t *testing.T) {
+	if err := loadReasonsCatalog(); err != nil {
+		t.Fatalf("loadReasonsCatalog: %v", err)
+	}
+
+	req, _ := http.NewRequest("POST", "/analyze", nil)
+	req.Header.Set("Accept-Language", "de-DE, fr-CH;q=0.8, en;q=0.5")
+	if got := reasonsLanguage(req); got != "fr" {
+		t.Errorf("reasonsLanguage() = %q, want fr", got)
+	}
+	req, _ = http.NewRequest("POST", "/analyze?lang=en", nil)
+	req.Header.Set("Accept-Language", "fr")
+	if got := reasonsLanguage(req); got != "en" {
+		t.Errorf("reasonsLanguage() with ?lang=en = %q", got)
+	}
+
+	reasons := verdictReasons(AnalysisResult{Action: "spam", Label: "encrypted_attachment"}, []string{"encrypted_attachment"}, true, "en")
+	if len(reasons) != 2 || reasons[0] != defaultReasons["en"]["encrypted_attachment"] || reasons[1] != defaultReasons["en"]["nested_match"] {
+		t.Errorf("verdictReasons() = %v", reasons)
+	}
+	if reasons := verdictReasons(AnalysisResult{Action: "spam", Label: "new_oracle_label"}, nil, false, "fr"); len(reasons) != 1 || reasons[0] != defaultReasons["fr"]["spam"] {
+		t.Errorf("verdictReasons() for unknown label = %v", reasons)
+	}
+	if reasons := verdictReasons(AnalysisResult{Action: "allow"}, nil, false, "en"); len(reasons) != 0 {
+		t.Errorf("verdictReasons() for clean message = %v", reasons)
+	}
+}
+
+func TestNextThreshold(t *testing.T) {
+	defer loadAdaptiveConfig()
+	atomic.StoreInt64(&adaptiveMinThreshold, 1)
+	atomic.StoreInt64(&adaptiveMaxThreshold, 4)
+	atomic.StoreInt64(&adaptiveTargetPercent, 2)
+	atomic.StoreInt64(&adaptiveMinSamples, 50)
+	atomic.StoreInt64(&adaptiveMinHam, 5)
+
+	tests := []struct {
+		current, flagged, ham int64
+		want                  int64
+	}{
+		{2, 10, 5, 2},   // Not enough samples
+		{2, 100, 0, 2},  // No ham report tells nothing: unchanged
+		{2, 1000, 4, 2}, // Not enough ham reports
+		{2, 100, 5, 3},  // 5% ham reports: raise
+		{4, 100, 5, 4},  // Capped by the max
+		{2, 250, 5, 2},  // On target
+		{2, 1000, 5, 1}, // Below half the target: lower
+		{1, 5000, 5, 1}, // Floored by the min
+	}
+	for _, tt := range tests {
+		if got := nextThreshold(tt.current, tt.flagged, tt.ham); got != tt.want {
+			t.Errorf("nextThreshold(%d, %d, %d) = %d, want %d", tt.current, tt.flagged, tt.ham, got, tt.want)
+		}
+	}
+
+	adaptiveEnabled.Store(true)
+	adaptiveMu.Lock()
+	adaptiveThresholds = map[string]int64{"acme": 3}
+	adaptiveMu.Unlock()
+	defer func() {
+		adaptiveMu.Lock()
+		adaptiveThresholds = map[string]int64{}
+		adaptiveMu.Unlock()
+	}()
+	if got := baselineProfile().forTenant("acme").SpamThreshold; got != 3 {
+		t.Errorf("forTenant(acme) threshold = %d, want 3", got)
+	}
+	if got := baselineProfile().forTenant("other").SpamThreshold; got != atomic.LoadInt64(&localSpamThreshold) {
+		t.Errorf("forTenant(other) threshold = %d, want the baseline", got)
+	}
+
+	// The floor defaults to SPAM_THRESHOLD
+	originalThreshold := atomic.LoadInt64(&localSpamThreshold)
+	atomic.StoreInt64(&localSpamThreshold, 3)
+	defer atomic.StoreInt64(&localSpamThreshold, originalThreshold)
+	loadAdaptiveConfig()
+	if got := atomic.LoadInt64(&adaptiveMinThreshold); got != 3 {
+		t.Errorf("default ADAPTIVE_MIN_THRESHOLD = %d, want SPAM_THRESHOLD", got)
+	}
+}
+
+func TestBlockHashHandler(t *testing.T) {
+	sig, err := analyze.TLSH(strings.Repeat("Your mailbox is full, confirm your password within 24 hours to keep receiving mail. ", 4))
+	if err != nil {
+		t.Fatalf("computeLocalTLSH: %v", err)
+	}
+	if !validTLSH(sig) {
+		t.Errorf("validTLSH(%q) = false", sig)
+	}
+	if validTLSH("T1NOTAHASH") || validTLSH(strings.TrimPrefix(sig, "T1")) {
+		t.Errorf("validTLSH accepted an invalid hash")
+	}
+
+	handler := http.HandlerFunc(blockHashHandler)
+	req, _ := http.NewRequest("POST", "/admin/block-hash", strings.NewReader(`{"hash":"T1NOTAHASH"}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Invalid hash returned wrong status: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	req, _ = http.NewRequest("GET", "/admin/unblock-hash", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(unblockHashHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/unblock-hash returned wrong status: got %v want %v", rr.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	before := atomic.LoadInt64(&syncLastSuccess)
+	doSync()
+	status := syncStatus()
+	if status["last_status"] != int64(http.StatusServiceUnavailable) {
+		t.Errorf("last_status = %v, want %d", status["last_status"], http.StatusServiceUnavailable)
+	}
+	if atomic.LoadInt64(&syncLastSuccess) != before {
+		t.Errorf("Failed sync recorded as a success")
+	}
+
+	recordSyncStatus(0)
+	if status := syncStatus(); status["last_status"] != int64(0) {
+		t.Errorf("last_status after request error = %v, want 0", status["last_status"])
+	}
+}
+
+func TestSummarizeDelta(t *testing.T) {
+	delta := SyncResponse{NewSeq: 12, Action: "UPDATE_DELTA", Ops: []SyncOp{
+		{Action: "add", Bands: []string{"b1", "b2", "b3"}, Files: []string{"f1"}},
+		{Action: "del", Bands: []string{"b4"}},
+		{Action: "noop", Bands: []string{"b5"}},
+	}}
+	preview := summarizeDelta(10, http.StatusOK, delta)
+	if preview.BandsAdded != 3 || preview.BandsRemoved != 1 || preview.FilesAdded != 1 || preview.Ignored != 1 {
+		t.Errorf("summarizeDelta() counts = %+v", preview)
+	}
+	if len(preview.SampleAdded) != 3 || preview.SampleRemoved[0] != "b4" || preview.NewSeq != 12 {
+		t.Errorf("summarizeDelta() samples = %+v", preview)
+	}
+
+	if preview := summarizeDelta(10, http.StatusNotModified, SyncResponse{}); preview.Action != "UP_TO_DATE" || preview.NewSeq != 10 {
+		t.Errorf("summarizeDelta() on 304 = %+v", preview)
+	}
+}
+
+func TestVerifyStateWithoutRedis(t *testing.T) {
+	originalRDB := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer func() { rdb = originalRDB }()
+
+	// Nothing can be verified, and nothing must be repaired blindly
+	if problems := verifyState(); problems != nil {
+		t.Errorf("verifyState() without Redis = %v, want nil", problems)
+	}
+}
+
+func TestJittered(t *testing.T) {
+	defer atomic.StoreInt64(&workerJitterPercent, DefaultWorkerJitter)
+
+	atomic.StoreInt64(&workerJitterPercent, 0)
+	if got := jittered(time.Minute); got != time.Minute {
+		t.Errorf("jittered() without jitter = %v", got)
+	}
+
+	atomic.StoreInt64(&workerJitterPercent, 10)
+	for i := 0; i < 100; i++ {
+		if got := jittered(time.Minute); got < 54*time.Second || got > 66*time.Second {
+			t.Fatalf("jittered(1m) = %v, outside ±10%%", got)
+		}
+	}
+}
+
+func TestOracleSettings(t *testing.T) {
+	defer setOracleSettings(map[string]string{})
+
+	kept := setOracleSettings(map[string]string{"SYNC_INTERVAL": "120", "ADMIN_TOKEN": "oracle-chosen"})
+	if len(kept) != 1 || kept["SYNC_INTERVAL"] != "120" {
+		t.Errorf("setOracleSettings() kept %v", kept)
+	}
+
+	// Oracle recommendations replace the built-in default only
+	if got := getEnv("SYNC_INTERVAL", "60"); got != "120" {
+		t.Errorf("getEnv(SYNC_INTERVAL) = %q, want the Oracle value", got)
+	}
+	if got := getEnv("ADMIN_TOKEN", ""); got != "" {
+		t.Errorf("getEnv(ADMIN_TOKEN) = %q, Oracle must not set it", got)
+	}
+	configMutex.Lock()
+	configMap["SYNC_INTERVAL"] = "30"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "SYNC_INTERVAL")
+		configMutex.Unlock()
+	}()
+	if got := getEnv("SYNC_INTERVAL", "60"); got != "30" {
+		t.Errorf("getEnv(SYNC_INTERVAL) = %q, want the local value", got)
+	}
+}
+
+func TestOraclePostFallback(t *testing.T) {
+	var contentTypes []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes = append(contentTypes, r.Header.Get("Content-Type")+"|"+r.Header.Get("Content-Encoding"))
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+	}))
+	defer ts.Close()
+
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	configMutex.Lock()
+	configMap["ORACLE_ENCODING"] = "cbor"
+	configMap["ORACLE_COMPRESSION"] = "gzip"
+	configMutex.Unlock()
+	loadOracleWireConfig()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ORACLE_ENCODING")
+		delete(configMap, "ORACLE_COMPRESSION")
+		configMutex.Unlock()
+		loadOracleWireConfig()
+		setOracleWireAccepted("", "")
+	}()
+
+	resp, err := oraclePost(&http.Client{Timeout: 5 * time.Second}, "/report", map[string]interface{}{"node_id": "n1"})
+	if err != nil {
+		t.Fatalf("oraclePost: %v", err)
+	}
+	body, _ := oracle.ResponseJSON(resp)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != `{"status":"ok"}` {
+		t.Errorf("oraclePost() = %d %s", resp.StatusCode, body)
+	}
+	if len(contentTypes) != 2 || contentTypes[0] != "application/cbor|gzip" || contentTypes[1] != "application/json|" {
+		t.Errorf("Requests sent = %v", contentTypes)
+	}
+	if wire := currentOracleWire(); wire.CBOR || wire.Gzip {
+		t.Errorf("Encoding not downgraded after 415: %+v", wire)
+	}
+}
+
+func TestSignOracleRequest(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	setNodeKey(priv)
+	defer setNodeKey(nil)
+
+	if got := nodePublicKey(); got != base64.StdEncoding.EncodeToString(pub) {
+		t.Errorf("nodePublicKey() = %q", got)
+	}
+
+	body := []byte(`{"node_id":"n1","report_type":"spam"}`)
+	req, _ := http.NewRequest("POST", "https://oracle.example/report", bytes.NewReader(body))
+	signOracleRequest(req, body)
+
+	sig, err := base64.StdEncoding.DecodeString(req.Header.Get("X-Mailuminati-Signature"))
+	if err != nil {
+		t.Fatalf("Invalid signature header: %v", err)
+	}
+	msg := oracle.SigningString("POST", "/report", req.Header.Get("X-Mailuminati-Timestamp"), body)
+	if !ed25519.Verify(pub, msg, sig) {
+		t.Errorf("Signature does not verify")
+	}
+	if ed25519.Verify(pub, oracle.SigningString("POST", "/report", req.Header.Get("X-Mailuminati-Timestamp"), []byte(`{}`)), sig) {
+		t.Errorf("Signature verifies a different body")
+	}
+}
+
+func TestInitNodeKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "node.key")
+	configMutex.Lock()
+	configMap["NODE_KEY_FILE"] = path
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "NODE_KEY_FILE")
+		configMutex.Unlock()
+		setNodeKey(nil)
+		rdb.Del(ctx, MetaNodeKey, MetaNodePublicKey)
+	}()
+
+	// A seed kept in Redis by former versions moves to the key file
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	rdb.Set(ctx, MetaNodeKey, priv.Seed(), 0)
+	if err := initNodeKey(); err != nil {
+		t.Fatalf("initNodeKey() = %v", err)
+	}
+	want := base64.StdEncoding.EncodeToString(pub)
+	if got := nodePublicKey(); got != want {
+		t.Errorf("nodePublicKey() = %q, want the key from Redis %q", got, want)
+	}
+	if rdb.Exists(ctx, MetaNodeKey).Val() != 0 {
+		t.Error("Node key seed left in Redis")
+	}
+	if got := rdb.Get(ctx, MetaNodePublicKey).Val(); got != want {
+		t.Errorf("Public key in Redis = %q, want %q", got, want)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("Key file = %v %v, want mode 0600", info, err)
+	}
+
+	// Later starts read the file
+	setNodeKey(nil)
+	if err := initNodeKey(); err != nil || nodePublicKey() != want {
+		t.Errorf("initNodeKey() from the file = %v, public key %q", err, nodePublicKey())
+	}
+	os.WriteFile(path, []byte("garbage\n"), 0o600)
+	if err := initNodeKey(); err == nil {
+		t.Error("initNodeKey() accepted an invalid key file")
+	}
+}
+
+func TestDecisionTrail(t *testing.T) {
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "EXPLAIN_SAMPLE_SPAM")
+		delete(configMap, "EXPLAIN_SAMPLE_ALLOW")
+		configMutex.Unlock()
+		loadExplainConfig()
+	}()
+
+	loadExplainConfig()
+	if trail := newDecisionTrail(); trail != nil {
+		t.Fatalf("expected no trail when sampling is off")
+	}
+	var nilTrail *decisionTrail
+	nilTrail.note("context", "source", "direct")
+
+	configMutex.Lock()
+	configMap["EXPLAIN_SAMPLE_SPAM"] = "100"
+	configMap["EXPLAIN_SAMPLE_ALLOW"] = "0.5%"
+	configMutex.Unlock()
+	loadExplainConfig()
+	if got := atomic.LoadInt64(&explainAllowRate); got != 5000 {
+		t.Errorf("allow rate = %d, want 5000", got)
+	}
+
+	trail := newDecisionTrail()
+	if trail == nil {
+		t.Fatalf("expected a trail when sampling is on")
+	}
+	trail.note("local_lookup", "candidates", 2, "match", true)
+	if len(trail.steps) != 1 || trail.steps[0] != "local_lookup candidates=2 match=true" {
+		t.Errorf("unexpected steps %q", trail.steps)
+	}
+
+	if got := percentToRate("250"); got != 1000000 {
+		t.Errorf("percentToRate(250) = %d, want capped 1000000", got)
+	}
+	if got := percentToRate("abc"); got != 0 {
+		t.Errorf("percentToRate(abc) = %d, want 0", got)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardian.log")
+	f, err := newRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	// Each file holds one 60 byte line: current + 2 backups, the oldest lines are dropped
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if info.Size() != 60 {
+			t.Errorf("%s size = %d, want 60", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups")
+	}
+
+	// Reopen follows a file moved away by an external tool
+	os.Rename(path, path+".moved")
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	f.Write(line)
+	if info, err := os.Stat(path); err != nil || info.Size() != 60 {
+		t.Errorf("expected a new file after reopen, got %v", err)
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	atomic.StoreInt64(&configuredLogRank, int64(slog.LevelInfo))
+	logLevel.Set(slog.LevelInfo)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/loglevel", strings.NewReader(`{"level":"debug"}`))
+	rr := httptest.NewRecorder()
+	logLevelHandler(rr, req)
+	if rr.Code != http.StatusOK || logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("POST debug: code %d, level %v", rr.Code, logLevel.Level())
+	}
+	var resp map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["level"] != "DEBUG" || resp["configured"] != "INFO" {
+		t.Errorf("unexpected response %v", resp)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/loglevel", strings.NewReader(`{"level":"verbose"}`))
+	rr = httptest.NewRecorder()
+	logLevelHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown level returned %d, want 400", rr.Code)
+	}
+
+	// SIGUSR1 toggle: DEBUG -> configured level -> DEBUG
+	if got := toggleDebug(); got != slog.LevelInfo {
+		t.Errorf("toggle from DEBUG = %v, want INFO", got)
+	}
+	if got := toggleDebug(); got != slog.LevelDebug {
+		t.Errorf("toggle from INFO = %v, want DEBUG", got)
+	}
+}
+
+func TestDedupeSignatures(t *testing.T) {
+	var text strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&text, "Line %d of a newsletter about gardening, tomatoes and seasonal planting.\n", i)
+	}
+	body, err := analyze.TLSH(text.String())
+	if err != nil {
+		t.Fatalf("tlsh: %v", err)
+	}
+	near, _ := analyze.TLSH(text.String() + "\n")
+	other, _ := analyze.TLSH(strings.Repeat("Completely unrelated invoice content, amount due 1234 EUR, pay now. ", 30))
+
+	if dist, _ := computeDistance(body, near, true, 0); dist > DuplicateSignatureDistance {
+		t.Skipf("near-duplicate fixture too far apart (%d)", dist)
+	}
+
+	got := dedupeSignatures([]string{body, body, near, other})
+	if len(got) != 2 || got[0] != body || got[1] != other {
+		t.Errorf("dedupeSignatures = %v, want [body other]", got)
+	}
+}
+
+func TestStoreScanResult(t *testing.T) {
+	originalRDB := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", DialTimeout: 100 * time.Millisecond, MaxRetries: -1})
+	defer func() { rdb = originalRDB }()
+	defer skipCleanScans.Store(false)
+
+	env, err := enmime.ReadEnvelope(strings.NewReader("Message-ID: <store@example.com>\r\nSubject: hi\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	// Clean scans are skipped without touching Redis
+	skipCleanScans.Store(true)
+	skipped := testutil.ToFloat64(promScanStore.WithLabelValues("skipped"))
+	storeScanResult(env, ScanResult{Hashes: []string{"T1AA"}, Action: "allow"})
+	if got := testutil.ToFloat64(promScanStore.WithLabelValues("skipped")); got != skipped+1 {
+		t.Errorf("skipped counter = %v, want %v", got, skipped+1)
+	}
+
+	// Scans with a match are still stored: the Redis failure is counted
+	failed := testutil.ToFloat64(promScanStore.WithLabelValues("error"))
+	storeScanResult(env, ScanResult{Hashes: []string{"T1AA"}, Action: "allow", Matched: true})
+	if got := testutil.ToFloat64(promScanStore.WithLabelValues("error")); got != failed+1 {
+		t.Errorf("error counter = %v, want %v", got, failed+1)
+	}
+}
+
+func TestEnvelopeMeta(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/analyze", nil)
+	req.Header.Set("X-Guardian-Client-IP", " 192.0.2.10 ")
+	req.Header.Set("X-Guardian-Helo", "relay.partner.net")
+	req.Header.Set("X-Guardian-Mail-From", "<bounce@sender.org>")
+	req.Header.Add("X-Guardian-Rcpt-To", "<a@beta.io>, b@acme.com")
+	req.Header.Add("X-Guardian-Rcpt-To", "<>")
+	req.Header.Add("X-Guardian-Rcpt-To", "c@acme.com")
+
+	meta := envelopeMeta(req)
+	if meta.ClientIP != "192.0.2.10" || meta.Helo != "relay.partner.net" || meta.MailFrom != "bounce@sender.org" {
+		t.Errorf("unexpected meta %+v", meta)
+	}
+	if len(meta.RcptTo) != 3 || meta.RcptTo[0] != "a@beta.io" || meta.RcptTo[2] != "c@acme.com" {
+		t.Errorf("RcptTo = %v", meta.RcptTo)
+	}
+
+	req.Header.Set("X-Guardian-Client-IP", "not-an-ip")
+	if got := envelopeMeta(req).ClientIP; got != "" {
+		t.Errorf("invalid client IP kept: %q", got)
+	}
+
+	// The envelope recipient takes precedence over the headers for the tenant
+	configMutex.Lock()
+	configMap["TENANT_MAP"] = "acme.com:acme,beta.io:beta"
+	configMap["TRUSTED_FORWARDERS"] = "partner.net"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "TENANT_MAP")
+		delete(configMap, "TRUSTED_FORWARDERS")
+		configMutex.Unlock()
+	}()
+	env, _ := enmime.ReadEnvelope(strings.NewReader("To: list@acme.com\r\nSubject: Test\r\n\r\nBody"))
+	if got := tenantOf(env, meta); got != "beta" {
+		t.Errorf("tenantOf() = %q, want beta", got)
+	}
+	// The HELO name is chosen by the client: only its IP is trusted
+	if got := classifyTrustedSource(env, meta); got != "" {
+		t.Errorf("classifyTrustedSource() by HELO = %q, want none", got)
+	}
+	configMutex.Lock()
+	configMap["TRUSTED_FORWARDERS"] = "192.0.2.10"
+	configMutex.Unlock()
+	if got := classifyTrustedSource(env, meta); got != SourceTrustedForwarder {
+		t.Errorf("classifyTrustedSource() = %q, want %q", got, SourceTrustedForwarder)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/?action=spam", "", ts.URL)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer ws.Close()
+
+	// Wait for the subscription before publishing
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&streamCount) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	publishVerdict(VerdictEvent{Action: "allow", MessageID: "clean"})
+	publishVerdict(VerdictEvent{Action: "spam", Label: "local_spam", Distance: 12, MessageID: "abc"})
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var ev VerdictEvent
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if ev.MessageID != "abc" || ev.Label != "local_spam" || ev.Distance != 12 {
+		t.Errorf("unexpected event %+v (allow verdicts should be filtered)", ev)
+	}
+
+	// Pages of other sites cannot open the stream, unless allowed
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/"
+	if foreign, err := websocket.Dial(wsURL, "", "https://evil.example"); err == nil {
+		foreign.Close()
+		t.Error("stream accepted a foreign origin")
+	}
+	configMutex.Lock()
+	configMap["ADMIN_ALLOWED_ORIGINS"] = "https://noc.example.com/"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ADMIN_ALLOWED_ORIGINS")
+		configMutex.Unlock()
+	}()
+	noc, err := websocket.Dial(wsURL, "", "https://noc.example.com")
+	if err != nil {
+		t.Fatalf("allowed origin refused: %v", err)
+	}
+	noc.Close()
+}
+
+func TestDashboard(t *testing.T) {
+	rr := httptest.NewRecorder()
+	dashboardHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/dashboard", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "/admin/dashboard/data") {
+		t.Fatalf("dashboard page: code %d", rr.Code)
+	}
+
+	recentSpamMu.Lock()
+	saved := recentSpam
+	recentSpam = nil
+	recentSpamMu.Unlock()
+	defer func() {
+		recentSpamMu.Lock()
+		recentSpam = saved
+		recentSpamMu.Unlock()
+	}()
+
+	for i := 0; i < DashboardRecentSpam+5; i++ {
+		rememberVerdict(VerdictEvent{Time: int64(i), Action: "spam"})
+	}
+	rememberVerdict(VerdictEvent{Time: 1000, Action: "allow"})
+	recent := recentSpamVerdicts()
+	if len(recent) != DashboardRecentSpam || recent[0].Time != int64(DashboardRecentSpam+4) {
+		t.Errorf("recent spam: %d entries, newest %d", len(recent), recent[0].Time)
+	}
+}
+
+func TestWriteMetricsTextfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guardian.prom")
+	promSyncSeq.Set(42)
+	if err := writeMetricsTextfile(path); err != nil {
+		t.Fatalf("writeMetricsTextfile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	text := string(data)
+	if !strings.Contains(text, "mailuminati_guardian_sync_seq 42") {
+		t.Errorf("sync_seq missing from textfile:\n%s", text)
+	}
+	if strings.Contains(text, "go_goroutines") || strings.Contains(text, "process_") {
+		t.Errorf("runtime metrics should be left to node_exporter")
+	}
+}
+
+func TestCheckFilenames(t *testing.T) {
+	configMutex.Lock()
+	configMap["FILENAME_BLOCK"] = "*.iso, /^invoice_[0-9]+\\.zip$/"
+	configMap["FILENAME_FLAG"] = "*.html,[bad"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "FILENAME_BLOCK")
+		delete(configMap, "FILENAME_FLAG")
+		configMutex.Unlock()
+		loadFilenameRules()
+	}()
+	loadFilenameRules()
+
+	build := func(names ...string) *enmime.Envelope {
+		b := enmime.Builder().From("a", "a@example.com").To("b", "b@example.com").Subject("files").Text([]byte("see attached"))
+		for _, n := range names {
+			b = b.AddAttachment([]byte("content"), "application/octet-stream", n)
+		}
+		part, err := b.Build()
+		if err != nil {
+			t.Fatalf("build: %v", err)
+		}
+		var buf bytes.Buffer
+		part.Encode(&buf)
+		env, err := enmime.ReadEnvelope(&buf)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		return env
+	}
+
+	tests := []struct {
+		names   []string
+		blocked string
+		signals []string
+	}{
+		{[]string{"report.pdf"}, "", nil},
+		{[]string{"Setup.ISO"}, "Setup.ISO", nil},
+		{[]string{"INVOICE_2024.zip"}, "INVOICE_2024.zip", nil},
+		{[]string{"scan.pdf.exe", "page.html"}, "", []string{"suspicious_filename", "double_extension"}},
+		{[]string{"v1.2.3.txt"}, "", nil},
+	}
+	for _, tt := range tests {
+		v := checkFilenames(build(tt.names...))
+		if v.Blocked != tt.blocked || strings.Join(v.Signals, ",") != strings.Join(tt.signals, ",") {
+			t.Errorf("checkFilenames(%v) = %+v, want blocked %q signals %v", tt.names, v, tt.blocked, tt.signals)
+		}
+	}
+}
+
+func TestCredentialForm(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain newsletter", `<p>Hello</p><a href="https://shop.example.com">Shop</a>`, ""},
+		{"search box", `<form action="https://search.example.net/q"><input name="q"></form>`, ""},
+		{"password field", `<form><input type="PASSWORD" name="pw"></form>`, "password_input"},
+		{"external post", `<form method="post" action="https://collect.evil.test/p.php"><input name="email"></form>`, "external_form:collect.evil.test"},
+		{"sender post", `<form method="POST" action="https://www.bank.example/survey"><input name="a"></form>`, ""},
+	}
+	for _, tt := range tests {
+		got := strings.Join(credentialForm(tt.body, "bank.example"), ",")
+		if got != tt.want {
+			t.Errorf("%s: credentialForm() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// renderQR draws text as a QR code of the given correction level (L, M, Q, H), scale
+// pixels per module, turned a quarter clockwise when rotate is set and with damage
+// modules of the data area inverted
+func renderQR(t *testing.T, text, level string, scale int, rotate bool, damage int) *image.Gray {
+	t.Helper()
+	hints := map[gozxing.EncodeHintType]interface{}{gozxing.EncodeHintType_ERROR_CORRECTION: level}
+	m, err := qrcode.NewQRCodeWriter().Encode(text, gozxing.BarcodeFormat_QR_CODE, 0, 0, hints)
+	if err != nil {
+		t.Fatalf("encode %q: %v", text, err)
+	}
+	size := m.GetWidth()
+	for i := 0; i < damage; i++ {
+		// Away from the finder and alignment patterns, inside the 4 module quiet zone
+		m.Flip(size-7, size-5-i*2)
+	}
+	side := size * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			col, row := x/scale, y/scale
+			if rotate {
+				col, row = y/scale, size-1-x/scale
+			}
+			if !m.Get(col, row) {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestDecodeQR(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		level  string
+		scale  int
+		rotate bool
+		damage int
+	}{
+		{"small", "https://ex.am", "M", 4, false, 0},
+		{"rotated", "https://login.example-bank.test/verify?id=0123456789", "L", 3, true, 0},
+		{"long", "https://secure-docs.example.test/shared/file?token=ABCDEFGHIJKLMNOPQRSTUVWXYZ01234", "Q", 5, false, 0},
+		{"damaged modules", "https://damaged.example.test/x", "H", 4, false, 6},
+	}
+	for _, tt := range tests {
+		got, err := decodeQR(renderQR(t, tt.text, tt.level, tt.scale, tt.rotate, tt.damage))
+		if err != nil || got != tt.text {
+			t.Errorf("%s: decodeQR() = %q, %v, want %q", tt.name, got, err, tt.text)
+		}
+	}
+
+	// Inside a larger picture, as an RGBA image
+	code := renderQR(t, "https://inside.example.test/", "M", 3, false, 0)
+	picture := image.NewRGBA(image.Rect(0, 0, 400, 300))
+	draw.Draw(picture, picture.Bounds(), image.NewUniform(color.RGBA{200, 220, 240, 255}), image.Point{}, draw.Src)
+	draw.Draw(picture, code.Bounds().Add(image.Pt(150, 80)), code, image.Point{}, draw.Src)
+	if got, err := decodeQR(picture); err != nil || got != "https://inside.example.test/" {
+		t.Errorf("decodeQR() of a code inside a picture = %q, %v", got, err)
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, renderQR(t, "https://quish.example.test/a", "M", 4, false, 0))
+	if got := qrURL(buf.Bytes()); got != "https://quish.example.test/a" {
+		t.Errorf("qrURL() = %q, want the encoded URL", got)
+	}
+	buf.Reset()
+	png.Encode(&buf, renderQR(t, "WIFI:S:guest;;", "M", 4, false, 0))
+	if got := qrURL(buf.Bytes()); got != "" {
+		t.Errorf("qrURL() = %q for a non-URL code, want empty", got)
+	}
+	buf.Reset()
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 64, 64)))
+	if got := qrURL(buf.Bytes()); got != "" {
+		t.Errorf("qrURL() = %q for a blank image, want empty", got)
+	}
+
+	// Oversized images are refused before any decoding
+	huge := image.NewGray(image.Rect(0, 0, MaxQRImagePixels/1000+1, 1000))
+	if _, err := decodeQR(huge); err == nil {
+		t.Errorf("decodeQR() searched an image above MaxQRImagePixels")
+	}
+
+	// Only the first images of a message are searched
+	buf.Reset()
+	png.Encode(&buf, renderQR(t, "https://last.example.test/", "M", 4, false, 0))
+	env := &enmime.Envelope{}
+	for i := 0; i < MaxQRImagesPerMessage; i++ {
+		env.Attachments = append(env.Attachments, &enmime.Part{ContentType: "image/png", Content: []byte("not an image")})
+	}
+	env.Attachments = append(env.Attachments, &enmime.Part{ContentType: "image/png", Content: buf.Bytes()})
+	if got := messageQRURLs(env); len(got) != 0 {
+		t.Errorf("messageQRURLs() = %v, want the images past MaxQRImagesPerMessage skipped", got)
+	}
+	env.Attachments = env.Attachments[MaxQRImagesPerMessage-1:]
+	if got := messageQRURLs(env); len(got) != 1 || got[0] != "https://last.example.test/" {
+		t.Errorf("messageQRURLs() = %v, want the encoded URL", got)
+	}
+}
+
+func TestImageHostAddress(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.10", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		if publicAddress(net.ParseIP(ip)) {
+			t.Errorf("publicAddress(%s) = true", ip)
+		}
+	}
+	for _, ip := range []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"} {
+		if !publicAddress(net.ParseIP(ip)) {
+			t.Errorf("publicAddress(%s) = false", ip)
+		}
+	}
+
+	fetched := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+		w.Write(make([]byte, MinExternalImageSize))
+	}))
+	defer internal.Close()
+	if _, err := downloadImage(context.Background(), internal.URL); !errors.Is(err, errImageAddress) || fetched {
+		t.Errorf("downloadImage() of a loopback host = %v, want refused", err)
+	}
+	if _, err := downloadImage(context.Background(), "file:///etc/passwd"); err == nil {
+		t.Errorf("downloadImage() of a file URL succeeded")
+	}
+
+	// An allowed host cannot redirect to a refused one
+	configMutex.Lock()
+	configMap["MI_IMAGE_ALLOWED_NETS"] = "127.0.0.1"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "MI_IMAGE_ALLOWED_NETS")
+		configMutex.Unlock()
+	}()
+	redirect := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	defer redirect.Close()
+	if _, err := downloadImage(context.Background(), redirect.URL); !errors.Is(err, errImageAddress) {
+		t.Errorf("downloadImage() redirected to a link-local host = %v, want refused", err)
+	}
+}
+
+func TestImageFetchPoliteness(t *testing.T) {
+	configMutex.Lock()
+	configMap["MI_IMAGE_USER_AGENT"] = "GuardianTest/1.0"
+	configMap["MI_IMAGE_ALLOWED_NETS"] = "127.0.0.1"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "MI_IMAGE_USER_AGENT")
+		delete(configMap, "MI_IMAGE_ALLOWED_NETS")
+		configMutex.Unlock()
+	}()
+
+	var agent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agent = r.Header.Get("User-Agent")
+		w.Write(make([]byte, MinExternalImageSize))
+	}))
+	defer ts.Close()
+
+	if _, err := downloadImage(context.Background(), ts.URL); err != nil {
+		t.Fatalf("downloadImage() error: %v", err)
+	}
+	if agent != "GuardianTest/1.0" {
+		t.Errorf("User-Agent = %q, want GuardianTest/1.0", agent)
+	}
+
+	// A single slot held elsewhere blocks downloads until their deadline
+	resizeFetchSlots(1)
+	defer resizeFetchSlots(DefaultImageGlobalConcurrency)
+	release, err := acquireFetchSlot(context.Background())
+	if err != nil {
+		t.Fatalf("acquireFetchSlot() error: %v", err)
+	}
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := downloadImage(short, ts.URL); err == nil {
+		t.Errorf("downloadImage() succeeded without a free slot")
+	}
+	release()
+	if _, err := downloadImage(context.Background(), ts.URL); err != nil {
+		t.Errorf("downloadImage() after release error: %v", err)
+	}
+}
+
+func TestRemoteImageHash(t *testing.T) {
+	var got struct {
+		URL string `json:"url"`
+	}
+	var auth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		auth = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"hash":"T1ABCDEF","size":%d}`, MinExternalImageSize+1)
+	}))
+	defer proxy.Close()
+
+	configMutex.Lock()
+	configMap["IMAGE_FETCH_MODE"] = "Proxy"
+	configMap["IMAGE_FETCH_PROXY_URL"] = proxy.URL
+	configMap["IMAGE_FETCH_PROXY_TOKEN"] = "secret"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "IMAGE_FETCH_MODE")
+		delete(configMap, "IMAGE_FETCH_PROXY_URL")
+		delete(configMap, "IMAGE_FETCH_PROXY_TOKEN")
+		configMutex.Unlock()
+	}()
+
+	mode := imageFetchMode()
+	if mode != "proxy" {
+		t.Fatalf("imageFetchMode() = %q, want proxy", mode)
+	}
+	hash, size, err := remoteImageHash(context.Background(), mode, "https://tracker.example.test/p.png?u=42")
+	if err != nil || hash != "T1ABCDEF" || size != MinExternalImageSize+1 {
+		t.Errorf("remoteImageHash() = %q, %d, %v", hash, size, err)
+	}
+	if got.URL != "https://tracker.example.test/p.png?u=42" || auth != "Bearer secret" {
+		t.Errorf("proxy received url %q, authorization %q", got.URL, auth)
+	}
+
+	configMutex.Lock()
+	configMap["IMAGE_FETCH_MODE"] = "bogus"
+	configMutex.Unlock()
+	if mode := imageFetchMode(); mode != "direct" {
+		t.Errorf("imageFetchMode() = %q for an unknown mode, want direct", mode)
+	}
+}
+
+func TestCoalescedAnalyzeHandler(t *testing.T) {
+	ts := setupMockOracle()
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	emailBody := "Subject: List post\r\nMessage-ID: <list-42@example.org>\r\n\r\nWeekly digest of the example mailing list."
+	analyze := func(rcpt string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(emailBody))
+		req.Header.Set("X-Guardian-Rcpt-To", rcpt)
+		rr := httptest.NewRecorder()
+		coalescedAnalyzeHandler(rr, req)
+		return rr
+	}
+
+	cached := testutil.ToFloat64(promAnalyzeDedup.WithLabelValues("cache"))
+	first := analyze("alice@example.net")
+	if first.Code != http.StatusOK {
+		t.Fatalf("POST /analyze = %d, want 200", first.Code)
+	}
+	second := analyze("Alice@example.net")
+	if second.Code != http.StatusOK || second.Body.String() != first.Body.String() {
+		t.Errorf("identical request = %d %s, want the first response", second.Code, second.Body.String())
+	}
+	if got := testutil.ToFloat64(promAnalyzeDedup.WithLabelValues("cache")) - cached; got != 1 {
+		t.Errorf("cache reuses = %v, want 1", got)
+	}
+
+	// Another recipient, even of the same domain, is analyzed (and quarantined) on its own
+	scans := atomic.LoadInt64(&scanCount)
+	analyze("bob@example.net")
+	analyze("carol@example.com")
+	if got := testutil.ToFloat64(promAnalyzeDedup.WithLabelValues("cache")) - cached; got != 1 {
+		t.Errorf("cache reuses after other recipients = %v, want 1", got)
+	}
+	if got := atomic.LoadInt64(&scanCount) - scans; got != 2 {
+		t.Errorf("analyses for other recipients = %d, want 2", got)
+	}
+}
+
+func TestVerdictCache(t *testing.T) {
+	ts := setupMockOracle()
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+	defer verdictCache.Purge()
+	originalThreshold := atomic.LoadInt64(&localSpamThreshold)
+	atomic.StoreInt64(&localSpamThreshold, 3)
+	defer atomic.StoreInt64(&localSpamThreshold, originalThreshold)
+
+	body := strings.Repeat("Your account statement for October is ready, sign in to review the recent transactions. ", 4)
+	analyze := func(messageID, attachment string) *httptest.ResponseRecorder {
+		raw := "From: <alerts@bank.example>\r\nSubject: Statement\r\nMessage-ID: <" + messageID + "@bank.example>\r\nMIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\n" + body +
+			"\r\n--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=\"" + attachment + "\"\r\n\r\n" +
+			strings.Repeat("statement data ", 20) + "\r\n--b--\r\n"
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(raw))
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		return rr
+	}
+	hits := func(level string) float64 { return testutil.ToFloat64(promVerdictCache.WithLabelValues(level)) }
+
+	memory, redisHits := hits("memory"), hits("redis")
+	first := analyze("retry-1", "statement.pdf")
+	if first.Code != http.StatusOK {
+		t.Fatalf("POST /analyze = %d, want 200", first.Code)
+	}
+	// A retry with another Message-ID is answered from memory, with the same hashes
+	second := analyze("retry-2", "statement.pdf")
+	if second.Body.String() != first.Body.String() || hits("memory")-memory != 1 {
+		t.Errorf("retried delivery = %s (memory hits %v), want the first response from memory", second.Body.String(), hits("memory")-memory)
+	}
+	// Another Guardian on the same Redis finds it there
+	verdictCache.Purge()
+	if third := analyze("retry-3", "statement.pdf"); third.Body.String() != first.Body.String() || hits("redis")-redisHits != 1 {
+		t.Errorf("copy after memory purge = %s (redis hits %v), want the first response from Redis", third.Body.String(), hits("redis")-redisHits)
+	}
+
+	// Attachment names count: FILENAME_BLOCK may apply to one and not the other
+	before := hits("memory") + hits("redis")
+	analyze("renamed", "statement.exe")
+	if hits("memory")+hits("redis") != before {
+		t.Error("Message with another attachment name was answered from the cache")
+	}
+
+	// Domain blocklists are checked before the cache
+	rdb.SAdd(ctx, domainBlocklists["sender"], "bank.example")
+	if blocked := analyze("blocked", "statement.pdf"); !strings.Contains(blocked.Body.String(), "blocked_sender") {
+		t.Errorf("blocked sender = %s, want blocked_sender rather than the cached verdict", blocked.Body.String())
+	}
+	rdb.SRem(ctx, domainBlocklists["sender"], "bank.example")
+
+	// A From-domain put under DMARC scrutiny keeps the profile name with a lower threshold
+	atomic.StoreInt64(&dmarcSpamThreshold, 1)
+	defer atomic.StoreInt64(&dmarcSpamThreshold, DefaultDmarcThreshold)
+	rdb.Set(ctx, DmarcScrutinyPrefix+"bank.example", "1", time.Hour)
+	analyze("scrutiny", "statement.pdf")
+	rdb.Del(ctx, DmarcScrutinyPrefix+"bank.example")
+	if hits("memory")+hits("redis") != before {
+		t.Error("Message under DMARC scrutiny was answered from the cache")
+	}
+
+	// Admin changes drop cached verdicts at once
+	forgetVerdicts()
+	left, _, _ := rdb.Scan(ctx, 0, VerdictCachePrefix+"*", 1000).Result()
+	if _, _, ok := cachedVerdict(verdictCacheKey(&enmime.Envelope{Text: body})); ok || len(left) != 0 {
+		t.Error("forgetVerdicts() left cached verdicts")
+	}
+
+	atomic.StoreInt64(&verdictCacheTTL, 0)
+	defer atomic.StoreInt64(&verdictCacheTTL, DefaultVerdictCacheTTL)
+	analyze("off-1", "statement.pdf")
+	analyze("off-2", "statement.pdf")
+	if hits("memory")+hits("redis") != before {
+		t.Error("VERDICT_CACHE_TTL=0 should disable the cache")
+	}
+}
+
+func TestOutboundAdvice(t *testing.T) {
+	configMutex.Lock()
+	configMap["OUTBOUND_DKIM_SELECTORS"] = "shop.example:mail2025"
+	configMap["OUTBOUND_BULK_RECIPIENTS"] = "3"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "OUTBOUND_DKIM_SELECTORS")
+		delete(configMap, "OUTBOUND_BULK_RECIPIENTS")
+		configMutex.Unlock()
+	}()
+
+	codes := func(advice []Advice) []string {
+		var c []string
+		for _, a := range advice {
+			c = append(c, a.Code)
+		}
+		return c
+	}
+
+	newsletter, _ := enmime.ReadEnvelope(strings.NewReader("From: News <news@shop.example>\r\nSubject: Deals\r\n" +
+		"Content-Type: text/html\r\n\r\n<p>Our deals of the week</p>"))
+	meta := EnvelopeMeta{MailFrom: "bounce@mailer.example", RcptTo: []string{"a@x.example", "b@y.example", "c@z.example"}, AuthUser: "news"}
+	advice := outboundAdvice(newsletter, meta)
+	want := []string{"dkim_sign", "list_unsubscribe", "message_id", "date", "text_part", "envelope_alignment"}
+	if !reflect.DeepEqual(codes(advice), want) {
+		t.Fatalf("outboundAdvice() = %v, want %v", codes(advice), want)
+	}
+	if advice[0].Selector != "mail2025" || advice[0].Domain != "shop.example" {
+		t.Errorf("dkim_sign advice = %+v, want selector mail2025 for shop.example", advice[0])
+	}
+
+	// A signed personal message with the usual headers needs nothing
+	personal, _ := enmime.ReadEnvelope(strings.NewReader("From: alice@shop.example\r\nDate: Mon, 2 Jun 2025 10:00:00 +0000\r\n" +
+		"Message-ID: <1@shop.example>\r\nDKIM-Signature: v=1; a=rsa-sha256; d=shop.example; s=mail2025; b=abc\r\n\r\nSee you tomorrow."))
+	if advice := outboundAdvice(personal, EnvelopeMeta{MailFrom: "alice@shop.example", RcptTo: []string{"bob@x.example"}}); len(advice) != 0 {
+		t.Errorf("outboundAdvice() = %v for a well formed message, want none", codes(advice))
+	}
+
+	// Only submissions get advice in the /analyze response
+	raw := "From: news@shop.example\r\nSubject: Deals\r\n\r\nOur deals of the week."
+	for _, tc := range []struct {
+		headers map[string]string
+		want    bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"X-Guardian-Auth-User": "news"}, true},
+		{map[string]string{"X-Guardian-Auth-User": "news", "X-Guardian-Direction": "inbound"}, false},
+		{map[string]string{"X-Guardian-Direction": "outbound"}, true},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(raw))
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		if got := strings.Contains(rr.Body.String(), `"advisories"`); got != tc.want {
+			t.Errorf("headers %v: advisories in response = %v, want %v (%s)", tc.headers, got, tc.want, rr.Body.String())
+		}
+	}
+}
+
+func TestMimeLimits(t *testing.T) {
+	// Multipart nested depth levels, each with a text part
+	nested := func(depth int) string {
+		var b strings.Builder
+		b.WriteString("Subject: nested\r\nContent-Type: multipart/mixed; boundary=\"b0\"\r\n\r\n")
+		for i := 0; i < depth; i++ {
+			fmt.Fprintf(&b, "--b%d\r\nContent-Type: text/plain\r\n\r\nlevel %d\r\n", i, i)
+			if i < depth-1 {
+				fmt.Fprintf(&b, "--b%d\r\nContent-Type: multipart/mixed;\r\n\tboundary=\"b%d\"\r\n\r\n", i, i+1)
+			}
+		}
+		for i := depth - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "--b%d--\r\n", i)
+		}
+		return b.String()
+	}
+	wide := func(parts int) string {
+		var b strings.Builder
+		b.WriteString("Subject: wide\r\nContent-Type: multipart/mixed; boundary=\"w\"\r\n\r\npreamble\r\n")
+		for i := 0; i < parts; i++ {
+			fmt.Fprintf(&b, "--w\r\nContent-Type: text/plain\r\n\r\n--not a boundary %d\r\n", i)
+		}
+		b.WriteString("--w--\r\n")
+		return b.String()
+	}
+
+	tests := []struct {
+		name      string
+		msg       string
+		wantLimit string
+	}{
+		{"within limits", nested(3), ""},
+		{"too deep", nested(5), "depth"},
+		{"too many parts", wide(12), "parts"},
+		{"plain text", "Subject: hi\r\n\r\n--w\r\n", ""},
+	}
+	for _, tt := range tests {
+		offset, limit := mimeLimitOffset([]byte(tt.msg), 10, 4)
+		if limit != tt.wantLimit {
+			t.Errorf("%s: mimeLimitOffset() limit = %q, want %q", tt.name, limit, tt.wantLimit)
+		}
+		if limit != "" && !strings.HasPrefix(tt.msg[offset:], "--") {
+			t.Errorf("%s: offset %d does not start a part", tt.name, offset)
+		}
+	}
+
+	atomic.StoreInt64(&mimeMaxParts, 10)
+	defer atomic.StoreInt64(&mimeMaxParts, DefaultMimeMaxParts)
+	env, limit, err := readEnvelopeLimited([]byte(wide(12)))
+	if err != nil || limit != "parts" {
+		t.Fatalf("readEnvelopeLimited() = %v, %q, want a truncated envelope", err, limit)
+	}
+	children := 0
+	for p := env.Root.FirstChild; p != nil; p = p.NextSibling {
+		children++
+	}
+	if children != 10 {
+		t.Errorf("truncated envelope has %d parts, want 10", children)
+	}
+
+	mimeLimitReject.Store(true)
+	defer mimeLimitReject.Store(false)
+	if _, _, err := readEnvelopeLimited([]byte(wide(12))); err != errMimeLimits {
+		t.Errorf("readEnvelopeLimited() error = %v, want errMimeLimits", err)
+	}
+}
+
+// benchmarkMessage is a typical marketing message: text and HTML alternatives and a PDF
+func benchmarkMessage() []byte {
+	var b strings.Builder
+	b.WriteString("From: Shop <news@shop.example>\r\nTo: user@example.net\r\nSubject: Weekly deals\r\nMessage-ID: <bench-1@shop.example>\r\n")
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n")
+	b.WriteString("--outer\r\nContent-Type: multipart/alternative; boundary=\"alt\"\r\n\r\n")
+	b.WriteString("--alt\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "Deal %d: save %d%% on item %06d, see https://shop.example/p/%d?utm_source=mail\r\n", i, i%50, i*7919, i)
+	}
+	b.WriteString("--alt\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<html><body>")
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&b, "<p style=\"color:#333\">Deal %d: <a href=\"https://shop.example/p/%d?utm_source=mail\">save %d%%</a></p>\r\n", i, i, i%50)
+	}
+	b.WriteString("</body></html>\r\n--alt--\r\n")
+	b.WriteString("--outer\r\nContent-Type: application/pdf; name=\"catalog.pdf\"\r\nContent-Disposition: attachment; filename=\"catalog.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	pdf := make([]byte, 48*1024)
+	for i := range pdf {
+		pdf[i] = byte(i * 31 % 251)
+	}
+	encoded := base64.StdEncoding.EncodeToString(pdf)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded + "\r\n--outer--\r\n")
+	return []byte(b.String())
+}
+
+func BenchmarkParse(b *testing.B) {
+	raw := benchmarkMessage()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readEnvelopeLimited(raw); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNormalizeEmailBody(b *testing.B) {
+	env, _, _ := readEnvelopeLimited(benchmarkMessage())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		normalizeEmailBody(env.Text, env.HTML)
+	}
+}
+
+func BenchmarkComputeLocalTLSH(b *testing.B) {
+	env, _, _ := readEnvelopeLimited(benchmarkMessage())
+	body := normalizeEmailBody(env.Text, env.HTML)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	for i := 0; i < b.N; i++ {
+		if _, err := analyze.TLSH(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExtractBands(b *testing.B) {
+	env, _, _ := readEnvelopeLimited(benchmarkMessage())
+	sig, _ := analyze.TLSH(normalizeEmailBody(env.Text, env.HTML))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		extractBands_6_3(sig)
+	}
+}
+
+func BenchmarkComputeDistanceBatch(b *testing.B) {
+	var candidates []string
+	for i := 0; i < 5000; i++ {
+		sig, _ := analyze.TLSH(fmt.Sprintf("Campaign variant %d %s", i, strings.Repeat("cheap watches and pills ", 8+i%5)))
+		candidates = append(candidates, sig)
+	}
+	for _, name := range []string{"reference", "fast"} {
+		backend := distanceBackends[name]
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				backend.Batch(candidates[0], candidates)
+			}
+		})
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	m := &benchMessage{raw: benchmarkMessage()}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, stage := range benchStages {
+			stage.run(m)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "deals.eml"), benchmarkMessage(), 0o644)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "sub", "short.eml"), []byte("Subject: hi\r\n\r\nShort note."), 0o644)
+
+	report, err := runBench(dir, 2)
+	if err != nil {
+		t.Fatalf("runBench() error: %v", err)
+	}
+	if report.Messages != 2 || report.Iterations != 2 || len(report.Stages) != len(benchStages) {
+		t.Errorf("runBench() = %+v, want 2 messages, 2 iterations and every stage", report)
+	}
+	if report.MsgsPerSec <= 0 || report.Stages[0].Stage != "parse" || report.Stages[0].AllocsPerMsg == 0 {
+		t.Errorf("runBench() stages = %+v, want measured stages", report.Stages)
+	}
+
+	if _, err := runBench(t.TempDir(), 1); err == nil {
+		t.Errorf("runBench() on an empty directory succeeded")
+	}
+}
+
+// fuzzMessages are malformed messages seeding the fuzz targets
+var fuzzMessages = []string{
+	"",
+	"Subject: no body",
+	"Subject: x\r\n\r\nplain body",
+	"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\n\r\nunterminated",
+	"Content-Type: multipart/mixed; boundary=\"\"\r\n\r\n--\r\n--\r\n",
+	"Content-Type: multipart/alternative; boundary=b\r\n\r\n--b\r\nContent-Type: text/html\r\n\r\n<img src=\"http://x/\"<img src='https://y/a.png'>\r\n--b--",
+	"Content-Type: multipart/mixed; boundary=a\r\n\r\n--a\r\nContent-Type: multipart/mixed; boundary=a\r\n\r\n--a\r\n--a--\r\n--a--",
+	"Content-Type: message/rfc822\r\n\r\nContent-Type: message/rfc822\r\n\r\nSubject: inner\r\n\r\nbody",
+	"Content-Type: text/plain; charset=\"x-unknown\"\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!not base64===",
+	"Content-Type: application/octet-stream; name=\"a.pdf.exe\"\r\nContent-Disposition: attachment; filename*=utf-8''%E2%80%AE\r\n\r\nMZ",
+	"Content-Type: text/html\r\n\r\n<form method=post action=\"//\"><input type=password></form><img src=\"https://",
+	"From: =?utf-8?B?broken?=\r\nSubject: =?x?Q?=ZZ?=\r\n\r\n",
+}
+
+func FuzzNormalizeEmailBody(f *testing.F) {
+	for _, m := range fuzzMessages {
+		f.Add(m, m)
+	}
+	f.Fuzz(func(t *testing.T, text, html string) {
+		normalizeEmailBody(text, html)
+	})
+}
+
+func FuzzExtractImageURLs(f *testing.F) {
+	for _, m := range fuzzMessages {
+		f.Add(m)
+	}
+	f.Fuzz(func(t *testing.T, html string) {
+		for _, u := range extractImageURLs(html) {
+			if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+				t.Errorf("extractImageURLs() returned %q", u)
+			}
+		}
+	})
+}
+
+func FuzzExtractBands(f *testing.F) {
+	f.Add("T1A9B0C1D2E3F4A5B6C7D8E9F0A1B2C3D4E5F6A7B8C9D0E1F2A3B4C5D6E7F8A9B0C1D2E3F")
+	f.Add("T1")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, sig string) {
+		for _, band := range extractBands_6_3(sig) {
+			if !strings.Contains(band, ":") {
+				t.Errorf("extractBands_6_3() band %q", band)
+			}
+		}
+	})
+}
+
+// FuzzAnalyzeMessage runs raw messages through the in-process stages of /analyze
+func FuzzAnalyzeMessage(f *testing.F) {
+	for _, m := range fuzzMessages {
+		f.Add([]byte(m))
+	}
+	f.Add(benchmarkMessage())
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		mimeLimitOffset(raw, DefaultMimeMaxParts, DefaultMimeMaxDepth)
+		m := &benchMessage{raw: raw}
+		if env, _, err := readEnvelopeLimited(raw); err != nil || env == nil {
+			return
+		}
+		for _, stage := range benchStages {
+			stage.run(m)
+		}
+		classifyTrustedSource(m.env, EnvelopeMeta{})
+		tenantOf(m.env, EnvelopeMeta{})
+	})
+}
+
+func FuzzQRDecode(f *testing.F) {
+	f.Add([]byte{0x40, 0xd6, 0x87, 0x47, 0x47, 0x07, 0x33, 0xa2, 0xf2, 0xf6, 0x57, 0x82, 0xe6, 0x16, 0xd0}, uint8(1))
+	f.Add([]byte{0x10, 0x20, 0x0c, 0x56, 0x61, 0x80}, uint8(10))
+	f.Add([]byte("\x89PNG\r\n\x1a\n"), uint8(32))
+	f.Fuzz(func(t *testing.T, data []byte, v uint8) {
+		// The bytes as an image file
+		qrURL(data)
+
+		// The same bytes as the pixels of a picture v pixels wide
+		if width := int(v) + 1; len(data) >= width {
+			img := image.NewGray(image.Rect(0, 0, width, len(data)/width))
+			copy(img.Pix, data)
+			decodeQR(img)
+		}
+	})
+}
+
+func TestEximFormat(t *testing.T) {
+	line := eximLine(AnalysisResult{Action: "spam", Label: "oracle_spam", ProximityMatch: true, Distance: 12},
+		"reject", `554 5.7.1 Rejected "spam"`, 0, nil)
+	want := `action=deny verdict=spam label=oracle_spam mta_action=reject proximity_match=true distance=12 message="554 5.7.1 Rejected \"spam\""` + "\n"
+	if line != want {
+		t.Errorf("eximLine() = %q, want %q", line, want)
+	}
+	for _, tc := range []struct{ verdict, action, want string }{
+		{"spam", "", "warn"},
+		{"spam", "quarantine", "warn"},
+		{"spam", "tempfail", "defer"},
+		{"spam", "discard", "discard"},
+		{"allow", "", "accept"},
+	} {
+		if got := eximVerb(tc.verdict, tc.action); got != tc.want {
+			t.Errorf("eximVerb(%q, %q) = %q, want %q", tc.verdict, tc.action, got, tc.want)
+		}
+	}
+
+	configMutex.Lock()
+	configMap["ACTION_TEST"] = "reject 554 5.7.1 Test message rejected"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ACTION_TEST")
+		configMutex.Unlock()
+	}()
+
+	raw := "From: a@example.com\r\nSubject: test\r\n\r\nMAILUMINATI-GUARDIAN-TEST-PATTERN-5D8E1F0B-SPAM-THIS-MESSAGE"
+	req := httptest.NewRequest(http.MethodPost, "/analyze?format=exim", strings.NewReader(raw))
+	rr := httptest.NewRecorder()
+	analyzeHandler(rr, req)
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	if got := rr.Body.String(); !strings.HasPrefix(got, "action=deny verdict=spam label=test mta_action=reject") ||
+		!strings.Contains(got, `message="554 5.7.1 Test message rejected"`) {
+		t.Errorf("exim response = %q", got)
+	}
+}
+
+func TestVerdictEndpoint(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	post := func(body string) (*httptest.ResponseRecorder, VerdictResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/verdict", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		verdictHandler(rr, req)
+		var resp VerdictResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	// Signatures computed by the client are looked up as they are
+	blocked, _ := analyze.TLSH(strings.Repeat("Your mailbox is full, sign in again to keep receiving mail. ", 6))
+	if err := blockHash(blocked, "test", time.Hour); err != nil {
+		t.Fatalf("blockHash() error: %v", err)
+	}
+	payload, _ := json.Marshal(VerdictRequest{Headers: "From: it@example.com\r\nSubject: Mailbox full\r\n", Signatures: []string{blocked}})
+	if rr, resp := post(string(payload)); rr.Code != http.StatusOK || resp.Verdict != "spam" || resp.Label != "kill_switch" {
+		t.Errorf("verdict for a blocked signature = %d %+v, want spam/kill_switch", rr.Code, resp)
+	}
+
+	// Without signatures, Guardian hashes the posted body
+	payload, _ = json.Marshal(VerdictRequest{Text: "Hello\n" + TestSpamPattern})
+	if _, resp := post(string(payload)); resp.Verdict != "spam" || resp.Label != "test" {
+		t.Errorf("verdict for the test pattern = %+v, want spam/test", resp)
+	}
+	payload, _ = json.Marshal(VerdictRequest{Text: strings.Repeat("Minutes of the weekly team meeting, see the agenda below. ", 4)})
+	if _, resp := post(string(payload)); resp.Verdict != "allow" || len(resp.Signatures) == 0 {
+		t.Errorf("verdict for a clean body = %+v, want allow with its signatures", resp)
+	}
+
+	for _, body := range []string{`{"signatures":["not-a-tlsh"]}`, `{"attachment_sha256":["1234"]}`, `{`} {
+		if rr, _ := post(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", body, rr.Code)
+		}
+	}
+}
+
+func TestMatchEndpoint(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	post := func(body string) (*httptest.ResponseRecorder, VerdictResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/match", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		matchHandler(rr, req)
+		var resp VerdictResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr, resp
+	}
+
+	clean, _ := analyze.TLSH(strings.Repeat("Lunch is served at noon in the main hall on Friday. ", 6))
+	blocked, _ := analyze.TLSH(strings.Repeat("Verify your bank account now or it will be suspended. ", 6))
+	if err := blockHash(blocked, "test", time.Hour); err != nil {
+		t.Fatalf("blockHash() error: %v", err)
+	}
+
+	payload, _ := json.Marshal(MatchRequest{Signatures: []string{clean, blocked}, MessageID: "match-1@example.com"})
+	rr, resp := post(string(payload))
+	if rr.Code != http.StatusOK || resp.Verdict != "spam" || resp.Label != "kill_switch" || resp.MatchedSig != blocked {
+		t.Fatalf("match = %d %+v, want spam/kill_switch on the blocked signature", rr.Code, resp)
+	}
+	payload, _ = json.Marshal(MatchRequest{Signatures: []string{clean}})
+	if _, resp := post(string(payload)); resp.Verdict != "allow" || resp.MatchedSig != "" {
+		t.Errorf("match for a clean signature = %+v, want allow", resp)
+	}
+
+	// The scan is stored under the message id, for /report
+	deadline := time.Now().Add(time.Second)
+	for rdb.Exists(ctx, "mi:msgid:"+messageIDHash("<match-1@example.com>")).Val() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scan of the matched message not stored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, body := range []string{`{}`, `{"signatures":["T1zz"]}`, `{"signatures":["` + clean + `"],"message_id":"a\r\nFrom: x"}`} {
+		if rr, _ := post(body); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", body, rr.Code)
+		}
+	}
+}
+
+func TestAnalyzeFlags(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	defer oracleDecisionCache.Purge()
+
+	configMutex.Lock()
+	configMap["ANALYZE_FLAGS_ALLOWED"] = "local_only,want_evidence"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "ANALYZE_FLAGS_ALLOWED")
+		configMutex.Unlock()
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/analyze?want_evidence=1&skip_oracle=1", nil)
+	req.Header.Set("X-Guardian-Flags", "local_only, bogus")
+	flags, denied := requestFlags(req)
+	if !flags.WantEvidence || !flags.LocalOnly || !flags.SkipOracle || !flags.SkipImages {
+		t.Errorf("requestFlags() = %+v, want want_evidence and local_only (implying the skips)", flags)
+	}
+	if !reflect.DeepEqual(denied, []string{"skip_oracle", "bogus"}) {
+		t.Errorf("requestFlags() denied = %v, want [skip_oracle bogus]", denied)
+	}
+
+	analyze := func(flags string) map[string]interface{} {
+		raw := "From: promo@example.com\r\nSubject: Offer\r\n\r\n" +
+			strings.Repeat("Exclusive offer for our members, claim your voucher before Sunday. ", 5)
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(raw))
+		req.Header.Set("X-Guardian-Flags", flags)
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		var resp map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+
+	// A cached Oracle verdict applies, unless the request is local_only
+	hashes, _ := analyze("")["hashes"].([]interface{})
+	if len(hashes) == 0 {
+		t.Fatal("no hashes computed")
+	}
+	setOracleDecision("mi:oracle_cache:"+hashes[0].(string), []byte(`{"action":"spam","label":"oracle_spam","proximity_match":true}`), time.Hour)
+
+	resp := analyze("want_evidence")
+	if resp["label"] != "oracle_spam" {
+		t.Errorf("label = %v, want oracle_spam", resp["label"])
+	}
+	if evidence, _ := resp["evidence"].([]interface{}); len(evidence) == 0 {
+		t.Errorf("want_evidence response has no evidence: %v", resp)
+	}
+	if resp := analyze("local_only"); resp["action"] != "allow" || resp["evidence"] != nil {
+		t.Errorf("local_only response = %v, want allow without evidence", resp)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1":      "127.0.0.1:12421",
+		"::1":            "[::1]:12421",
+		"[::1]":          "[::1]:12421",
+		"[::1]:12500":    "[::1]:12500",
+		"10.0.0.5:12422": "10.0.0.5:12422",
+		"0.0.0.0":        "0.0.0.0:12421",
+	} {
+		if got := listenAddr(addr, "12421"); got != want {
+			t.Errorf("listenAddr(%q) = %q, want %q", addr, got, want)
+		}
+	}
+
+	configMutex.Lock()
+	configMap["GUARDIAN_BIND_ADDR"] = "127.0.0.1, ::1"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"GUARDIAN_BIND_ADDR", "LISTENERS", "LISTENER_LAN_ADDR", "LISTENER_LAN_TOKEN", "LISTENER_LAN_TLS_CERT", "LISTENER_EMPTY_ADDR"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+	listeners := listenerConfigs()
+	if len(listeners) != 1 || !reflect.DeepEqual(listeners[0].Addrs, []string{"127.0.0.1:12421", "[::1]:12421"}) {
+		t.Errorf("listenerConfigs() = %+v, want the dual-stack default listener", listeners)
+	}
+
+	configMutex.Lock()
+	configMap["LISTENERS"] = "lan,empty"
+	configMap["LISTENER_LAN_ADDR"] = "10.0.0.5:12422"
+	configMap["LISTENER_LAN_TOKEN"] = "s3cret"
+	configMap["LISTENER_LAN_TLS_CERT"] = "/etc/guardian/lan.crt"
+	configMutex.Unlock()
+	listeners = listenerConfigs()
+	if len(listeners) != 1 || listeners[0].Name != "lan" || listeners[0].Token != "s3cret" || listeners[0].CertFile != "" {
+		t.Errorf("listenerConfigs() = %+v, want lan only, without half a TLS pair", listeners)
+	}
+
+	h := listenerAuth("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		path, auth string
+		want       int
+	}{
+		{"/analyze", "", http.StatusUnauthorized},
+		{"/analyze", "Bearer wrong", http.StatusUnauthorized},
+		{"/analyze", "Bearer s3cret", http.StatusOK},
+		{"/admin/bands", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s with %q = %d, want %d", tc.path, tc.auth, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestConnACL(t *testing.T) {
+	configMutex.Lock()
+	configMap["GUARDIAN_ALLOWED_CIDRS"] = "127.0.0.1,10.0.0.0/8,::1"
+	configMap["GUARDIAN_ALLOWED_CIDRS_REPORT"] = "192.0.2.0/24"
+	configMap["GUARDIAN_ALLOWED_CIDRS_ADMIN"] = "127.0.0.1"
+	configMap["GUARDIAN_ALLOWED_CIDRS_ADMIN_BANDS"] = "10.1.2.3"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"GUARDIAN_ALLOWED_CIDRS", "GUARDIAN_ALLOWED_CIDRS_REPORT", "GUARDIAN_ALLOWED_CIDRS_ADMIN", "GUARDIAN_ALLOWED_CIDRS_ADMIN_BANDS"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	h := connACL(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		remote, path string
+		want         int
+	}{
+		{"127.0.0.1:40000", "/analyze", http.StatusOK},
+		{"[::1]:40000", "/analyze", http.StatusOK},
+		{"10.20.30.40:40000", "/v1/verdict", http.StatusOK},
+		{"203.0.113.9:40000", "/analyze", http.StatusForbidden},
+		{"192.0.2.7:40000", "/report", http.StatusOK},
+		{"127.0.0.1:40000", "/report", http.StatusForbidden},
+		{"127.0.0.1:40000", "/admin/conflicts", http.StatusOK},
+		{"10.9.9.9:40000", "/admin/conflicts", http.StatusForbidden},
+		{"10.1.2.3:40000", "/admin/bands", http.StatusOK},
+		{"127.0.0.1:40000", "/admin/bands", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, tc.path, nil)
+		req.RemoteAddr = tc.remote
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s from %s = %d, want %d", tc.path, tc.remote, rr.Code, tc.want)
+		}
+	}
+
+	// Forwarded headers are not trusted
+	req := httptest.NewRequest(http.MethodPost, "/analyze", nil)
+	req.RemoteAddr = "203.0.113.9:40000"
+	req.Header.Set("X-Forwarded-For", "127.0.0.1")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("X-Forwarded-For bypassed the ACL: %d", rr.Code)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	decode := func(rr *httptest.ResponseRecorder) APIError {
+		t.Helper()
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", ct)
+		}
+		var e APIError
+		if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+			t.Fatalf("error body %q is not JSON: %v", rr.Body.String(), err)
+		}
+		return e
+	}
+
+	rr := httptest.NewRecorder()
+	analyzeHandler(rr, httptest.NewRequest(http.MethodGet, "/analyze", nil))
+	if e := decode(rr); rr.Code != http.StatusMethodNotAllowed || e.Code != ErrMethodNotAllowed || e.Retryable {
+		t.Errorf("GET /analyze = %d %+v, want 405 method_not_allowed, not retryable", rr.Code, e)
+	}
+
+	rr = httptest.NewRecorder()
+	verdictHandler(rr, httptest.NewRequest(http.MethodPost, "/v1/verdict", strings.NewReader(`{"signatures":["T1zz"]}`)))
+	if e := decode(rr); rr.Code != http.StatusBadRequest || e.Code != ErrInvalidRequest || e.Message != "Invalid signature" {
+		t.Errorf("invalid signature = %d %+v, want 400 invalid_request", rr.Code, e)
+	}
+
+	// Redis down: the MTA should tempfail and retry
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	rr = httptest.NewRecorder()
+	reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"<down@example.com>","report_type":"spam"}`)))
+	if e := decode(rr); rr.Code != http.StatusInternalServerError || e.Code != ErrStoreUnavailable || !e.Retryable {
+		t.Errorf("report with Redis down = %d %+v, want 500 store_unavailable, retryable", rr.Code, e)
+	}
+}
+
+func TestOracleOutageCacheExtension(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	originalSync, originalAnswer, originalStart := atomic.LoadInt64(&syncLastSuccess), atomic.LoadInt64(&oracleLastAnswer), engineStarted
+	defer func() {
+		atomic.StoreInt64(&syncLastSuccess, originalSync)
+		atomic.StoreInt64(&oracleLastAnswer, originalAnswer)
+		engineStarted = originalStart
+		oracleOutageActive.Store(false)
+	}()
+
+	decision := OracleDecisionPrefix + "sig-expiring"
+	fresh := OracleDecisionPrefix + "sig-fresh"
+	band := OracleCacheFragPrefix + "0:abc"
+	rdb.Set(ctx, decision, `{"action":"spam"}`, time.Minute)
+	rdb.Set(ctx, fresh, `{"action":"spam"}`, time.Hour)
+	rdb.SAdd(ctx, band, "sig-expiring")
+	rdb.Expire(ctx, band, 2*time.Minute)
+
+	// Oracle answered a moment ago: nothing to do
+	now := time.Now().Unix()
+	engineStarted = now - 3600
+	atomic.StoreInt64(&syncLastSuccess, 0)
+	atomic.StoreInt64(&oracleLastAnswer, now)
+	checkOracleOutage()
+	if oracleOutageActive.Load() || rdb.TTL(ctx, decision).Val() > time.Minute {
+		t.Fatalf("cache extended while the Oracle answers")
+	}
+
+	// No answer for longer than ORACLE_OUTAGE_SECONDS
+	atomic.StoreInt64(&oracleLastAnswer, now-DefaultOracleOutage-1)
+	checkOracleOutage()
+	if !oracleOutageActive.Load() {
+		t.Fatalf("outage not detected")
+	}
+	for _, key := range []string{decision, band} {
+		if ttl := rdb.TTL(ctx, key).Val(); ttl < OracleOutageTTLFloor-time.Second {
+			t.Errorf("TTL of %s during outage = %v, want %v", key, ttl, OracleOutageTTLFloor)
+		}
+	}
+	if ttl := rdb.TTL(ctx, fresh).Val(); ttl <= OracleOutageTTLFloor {
+		t.Errorf("TTL of a fresh entry lowered to %v", ttl)
+	}
+
+	// The Oracle answers again: extended entries expire within the recovery window
+	atomic.StoreInt64(&oracleLastAnswer, time.Now().Unix())
+	checkOracleOutage()
+	if oracleOutageActive.Load() {
+		t.Fatalf("outage not cleared")
+	}
+	for _, key := range []string{decision, band} {
+		if ttl := rdb.TTL(ctx, key).Val(); ttl <= 0 || ttl > OracleRecoveryWindow+time.Second {
+			t.Errorf("TTL of %s after recovery = %v, want within %v", key, ttl, OracleRecoveryWindow)
+		}
+	}
+	if ttl := rdb.TTL(ctx, fresh).Val(); ttl <= OracleOutageTTLFloor {
+		t.Errorf("TTL of a fresh entry lowered to %v after recovery", ttl)
+	}
+	if rdb.Exists(ctx, OracleExtendedKey).Val() != 0 {
+		t.Errorf("%s not cleared after recovery", OracleExtendedKey)
+	}
+}
+
+func TestLogTailLearning(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	configMutex.Lock()
+	configMap["LOG_TAIL_SPAM_PATTERN"] = `postfix/cleanup\[\d+\]: (?P<qid>[0-9A-F]+): milter-reject`
+	configMap["LOG_TAIL_HAM_PATTERN"] = `imapsieve: report_ham msgid=(?P<msgid>\S+)`
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "LOG_TAIL_SPAM_PATTERN")
+		delete(configMap, "LOG_TAIL_HAM_PATTERN")
+		configMutex.Unlock()
+	}()
+
+	originalSpam, originalHam, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&hamWeight), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	atomic.StoreInt64(&hamWeight, 2)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&hamWeight, originalHam)
+		localRetentionDuration = originalRetention
+	}()
+
+	spamSig, _ := analyze.TLSH(strings.Repeat("Your mailbox is full, verify your account to keep receiving mail. ", 6))
+	hamSig, _ := analyze.TLSH(strings.Repeat("Minutes of the board meeting are attached for your review. ", 6))
+	for id, sig := range map[string]string{"<tail-spam@example.com>": spamSig, "<tail-ham@example.com>": hamSig} {
+		data, _ := json.Marshal(ScanResult{Hashes: []string{sig}, Action: "allow"})
+		sealed, _ := sealValue(data)
+		rdb.Set(ctx, "mi:msgid:"+messageIDHash(id), sealed, time.Hour)
+	}
+	rdb.Set(ctx, LocalScorePrefix+hamSig, 10, time.Hour)
+	addToBands(LocalFragPrefix, extractBands_6_3(hamSig), hamSig, time.Hour)
+
+	path := filepath.Join(t.TempDir(), "mail.log")
+	os.WriteFile(path, []byte("Oct 15 10:00:00 mx postfix/cleanup[1]: 0AB12: milter-reject: END-OF-MESSAGE (old line)\n"), 0o644)
+	tf := &tailedFile{path: path}
+	defer tf.close()
+	rules := compileLogTailRules()
+	tf.poll(rules)
+
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	f.WriteString("Oct 15 10:00:01 mx postfix/cleanup[1]: 4F2A9C: message-id=<tail-spam@example.com>\n")
+	f.WriteString("Oct 15 10:00:02 mx postfix/cleanup[1]: 4F2A9C: milter-reject: END-OF-MESSAGE from unknown\n")
+	f.WriteString("Oct 15 10:00:03 mx dovecot: imapsieve: report_ham msgid=<tail-ham@example.com>\n")
+	f.WriteString("Oct 15 10:00:04 mx dovecot: imapsieve: report_ham msgid=<tail-ham@exa")
+	f.Close()
+	tf.poll(rules)
+
+	if score, err := rdb.Get(ctx, LocalScorePrefix+spamSig).Float64(); err != nil || score <= 0 {
+		t.Errorf("spam score after reject line = %v (%v), want > 0", score, err)
+	}
+	if score, _ := rdb.Get(ctx, LocalScorePrefix+hamSig).Float64(); score >= 10 {
+		t.Errorf("ham score after report line = %v, want < 10", score)
+	}
+	if tf.partial == "" {
+		t.Errorf("incomplete last line not kept for the next poll")
+	}
+
+	// A duplicate line does not learn twice
+	before, _ := rdb.Get(ctx, LocalScorePrefix+spamSig).Float64()
+	learnFromLog("<tail-spam@example.com>", "spam")
+	if after, _ := rdb.Get(ctx, LocalScorePrefix+spamSig).Float64(); after != before {
+		t.Errorf("duplicate log event learned again: %v -> %v", before, after)
+	}
+
+	// Rotation: the new file is read from its start
+	os.Rename(path, path+".1")
+	os.WriteFile(path, []byte("Oct 15 10:01:00 mx postfix/cleanup[1]: 77EE: message-id=<tail-rotated@example.com>\n"), 0o644)
+	tf.poll(rules)
+	if id, _ := logQueueIDs.Get("77EE"); id != "<tail-rotated@example.com>" {
+		t.Errorf("queue ID of the rotated file = %q, want <tail-rotated@example.com>", id)
+	}
+}
+
+func TestQuarantineDelivery(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	settings := []string{"QUARANTINE_DELIVERY", "QUARANTINE_MAILBOX", "QUARANTINE_IMAP_ADDR", "QUARANTINE_IMAP_TLS",
+		"QUARANTINE_IMAP_USER", "QUARANTINE_IMAP_PASSWORD", "QUARANTINE_JMAP_URL", "QUARANTINE_JMAP_TOKEN"}
+	setConfig := func(values map[string]string) {
+		configMutex.Lock()
+		for _, k := range settings {
+			delete(configMap, k)
+		}
+		for k, v := range values {
+			configMap[k] = v
+		}
+		configMutex.Unlock()
+	}
+	defer setConfig(nil)
+
+	raw := []byte("From: a@example.com\nMessage-ID: <q-1@example.com>\nSubject: Win\n\nClaim your prize\n")
+	res := AnalysisResult{Action: "spam", Label: "local_spam", Distance: 12}
+	meta := EnvelopeMeta{MailFrom: "a@example.com", RcptTo: []string{"bob@example.org"}}
+
+	// IMAP: LOGIN then APPEND of the message with the Guardian headers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	appended := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			tag, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+			switch {
+			case strings.HasPrefix(cmd, `LOGIN "guardian" "s3cret"`):
+				conn.Write([]byte(tag + " OK LOGIN completed\r\n"))
+			case strings.HasPrefix(cmd, `APPEND "Junk Review" {`):
+				size, _ := strconv.Atoi(strings.TrimSuffix(cmd[strings.Index(cmd, "{")+1:], "}"))
+				conn.Write([]byte("+ Ready\r\n"))
+				msg := make([]byte, size+2)
+				io.ReadFull(r, msg)
+				appended <- string(msg[:size])
+				conn.Write([]byte(tag + " OK APPEND completed\r\n"))
+			case cmd == "LOGOUT":
+				conn.Write([]byte("* BYE\r\n" + tag + " OK\r\n"))
+				return
+			default:
+				conn.Write([]byte(tag + " NO unexpected\r\n"))
+			}
+		}
+	}()
+	setConfig(map[string]string{"QUARANTINE_DELIVERY": "imap", "QUARANTINE_MAILBOX": "Junk Review", "QUARANTINE_IMAP_ADDR": ln.Addr().String(),
+		"QUARANTINE_IMAP_TLS": "false", "QUARANTINE_IMAP_USER": "guardian", "QUARANTINE_IMAP_PASSWORD": "s3cret"})
+	if !quarantine(raw, "<q-1@example.com>", res, meta) {
+		t.Fatalf("IMAP quarantine failed")
+	}
+	msg := <-appended
+	for _, want := range []string{"X-Guardian-Verdict: spam\r\n", "X-Guardian-Label: local_spam\r\n", "X-Guardian-Rcpt-To: bob@example.org\r\n", "\r\nClaim your prize\r\n"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("appended message lacks %q:\n%s", want, msg)
+		}
+	}
+	// MTA retries of a quarantined message are not delivered again (the fake server is gone)
+	ln.Close()
+	if !quarantine(raw, "<q-1@example.com>", res, meta) {
+		t.Errorf("retry of a quarantined message not reported as quarantined")
+	}
+	if quarantine(raw, "<q-2@example.com>", res, meta) {
+		t.Errorf("delivery to a closed IMAP server reported as quarantined")
+	}
+	// A copy split for another recipient is not stored yet
+	other := meta
+	other.RcptTo = []string{"carol@example.org"}
+	if quarantine(raw, "<q-1@example.com>", res, other) {
+		t.Errorf("copy for another recipient reported as quarantined")
+	}
+	// Erasure drops the quarantine records of a recipient and of a message
+	if removed := purgeRecipient("Bob@example.org", true); len(removed) != 1 || removed[0] != QuarantinedPrefix+messageIDHash("<q-1@example.com>")+"#bob@example.org" {
+		t.Errorf("purgeRecipient() = %v, want the quarantine record", removed)
+	}
+	if removed := purgeMessageID("q-1@example.com", false); len(removed) != 1 || removed[0] != QuarantinedPrefix+messageIDHash("<q-1@example.com>") {
+		t.Errorf("purgeMessageID() = %v, want the quarantine record", removed)
+	}
+
+	// JMAP: session, upload, then Email/import into the mailbox found by name
+	var imported map[string]interface{}
+	var jmap *httptest.Server
+	jmap = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/.well-known/jmap":
+			fmt.Fprintf(w, `{"apiUrl":%q,"uploadUrl":%q,"primaryAccounts":{"urn:ietf:params:jmap:mail":"acc1"}}`,
+				jmap.URL+"/api", jmap.URL+"/upload/{accountId}")
+		case "/upload/acc1":
+			w.Write([]byte(`{"blobId":"blob1"}`))
+		case "/api":
+			var req struct {
+				MethodCalls [][]json.RawMessage `json:"methodCalls"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			var name string
+			json.Unmarshal(req.MethodCalls[0][0], &name)
+			if name == "Mailbox/query" {
+				w.Write([]byte(`{"methodResponses":[["Mailbox/query",{"ids":["mb7"]},"g"]]}`))
+				return
+			}
+			json.Unmarshal(req.MethodCalls[0][1], &imported)
+			w.Write([]byte(`{"methodResponses":[["Email/import",{"created":{"q":{"id":"e1"}}},"g"]]}`))
+		}
+	}))
+	defer jmap.Close()
+	setConfig(map[string]string{"QUARANTINE_DELIVERY": "jmap", "QUARANTINE_JMAP_URL": jmap.URL + "/.well-known/jmap", "QUARANTINE_JMAP_TOKEN": "tok"})
+	if !quarantine(raw, "<q-3@example.com>", res, meta) {
+		t.Fatalf("JMAP quarantine failed")
+	}
+	email, _ := imported["emails"].(map[string]interface{})["q"].(map[string]interface{})
+	if email["blobId"] != "blob1" || email["mailboxIds"].(map[string]interface{})["mb7"] != true {
+		t.Errorf("Email/import arguments = %v", imported)
+	}
+
+	// Disabled: nothing is delivered
+	setConfig(nil)
+	if quarantine(raw, "<q-4@example.com>", res, meta) {
+		t.Errorf("quarantine reported without QUARANTINE_DELIVERY")
+	}
+}
+
+func TestLinkVerdicts(t *testing.T) {
+	raw := "From: Shop <news@shop.example>\r\nSubject: Your order\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nTrack it at http://192.0.2.10/track?id=1.\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n" +
+		`<a href="https://shop.example/orders">Your orders</a>` +
+		`<a href="https://login.evil.example/paypal">https://www.paypal.com/signin</a>` +
+		`<a href="https://bit.ly/3xYz">Details</a>` +
+		`<a href="https://www.paypal.com@evil.example/">PayPal</a>` + "\r\n--b--\r\n"
+	env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadEnvelope: %v", err)
+	}
+
+	if links := linkVerdicts(env, AnalysisResult{Action: "allow"}); links != nil {
+		t.Fatalf("links listed without LINK_SUGGESTIONS: %v", links)
+	}
+	configMutex.Lock()
+	configMap["LINK_SUGGESTIONS"] = "true"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "LINK_SUGGESTIONS")
+		configMutex.Unlock()
+	}()
+
+	got := make(map[string]LinkVerdict)
+	for _, l := range linkVerdicts(env, AnalysisResult{Action: "allow"}) {
+		got[l.URL] = l
+	}
+	if _, ok := got["https://shop.example/orders"]; ok {
+		t.Errorf("link to the sender's domain listed")
+	}
+	if _, ok := got["https://bit.ly/3xYz"]; ok {
+		t.Errorf("shortener alone listed as suspicious")
+	}
+	if l := got["https://login.evil.example/paypal"]; l.Verdict != "suspicious" || l.Suggestion != "warn" || !slices.Contains(l.Reasons, "text_mismatch") {
+		t.Errorf("mismatched anchor = %+v, want suspicious with text_mismatch", l)
+	}
+	if l := got["http://192.0.2.10/track?id=1"]; l.Verdict != "suspicious" || l.Rewrite != "hxxp://192[.]0[.]2[.]10/track?id=1" {
+		t.Errorf("IP link = %+v, want suspicious, defanged", l)
+	}
+	if l := got["https://www.paypal.com@evil.example/"]; l.Host != "evil.example" || !slices.Contains(l.Reasons, "userinfo") {
+		t.Errorf("userinfo link = %+v, want host evil.example with userinfo", l)
+	}
+
+	// In a spam message, the same links cross the defang score
+	for _, l := range linkVerdicts(env, AnalysisResult{Action: "spam"}) {
+		if l.URL == "https://login.evil.example/paypal" && (l.Verdict != "malicious" || l.Suggestion != "defang") {
+			t.Errorf("mismatched anchor in spam = %+v, want malicious, defang", l)
+		}
+	}
+}
+
+func TestTarpitDelay(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	ham := AnalysisResult{Action: "allow"}
+	spam := AnalysisResult{Action: "spam", Label: "local_spam"}
+	if d := tarpitDelay("192.0.2.1", ham, ""); d != 0 {
+		t.Fatalf("delay without TARPIT_MAX_SECONDS = %d, want 0", d)
+	}
+
+	configMutex.Lock()
+	configMap["TARPIT_MAX_SECONDS"] = "20"
+	configMap["TARPIT_BURST"] = "10"
+	configMap["TARPIT_MIN_MESSAGES"] = "4"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"TARPIT_MAX_SECONDS", "TARPIT_BURST", "TARPIT_MIN_MESSAGES"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	// A clean sender is never slowed down
+	for i := 0; i < 5; i++ {
+		if d := tarpitDelay("192.0.2.2", ham, ""); d != 0 {
+			t.Fatalf("delay of a clean sender = %d, want 0", d)
+		}
+	}
+	// Half spam: half the maximum once the sender has TARPIT_MIN_MESSAGES messages
+	if d := tarpitDelay("192.0.2.3", spam, ""); d != 0 {
+		t.Errorf("delay of a new sender = %d, want 0", d)
+	}
+	tarpitDelay("192.0.2.3", ham, "")
+	tarpitDelay("192.0.2.3", spam, "")
+	if d := tarpitDelay("192.0.2.3", ham, ""); d != 10 {
+		t.Errorf("delay of a half-spam sender = %d, want 10", d)
+	}
+	// Trusted sources keep their counts but are not delayed
+	if d := tarpitDelay("192.0.2.3", ham, "mailing_list"); d != 0 {
+		t.Errorf("delay of a trusted source = %d, want 0", d)
+	}
+	// Bursts: 15 messages in a minute with TARPIT_BURST=10 is half the maximum
+	var d int
+	for i := 0; i < 15; i++ {
+		d = tarpitDelay("192.0.2.4", ham, "")
+	}
+	if d != 10 {
+		t.Errorf("delay of a bursting sender = %d, want 10", d)
+	}
+
+	// /analyze recommends the delay action for borderline senders
+	req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader("From: a@example.com\r\nMessage-ID: <tarpit@example.com>\r\nSubject: Hi\r\n\r\nHello there\r\n"))
+	req.Header.Set("X-Guardian-Client-IP", "192.0.2.4")
+	rr := httptest.NewRecorder()
+	analyzeHandler(rr, req)
+	var resp struct {
+		MTAAction    string `json:"mta_action"`
+		DelaySeconds int    `json:"delay_seconds"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.MTAAction != "delay" || resp.DelaySeconds == 0 {
+		t.Errorf("analyze response = %s, want mta_action delay with delay_seconds", rr.Body.String())
+	}
+}
+
+func TestImageGuard(t *testing.T) {
+	configMutex.Lock()
+	configMap["IMAGE_GUARD_INFLIGHT"] = "10"
+	configMap["IMAGE_GUARD_QUEUE"] = "0"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "IMAGE_GUARD_INFLIGHT")
+		delete(configMap, "IMAGE_GUARD_QUEUE")
+		configMutex.Unlock()
+		atomic.StoreInt64(&analyzeInFlight, 0)
+		atomic.StoreInt64(&redisLatencyMicro, 0)
+		imageGuardPaused.Store(false)
+	}()
+
+	now := time.Now()
+	atomic.StoreInt64(&analyzeInFlight, 10)
+	checkImageGuard(now)
+	if imageGuardPaused.Load() {
+		t.Fatalf("paused at the limit")
+	}
+	atomic.StoreInt64(&analyzeInFlight, 11)
+	checkImageGuard(now)
+	if !imageGuardPaused.Load() {
+		t.Fatalf("not paused above IMAGE_GUARD_INFLIGHT")
+	}
+
+	// Below the limit but above half of it: still paused
+	atomic.StoreInt64(&analyzeInFlight, 8)
+	checkImageGuard(now.Add(time.Minute))
+	if !imageGuardPaused.Load() {
+		t.Fatalf("resumed above half the limit")
+	}
+	// Calm, but not for ImageGuardHold yet
+	atomic.StoreInt64(&analyzeInFlight, 2)
+	checkImageGuard(now.Add(2 * time.Minute))
+	checkImageGuard(now.Add(2*time.Minute + ImageGuardHold - time.Second))
+	if !imageGuardPaused.Load() {
+		t.Fatalf("resumed before ImageGuardHold")
+	}
+	checkImageGuard(now.Add(2*time.Minute + ImageGuardHold))
+	if imageGuardPaused.Load() {
+		t.Fatalf("not resumed after ImageGuardHold of calm")
+	}
+
+	// Redis latency trips it too; the queue check is disabled
+	atomic.StoreInt64(&fetchWaiting, 1000)
+	defer atomic.StoreInt64(&fetchWaiting, 0)
+	checkImageGuard(now)
+	if imageGuardPaused.Load() {
+		t.Fatalf("paused on the queue with IMAGE_GUARD_QUEUE=0")
+	}
+	atomic.StoreInt64(&redisLatencyMicro, (DefaultImageGuardRedisMs+1)*1000)
+	checkImageGuard(now)
+	if over, reason := imageGuardOverload(1); !imageGuardPaused.Load() || !over || reason != "redis_latency" {
+		t.Fatalf("Redis latency: paused=%v reason=%q", imageGuardPaused.Load(), reason)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	oracle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer oracle.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	originalOracle, originalTransport := oracleURL, http.DefaultTransport
+	oracleURL = oracle.URL
+	defer func() {
+		oracleURL, http.DefaultTransport = originalOracle, originalTransport
+		faultsEnabled.Store(false)
+		activeFaults.Store(nil)
+	}()
+
+	call := func(method, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		faultsHandler(rr, httptest.NewRequest(method, "/admin/faults", strings.NewReader(body)))
+		return rr
+	}
+	if rr := call(http.MethodPost, `{"redis_drop_percent":100}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("faults without FAULT_INJECTION = %d, want 403", rr.Code)
+	}
+
+	configMutex.Lock()
+	configMap["FAULT_INJECTION"] = "true"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "FAULT_INJECTION")
+		configMutex.Unlock()
+	}()
+	enableFaultInjection(client)
+
+	if rr := call(http.MethodPost, `{"redis_drop_percent":150}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("percentage above 100 = %d, want 400", rr.Code)
+	}
+	if rr := call(http.MethodPost, `{"redis_drop_percent":100,"oracle_fail_percent":100,"duration_seconds":60}`); rr.Code != http.StatusOK ||
+		!strings.Contains(rr.Body.String(), `"active":true`) {
+		t.Fatalf("set faults = %d %s", rr.Code, rr.Body.String())
+	}
+	if err := rdb.Set(ctx, "k", "v", 0).Err(); err != errInjectedFault {
+		t.Errorf("Redis command with 100%% drop: err = %v, want injected fault", err)
+	}
+	pipe := rdb.Pipeline()
+	get := pipe.Get(ctx, "k")
+	pipe.Exec(ctx)
+	if get.Err() != errInjectedFault {
+		t.Errorf("pipelined command with 100%% drop: err = %v, want injected fault", get.Err())
+	}
+	if _, err := http.Get(oracle.URL + "/analyze"); err == nil || !strings.Contains(err.Error(), errInjectedFault.Error()) {
+		t.Errorf("Oracle request with 100%% failure: err = %v, want injected fault", err)
+	}
+	if resp, err := http.Get(other.URL); err != nil {
+		t.Errorf("request to another host failed: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// Expired or cleared faults stop
+	activeFaults.Load().Expires = time.Now().Unix() - 1
+	if err := rdb.Set(ctx, "k", "v", 0).Err(); err != nil {
+		t.Errorf("Redis command after expiry: %v", err)
+	}
+	call(http.MethodPost, `{"redis_drop_percent":100}`)
+	if rr := call(http.MethodDelete, ""); !strings.Contains(rr.Body.String(), `"active":false`) {
+		t.Errorf("clear faults = %s", rr.Body.String())
+	}
+	if err := rdb.Get(ctx, "k").Err(); err != nil {
+		t.Errorf("Redis command after clearing: %v", err)
+	}
+}
+
+func TestReportSummary(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	ts := setupMockOracle()
+	defer ts.Close()
+	originalOracleURL, originalNodeID := oracleURL, nodeID
+	oracleURL, nodeID = ts.URL, "test-node-id"
+	defer func() { oracleURL, nodeID = originalOracleURL, originalNodeID }()
+
+	originalSpam, originalHam, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&hamWeight), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	atomic.StoreInt64(&hamWeight, 2)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&hamWeight, originalHam)
+		localRetentionDuration = originalRetention
+	}()
+
+	sig, _ := analyze.TLSH(strings.Repeat("Claim the parcel waiting for you at the depot before it is returned. ", 6))
+	data, _ := json.Marshal(ScanResult{Hashes: []string{sig}, Action: "allow"})
+	sealed, _ := sealValue(data)
+	rdb.Set(ctx, "mi:msgid:"+messageIDHash("<summary@example.com>"), sealed, time.Hour)
+
+	rr := httptest.NewRecorder()
+	reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"<summary@example.com>","report_type":"spam"}`)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("report = %d %s, want 200", rr.Code, rr.Body.String())
+	}
+	var summary ReportSummary
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("summary %q is not JSON: %v", rr.Body.String(), err)
+	}
+	if summary.Status != "ok" || summary.ReportType != "spam" || !summary.OracleNotified || summary.OracleStatus != http.StatusOK || summary.Signatures != 1 {
+		t.Errorf("summary = %+v, want ok, spam, Oracle notified", summary)
+	}
+	if len(summary.Learned) != 1 || summary.Learned[0].Hash != sig || summary.Learned[0].Score <= 0 || summary.MatchedExisting {
+		t.Errorf("learned = %+v, want a new score for the reported signature", summary.Learned)
+	}
+	if string(summary.Oracle) == "" {
+		t.Errorf("summary lacks the Oracle reply")
+	}
+
+	// Oracle down: learned locally, still acknowledged
+	oracleURL = "http://127.0.0.1:1"
+	rr = httptest.NewRecorder()
+	reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"<summary@example.com>","report_type":"ham"}`)))
+	summary = ReportSummary{}
+	json.Unmarshal(rr.Body.Bytes(), &summary)
+	if rr.Code != http.StatusOK || summary.Status != "learned_locally" || summary.OracleNotified || summary.OracleError != ErrOracleUnavailable {
+		t.Errorf("report with Oracle down = %d %+v, want 200 learned_locally", rr.Code, summary)
+	}
+	if len(summary.Learned) != 1 || !summary.MatchedExisting {
+		t.Errorf("ham learned = %+v, want the existing signature matched", summary.Learned)
+	}
+
+	// The admin role comes from ADMIN_TOKEN, never from the reporter the body claims
+	originalAdminWeight := atomic.LoadInt64(&adminReportWeight)
+	atomic.StoreInt64(&adminReportWeight, 3)
+	configMutex.Lock()
+	configMap["ADMIN_TOKEN"] = "admin-secret"
+	configMutex.Unlock()
+	defer func() {
+		atomic.StoreInt64(&adminReportWeight, originalAdminWeight)
+		configMutex.Lock()
+		delete(configMap, "ADMIN_TOKEN")
+		configMutex.Unlock()
+	}()
+	rr = httptest.NewRecorder()
+	reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"<summary@example.com>","report_type":"spam","reporter":"admin:alice"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("report claiming an admin identity = %d, want 400", rr.Code)
+	}
+	rdb.Del(ctx, "mi:rpt:"+messageIDHash("<summary@example.com>")+":spam")
+	req := httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"<summary@example.com>","report_type":"spam","reporter":"alice"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr = httptest.NewRecorder()
+	reportHandler(rr, req)
+	if reporters := rdb.HGetAll(ctx, LocalReporterPrefix+sig).Val(); rr.Code != http.StatusOK || reporters[AdminReporterPrefix+"alice"] != "spam" {
+		t.Errorf("report with ADMIN_TOKEN = %d, reporters %v", rr.Code, reporters)
+	}
+	if admin, user := reportWeight(AdminReporterPrefix+"bob", 1), reportWeight("bob", 1); admin != 3*user {
+		t.Errorf("reportWeight() admin = %v, user = %v", admin, user)
+	}
+
+	// Quotas count callers by IP, whatever reporter they claim, and only for known scans
+	originalQuota := atomic.LoadInt64(&reportQuotaReporter)
+	atomic.StoreInt64(&reportQuotaReporter, 1)
+	defer atomic.StoreInt64(&reportQuotaReporter, originalQuota)
+	for _, id := range []string{"<unknown-1@example.com>", "<unknown-2@example.com>"} {
+		rr = httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(`{"message-id":"`+id+`","report_type":"spam"}`)))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("report on %s = %d, want 404", id, rr.Code)
+		}
+	}
+	for i, id := range []string{"<quota-1@example.com>", "<quota-2@example.com>"} {
+		rdb.Set(ctx, "mi:msgid:"+messageIDHash(id), sealed, time.Hour)
+		rr = httptest.NewRecorder()
+		reportHandler(rr, httptest.NewRequest(http.MethodPost, "/report", strings.NewReader(fmt.Sprintf(`{"message-id":"%s","report_type":"spam","reporter":"user%d@example.com"}`, id, i))))
+		if want := []int{http.StatusOK, http.StatusTooManyRequests}[i]; rr.Code != want {
+			t.Errorf("report %d from the same IP = %d, want %d", i+1, rr.Code, want)
+		}
+	}
+}
+
+func TestCheckReportQuota(t *testing.T) {
+	originalRDB := rdb
+	defer func() { rdb = originalRDB }()
+	originals := []int64{atomic.LoadInt64(&reportQuotaReporter), atomic.LoadInt64(&reportQuotaDomain), atomic.LoadInt64(&reportQuotaGlobal)}
+	defer func() {
+		atomic.StoreInt64(&reportQuotaReporter, originals[0])
+		atomic.StoreInt64(&reportQuotaDomain, originals[1])
+		atomic.StoreInt64(&reportQuotaGlobal, originals[2])
+	}()
+
+	type report struct{ reporter, domain, want string }
+	tests := []struct {
+		name                     string
+		reporter, domain, global int64
+		reports                  []report
+	}{
+		{"unlimited", 0, 0, 0, []report{
+			{"alice@a.example", "a.example", ""}, {"alice@a.example", "a.example", ""}, {"alice@a.example", "a.example", ""},
+		}},
+		{"reporter quota", 2, 0, 0, []report{
+			{"alice@a.example", "a.example", ""}, {"Alice@a.example", "a.example", ""}, {"alice@a.example", "a.example", "reporter"},
+			{"bob@a.example", "a.example", ""},
+		}},
+		{"domain quota", 0, 2, 0, []report{
+			{"alice@a.example", "a.example", ""}, {"bob@a.example", "a.example", ""}, {"carol@a.example", "A.example", "domain"},
+			{"dave@b.example", "b.example", ""},
+		}},
+		{"reports without a domain skip the domain quota", 0, 1, 0, []report{
+			{"alice", "", ""}, {"bob", "", ""},
+		}},
+		{"global quota", 0, 0, 2, []report{
+			{"alice@a.example", "a.example", ""}, {"bob@b.example", "b.example", ""}, {"carol@c.example", "c.example", "global"},
+		}},
+		// An exceeded reporter quota is not charged to the domain or global budget
+		{"reporter before domain and global", 1, 2, 2, []report{
+			{"alice@a.example", "a.example", ""}, {"alice@a.example", "a.example", "reporter"}, {"alice@a.example", "a.example", "reporter"},
+			{"bob@a.example", "a.example", ""}, {"carol@a.example", "a.example", "domain"}, {"dave@b.example", "b.example", "global"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client, err := store.NewMemory()
+			if err != nil {
+				t.Fatalf("store.NewMemory() error: %v", err)
+			}
+			defer server.Close()
+			rdb = client
+			atomic.StoreInt64(&reportQuotaReporter, tt.reporter)
+			atomic.StoreInt64(&reportQuotaDomain, tt.domain)
+			atomic.StoreInt64(&reportQuotaGlobal, tt.global)
+			for i, r := range tt.reports {
+				if got := checkReportQuota(r.reporter, r.domain); got != r.want {
+					t.Errorf("report %d checkReportQuota(%q, %q) = %q, want %q", i+1, r.reporter, r.domain, got, r.want)
+				}
+			}
+		})
+	}
+
+	// A rejected report releases its dedup key, so it can be sent again once the quota resets
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	rdb = client
+	atomic.StoreInt64(&reportQuotaReporter, 1)
+	atomic.StoreInt64(&reportQuotaDomain, 0)
+	atomic.StoreInt64(&reportQuotaGlobal, 0)
+	env, err := enmime.ReadEnvelope(strings.NewReader("Message-ID: <quota@example.com>\r\nSubject: hi\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	storeScanResult(env, ScanResult{Hashes: []string{"T1AA"}, Action: "allow"})
+	checkReportQuota("alice@a.example", "a.example")
+	_, err = submitReport(reportRequest{MessageID: "quota@example.com", ReportType: "spam"}, "alice@a.example", "alice@a.example")
+	var quotaErr *reportQuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Scope != "reporter" {
+		t.Fatalf("submitReport() over quota = %v, want a reporter quota error", err)
+	}
+	if client.Exists(ctx, "mi:rpt:"+messageIDHash("<quota@example.com>")+":spam").Val() != 0 {
+		t.Error("Dedup key kept after a quota rejection")
+	}
+}
+
+func TestRefreshBandTTLs(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	retention := 10 * time.Hour
+	rdb.SAdd(ctx, LocalFragPrefix+"fresh", "h")
+	rdb.Expire(ctx, LocalFragPrefix+"fresh", 8*time.Hour)
+	rdb.SAdd(ctx, LocalFragPrefix+"stale", "h")
+	rdb.Expire(ctx, LocalFragPrefix+"stale", 2*time.Hour)
+	rdb.SAdd(ctx, LocalFragPrefix+"persistent", "h")
+
+	refreshBandTTLs([]string{LocalFragPrefix + "fresh", LocalFragPrefix + "stale", LocalFragPrefix + "persistent", LocalFragPrefix + "missing"}, retention)
+
+	if ttl := rdb.TTL(ctx, LocalFragPrefix+"fresh").Val(); ttl != 8*time.Hour {
+		t.Errorf("fresh band TTL = %v, want it left at 8h", ttl)
+	}
+	for _, band := range []string{"stale", "persistent"} {
+		if ttl := rdb.TTL(ctx, LocalFragPrefix+band).Val(); ttl != retention {
+			t.Errorf("%s band TTL = %v, want %v", band, ttl, retention)
+		}
+	}
+	if rdb.Exists(ctx, LocalFragPrefix+"missing").Val() != 0 {
+		t.Errorf("refresh created a missing band")
+	}
+}
+
+func TestSubjectSignature(t *testing.T) {
+	if got := normalizeSubject("RE: Fwd: [Promo] Your parcel #48213 is waiting 📦!"); got != "your parcel is waiting" {
+		t.Errorf("normalizeSubject() = %q", got)
+	}
+	if sig := subjectSignature("Re: hi 123"); sig != "" {
+		t.Errorf("short subject signed: %q", sig)
+	}
+	a := subjectSignature("Your parcel #48213 is waiting at the depot 📦")
+	b := subjectSignature("RE: your PARCEL 99120 is waiting at the depot!!")
+	c := subjectSignature("Minutes of the quarterly board meeting")
+	if a == "" || a != b {
+		t.Errorf("variants of a subject template = %q, %q, want equal signatures", a, b)
+	}
+	if s := subjectSimilarity(a, c); s >= 0.5 {
+		t.Errorf("similarity of unrelated subjects = %v", s)
+	}
+	if s := subjectSimilarity(a, subjectSignature("Your parcel #1 is waiting at the depot near you")); s < 0.5 {
+		t.Errorf("similarity of close subjects = %v, want >= 0.5", s)
+	}
+
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	originalSpam, originalHam, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&hamWeight), localRetentionDuration
+	originalThreshold := atomic.LoadInt64(&subjectSpamThreshold)
+	atomic.StoreInt64(&spamWeight, 2)
+	atomic.StoreInt64(&hamWeight, 3)
+	atomic.StoreInt64(&subjectSpamThreshold, 3)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&hamWeight, originalHam)
+		atomic.StoreInt64(&subjectSpamThreshold, originalThreshold)
+		localRetentionDuration = originalRetention
+	}()
+
+	learnSubject(a, "spam", "")
+	if _, _, ok := subjectSpam(b); ok {
+		t.Errorf("subject flagged below the threshold")
+	}
+	learnSubject(b, "spam", "")
+	// Learned only by default
+	atomic.StoreInt64(&subjectSpamThreshold, DefaultSubjectLimit)
+	if _, _, ok := subjectSpam(b); ok {
+		t.Errorf("subject flagged with the default threshold")
+	}
+	atomic.StoreInt64(&subjectSpamThreshold, 3)
+	if score, similarity, ok := subjectSpam(b); !ok || score != 4 || similarity != 1 {
+		t.Errorf("subjectSpam() = %v, %v, %v, want flagged with score 4", score, similarity, ok)
+	}
+	if _, _, ok := subjectSpam(c); ok {
+		t.Errorf("unrelated subject flagged")
+	}
+	learnSubject(c, "ham", "")
+	if rdb.Exists(ctx, LocalSubjectPrefix+c).Val() != 0 {
+		t.Errorf("ham report learned an unknown subject")
+	}
+	learnSubject(a, "ham", "")
+	if _, _, ok := subjectSpam(a); ok {
+		t.Errorf("subject still flagged after a ham report")
+	}
+}
+
+func TestTextSignals(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain text", "Hello team, the quarterly report is attached for your review.", ""},
+		{"emoji wall", "🔥🔥🔥 WIN 💰💰💰 a brand new 📱📱 today 🎁🎁🎁 click now 🚀🚀🚀", "emoji_density"},
+		{"zero-width split", "Ve\u200bri\u200bfy your ac\u200bco\u200bunt no\u200bw or it will be closed", "zero_width_chars"},
+		{"homoglyphs", "Your pаypal аccount has been limited, please cоnfirm", "mixed_script"},
+		{"family emoji", "Happy holidays from all of us 👨\u200d👩\u200d👧 see you next year at the office", ""},
+		{"japanese", "iPhone用のアプリを更新しました。詳しくはサポートページをご覧ください。", ""},
+	}
+	for _, tt := range tests {
+		got := strings.Join(textSignals(textStats(tt.text)), ",")
+		if got != tt.want {
+			t.Errorf("%s: textSignals() = %q, want %q (%+v)", tt.name, got, tt.want, textStats(tt.text))
+		}
+	}
+
+	env, err := enmime.ReadEnvelope(strings.NewReader("Subject: Offer\r\nContent-Type: text/html\r\n\r\n<p>Cl&#8203;i&#8203;c&#8203;k h&#8203;e&#8203;re for your reward</p>\r\n"))
+	if err != nil {
+		t.Fatalf("ReadEnvelope() error: %v", err)
+	}
+	if st := messageTextStats(env); st.ZeroWidth != 5 {
+		t.Errorf("zero-width characters of the HTML body = %d, want 5", st.ZeroWidth)
+	}
+}
+
+func TestStripFooters(t *testing.T) {
+	content := strings.Repeat("Our spring collection has arrived, with new colours and fabrics for every room. ", 5)
+	text := content + "\n\nSee you soon,\nThe team\n-- \nYou received this email because you subscribed on our website.\nUnsubscribe: https://esp.example/u/123\n"
+	if got := stripTextFooter(text); got != content+"\n\nSee you soon,\nThe team\n" {
+		t.Errorf("stripTextFooter() = %q", got)
+	}
+	html := "<html><body><p>" + content + "</p><table><tr><td>Sent by Esp. <a href=\"https://esp.example/u/123\">Unsubscribe</a> | &copy; 2025</td></tr></table></body></html>"
+	if got := stripHTMLFooter(html); got != "<html><body><p>"+content+"</p><table><tr>" {
+		t.Errorf("stripHTMLFooter() = %q", got)
+	}
+	short := "Click here to unsubscribe from this list."
+	if got := stripTextFooter(short); got != short {
+		t.Errorf("short body stripped to %q", got)
+	}
+	early := "Unsubscribe is what you asked for. " + content
+	if got := stripTextFooter(early); got != early {
+		t.Errorf("marker outside the footer zone stripped: %q", got)
+	}
+
+	configMutex.Lock()
+	configMap["STRIP_FOOTERS"] = "true"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "STRIP_FOOTERS")
+		configMutex.Unlock()
+	}()
+	other := strings.Replace(text, "spring collection", "autumn collection", 1)
+	if hashableBody(text, "") == hashableBody(other, "") {
+		t.Errorf("bodies differing before the footer hash alike")
+	}
+	if hashableBody(text, "") != hashableBody(strings.Replace(text, "our website", "a partner site", 1), "") {
+		t.Errorf("footer variations change the hashed body")
+	}
+}
+
+func TestDomainBlocklistExport(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	rr := httptest.NewRecorder()
+	domainBlocklistHandler(rr, httptest.NewRequest(http.MethodPost, "/admin/blocklist/domains", strings.NewReader(`{"list":"sender","add":["@Spam.Example","not a domain"]}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid domain = %d, want 400", rr.Code)
+	}
+	for _, body := range []string{`{"list":"sender","add":["@Spam.Example"]}`, `{"list":"url","add":["*.evil.test"]}`} {
+		rr = httptest.NewRecorder()
+		domainBlocklistHandler(rr, httptest.NewRequest(http.MethodPost, "/admin/blocklist/domains", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, rr.Code, rr.Body.String())
+		}
+	}
+
+	for raw, want := range map[string]string{
+		"From: Promo <news@mail.spam.example>\r\n\r\nHello":                                         "spam.example/sender",
+		"From: a@ok.example\r\nContent-Type: text/plain\r\n\r\nGo to https://login.evil.test/x now": "evil.test/url",
+		"From: a@ok.example\r\nContent-Type: text/plain\r\n\r\nGo to https://notevil.test/x now":    "/",
+	} {
+		env, _ := enmime.ReadEnvelope(strings.NewReader(raw))
+		if domain, list := blockedDomain(env); domain+"/"+list != want {
+			t.Errorf("blockedDomain(%q) = %s/%s, want %s", raw, domain, list, want)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	postfixMapHandler(rr, httptest.NewRequest(http.MethodGet, "/export/postfix-map", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "\nspam.example\tREJECT 5.7.1 Blocked by Mailuminati Guardian\n") {
+		t.Errorf("postfix sender map = %d %q", rr.Code, rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+	req := httptest.NewRequest(http.MethodGet, "/export/postfix-map", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	postfixMapHandler(rr, req)
+	if etag == "" || rr.Code != http.StatusNotModified {
+		t.Errorf("unchanged map = %d, want 304", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	postfixMapHandler(rr, httptest.NewRequest(http.MethodGet, "/export/postfix-map?list=url", nil))
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	pattern, _, _ := strings.Cut(lines[len(lines)-1], "\t")
+	re := regexp.MustCompile("(?i)" + strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/i"))
+	if !re.MatchString("see https://login.EVIL.test/x") || re.MatchString("see https://notevil.test/x") {
+		t.Errorf("postfix url pattern %q does not match as expected", pattern)
+	}
+
+	rr = httptest.NewRecorder()
+	rspamdMapHandler(rr, httptest.NewRequest(http.MethodGet, "/export/rspamd-map?list=url", nil))
+	if !strings.HasSuffix(rr.Body.String(), "\nevil.test\n") {
+		t.Errorf("rspamd url map = %q", rr.Body.String())
+	}
+	rr = httptest.NewRecorder()
+	rspamdMapHandler(rr, httptest.NewRequest(http.MethodGet, "/export/rspamd-map?list=ip", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("unknown list = %d, want 400", rr.Code)
+	}
+}
+
+func TestReportDigest(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	// Fake relay, keeping the DATA of each message
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	received := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			conn.Write([]byte("220 relay ready\r\n"))
+			var data strings.Builder
+			inData := false
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if inData {
+					if line == ".\r\n" {
+						inData = false
+						received <- data.String()
+						conn.Write([]byte("250 queued\r\n"))
+					} else {
+						data.WriteString(line)
+					}
+					continue
+				}
+				switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+				case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+					conn.Write([]byte("250 relay\r\n"))
+				case cmd == "DATA":
+					inData = true
+					conn.Write([]byte("354 go ahead\r\n"))
+				case cmd == "QUIT":
+					conn.Write([]byte("221 bye\r\n"))
+				default:
+					conn.Write([]byte("250 ok\r\n"))
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	settings := map[string]string{"DIGEST_RECIPIENTS": "admin@example.org", "SMTP_RELAY": ln.Addr().String(), "SMTP_FROM": "guardian@example.org", "DIGEST_HOUR": "6"}
+	configMutex.Lock()
+	for k, v := range settings {
+		configMap[k] = v
+	}
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for k := range settings {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	now := time.Date(2025, 10, 15, 7, 30, 0, 0, time.UTC)
+	if p := digestPeriod(now.Add(-2 * time.Hour)); p != "" {
+		t.Errorf("digest due before DIGEST_HOUR: %q", p)
+	}
+	period := digestPeriod(now)
+	if period != "2025-10-15" {
+		t.Fatalf("digestPeriod() = %q", period)
+	}
+
+	// Counters of other tests may not be persisted yet: the snapshot is set against the totals
+	rdb.HSet(ctx, MetaCounters, "scanned_count", 100, "local_spam_count", 10)
+	totals := digestTotals()
+	rdb.HSet(ctx, DigestSnapshotKey, "time", now.Add(-24*time.Hour).Unix(),
+		"scanned_count", totals["scanned_count"]-60, "local_spam_count", totals["local_spam_count"])
+	countReport("spam", false)
+	countReport("ham", true)
+	rdb.ZAdd(ctx, ConflictSetKey, &redis.Z{Score: float64(now.Add(-time.Hour).Unix()), Member: "T1AA"})
+
+	if err := runDigest(now, period); err != nil {
+		t.Fatalf("runDigest() error: %v", err)
+	}
+	msg := <-received
+	for _, want := range []string{"To: admin@example.org\r\n", "Subject: Mailuminati Guardian digest 2025-10-15\r\n",
+		"Messages analyzed                  60\r\n", "Spam detected locally              0\r\n",
+		"False positives reversed           1\r\n", "Hashes with conflicting reports    1\r\n", "Last successful sync"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("digest lacks %q:\n%s", want, msg)
+		}
+	}
+	if v, _ := rdb.HGet(ctx, DigestSnapshotKey, "scanned_count").Int64(); v != totals["scanned_count"] {
+		t.Errorf("snapshot after the digest = %d, want %d", v, totals["scanned_count"])
+	}
+
+	// Another node, or a later check, does not send the period again
+	if err := runDigest(now.Add(time.Hour), period); err != nil {
+		t.Fatalf("runDigest() error: %v", err)
+	}
+	select {
+	case <-received:
+		t.Errorf("digest of the period sent twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpdateCheck(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	manifest := []byte(`{"version":"99.0.0","security":true,"builds":{"` + platform() + `":{"url":"https://example.org/guardian","sha256":"abcd"}}}`)
+	signature := ed25519.Sign(priv, manifest)
+	doc := map[string]string{
+		"manifest":  base64.StdEncoding.EncodeToString(manifest),
+		"signature": base64.StdEncoding.EncodeToString(signature),
+	}
+	var fail atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	defer ts.Close()
+
+	configMutex.Lock()
+	configMap["UPDATE_CHECK_URL"] = ts.URL
+	configMap["UPDATE_PUBLIC_KEY"] = base64.StdEncoding.EncodeToString(pub)
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "UPDATE_CHECK_URL")
+		delete(configMap, "UPDATE_PUBLIC_KEY")
+		configMutex.Unlock()
+		updateMu.Lock()
+		updateStatus = nil
+		updateMu.Unlock()
+	}()
+
+	if err := checkUpdate(); err != nil {
+		t.Fatalf("checkUpdate() error: %v", err)
+	}
+	status := currentUpdateStatus()
+	if !status.Available || status.Latest != "99.0.0" || !status.Security || status.Build == nil || status.Build.SHA256 != "abcd" {
+		t.Errorf("update status = %+v", status)
+	}
+
+	// A failed check keeps the previous outcome
+	fail.Store(true)
+	if err := checkUpdate(); err == nil {
+		t.Errorf("checkUpdate() succeeded against a failing endpoint")
+	}
+	if status := currentUpdateStatus(); !status.Available || status.LastError == "" {
+		t.Errorf("update status after a failure = %+v", status)
+	}
+	fail.Store(false)
+
+	// A manifest signed with another key is ignored
+	other, _, _ := ed25519.GenerateKey(nil)
+	configMutex.Lock()
+	configMap["UPDATE_PUBLIC_KEY"] = base64.StdEncoding.EncodeToString(other)
+	configMutex.Unlock()
+	if err := checkUpdate(); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("checkUpdate() with a wrong key = %v", err)
+	}
+
+	// No build for this platform, no update
+	configMutex.Lock()
+	configMap["UPDATE_PUBLIC_KEY"] = base64.StdEncoding.EncodeToString(pub)
+	configMutex.Unlock()
+	manifest = []byte(`{"version":"99.0.0","builds":{"plan9/mips":{"url":"https://example.org/guardian","sha256":"abcd"}}}`)
+	doc["manifest"] = base64.StdEncoding.EncodeToString(manifest)
+	doc["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest))
+	if err := checkUpdate(); err != nil {
+		t.Fatalf("checkUpdate() error: %v", err)
+	}
+	if status := currentUpdateStatus(); status.Available || status.Build != nil {
+		t.Errorf("update offered without a build for %s: %+v", platform(), status)
+	}
+
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{{"0.7.6", "0.7.10", -1}, {"v1.0", "1.0.0", 0}, {"0.8.0-rc1", "0.8.0", -1}, {"0.8.0", "0.7.9", 1}} {
+		if got := compareVersions(c.a, c.b); got != c.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestExternalClassifier(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	var got ClassifierRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if strings.Contains(got.Subject, "slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Write([]byte(`{"score":0.9,"label":"invoice-fraud"}`))
+	}))
+	defer ts.Close()
+
+	configMutex.Lock()
+	configMap["CLASSIFIER_URL"] = ts.URL
+	configMap["CLASSIFIER_TIMEOUT_MS"] = "100"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"CLASSIFIER_URL", "CLASSIFIER_COMMAND", "CLASSIFIER_TIMEOUT_MS"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+		atomic.StoreInt64(&classifierWeight, 0)
+	}()
+
+	analyze := func(subject string) (string, []string) {
+		raw := "From: billing@example.com\r\nMessage-ID: <" + strings.ReplaceAll(subject, " ", ".") + "@example.com>\r\nSubject: " + subject +
+			"\r\nContent-Type: text/plain\r\n\r\nPlease settle the attached invoice today (" + subject + ").\r\n"
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(raw))
+		req.Header.Set("X-Guardian-Client-IP", "192.0.2.9")
+		rr := httptest.NewRecorder()
+		analyzeHandler(rr, req)
+		var resp struct {
+			Label   string   `json:"label"`
+			Signals []string `json:"signals"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp.Label, resp.Signals
+	}
+
+	// Weight 0: signal only
+	if label, signals := analyze("Invoice one"); label != "" || !hasSignal(signals, "classifier") {
+		t.Errorf("signal only classifier = label %q, signals %v", label, signals)
+	}
+	if !strings.Contains(got.Body, "settle the attached invoice") || got.ClientIP != "192.0.2.9" || got.From != "billing@example.com" {
+		t.Errorf("classifier request = %+v", got)
+	}
+
+	// 0.9 x 6 reaches the default threshold of 5
+	atomic.StoreInt64(&classifierWeight, 6)
+	if label, _ := analyze("Invoice two"); label != "classifier" {
+		t.Errorf("weighted classifier label = %q, want classifier", label)
+	}
+
+	// A slow classifier is skipped
+	if label, signals := analyze("Invoice slow"); label != "" || hasSignal(signals, "classifier") {
+		t.Errorf("slow classifier = label %q, signals %v", label, signals)
+	}
+
+	// Exec hook: the request on stdin, the answer on stdout
+	script := filepath.Join(t.TempDir(), "classify.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\ncat >/dev/null\necho '{\"score\":0.2}'\n"), 0o755)
+	configMutex.Lock()
+	delete(configMap, "CLASSIFIER_URL")
+	configMap["CLASSIFIER_COMMAND"] = script
+	configMap["CLASSIFIER_TIMEOUT_MS"] = "2000"
+	configMutex.Unlock()
+	env, _ := enmime.ReadEnvelope(strings.NewReader("Subject: Hi\r\n\r\nHello\r\n"))
+	if result, err := classify(env, EnvelopeMeta{}, TenantUnknown, nil, nil); err != nil || result.Score != 0.2 {
+		t.Errorf("classify() with a command = %+v, %v", result, err)
+	}
+}
+
+func TestBayesModel(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	defer atomic.StoreInt64(&bayesWeight, 0)
+
+	tokensOf := func(raw string) []string {
+		env, err := enmime.ReadEnvelope(strings.NewReader(raw))
+		if err != nil {
+			t.Fatalf("ReadEnvelope() error: %v", err)
+		}
+		return bayesTokens(env)
+	}
+	spam := tokensOf("From: win@lottery.test\r\nSubject: Claim your prize\r\n\r\nClaim your lottery prize now at http://prize.lottery.test/claim\r\n")
+	ham := tokensOf("From: bob@example.com\r\nSubject: Meeting notes\r\n\r\nHere are the notes of the weekly meeting, see you tomorrow.\r\n")
+	if len(spam) == 0 || len(ham) == 0 {
+		t.Fatalf("bayesTokens() returned no tokens")
+	}
+	for _, token := range spam {
+		if strings.Contains(token, "prize") {
+			t.Fatalf("token %q stored in clear", token)
+		}
+	}
+
+	// Untrained model
+	if _, ok := bayesProbability(spam); ok {
+		t.Errorf("bayesProbability() used before BAYES_MIN_TRAINED reports")
+	}
+
+	for i := 0; i < DefaultBayesMinTrained; i++ {
+		learnTokens(spam, "spam")
+		learnTokens(ham, "ham")
+	}
+	if p, ok := bayesProbability(spam); !ok || p < BayesSignalScore {
+		t.Errorf("bayesProbability(spam) = %v, %v", p, ok)
+	}
+	if p, ok := bayesProbability(ham); !ok || p > 0.1 {
+		t.Errorf("bayesProbability(ham) = %v, %v", p, ok)
+	}
+
+	// Weight 0: signal only, then 0.99 x 6 reaches the threshold
+	if _, signal, ok := bayesSpam(spam, 5); !signal || ok {
+		t.Errorf("bayesSpam() with weight 0 = %v, %v", signal, ok)
+	}
+	atomic.StoreInt64(&bayesWeight, 6)
+	if _, signal, ok := bayesSpam(spam, 5); !signal || !ok {
+		t.Errorf("bayesSpam() with weight 6 = %v, %v", signal, ok)
+	}
+	if _, signal, ok := bayesSpam(ham, 5); signal || ok {
+		t.Errorf("bayesSpam(ham) = %v, %v", signal, ok)
+	}
+}
+
+func TestOracleAllowCacheEscalation(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	var calls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Write([]byte(`{"result": {"action": "allow", "proximity_match": true}}`))
+	}))
+	defer ts.Close()
+	originalOracleURL := oracleURL
+	oracleURL = ts.URL
+	defer func() { oracleURL = originalOracleURL }()
+
+	atomic.StoreInt64(&oracleAllowMaxHits, 2)
+	defer atomic.StoreInt64(&oracleAllowMaxHits, DefaultOracleAllowHits)
+
+	sig := "T1ALLOWCACHE0000000000000000000000000000000000000000000000000000000000"
+	want := []int64{1, 1, 1, 2, 2}
+	for i, w := range want {
+		if res := callOracleDecision(sig); res.Action != "allow" {
+			t.Fatalf("callOracleDecision() #%d action = %q", i+1, res.Action)
+		}
+		if got := atomic.LoadInt64(&calls); got != w {
+			t.Errorf("after call #%d, Oracle queried %d times, want %d", i+1, got, w)
+		}
+	}
+	if ttl := server.TTL(OracleDecisionPrefix + sig); ttl != DefaultOracleAllowTTL*time.Second {
+		t.Errorf("allow decision TTL = %v", ttl)
+	}
+
+	// 0: cached until expiry
+	atomic.StoreInt64(&oracleAllowMaxHits, 0)
+	for i := 0; i < 5; i++ {
+		callOracleDecision(sig)
+	}
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Errorf("ORACLE_ALLOW_MAX_HITS=0: Oracle queried %d times, want 2", got)
+	}
+}
+
+func TestAnalyzeByReference(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	raw := "From: a@example.com\r\nMessage-ID: <ref-1@example.com>\r\nSubject: Spool\r\n\r\nHello from the spool, " + TestSpamPattern + "\r\n"
+	spool := t.TempDir()
+	os.WriteFile(filepath.Join(spool, "4Bx1Ck"), []byte(raw), 0o644)
+	outside := filepath.Join(t.TempDir(), "other")
+	os.WriteFile(outside, []byte(raw), 0o644)
+	os.Symlink(outside, filepath.Join(spool, "link"))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					tag, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+					switch {
+					case strings.HasPrefix(cmd, "LOGIN "), cmd == `EXAMINE "Held"`:
+						conn.Write([]byte(tag + " OK done\r\n"))
+					case cmd == "UID FETCH 42 (BODY.PEEK[])":
+						fmt.Fprintf(conn, "* 3 FETCH (UID 42 BODY[] {%d}\r\n%s)\r\n%s OK FETCH completed\r\n", len(raw), raw, tag)
+					case strings.HasPrefix(cmd, "UID FETCH "):
+						conn.Write([]byte(tag + " OK FETCH completed\r\n"))
+					case cmd == "LOGOUT":
+						conn.Write([]byte("* BYE\r\n" + tag + " OK\r\n"))
+						return
+					default:
+						conn.Write([]byte(tag + " NO unknown\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	configMutex.Lock()
+	configMap["ANALYZE_SPOOL_DIRS"] = spool
+	configMap["ANALYZE_IMAP_ADDR"] = ln.Addr().String()
+	configMap["ANALYZE_IMAP_TLS"] = "false"
+	configMap["ANALYZE_IMAP_MAILBOX"] = "Held"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"ANALYZE_SPOOL_DIRS", "ANALYZE_IMAP_ADDR", "ANALYZE_IMAP_TLS", "ANALYZE_IMAP_MAILBOX"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"spool file", `{"path": "` + filepath.Join(spool, "4Bx1Ck") + `"}`, http.StatusOK},
+		{"imap uid", `{"imap_uid": 42}`, http.StatusOK},
+		{"unknown uid", `{"imap_uid": 7}`, http.StatusNotFound},
+		{"missing file", `{"path": "` + filepath.Join(spool, "gone") + `"}`, http.StatusNotFound},
+		{"outside the spool", `{"path": "` + outside + `"}`, http.StatusForbidden},
+		{"symlink out of the spool", `{"path": "` + filepath.Join(spool, "link") + `"}`, http.StatusForbidden},
+		{"relative path", `{"path": "4Bx1Ck"}`, http.StatusForbidden},
+		{"both references", `{"path": "/x", "imap_uid": 42}`, http.StatusBadRequest},
+		{"invalid json", `{"path":`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/analyze", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		coalescedAnalyzeHandler(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d (%s)", tt.name, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+		if tt.status == http.StatusOK && !strings.Contains(rr.Body.String(), `"label":"test"`) {
+			t.Errorf("%s: response = %s, want the test verdict", tt.name, rr.Body.String())
+		}
+	}
+}
+
+func TestPrecheck(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	originalLookup := lookupDNSBL
+	lookupDNSBL = func(_ context.Context, host string) ([]string, error) {
+		switch host {
+		case "20.2.0.192.dnsbl.example":
+			return []string{"127.0.0.2"}, nil
+		case "21.2.0.192.dnsbl.example":
+			return []string{"127.255.255.254"}, nil // query refused
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	defer func() { lookupDNSBL = originalLookup }()
+
+	configMutex.Lock()
+	configMap["PRECHECK_DNSBL"] = "dnsbl.example"
+	configMap["PRECHECK_SPAM_RATIO"] = "80"
+	configMap["PRECHECK_MIN_MESSAGES"] = "3"
+	configMap["ACTION_DNSBL"] = "reject 554 5.7.1 Listed in a DNSBL"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"PRECHECK_DNSBL", "PRECHECK_SPAM_RATIO", "PRECHECK_MIN_MESSAGES", "ACTION_DNSBL"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+	client.SAdd(ctx, BlocklistSenderKey, "blocked.example")
+	// Reputation recorded by /analyze verdicts
+	for i := 0; i < 4; i++ {
+		tarpitDelay("198.51.100.7", AnalysisResult{Action: "spam"}, "")
+	}
+
+	precheck := func(clientIP, headers string) PrecheckResponse {
+		req := httptest.NewRequest(http.MethodPost, "/precheck", strings.NewReader(headers))
+		req.Header.Set("X-Guardian-Client-IP", clientIP)
+		rr := httptest.NewRecorder()
+		precheckHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("precheck status = %d (%s)", rr.Code, rr.Body.String())
+		}
+		var resp PrecheckResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return resp
+	}
+	clean := "From: Alice <alice@example.com>\r\nDate: Mon, 1 Jun 2026 10:00:00 +0000\r\nMessage-ID: <p1@example.com>\r\n"
+
+	if resp := precheck("192.0.2.1", clean+"\r\nBody is ignored\r\n"); resp.Action != "allow" || resp.Label != "" || len(resp.Signals) != 0 {
+		t.Errorf("clean precheck = %+v", resp)
+	}
+	if resp := precheck("192.0.2.20", clean); resp.Label != "dnsbl" || resp.DNSBL != "dnsbl.example" || resp.MTAAction != "reject" {
+		t.Errorf("listed IP precheck = %+v", resp)
+	}
+	if resp := precheck("192.0.2.21", clean); resp.Action != "allow" {
+		t.Errorf("refused DNSBL query precheck = %+v", resp)
+	}
+	if resp := precheck("198.51.100.7", clean); resp.Label != "poor_reputation" {
+		t.Errorf("poor reputation precheck = %+v", resp)
+	}
+	if resp := precheck("192.0.2.1", "From: promo@news.blocked.example\r\n"); resp.Label != "blocked_sender" {
+		t.Errorf("blocked sender precheck = %+v", resp)
+	}
+	resp := precheck("192.0.2.1", "From: \"service@paypal.com\" <billing@paypa1.example>\r\n")
+	if resp.Action != "allow" || strings.Join(resp.Signals, ",") != "missing_message_id,missing_date,display_name_spoof" {
+		t.Errorf("header heuristics precheck = %+v", resp)
+	}
+}
+
+func TestSizeTiers(t *testing.T) {
+	defer loadSizeTiers()
+
+	if got := []string{sizeTier(10 << 10), sizeTier(SizeTierMedium), sizeTier(SizeTierLarge + 1)}; strings.Join(got, ",") != "small,medium,large" {
+		t.Errorf("sizeTier() = %v", got)
+	}
+
+	// Hashed in full by default, like Oracles and other nodes do
+	loadSizeTiers()
+	large := strings.Repeat("0123456789", 1<<18)
+	if got := attachmentSample([]byte(large)); got != large || !hashRawBody(len(large)) {
+		t.Errorf("large content hashed partially by default")
+	}
+
+	// Only the head and the tail of large attachments are hashed
+	atomic.StoreInt64(&attachmentSampleBytes, 4)
+	if got := attachmentSample([]byte("0123456789")); got != "01236789" {
+		t.Errorf("attachmentSample() = %q", got)
+	}
+	if got := attachmentSample([]byte("01234567")); got != "01234567" {
+		t.Errorf("attachmentSample() of a small attachment = %q", got)
+	}
+
+	// The raw body signature is skipped over RAW_HASH_MAX_KB
+	body := strings.Repeat("Quarterly results are attached for your review, with the usual figures. ", 40)
+	env, _ := enmime.ReadEnvelope(strings.NewReader("Subject: Results\r\nContent-Type: text/plain\r\n\r\n" + body))
+	kinds := func() string {
+		var k []string
+		for _, part := range messageSignatures(env, "", logger) {
+			k = append(k, part.Kind)
+		}
+		return strings.Join(k, ",")
+	}
+	if got := kinds(); got != "body,raw" {
+		t.Errorf("signatures of a small body = %s", got)
+	}
+	atomic.StoreInt64(&rawHashMaxBytes, 1024)
+	if got := kinds(); got != "body" {
+		t.Errorf("signatures over RAW_HASH_MAX_KB = %s", got)
+	}
+}
+
+func TestAsyncQueue(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	// IMAP: the message is only found in the second search, as if delivered meanwhile
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	var searches int64
+	var mu sync.Mutex
+	var logins, moves []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				conn.Write([]byte("* OK IMAP4rev1 ready\r\n"))
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					tag, cmd, _ := strings.Cut(strings.TrimSpace(line), " ")
+					switch {
+					case strings.HasPrefix(cmd, "LOGIN "):
+						mu.Lock()
+						logins = append(logins, cmd)
+						mu.Unlock()
+						conn.Write([]byte(tag + " OK done\r\n"))
+					case cmd == `SELECT "INBOX"`:
+						conn.Write([]byte(tag + " OK done\r\n"))
+					case cmd == `UID SEARCH HEADER Message-ID "<async-1@example.com>"`:
+						if atomic.AddInt64(&searches, 1) == 1 {
+							conn.Write([]byte("* SEARCH\r\n" + tag + " OK done\r\n"))
+						} else {
+							conn.Write([]byte("* SEARCH 7 9\r\n" + tag + " OK done\r\n"))
+						}
+					case strings.HasPrefix(cmd, "UID MOVE "):
+						mu.Lock()
+						moves = append(moves, cmd)
+						mu.Unlock()
+						conn.Write([]byte(tag + " OK done\r\n"))
+					case cmd == "LOGOUT":
+						conn.Write([]byte("* BYE\r\n" + tag + " OK\r\n"))
+						return
+					default:
+						conn.Write([]byte(tag + " NO unknown\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+
+	notes := make(chan AsyncNotification, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var note AsyncNotification
+		json.NewDecoder(r.Body).Decode(&note)
+		notes <- note
+	}))
+	defer webhook.Close()
+
+	settings := map[string]string{
+		"ASYNC_QUEUE":        "true",
+		"ASYNC_IMAP_ADDR":    ln.Addr().String(),
+		"ASYNC_IMAP_TLS":     "false",
+		"ASYNC_IMAP_USER":    "{rcpt}*guardian",
+		"ASYNC_WEBHOOK_URL":  webhook.URL,
+		"ASYNC_MAX_ATTEMPTS": "3",
+	}
+	configMutex.Lock()
+	for k, v := range settings {
+		configMap[k] = v
+	}
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for k := range settings {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	raw := "From: a@example.com\r\nMessage-ID: <async-1@example.com>\r\nSubject: Queued\r\n\r\nQueued message " + TestSpamPattern + "\r\n"
+	req := httptest.NewRequest(http.MethodPost, "/enqueue?format=exim", strings.NewReader(raw))
+	req.Header.Set("X-Guardian-Rcpt-To", "bob@example.org")
+	rr := httptest.NewRecorder()
+	enqueueHandler(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("enqueue status = %d (%s)", rr.Code, rr.Body.String())
+	}
+
+	if err := client.XGroupCreateMkStream(ctx, AsyncQueueKey, AsyncQueueGroup, "0").Err(); err != nil {
+		t.Fatalf("XGroupCreateMkStream() error: %v", err)
+	}
+	streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: AsyncQueueGroup, Consumer: "test", Streams: []string{AsyncQueueKey, ">"}, Count: 10}).Result()
+	if err != nil || len(streams) == 0 {
+		t.Fatalf("XReadGroup() = %v, %v", streams, err)
+	}
+
+	// Not in the mailbox yet: left pending for a retry, with its verdict
+	scansBefore := atomic.LoadInt64(&scanCount)
+	processAsyncBatch(streams[0].Messages)
+	if n := client.XLen(ctx, AsyncQueueKey).Val(); n != 1 {
+		t.Fatalf("queue length after a failed move = %d, want 1", n)
+	}
+	id := streams[0].Messages[0].ID
+	if kept, ok := storedAsyncVerdict(AsyncVerdictPrefix + id); !ok || kept.Label != "test" || kept.MessageID != "<async-1@example.com>" {
+		t.Errorf("kept verdict = %+v, %v", kept, ok)
+	}
+	// Claimed again, as asyncQueueWorker does after ASYNC_RETRY_SECONDS
+	claimed := claimStaleMessages("other", 0, 10)
+	if len(claimed) != 1 {
+		t.Fatalf("claimStaleMessages() = %v", claimed)
+	}
+	processAsyncBatch(claimed)
+	if n := client.XLen(ctx, AsyncQueueKey).Val(); n != 0 {
+		t.Errorf("queue length after the scan = %d, want 0", n)
+	}
+	// The retry only moved the message: it was analyzed once
+	if scans := atomic.LoadInt64(&scanCount) - scansBefore; scans != 1 {
+		t.Errorf("message analyzed %d times, want 1", scans)
+	}
+	if client.Exists(ctx, AsyncVerdictPrefix+id).Val() != 0 {
+		t.Errorf("verdict kept after the message was done with")
+	}
+	mu.Lock()
+	if len(moves) != 1 || moves[0] != `UID MOVE 7,9 "Junk"` || logins[0] != `LOGIN "bob@example.org*guardian" ""` {
+		t.Errorf("IMAP logins %v, moves %v", logins, moves)
+	}
+	mu.Unlock()
+	select {
+	case note := <-notes:
+		if note.Label != "test" || note.MessageID != "<async-1@example.com>" || len(note.Moved) != 1 {
+			t.Errorf("webhook notification = %+v", note)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("webhook not notified")
+	}
+
+	// Disabled queue
+	configMutex.Lock()
+	delete(configMap, "ASYNC_QUEUE")
+	configMutex.Unlock()
+	rr = httptest.NewRecorder()
+	enqueueHandler(rr, httptest.NewRequest(http.MethodPost, "/enqueue", strings.NewReader(raw)))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("enqueue with ASYNC_QUEUE unset = %d, want 404", rr.Code)
+	}
+}
+
+// TestReportPropagation checks that reports learned on one node reach the others
+// through the shared stream, once, and are not published again by them
+func TestReportPropagation(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	sharedServer, shared, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer sharedServer.Close()
+	originalRDB, originalNodeID := rdb, nodeID
+	rdb, propagationClient = client, shared
+	defer func() { rdb, nodeID, propagationClient = originalRDB, originalNodeID, nil }()
+	originalSpam, originalRetention := atomic.LoadInt64(&spamWeight), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		localRetentionDuration = originalRetention
+	}()
+
+	hash, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	nodeID = "mx1"
+	learnFromReport(ScanResult{Hashes: []string{hash}}, "spam", "alice@example.org", "<a@example.org>")
+
+	msgs, err := shared.XRange(ctx, DefaultPropagationStream, "-", "+").Result()
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("XRange() = %v, %v; want one published report", msgs, err)
+	}
+
+	// MX1 skips its own report
+	applyPropagated(msgs)
+	client.FlushAll(ctx)
+
+	// MX2 learns it as a report of node mx1, without publishing it again
+	nodeID = "mx2"
+	applyPropagated(msgs)
+	score, err := client.Get(ctx, LocalScorePrefix+hash).Float64()
+	if err != nil || score <= 0 {
+		t.Fatalf("score on mx2 = %v, %v; want a learned spam", score, err)
+	}
+	if reporters := client.HGetAll(ctx, LocalReporterPrefix+hash).Val(); reporters["node:mx1"] != "spam" {
+		t.Errorf("reporters = %v, want node:mx1", reporters)
+	}
+	if n := shared.XLen(ctx, DefaultPropagationStream).Val(); n != 1 {
+		t.Errorf("stream length = %d, want 1 (no echo)", n)
+	}
+	if last := client.Get(ctx, PropagationLastIDKey).Val(); last != msgs[0].ID {
+		t.Errorf("last ID = %q, want %q", last, msgs[0].ID)
+	}
+}
+
+// TestGossip checks that peers exchange learned spam signed with the shared secret,
+// learn it with their weight, relay it once and drop what they already handled
+func TestGossip(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB, originalNodeID := rdb, nodeID
+	rdb, nodeID = client, "mx1"
+	defer func() { rdb, nodeID = originalRDB, originalNodeID }()
+	originalSpam, originalRetention := atomic.LoadInt64(&spamWeight), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 2)
+	localRetentionDuration = time.Hour
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		localRetentionDuration = originalRetention
+	}()
+
+	// mx2 and mx3 record what they receive
+	var mu sync.Mutex
+	received := map[string][]GossipMessage{}
+	peer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get(GossipSignatureHeader) != gossipSignature(name, body) || r.Header.Get(GossipPeerHeader) != "mx1" {
+				t.Errorf("%s: unsigned gossip from %q", name, r.Header.Get(GossipPeerHeader))
+			}
+			var msg GossipMessage
+			json.Unmarshal(body, &msg)
+			mu.Lock()
+			received[name] = append(received[name], msg)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+	mx2, mx3 := peer("mx2"), peer("mx3")
+	defer mx2.Close()
+	defer mx3.Close()
+
+	configMutex.Lock()
+	configMap["GOSSIP_NAME"] = "MX1"
+	configMap["GOSSIP_PEERS"] = "mx2,mx3"
+	configMap["GOSSIP_PEER_MX2_URL"] = mx2.URL
+	configMap["GOSSIP_PEER_MX2_WEIGHT"] = "50"
+	configMap["GOSSIP_PEER_MX2_SECRET"] = "mx1-mx2"
+	configMap["GOSSIP_PEER_MX3_URL"] = mx3.URL
+	configMap["GOSSIP_PEER_MX3_SECRET"] = "mx1-mx3"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		for _, k := range []string{"GOSSIP_NAME", "GOSSIP_PEERS", "GOSSIP_PEER_MX2_URL", "GOSSIP_PEER_MX2_WEIGHT", "GOSSIP_PEER_MX2_SECRET", "GOSSIP_PEER_MX3_URL", "GOSSIP_PEER_MX3_SECRET"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+	}()
+
+	// A spam reported locally is sent to both peers with the next batch
+	local, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	learnFromReport(ScanResult{Hashes: []string{local}, Kinds: map[string]string{local: KindAttachment}}, "spam", "alice@example.org", "")
+	learnFromReport(ScanResult{Hashes: []string{local}}, "ham", "bob@example.org", "")
+	flushGossip()
+	if len(received["mx2"]) != 1 || len(received["mx3"]) != 1 {
+		t.Fatalf("received = %v, want one batch per peer", received)
+	}
+	if sent := received["mx2"][0]; sent.Origin != "mx1" || sent.Hops != 0 || len(sent.Hashes) != 1 || sent.Hashes[0] != local || sent.Kinds[local] != KindAttachment {
+		t.Errorf("batch = %+v", sent)
+	}
+
+	post := func(from string, msg GossipMessage, signature string) int {
+		body, _ := json.Marshal(msg)
+		if signature == "" {
+			signature = gossipSignature(from, body)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/gossip", bytes.NewReader(body))
+		req.Header.Set(GossipPeerHeader, from)
+		req.Header.Set(GossipSignatureHeader, signature)
+		rr := httptest.NewRecorder()
+		gossipHandler(rr, req)
+		return rr.Code
+	}
+
+	// Spam gossiped by mx2 is learned at half the weight, and relayed to mx3 only
+	remote, _ := analyze.TLSH(strings.Repeat("Congratulations, you won a gift card from our partners! ", 6))
+	msg := GossipMessage{ID: "b1", Origin: "node-of-mx2", Time: time.Now().Unix(), Hashes: []string{remote}}
+	if code := post("mx2", msg, ""); code != http.StatusNoContent {
+		t.Fatalf("gossip from mx2 = %d, want 204", code)
+	}
+	if score, _ := client.Get(ctx, LocalScorePrefix+remote).Float64(); score != 1 {
+		t.Errorf("score = %v, want 1 (spam weight 2 at 50%%)", score)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(received["mx3"])
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if len(received["mx2"]) != 1 || len(received["mx3"]) != 2 || received["mx3"][1].Hops != 1 || received["mx3"][1].ID != "b1" {
+		t.Errorf("relayed = %v, want b1 relayed to mx3 only with one hop", received)
+	}
+	mu.Unlock()
+
+	// Loops: the same batch again, or our own batch coming back, is not learned
+	if code := post("mx3", msg, ""); code != http.StatusNoContent {
+		t.Errorf("duplicate gossip = %d, want 204", code)
+	}
+	if score, _ := client.Get(ctx, LocalScorePrefix+remote).Float64(); score != 1 {
+		t.Errorf("score after duplicate = %v, want 1", score)
+	}
+	// Not relayed beyond GOSSIP_MAX_HOPS
+	last := GossipMessage{ID: "b2", Origin: "node-of-mx3", Hops: DefaultGossipMaxHops - 1, Time: time.Now().Unix(), Hashes: []string{remote}}
+	post("mx3", last, "")
+
+	// Unknown peers, bad signatures and stale messages are refused
+	if code := post("mx9", GossipMessage{ID: "b3", Origin: "x", Time: time.Now().Unix()}, ""); code != http.StatusUnauthorized {
+		t.Errorf("unknown peer = %d, want 401", code)
+	}
+	if code := post("mx2", GossipMessage{ID: "b4", Origin: "x", Time: time.Now().Unix()}, "00"); code != http.StatusUnauthorized {
+		t.Errorf("bad signature = %d, want 401", code)
+	}
+	// mx3 cannot pass for mx2 to get its weight: it does not know their secret
+	impostor, _ := json.Marshal(GossipMessage{ID: "b6", Origin: "x", Time: time.Now().Unix()})
+	if code := post("mx2", GossipMessage{ID: "b6", Origin: "x", Time: time.Now().Unix()}, gossipSignature("mx3", impostor)); code != http.StatusUnauthorized {
+		t.Errorf("gossip signed by mx3 as mx2 = %d, want 401", code)
+	}
+	if code := post("mx2", GossipMessage{ID: "b5", Origin: "x", Time: time.Now().Add(-time.Hour).Unix()}, ""); code != http.StatusBadRequest {
+		t.Errorf("stale gossip = %d, want 400", code)
+	}
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if len(received["mx3"]) != 2 {
+		t.Errorf("mx3 received %d batches, want 2", len(received["mx3"]))
+	}
+	mu.Unlock()
+
+	// Image signatures keep their own weight across peers
+	originalImage := atomic.LoadInt64(&imageSpamWeight)
+	atomic.StoreInt64(&imageSpamWeight, 4)
+	defer atomic.StoreInt64(&imageSpamWeight, originalImage)
+	image, _ := analyze.TLSH(strings.Repeat("Scanned flyer with the unbeatable offer of the week. ", 6))
+	imageMsg := GossipMessage{ID: "b7", Origin: "node-of-mx2", Hops: DefaultGossipMaxHops, Time: time.Now().Unix(), Hashes: []string{image}, Kinds: map[string]string{image: KindImage}}
+	if code := post("mx2", imageMsg, ""); code != http.StatusNoContent {
+		t.Fatalf("gossip of an image = %d, want 204", code)
+	}
+	// mx2 is trusted more by now (mx3 agreed with it): compare with its current trust
+	if score, _ := client.Get(ctx, LocalScorePrefix+image).Float64(); score != reportWeight(GossipReporterPrefix+"mx2", 4) || score <= reportWeight(GossipReporterPrefix+"mx2", 2) {
+		t.Errorf("image score = %v, want the image weight 4 at 50%%", score)
+	}
+}
+
+// TestKindWeights checks that attachment and image signatures are learned with their
+// own weights and need their own threshold to flag a message
+func TestKindWeights(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	originalSpam, originalHam, originalThreshold, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&hamWeight), atomic.LoadInt64(&localSpamThreshold), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	atomic.StoreInt64(&hamWeight, 2)
+	atomic.StoreInt64(&localSpamThreshold, 1)
+	localRetentionDuration = time.Hour
+	configMutex.Lock()
+	configMap["ATTACHMENT_SPAM_WEIGHT"] = "1"
+	configMap["ATTACHMENT_HAM_WEIGHT"] = "5"
+	configMap["ATTACHMENT_SPAM_THRESHOLD"] = "3"
+	configMap["IMAGE_SPAM_WEIGHT"] = "2"
+	configMutex.Unlock()
+	loadKindWeights()
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&hamWeight, originalHam)
+		atomic.StoreInt64(&localSpamThreshold, originalThreshold)
+		localRetentionDuration = originalRetention
+		configMutex.Lock()
+		for _, k := range []string{"ATTACHMENT_SPAM_WEIGHT", "ATTACHMENT_HAM_WEIGHT", "ATTACHMENT_SPAM_THRESHOLD", "IMAGE_SPAM_WEIGHT"} {
+			delete(configMap, k)
+		}
+		configMutex.Unlock()
+		loadKindWeights()
+	}()
+
+	if got := attachmentKind("image/png"); got != KindImage {
+		t.Errorf("attachmentKind(image/png) = %q", got)
+	}
+	for _, tc := range []struct {
+		kind, reportType string
+		want             int64
+	}{
+		{"", "spam", 1}, {"", "ham", 2},
+		{KindAttachment, "spam", 1}, {KindAttachment, "ham", 5},
+		{KindImage, "spam", 2}, {KindImage, "ham", 2},
+	} {
+		if got := kindWeight(tc.kind, tc.reportType); got != tc.want {
+			t.Errorf("kindWeight(%q, %s) = %d, want %d", tc.kind, tc.reportType, got, tc.want)
+		}
+	}
+
+	body, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	pdf, _ := analyze.TLSH(strings.Repeat("Invoice template: amount due, reference, payment terms. ", 6))
+	logo, _ := analyze.TLSH(strings.Repeat("Congratulations, you won a gift card from our partners! ", 6))
+	scan := ScanResult{Hashes: []string{body, pdf, logo}, Kinds: map[string]string{pdf: KindAttachment, logo: KindImage}}
+	learnFromReport(scan, "spam", "", "")
+	learnFromReport(scan, "spam", "", "")
+	for hash, want := range map[string]float64{body: 2, pdf: 2, logo: 4} {
+		if got, _ := client.Get(ctx, LocalScorePrefix+hash).Float64(); got != want {
+			t.Errorf("score of %s = %v, want %v", scan.Kinds[hash], got, want)
+		}
+	}
+
+	lookup := func(sig string, kinds map[string]string) string {
+		res, _, _ := lookupSignatures(signatureLookup{Signatures: []string{sig}, Kinds: kinds, Profile: baselineProfile(), Log: logger, LocalOnly: true, SkipOracle: true})
+		return res.Action
+	}
+	if got := lookup(body, nil); got != "spam" {
+		t.Errorf("body signature = %s, want spam", got)
+	}
+	// Two spam reports do not reach ATTACHMENT_SPAM_THRESHOLD; the image has no threshold of its own
+	if got := lookup(pdf, scan.Kinds); got != "allow" {
+		t.Errorf("attachment signature = %s, want allow", got)
+	}
+	if got := lookup(logo, scan.Kinds); got != "spam" {
+		t.Errorf("image signature = %s, want spam", got)
+	}
+	learnFromReport(ScanResult{Hashes: []string{pdf}, Kinds: scan.Kinds}, "spam", "", "")
+	if got := lookup(pdf, scan.Kinds); got != "spam" {
+		t.Errorf("attachment signature after a third report = %s, want spam", got)
+	}
+}
+
+// TestHashSeen checks the first/last seen tracking of learned hashes, its exposure
+// through /admin/lookup and /admin/campaigns, and the decay of hashes gone quiet
+func TestHashSeen(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	originalSpam, originalThreshold, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&localSpamThreshold), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	atomic.StoreInt64(&localSpamThreshold, 1)
+	localRetentionDuration = 30 * 24 * time.Hour
+	loadRecency()
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&localSpamThreshold, originalThreshold)
+		localRetentionDuration = originalRetention
+	}()
+
+	now := time.Now()
+	for _, tc := range []struct {
+		idle time.Duration
+		want float64
+	}{
+		{time.Hour, 1}, {24 * time.Hour, 1}, {8 * 24 * time.Hour, 0.5}, {15 * 24 * time.Hour, 0.25},
+	} {
+		if got := recencyFactor(now.Add(-tc.idle).Unix(), now); math.Abs(got-tc.want) > 0.001 {
+			t.Errorf("recencyFactor(%v ago) = %v, want %v", tc.idle, got, tc.want)
+		}
+	}
+	if got := recencyFactor(0, now); got != 1 {
+		t.Errorf("recencyFactor(untracked) = %v, want 1", got)
+	}
+
+	hash, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	learnFromReport(ScanResult{Hashes: []string{hash}}, "spam", "alice@example.org", "")
+	lookup := func() string {
+		res, _, _ := lookupSignatures(signatureLookup{Signatures: []string{hash}, Profile: baselineProfile(), Log: logger, LocalOnly: true, SkipOracle: true})
+		return res.Action
+	}
+	if got := lookup(); got != "spam" {
+		t.Fatalf("fresh hash = %s, want spam", got)
+	}
+	lookup()
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+	rr := get(lookupHashHandler, "/admin/lookup?hash="+hash)
+	var details HashDetails
+	if err := json.Unmarshal(rr.Body.Bytes(), &details); rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("/admin/lookup = %d %s", rr.Code, rr.Body.String())
+	}
+	if details.Hits != 2 || details.FirstSeen == 0 || details.LastSeen < details.FirstSeen || details.Score != 1 || details.EffectiveScore != 1 ||
+		details.Reporters["alice@example.org"] != "spam" {
+		t.Errorf("details = %+v", details)
+	}
+	unknown, _ := analyze.TLSH(strings.Repeat("Congratulations, you won a gift card from our partners! ", 6))
+	if rr := get(lookupHashHandler, "/admin/lookup?hash="+unknown); rr.Code != http.StatusNotFound {
+		t.Errorf("unknown hash = %d, want 404", rr.Code)
+	}
+	if rr := get(lookupHashHandler, "/admin/lookup?hash=nope"); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid hash = %d, want 400", rr.Code)
+	}
+
+	// Unseen for ten days: half the score or less, below the threshold
+	client.HSet(ctx, LocalSeenPrefix+hash, "last", now.Add(-10*24*time.Hour).Unix())
+	if got := lookup(); got != "allow" {
+		t.Errorf("hash unseen for 10 days = %s, want allow", got)
+	}
+	// That lookup matched it again: back to full score
+	if got := lookup(); got != "spam" {
+		t.Errorf("hash seen again = %s, want spam", got)
+	}
+
+	rr = get(campaignsHandler, "/admin/campaigns?limit=5")
+	var campaigns struct {
+		Campaigns []Campaign `json:"campaigns"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &campaigns); err != nil || len(campaigns.Campaigns) != 1 {
+		t.Fatalf("/admin/campaigns = %s", rr.Body.String())
+	}
+	if c := campaigns.Campaigns[0]; c.Hash != hash || c.Hits != 4 || c.FirstSeen == 0 {
+		t.Errorf("campaign = %+v", c)
+	}
+}
+
+// TestCalibration checks the ham sampling and the distance distribution of the
+// baseline to the learned spam
+func TestMigrations(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+
+	// Moved keys keep their TTL, merged ones sum their scores and counters
+	client.Set(ctx, "mi:old:moved", 4, time.Hour)
+	client.Set(ctx, "mi:old:score", 2.5, time.Hour)
+	client.Set(ctx, "mi:new:score", 1, 2*time.Hour)
+	client.HSet(ctx, "mi:old:stats", "spam", 2, "weight", "1.5", "last", "alice")
+	client.HSet(ctx, "mi:new:stats", "spam", 3, "weight", "1", "last", "bob")
+	client.SAdd(ctx, "mi:old:set", "a", "b")
+	client.SAdd(ctx, "mi:new:set", "b", "c")
+	renamed, merged, err := renameKeyPrefix("mi:old:", "mi:new:", false)
+	if err != nil || renamed != 1 || merged != 3 {
+		t.Fatalf("renameKeyPrefix() = %d, %d, %v, want 1 renamed and 3 merged", renamed, merged, err)
+	}
+	if ttl := client.TTL(ctx, "mi:new:moved").Val(); ttl <= 0 {
+		t.Errorf("TTL of a moved key = %v", ttl)
+	}
+	if v, _ := client.Get(ctx, "mi:new:score").Float64(); v != 3.5 {
+		t.Errorf("merged score = %v, want 3.5", v)
+	}
+	if stats := client.HGetAll(ctx, "mi:new:stats").Val(); stats["spam"] != "5" || stats["weight"] != "2.5" || stats["last"] != "bob" {
+		t.Errorf("merged counters = %v, want spam 5, weight 2.5 and last kept", stats)
+	}
+	if members := client.SCard(ctx, "mi:new:set").Val(); members != 3 {
+		t.Errorf("merged set has %d members, want 3", members)
+	}
+	if n := client.Exists(ctx, "mi:old:moved", "mi:old:score", "mi:old:stats", "mi:old:set").Val(); n != 0 {
+		t.Errorf("%d source keys left", n)
+	}
+	// A key that cannot be merged is reported, not dropped
+	client.RPush(ctx, "mi:old:list", "x")
+	client.RPush(ctx, "mi:new:list", "y")
+	if _, _, err := renameKeyPrefix("mi:old:", "mi:new:", false); err == nil || client.Exists(ctx, "mi:old:list").Val() != 1 {
+		t.Errorf("renameKeyPrefix() of lists = %v, want an error and the source kept", err)
+	}
+
+	// v2 drops the per-message quarantine markers; the index of another geometry is rebuilt
+	client.Set(ctx, MetaSchema, 1, 0)
+	client.Set(ctx, MetaBandGeometry, "8_4", 0)
+	client.Set(ctx, QuarantinedPrefix+"old", "1", time.Hour)
+	client.HSet(ctx, QuarantinedPrefix+"new", "alice@example.org", 1)
+	learned, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	client.Set(ctx, LocalScorePrefix+learned, 3, time.Hour)
+	if !keyspaceOutdated() {
+		t.Fatal("keyspace of schema 1 not outdated")
+	}
+	report, err := runMigrations(true)
+	if err != nil || report.ConvertedKeys != 1 || report.RebuiltBands != 1 || client.Exists(ctx, QuarantinedPrefix+"old").Val() != 1 {
+		t.Errorf("dry run = %+v, %v", report, err)
+	}
+	report, err = runMigrations(false)
+	if err != nil || report.FromVersion != 1 || report.ToVersion != 2 || report.ConvertedKeys != 1 || report.RebuiltBands != 1 {
+		t.Fatalf("runMigrations() = %+v, %v", report, err)
+	}
+	if client.Exists(ctx, QuarantinedPrefix+"old").Val() != 0 || client.Exists(ctx, QuarantinedPrefix+"new").Val() != 1 {
+		t.Errorf("quarantine records after migration: old %d, new %d", client.Exists(ctx, QuarantinedPrefix+"old").Val(), client.Exists(ctx, QuarantinedPrefix+"new").Val())
+	}
+	if n := client.Exists(ctx, LocalFragPrefix+extractBands_6_3(learned)[0]).Val(); n != 1 {
+		t.Errorf("bands of the learned hash not rebuilt")
+	}
+	if keyspaceOutdated() {
+		t.Error("keyspace still outdated after migration")
+	}
+}
+
+func TestCalibration(t *testing.T) {
+	server, client, err := store.NewMemory()
+	if err != nil {
+		t.Fatalf("store.NewMemory() error: %v", err)
+	}
+	defer server.Close()
+	originalRDB := rdb
+	rdb = client
+	defer func() { rdb = originalRDB }()
+	originalSpam, originalThreshold, originalRetention := atomic.LoadInt64(&spamWeight), atomic.LoadInt64(&localSpamThreshold), localRetentionDuration
+	atomic.StoreInt64(&spamWeight, 1)
+	atomic.StoreInt64(&localSpamThreshold, 1)
+	localRetentionDuration = time.Hour
+	configMutex.Lock()
+	configMap["HAM_SAMPLE_PERCENT"] = "100"
+	configMap["CALIBRATION_SAMPLES"] = "2"
+	configMutex.Unlock()
+	loadCalibration()
+	defer func() {
+		atomic.StoreInt64(&spamWeight, originalSpam)
+		atomic.StoreInt64(&localSpamThreshold, originalThreshold)
+		localRetentionDuration = originalRetention
+		configMutex.Lock()
+		delete(configMap, "HAM_SAMPLE_PERCENT")
+		delete(configMap, "CALIBRATION_SAMPLES")
+		configMutex.Unlock()
+		loadCalibration()
+	}()
+
+	spam, _ := analyze.TLSH(strings.Repeat("Your parcel is waiting, confirm the delivery fee today. ", 6))
+	ham, _ := analyze.TLSH(strings.Repeat("Minutes of the board meeting and the agenda for next week. ", 6))
+	old, _ := analyze.TLSH(strings.Repeat("Congratulations, you won a gift card from our partners! ", 6))
+	learnFromReport(ScanResult{Hashes: []string{spam}}, "spam", "", "")
+
+	rr := httptest.NewRecorder()
+	calibrationHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/calibration", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("GET before any calibration = %d, want 404", rr.Code)
+	}
+
+	sampleHam(AnalysisResult{Action: "spam"}, []string{spam})
+	client.ZAdd(ctx, CalibrationSampleKey, &redis.Z{Score: 1, Member: old}) // sampled long ago
+	// Allowed before the spam was learned, or a false negative: both are in the baseline
+	sampleHam(AnalysisResult{Action: "allow"}, []string{spam, ham})
+	if members := client.ZRange(ctx, CalibrationSampleKey, 0, -1).Val(); len(members) != 2 {
+		t.Fatalf("baseline = %v, want the 2 latest samples", members)
+	}
+
+	report, err := calibrate()
+	if err != nil {
+		t.Fatalf("calibrate() error: %v", err)
+	}
+	if report.Samples != 2 || report.Flagged != 1 || report.OverlapRisk != 0.5 || report.Distances["30"] != 0.5 || report.Distances["far"] != 0.5 {
+		t.Errorf("report = %+v", report)
+	}
+
+	rr = httptest.NewRecorder()
+	calibrationHandler(rr, httptest.NewRequest(http.MethodGet, "/admin/calibration", nil))
+	var got CalibrationReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); rr.Code != http.StatusOK || err != nil || got.Flagged != 1 || got.Threshold != 1 {
+		t.Errorf("GET /admin/calibration = %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Neighbours beyond ProximityDistance are measured too, not dropped by the prefilter
+	agenda := strings.Repeat("Minutes of the board meeting and the agenda for next week. ", 6)
+	neighbour, _ := analyze.TLSH(agenda + "Bring your laptop. ")
+	client.Del(ctx, CalibrationSampleKey)
+	sampleHam(AnalysisResult{Action: "allow"}, []string{ham})
+	addToBands(LocalFragPrefix, extractBands_6_3(ham), neighbour, time.Hour)
+	client.Set(ctx, LocalScorePrefix+neighbour, 1, time.Hour)
+	if d, _ := computeDistance(ham, neighbour, false, 0); d <= ProximityDistance || d > 100 {
+		t.Fatalf("distance(ham, neighbour) = %d, want between %d and 100", d, ProximityDistance)
+	}
+	if report, err := calibrate(); err != nil || report.Distances["100"] != 1 {
+		t.Errorf("report = %+v (%v), want the neighbour in the 100 bucket", report, err)
+	}
+}
+
+func TestMaintenanceWindows(t *testing.T) {
+	if _, err := parseCron("0 2 * *"); err == nil {
+		t.Error("parseCron accepted 4 fields")
+	}
+	for _, expr := range []string{"60 * * * *", "* * * foo *", "* 5-2 * * *", "*/0 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+
+	day := func(y int, m time.Month, d, h, min int) time.Time { return time.Date(y, m, d, h, min, 0, 0, time.UTC) }
+	cases := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"*/15 1-4 * * *", day(2025, time.March, 3, 2, 30), true},
+		{"*/15 1-4 * * *", day(2025, time.March, 3, 2, 31), false},
+		{"*/15 1-4 * * *", day(2025, time.March, 3, 5, 0), false},
+		{"* 0-6 * * MON-fri", day(2025, time.March, 3, 3, 0), true},  // Monday
+		{"* 0-6 * * MON-fri", day(2025, time.March, 8, 3, 0), false}, // Saturday
+		{"* * * * 7", day(2025, time.March, 9, 12, 0), true},         // Sunday
+		{"* * * dec,jan *", day(2025, time.January, 9, 12, 0), true},
+		{"* * * dec,jan *", day(2025, time.March, 9, 12, 0), false},
+		// Day of month and day of week both restricted: either matches
+		{"* * 1 * sat", day(2025, time.March, 8, 12, 0), true},
+		{"* * 1 * sat", day(2025, time.March, 1, 12, 0), true},
+		{"* * 1 * sat", day(2025, time.March, 3, 12, 0), false},
+	}
+	for _, c := range cases {
+		s, err := parseCron(c.expr)
+		if err != nil {
+			t.Fatalf("parseCron(%q) error: %v", c.expr, err)
+		}
+		if got := s.matches(c.at); got != c.want {
+			t.Errorf("%q matches %v = %v, want %v", c.expr, c.at, got, c.want)
+		}
+	}
+
+	loadMaintenance()
+	if !inMaintenanceWindow(time.Now()) || !maintenanceAllowed("audit") {
+		t.Error("tasks deferred without MAINTENANCE_WINDOWS")
+	}
+
+	configMutex.Lock()
+	configMap["MAINTENANCE_WINDOWS"] = "bad; 0-59 2-4 * * *"
+	configMap["MAINTENANCE_TIMEZONE"] = "Europe/Paris"
+	configMutex.Unlock()
+	defer func() {
+		configMutex.Lock()
+		delete(configMap, "MAINTENANCE_WINDOWS")
+		delete(configMap, "MAINTENANCE_TIMEZONE")
+		delete(configMap, "MAINTENANCE_MAX_SCAN_RATE")
+		configMutex.Unlock()
+		loadMaintenance()
+		atomic.StoreInt64(&maintenanceRate, 0)
+	}()
+	loadMaintenance()
+	// 01:30 UTC is 03:30 in Paris during summer time, 02:30 in winter
+	if !inMaintenanceWindow(day(2025, time.July, 1, 1, 30)) || !inMaintenanceWindow(day(2025, time.January, 1, 1, 30)) {
+		t.Error("window not evaluated in MAINTENANCE_TIMEZONE")
+	}
+	if inMaintenanceWindow(day(2025, time.July, 1, 3, 30)) {
+		t.Error("05:30 Paris time is out of the window")
+	}
+
+	// Inside the window, a busy minute still defers the task
+	configMutex.Lock()
+	configMap["MAINTENANCE_WINDOWS"] = "* * * * *"
+	configMap["MAINTENANCE_MAX_SCAN_RATE"] = "100"
+	configMutex.Unlock()
+	loadMaintenance()
+	atomic.StoreInt64(&maintenanceRate, 250)
+	if maintenanceAllowed("resync") {
+		t.Error("task allowed above MAINTENANCE_MAX_SCAN_RATE")
+	}
+	atomic.StoreInt64(&maintenanceRate, 40)
+	if !maintenanceAllowed("resync") {
+		t.Error("task deferred below MAINTENANCE_MAX_SCAN_RATE")
+	}
+}
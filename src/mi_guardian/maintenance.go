@@ -0,0 +1,210 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	_ "time/tzdata" // MAINTENANCE_TIMEZONE without the zoneinfo of the system
+)
+
+// --- Maintenance windows ---
+//
+// The consistency audit, the calibration and full resyncs from the Oracle scan
+// large parts of Redis. Run during a mail peak they compete with /analyze for it.
+// MAINTENANCE_WINDOWS restricts them to off-peak minutes, given as cron-like
+// expressions in MAINTENANCE_TIMEZONE, and MAINTENANCE_MAX_SCAN_RATE defers them
+// while more messages per minute are being scanned. A deferred task runs at the
+// next minute allowed.
+
+// cronFields are the fields of a window expression: minute, hour, day of month,
+// month and day of week, with their range and names
+var cronFields = []struct {
+	min, max int
+	names    []string
+}{
+	{0, 59, nil},
+	{0, 23, nil},
+	{1, 31, nil},
+	{1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// cronSchedule holds the values each field matches, as bit sets
+type cronSchedule struct {
+	fields     [5]uint64
+	domAny     bool // day of month was "*"
+	dowAny     bool // day of week was "*"
+	expression string
+}
+
+var (
+	maintenanceMu       sync.Mutex
+	maintenanceWindows  []cronSchedule
+	maintenanceLocation = time.UTC
+	maintenanceRate     int64 // Messages scanned during the last minute
+	maintenanceLastScan int64 // scanCount at the last sample
+)
+
+// parseCronValue parses a number or a name of a field
+func parseCronValue(s string, field int) (int, error) {
+	f := cronFields[field]
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < f.min || n > f.max {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return n, nil
+}
+
+// parseCron parses a five field expression: "*", values, ranges ("1-5", "mon-fri"),
+// steps ("*/15", "0-30/10") and comma separated lists
+func parseCron(expr string) (cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return cronSchedule{}, fmt.Errorf("%q: 5 fields expected", expr)
+	}
+	s := cronSchedule{domAny: parts[2] == "*", dowAny: parts[4] == "*", expression: expr}
+	for i, part := range parts {
+		for _, item := range strings.Split(part, ",") {
+			step := 1
+			if base, st, ok := strings.Cut(item, "/"); ok {
+				n, err := strconv.Atoi(st)
+				if err != nil || n <= 0 {
+					return cronSchedule{}, fmt.Errorf("%q: invalid step %q", expr, st)
+				}
+				item, step = base, n
+			}
+			lo, hi := cronFields[i].min, cronFields[i].max
+			if item != "*" {
+				from, to, isRange := strings.Cut(item, "-")
+				var err error
+				if lo, err = parseCronValue(from, i); err != nil {
+					return cronSchedule{}, fmt.Errorf("%q: %w", expr, err)
+				}
+				hi = lo
+				if isRange {
+					if hi, err = parseCronValue(to, i); err != nil || hi < lo {
+						return cronSchedule{}, fmt.Errorf("%q: invalid range %q", expr, item)
+					}
+				}
+			}
+			for v := lo; v <= hi; v += step {
+				s.fields[i] |= 1 << uint(v)
+			}
+		}
+	}
+	// Sunday is 0 or 7
+	if s.fields[4]&(1<<7) != 0 {
+		s.fields[4] |= 1
+	}
+	return s, nil
+}
+
+// matches tells whether a minute is within the window. As in cron, a restricted
+// day of month and day of week match when either does.
+func (s cronSchedule) matches(t time.Time) bool {
+	has := func(field, v int) bool { return s.fields[field]&(1<<uint(v)) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// loadMaintenance reads MAINTENANCE_WINDOWS (";" separated expressions) and
+// MAINTENANCE_TIMEZONE. Invalid expressions are ignored.
+func loadMaintenance() {
+	var windows []cronSchedule
+	for _, expr := range strings.Split(getEnv("MAINTENANCE_WINDOWS", ""), ";") {
+		if expr = strings.TrimSpace(expr); expr == "" {
+			continue
+		}
+		s, err := parseCron(expr)
+		if err != nil {
+			logger.Warn("Invalid maintenance window ignored", "error", err)
+			continue
+		}
+		windows = append(windows, s)
+	}
+	location := time.UTC
+	if tz := getEnv("MAINTENANCE_TIMEZONE", ""); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			location = loc
+		} else {
+			logger.Warn("Invalid MAINTENANCE_TIMEZONE, using UTC", "timezone", tz, "error", err)
+		}
+	}
+	maintenanceMu.Lock()
+	maintenanceWindows, maintenanceLocation = windows, location
+	maintenanceMu.Unlock()
+}
+
+// inMaintenanceWindow tells whether heavy tasks may run at that time: always
+// without MAINTENANCE_WINDOWS
+func inMaintenanceWindow(now time.Time) bool {
+	maintenanceMu.Lock()
+	windows, location := maintenanceWindows, maintenanceLocation
+	maintenanceMu.Unlock()
+	if len(windows) == 0 {
+		return true
+	}
+	local := now.In(location)
+	for _, w := range windows {
+		if w.matches(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceAllowed tells whether a heavy task may run now, and counts it when
+// deferred
+func maintenanceAllowed(task string) bool {
+	reason := ""
+	if !inMaintenanceWindow(time.Now()) {
+		reason = "window"
+	} else if limit := getEnvInt("MAINTENANCE_MAX_SCAN_RATE", 0); limit > 0 && atomic.LoadInt64(&maintenanceRate) > limit {
+		reason = "scan_rate"
+	}
+	if reason == "" {
+		return true
+	}
+	logger.Debug("Maintenance task deferred", "task", task, "reason", reason, "scan_rate", atomic.LoadInt64(&maintenanceRate))
+	promMaintenanceDeferred.WithLabelValues(task, reason).Inc()
+	return false
+}
+
+// maintenanceWorker measures the scan rate every minute
+func maintenanceWorker() {
+	atomic.StoreInt64(&maintenanceLastScan, atomic.LoadInt64(&scanCount))
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		count := atomic.LoadInt64(&scanCount)
+		atomic.StoreInt64(&maintenanceRate, count-atomic.SwapInt64(&maintenanceLastScan, count))
+	}
+}
@@ -0,0 +1,325 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Keyspace migrations ---
+
+type prefixRename struct {
+	Old string
+	New string
+}
+
+type keyMigration struct {
+	Version     int
+	Description string
+	Renames     []prefixRename                 // Key prefix rewrites, TTLs preserved
+	Convert     func(dryRun bool) (int, error) // Rewrites values whose format changed, returns the keys converted
+}
+
+// keyMigrations lists keyspace changes between Guardian versions, in order.
+// Append an entry (never edit a released one) when a prefix or a value format changes.
+var keyMigrations = []keyMigration{
+	{Version: 1, Description: "Versioned keyspace baseline"},
+	{Version: 2, Description: "Quarantine delivery records per recipient", Convert: convertQuarantined},
+}
+
+// currentKeyspaceVersion is the version of the last declared migration
+func currentKeyspaceVersion() int {
+	return keyMigrations[len(keyMigrations)-1].Version
+}
+
+// markKeyspaceCurrent records the current schema and band geometry (fresh nodes)
+func markKeyspaceCurrent() {
+	rdb.Set(ctx, MetaSchema, currentKeyspaceVersion(), 0)
+	rdb.Set(ctx, MetaBandGeometry, BandGeometry, 0)
+}
+
+// storedBandGeometry returns the geometry of the stored band index.
+// Nodes predating the marker only ever used the 6/3 geometry.
+func storedBandGeometry() string {
+	geometry, _ := rdb.Get(ctx, MetaBandGeometry).Result()
+	if geometry == "" {
+		return "6_3"
+	}
+	return geometry
+}
+
+// keyspaceOutdated reports whether stored data predates the running engine
+func keyspaceOutdated() bool {
+	version, _ := rdb.Get(ctx, MetaSchema).Int()
+	return version < currentKeyspaceVersion() || storedBandGeometry() != BandGeometry
+}
+
+// runMigrations applies pending prefix renames and rebuilds the local band
+// index when the band geometry changed. With dryRun nothing is written.
+func runMigrations(dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{DryRun: dryRun, ToVersion: currentKeyspaceVersion(), Steps: []string{}}
+
+	version, err := rdb.Get(ctx, MetaSchema).Int()
+	if err != nil && err != redis.Nil {
+		return report, err
+	}
+	report.FromVersion = version
+
+	for _, m := range keyMigrations {
+		if m.Version <= version {
+			continue
+		}
+		report.Steps = append(report.Steps, fmt.Sprintf("v%d: %s", m.Version, m.Description))
+		for _, rn := range m.Renames {
+			renamed, merged, err := renameKeyPrefix(rn.Old, rn.New, dryRun)
+			if err != nil {
+				return report, err
+			}
+			report.RenamedKeys += renamed
+			report.MergedKeys += merged
+		}
+		if m.Convert != nil {
+			converted, err := m.Convert(dryRun)
+			report.ConvertedKeys += converted
+			if err != nil {
+				return report, fmt.Errorf("v%d: %w", m.Version, err)
+			}
+		}
+		if !dryRun {
+			if err := rdb.Set(ctx, MetaSchema, m.Version, 0).Err(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if geometry := storedBandGeometry(); geometry != BandGeometry {
+		report.Steps = append(report.Steps, fmt.Sprintf("bands: rebuild local index %q -> %q", geometry, BandGeometry))
+		rebuilt, err := rebuildLocalBands(dryRun)
+		if err != nil {
+			return report, err
+		}
+		report.RebuiltBands = rebuilt
+		if !dryRun {
+			// The oracle index uses the same geometry: drop it and resync from scratch
+			unlinkByPattern(FragKeyPrefix + "*")
+			if err := rdb.Set(ctx, MetaVer, 0, 0).Err(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if !dryRun {
+		if err := rdb.Set(ctx, MetaBandGeometry, BandGeometry, 0).Err(); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// renameKeyPrefix moves every key from oldPrefix to newPrefix keeping TTLs.
+// When the destination already exists, sets are merged and scores and counters
+// summed. The first failing key stops the migration with its error.
+func renameKeyPrefix(oldPrefix, newPrefix string, dryRun bool) (int, int, error) {
+	renamed, merged := 0, 0
+	iter := rdb.Scan(ctx, 0, oldPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		oldKey := iter.Val()
+		newKey := newPrefix + strings.TrimPrefix(oldKey, oldPrefix)
+
+		exists, err := rdb.Exists(ctx, newKey).Result()
+		if err != nil {
+			return renamed, merged, err
+		}
+		if exists == 0 {
+			if !dryRun {
+				// RENAME keeps the TTL of the source key
+				if err := rdb.Rename(ctx, oldKey, newKey).Err(); err != nil {
+					return renamed, merged, fmt.Errorf("rename %s: %w", oldKey, err)
+				}
+			}
+			renamed++
+			continue
+		}
+
+		if !dryRun {
+			if err := mergeKey(oldKey, newKey); err != nil {
+				return renamed, merged, fmt.Errorf("merge %s into %s: %w", oldKey, newKey, err)
+			}
+		}
+		merged++
+	}
+	return renamed, merged, iter.Err()
+}
+
+// mergeKey adds oldKey to the existing newKey and deletes it: sets are united,
+// scores and numeric hash fields (counters) summed, other hash fields kept from
+// newKey. The longest remaining lifetime is kept.
+func mergeKey(oldKey, newKey string) error {
+	oldTTL, err := rdb.PTTL(ctx, oldKey).Result()
+	if err != nil {
+		return err
+	}
+	newTTL, err := rdb.PTTL(ctx, newKey).Result()
+	if err != nil {
+		return err
+	}
+	kind, err := rdb.Type(ctx, oldKey).Result()
+	if err != nil {
+		return err
+	}
+
+	pipe := rdb.TxPipeline()
+	switch kind {
+	case "set":
+		pipe.SUnionStore(ctx, newKey, newKey, oldKey)
+	case "string":
+		v, err := rdb.Get(ctx, oldKey).Float64()
+		if err != nil {
+			return fmt.Errorf("not a score: %w", err)
+		}
+		pipe.IncrByFloat(ctx, newKey, v)
+	case "hash":
+		fields, err := rdb.HGetAll(ctx, oldKey).Result()
+		if err != nil {
+			return err
+		}
+		for field, v := range fields {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				pipe.HIncrBy(ctx, newKey, field, n)
+			} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+				pipe.HIncrByFloat(ctx, newKey, field, f)
+			} else {
+				pipe.HSetNX(ctx, newKey, field, v)
+			}
+		}
+	default:
+		return fmt.Errorf("cannot merge a %s", kind)
+	}
+	// Negative PTTL means persistent
+	if oldTTL < 0 || newTTL < 0 {
+		pipe.Persist(ctx, newKey)
+	} else if oldTTL > newTTL {
+		pipe.PExpire(ctx, newKey, oldTTL)
+	}
+	pipe.Del(ctx, oldKey)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// convertQuarantined drops the quarantine delivery markers of one message, kept
+// before deliveries were recorded per recipient: they are plain strings that the
+// per-recipient records (hashes) cannot extend, and expire within 24 hours anyway.
+func convertQuarantined(dryRun bool) (int, error) {
+	converted := 0
+	iter := rdb.Scan(ctx, 0, QuarantinedPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		kind, err := rdb.Type(ctx, iter.Val()).Result()
+		if err != nil {
+			return converted, err
+		}
+		if kind != "string" {
+			continue
+		}
+		if !dryRun {
+			if err := rdb.Del(ctx, iter.Val()).Err(); err != nil {
+				return converted, err
+			}
+		}
+		converted++
+	}
+	return converted, iter.Err()
+}
+
+// rebuildLocalBands recreates lg_f: sets from lg_s: score keys with the current
+// band geometry. Band TTLs follow the remaining lifetime of each score.
+func rebuildLocalBands(dryRun bool) (int, error) {
+	type learned struct {
+		hash string
+		ttl  time.Duration
+	}
+	var hashes []learned
+	iter := rdb.Scan(ctx, 0, LocalScorePrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		hash := strings.TrimPrefix(iter.Val(), LocalScorePrefix)
+		hashes = append(hashes, learned{hash: hash, ttl: rdb.PTTL(ctx, iter.Val()).Val()})
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return len(hashes), nil
+	}
+
+	unlinkByPattern(LocalFragPrefix + "*")
+	defer bandExistsCache.Purge()
+	for _, h := range hashes {
+		ttl := h.ttl
+		if ttl <= 0 {
+			ttl = localRetentionDuration
+		}
+		addToBands(LocalFragPrefix, extractBands_6_3(h.hash), h.hash, ttl)
+	}
+	return len(hashes), nil
+}
+
+// unlinkByPattern removes keys matching pattern in batches
+func unlinkByPattern(pattern string) {
+	iter := rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= 1000 {
+			rdb.Unlink(ctx, keys...)
+			keys = keys[:0] // Clear slice, keeping capacity
+		}
+	}
+	if len(keys) > 0 {
+		rdb.Unlink(ctx, keys...)
+	}
+}
+
+// migrateHandler runs keyspace migrations (POST, ?dry_run=1 to preview)
+func migrateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	report, err := runMigrations(dryRun)
+	if err != nil {
+		// Steps done so far are kept: the schema version is only raised once a step completes
+		logger.Error("Keyspace migration failed", "error", err, "renamed", report.RenamedKeys, "merged", report.MergedKeys,
+			"converted", report.ConvertedKeys)
+		writeError(w, http.StatusInternalServerError, ErrInternal, "Migration failed: "+err.Error())
+		return
+	}
+	logger.Info("Keyspace migration", "dry_run", dryRun, "from", report.FromVersion, "to", report.ToVersion,
+		"renamed", report.RenamedKeys, "merged", report.MergedKeys, "converted", report.ConvertedKeys, "rebuilt_bands", report.RebuiltBands)
+
+	respBytes, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
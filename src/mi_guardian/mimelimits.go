@@ -0,0 +1,160 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- MIME limits ---
+//
+// enmime builds the whole part tree in memory, so a message with thousands of
+// parts or hundreds of nested multiparts sets our memory and CPU worst case.
+// Before parsing, a line scan counts the parts and the nesting depth; a message
+// over MIME_MAX_PARTS or MIME_MAX_DEPTH is rejected (MIME_LIMIT_ACTION=reject) or
+// cut before the first part over the limit. Decoded parts larger than
+// MIME_MAX_PART_SIZE_MB are left out of hashing.
+
+var errMimeLimits = errors.New("message exceeds MIME limits")
+
+var (
+	mimeMaxParts    int64 = DefaultMimeMaxParts
+	mimeMaxDepth    int64 = DefaultMimeMaxDepth
+	mimeMaxPartSize int64 // Bytes (0 = unlimited)
+	mimeLimitReject atomic.Bool
+)
+
+// loadMimeLimits reads MIME_MAX_PARTS, MIME_MAX_DEPTH, MIME_MAX_PART_SIZE_MB and MIME_LIMIT_ACTION
+func loadMimeLimits() {
+	atomic.StoreInt64(&mimeMaxParts, getEnvPositiveInt("MIME_MAX_PARTS", DefaultMimeMaxParts))
+	atomic.StoreInt64(&mimeMaxDepth, getEnvPositiveInt("MIME_MAX_DEPTH", DefaultMimeMaxDepth))
+	atomic.StoreInt64(&mimeMaxPartSize, getEnvInt("MIME_MAX_PART_SIZE_MB", 0)*1024*1024)
+	mimeLimitReject.Store(strings.ToLower(getEnv("MIME_LIMIT_ACTION", "truncate")) == "reject")
+}
+
+// mimeLimitOffset scans the raw message and returns the offset of the boundary line
+// opening the first part over the limits, with the limit hit ("parts" or "depth"),
+// or -1 when the message is within them
+func mimeLimitOffset(data []byte, maxParts, maxDepth int) (int, string) {
+	var boundaries []string // Open multipart boundaries, outermost first
+	inHeaders := true
+	var header strings.Builder
+	parts := 0
+
+	// endHeaders opens a multipart when the headers just read declare one
+	endHeaders := func() {
+		contentType := ""
+		for _, line := range strings.Split(header.String(), "\n") {
+			if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Content-Type") {
+				contentType = value
+			}
+		}
+		header.Reset()
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(contentType))
+		if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+			boundaries = append(boundaries, params["boundary"])
+		}
+	}
+
+	for offset := 0; offset < len(data); {
+		end := bytes.IndexByte(data[offset:], '\n')
+		next := len(data)
+		if end >= 0 {
+			next = offset + end + 1
+		}
+		line := strings.TrimRight(string(data[offset:next]), "\r\n")
+
+		if inHeaders {
+			switch {
+			case line == "":
+				inHeaders = false
+				endHeaders()
+			case line[0] == ' ' || line[0] == '\t':
+				header.WriteString(" " + strings.TrimSpace(line))
+			default:
+				header.WriteString("\n" + line)
+			}
+			offset = next
+			continue
+		}
+
+		if strings.HasPrefix(line, "--") {
+			delim := strings.TrimRight(line[2:], " \t")
+			for i := len(boundaries) - 1; i >= 0; i-- {
+				if delim == boundaries[i]+"--" {
+					// Closing delimiter: back to the enclosing multipart
+					boundaries = boundaries[:i]
+					break
+				}
+				if delim == boundaries[i] {
+					boundaries = boundaries[:i+1]
+					parts++
+					if parts > maxParts {
+						return offset, "parts"
+					}
+					if len(boundaries) > maxDepth {
+						return offset, "depth"
+					}
+					inHeaders = true
+					break
+				}
+			}
+		}
+		offset = next
+	}
+	return -1, ""
+}
+
+// readEnvelopeLimited parses a message within the MIME limits. It returns the limit
+// that was hit ("parts", "depth", "part_size") when the message was cut or parts
+// were left out, and errMimeLimits when such messages are rejected.
+func readEnvelopeLimited(data []byte) (*enmime.Envelope, string, error) {
+	limit := ""
+	if offset, hit := mimeLimitOffset(data, int(atomic.LoadInt64(&mimeMaxParts)), int(atomic.LoadInt64(&mimeMaxDepth))); offset >= 0 {
+		promMimeLimits.WithLabelValues(hit).Inc()
+		if mimeLimitReject.Load() {
+			return nil, hit, errMimeLimits
+		}
+		data, limit = data[:offset], hit
+	}
+
+	env, err := enmime.ReadEnvelope(bytes.NewReader(data))
+	if err != nil {
+		return nil, limit, err
+	}
+
+	if maxSize := atomic.LoadInt64(&mimeMaxPartSize); maxSize > 0 {
+		for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+			for _, p := range group {
+				if int64(len(p.Content)) > maxSize {
+					logger.Debug("Part left out of hashing (size limit)", "filename", p.FileName, "content_type", p.ContentType, "size", len(p.Content))
+					p.Content = nil
+					if limit == "" {
+						limit = "part_size"
+						promMimeLimits.WithLabelValues(limit).Inc()
+					}
+				}
+			}
+		}
+	}
+	return env, limit, nil
+}
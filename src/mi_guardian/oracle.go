@@ -0,0 +1,116 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mailuminati-guardian/internal/oracle"
+)
+
+// --- Oracle wire encoding ---
+
+// /report, /stats and /sync payloads can be sent as CBOR and/or gzip compressed.
+// ORACLE_ENCODING / ORACLE_COMPRESSION force a choice; "auto" uses what the Oracle
+// selected at registration. An Oracle answering 415 is sent plain JSON afterwards.
+
+var (
+	oracleWireMu   sync.RWMutex
+	oracleWireConf oracle.Wire // From ORACLE_ENCODING / ORACLE_COMPRESSION
+	oracleWireAuto struct {    // "auto" settings and what the Oracle accepted
+		Encoding, Compression bool
+		Accepted              oracle.Wire
+	}
+	oracleWireRejected bool // Set on 415 until the next registration
+)
+
+// loadOracleWireConfig reads ORACLE_ENCODING (json, cbor, auto) and ORACLE_COMPRESSION (none, gzip, auto)
+func loadOracleWireConfig() {
+	encoding := strings.ToLower(getEnv("ORACLE_ENCODING", "json"))
+	compression := strings.ToLower(getEnv("ORACLE_COMPRESSION", "none"))
+
+	oracleWireMu.Lock()
+	defer oracleWireMu.Unlock()
+	oracleWireConf = oracle.Wire{CBOR: encoding == "cbor", Gzip: compression == "gzip"}
+	oracleWireAuto.Encoding = encoding == "auto"
+	oracleWireAuto.Compression = compression == "auto"
+}
+
+// setOracleWireAccepted records the encoding and compression selected by the Oracle at registration
+func setOracleWireAccepted(encoding, compression string) {
+	oracleWireMu.Lock()
+	defer oracleWireMu.Unlock()
+	oracleWireAuto.Accepted = oracle.Wire{CBOR: encoding == "cbor", Gzip: compression == "gzip"}
+	oracleWireRejected = false
+}
+
+// currentOracleWire returns the encoding to use for the next request
+func currentOracleWire() oracle.Wire {
+	oracleWireMu.RLock()
+	defer oracleWireMu.RUnlock()
+	if oracleWireRejected {
+		return oracle.Wire{}
+	}
+	wire := oracleWireConf
+	if oracleWireAuto.Encoding {
+		wire.CBOR = oracleWireAuto.Accepted.CBOR
+	}
+	if oracleWireAuto.Compression {
+		wire.Gzip = oracleWireAuto.Accepted.Gzip
+	}
+	return wire
+}
+
+// oracleTransport carries the Oracle requests of an embedding Engine (nil: the
+// default transport). Set once by NewEngine, before any request.
+var oracleTransport http.RoundTripper
+
+// oracleClient returns the HTTP client of Oracle requests
+func oracleClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: oracleTransport}
+}
+
+// oraclePost sends a payload to an Oracle endpoint with the negotiated encoding
+func oraclePost(client *http.Client, path string, payload interface{}) (*http.Response, error) {
+	wire := currentOracleWire()
+	for {
+		body, err := oracle.Encode(payload, wire)
+		if err != nil {
+			return nil, err
+		}
+		req, err := oracle.NewRequest(oracleURL+path, body, wire)
+		if err != nil {
+			return nil, err
+		}
+		signOracleRequest(req, body)
+
+		resp, err := client.Do(req)
+		if err != nil || resp.StatusCode != http.StatusUnsupportedMediaType || wire == (oracle.Wire{}) {
+			return resp, err
+		}
+
+		// The Oracle does not (or no longer) support it: plain JSON until the next registration
+		resp.Body.Close()
+		logger.Warn("Oracle rejected the payload encoding, falling back to JSON", "path", path, "cbor", wire.CBOR, "gzip", wire.Gzip)
+		oracleWireMu.Lock()
+		oracleWireRejected = true
+		oracleWireMu.Unlock()
+		wire = oracle.Wire{}
+	}
+}
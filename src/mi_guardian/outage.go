@@ -0,0 +1,181 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Oracle outages ---
+//
+// Oracle decisions (mi:oracle_cache:) and their bands (oc_f:) are cached for an
+// hour: without Oracle answers to refresh them, the campaigns they cover would be
+// missed again one hour into an incident. When the Oracle has not answered for
+// ORACLE_OUTAGE_SECONDS, cache entries are kept alive at OracleOutageTTLFloor; once
+// it answers again, they expire over OracleRecoveryWindow so the Oracle is not
+// queried for all of them at once.
+
+var (
+	oracleOutageSeconds int64 = DefaultOracleOutage
+	oracleOutageActive  atomic.Bool
+	engineStarted       = time.Now().Unix()
+)
+
+// oracleInOutage tells whether the Oracle has not answered a sync or a decision
+// query for ORACLE_OUTAGE_SECONDS
+func oracleInOutage() bool {
+	limit := atomic.LoadInt64(&oracleOutageSeconds)
+	if limit <= 0 {
+		return false
+	}
+	last := max(atomic.LoadInt64(&syncLastSuccess), atomic.LoadInt64(&oracleLastAnswer), engineStarted)
+	return time.Now().Unix()-last >= limit
+}
+
+// extendOracleCache brings the TTL of Oracle cache entries expiring sooner up to
+// OracleOutageTTLFloor and records them in OracleExtendedKey
+func extendOracleCache() (int64, error) {
+	var extended int64
+	for _, pattern := range []string{OracleDecisionPrefix + "*", OracleCacheFragPrefix + "*"} {
+		var keys []string
+		flush := func() error {
+			pipe := rdb.Pipeline()
+			ttls := make([]*redis.DurationCmd, len(keys))
+			for i, key := range keys {
+				ttls[i] = pipe.PTTL(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				return err
+			}
+			pipe = rdb.Pipeline()
+			var n int64
+			for i, key := range keys {
+				// Negative TTLs: gone, or without expiry
+				if ttl := ttls[i].Val(); ttl > 0 && ttl < OracleOutageTTLFloor {
+					pipe.PExpire(ctx, key, OracleOutageTTLFloor)
+					pipe.SAdd(ctx, OracleExtendedKey, key)
+					n++
+				}
+			}
+			keys = keys[:0]
+			if n == 0 {
+				return nil
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+			extended += n
+			return nil
+		}
+
+		iter := rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) >= 1000 {
+				if err := flush(); err != nil {
+					return extended, err
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return extended, err
+		}
+		if err := flush(); err != nil {
+			return extended, err
+		}
+	}
+	return extended, nil
+}
+
+// restoreOracleCache spreads the expiry of the entries kept alive during an outage
+// over OracleRecoveryWindow. Entries the Oracle refreshed since keep their TTL.
+func restoreOracleCache() (int64, error) {
+	keys, err := rdb.SMembers(ctx, OracleExtendedKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	pipe := rdb.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, err
+		}
+	}
+
+	var restored int64
+	pipe = rdb.Pipeline()
+	for i, key := range keys {
+		if ttl := ttls[i].Val(); ttl > 0 && ttl <= OracleOutageTTLFloor {
+			pipe.PExpire(ctx, key, time.Second+time.Duration(rand.Int63n(int64(OracleRecoveryWindow))))
+			restored++
+		}
+	}
+	pipe.Del(ctx, OracleExtendedKey)
+	_, err = pipe.Exec(ctx)
+	return restored, err
+}
+
+// checkOracleOutage keeps the Oracle cache alive during an outage and restores it
+// once the Oracle answers again
+func checkOracleOutage() {
+	outage := oracleInOutage()
+	wasOutage := oracleOutageActive.Swap(outage)
+	if outage {
+		promOracleOutage.Set(1)
+	} else {
+		promOracleOutage.Set(0)
+	}
+
+	switch {
+	case outage:
+		if !wasOutage {
+			logger.Warn("Oracle unreachable, keeping its cache entries alive", "seconds", atomic.LoadInt64(&oracleOutageSeconds))
+		}
+		// One node per round is enough, the cache is shared
+		if ok, _ := rdb.SetNX(ctx, OracleOutageLockKey, nodeID, 50*time.Second).Result(); !ok {
+			return
+		}
+		n, err := extendOracleCache()
+		promOracleCacheExtended.Add(float64(n))
+		if err != nil {
+			logger.Warn("Oracle cache extension failed", "error", err)
+		} else if n > 0 {
+			logger.Info("Oracle cache entries extended", "keys", n, "ttl", OracleOutageTTLFloor)
+		}
+	case wasOutage:
+		n, err := restoreOracleCache()
+		if err != nil {
+			logger.Warn("Oracle cache restore failed", "error", err)
+			oracleOutageActive.Store(true) // Retried next round
+			return
+		}
+		logger.Info("Oracle reachable again, cache TTLs restored", "keys", n, "window", OracleRecoveryWindow)
+	}
+}
+
+func oracleOutageWorker() {
+	ticker := time.NewTicker(1 * time.Minute)
+	for range ticker.C {
+		checkOracleOutage()
+	}
+}
@@ -0,0 +1,119 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+
+	"mailuminati-guardian/internal/analyze"
+)
+
+// --- Nested parts ---
+
+// findParts walks the whole MIME tree: enmime only sorts parts with a
+// disposition, forwarded messages and invites often have none
+func findParts(env *enmime.Envelope, match func(p *enmime.Part) bool) []*enmime.Part {
+	var parts []*enmime.Part
+	var walk func(p *enmime.Part)
+	walk = func(p *enmime.Part) {
+		for ; p != nil; p = p.NextSibling {
+			if match(p) {
+				parts = append(parts, p)
+			}
+			walk(p.FirstChild)
+		}
+	}
+	walk(env.Root)
+	return parts
+}
+
+// isAttachedMessage matches forwarded messages and bounce originals
+func isAttachedMessage(p *enmime.Part) bool {
+	ct := strings.ToLower(p.ContentType)
+	return ct == "message/rfc822" || ct == "message/global" || strings.HasSuffix(strings.ToLower(p.FileName), ".eml")
+}
+
+// isVCard matches contact cards
+func isVCard(p *enmime.Part) bool {
+	ct := strings.ToLower(p.ContentType)
+	return ct == "text/vcard" || ct == "text/x-vcard" || strings.HasSuffix(strings.ToLower(p.FileName), ".vcf")
+}
+
+// vcardText extracts the free text fields of a vCard (name, organization, note, URLs)
+func vcardText(data string) string {
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	var b strings.Builder
+	for _, line := range strings.Split(data, "\n") {
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		name := strings.ToUpper(line[:colon])
+		if semi := strings.IndexByte(name, ';'); semi >= 0 {
+			name = name[:semi]
+		}
+		switch name {
+		case "FN", "ORG", "TITLE", "NOTE", "URL":
+			b.WriteString(icsUnescape.Replace(line[colon+1:]) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// nestedSignatures hashes messages attached to env (forwards, bounces), recursively
+// up to MaxNestedDepth levels, like the top-level body and attachments
+func nestedSignatures(env *enmime.Envelope, depth int) []string {
+	if depth >= MaxNestedDepth {
+		return nil
+	}
+	var signatures []string
+	for _, part := range findParts(env, isAttachedMessage) {
+		inner, _, err := readEnvelopeLimited(part.Content)
+		if err != nil {
+			continue
+		}
+		if body := hashableBody(inner.Text, inner.HTML); len(body) > 100 {
+			if sig, err := analyze.TLSH(body); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+		for _, att := range inner.Attachments {
+			isImg := strings.HasPrefix(att.ContentType, "image/")
+			if isAttachedMessage(att) || (isImg && len(att.Content) <= MinVisualSize) || (!isImg && len(att.Content) <= 128) {
+				continue
+			}
+			if sig, err := analyze.TLSH(attachmentSample(att.Content)); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+		signatures = append(signatures, nestedSignatures(inner, depth+1)...)
+	}
+	return signatures
+}
+
+// nestedHashes lists, in order, the signatures coming from attached messages
+func nestedHashes(signatures []string, nested map[string]bool) []string {
+	var hashes []string
+	for _, sig := range signatures {
+		if nested[sig] {
+			hashes = append(hashes, sig)
+		}
+	}
+	return hashes
+}
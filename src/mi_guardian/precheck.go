@@ -0,0 +1,225 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Header-only pre-check ---
+//
+// At the start of DATA the MTA has the envelope and, soon after, the header block,
+// but buffering a 15 MB body just to reject a message from a listed IP is wasted
+// work. /precheck answers from what needs no body: the trusted DKIM domains, the
+// sender domain blocklist, DMARC spoofing, the reputation of the client IP, DNSBL
+// zones and header heuristics. Messages it allows still go through /analyze.
+
+const (
+	MaxPrecheckSize           = 256 << 10 // Header block read by /precheck
+	DefaultPrecheckMinVolume  = 20        // Messages of a client IP before its spam ratio counts
+	DefaultDNSBLTimeoutMillis = 1500      // Budget of all DNSBL queries of a pre-check
+)
+
+var reNameAddress = regexp.MustCompile(`[a-z0-9._%+-]+@([a-z0-9-]+(\.[a-z0-9-]+)*\.[a-z]{2,})`)
+
+// lookupDNSBL resolves DNSBL queries (replaced in tests)
+var lookupDNSBL = net.DefaultResolver.LookupHost
+
+// PrecheckResponse is the answer of POST /precheck
+type PrecheckResponse struct {
+	Action       string   `json:"action"` // allow or spam
+	Label        string   `json:"label,omitempty"`
+	DNSBL        string   `json:"dnsbl,omitempty"` // zone listing the client IP
+	Signals      []string `json:"signals,omitempty"`
+	MTAAction    string   `json:"mta_action,omitempty"`
+	SMTPResponse string   `json:"smtp_response,omitempty"`
+	Reasons      []string `json:"reasons,omitempty"`
+}
+
+// precheckSpamRatio is the spam ratio (PRECHECK_SPAM_RATIO percent) from which a
+// client IP is refused, 0 when reputation is not checked
+func precheckSpamRatio() float64 {
+	return float64(getEnvInt("PRECHECK_SPAM_RATIO", 0)) / 100
+}
+
+// poorReputation tells whether the client IP sent PRECHECK_MIN_MESSAGES messages
+// or more, with a spam ratio of PRECHECK_SPAM_RATIO or more
+func poorReputation(clientIP string) (float64, bool) {
+	limit := precheckSpamRatio()
+	if limit <= 0 || clientIP == "" {
+		return 0, false
+	}
+	counts, err := rdb.HMGet(ctx, SenderReputationPrefix+clientIP, "total", "spam").Result()
+	if err != nil {
+		return 0, false
+	}
+	total, spam := hashInt(counts[0]), hashInt(counts[1])
+	if total < getEnvPositiveInt("PRECHECK_MIN_MESSAGES", DefaultPrecheckMinVolume) {
+		return 0, false
+	}
+	ratio := float64(spam) / float64(total)
+	return ratio, ratio >= limit
+}
+
+// dnsblQuery returns the name queried for an IP in a DNSBL zone: reversed octets
+// for IPv4, reversed nibbles for IPv6
+func dnsblQuery(ip net.IP, zone string) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", v4[3], v4[2], v4[1], v4[0], zone)
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	return b.String() + zone
+}
+
+// dnsblListed returns the first PRECHECK_DNSBL zone listing the client IP. Answers
+// outside 127.0.0.0/8, and the 127.255.255.x codes of refused queries, do not count.
+func dnsblListed(clientIP string) string {
+	zones := getEnvList("PRECHECK_DNSBL")
+	ip := net.ParseIP(clientIP)
+	if len(zones) == 0 || ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return ""
+	}
+	timeout := time.Duration(getEnvPositiveInt("PRECHECK_DNSBL_TIMEOUT_MS", DefaultDNSBLTimeoutMillis)) * time.Millisecond
+	lookupCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, zone := range zones {
+		addrs, err := lookupDNSBL(lookupCtx, dnsblQuery(ip, zone))
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if v4 := net.ParseIP(a).To4(); v4 != nil && v4[0] == 127 && !(v4[1] == 255 && v4[2] == 255) {
+				return zone
+			}
+		}
+	}
+	return ""
+}
+
+// headerSignals returns the header heuristics raised by a message: no Message-ID,
+// no Date, and a From display name carrying an address of another domain
+func headerSignals(env *enmime.Envelope) []string {
+	var signals []string
+	if strings.TrimSpace(env.GetHeader("Message-ID")) == "" {
+		signals = append(signals, "missing_message_id")
+	}
+	if strings.TrimSpace(env.GetHeader("Date")) == "" {
+		signals = append(signals, "missing_date")
+	}
+	if list, err := env.AddressList("From"); err == nil && len(list) > 0 {
+		from := addressDomain(list[0].Address)
+		if m := reNameAddress.FindStringSubmatch(strings.ToLower(list[0].Name)); m != nil && from != "" &&
+			!domainMatches(m[1], from) && !domainMatches(from, m[1]) {
+			signals = append(signals, "display_name_spoof")
+		}
+	}
+	return signals
+}
+
+// precheckHandler serves POST /precheck: a verdict from the header block and the
+// envelope (X-Guardian-* headers) alone
+func precheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, MaxPrecheckSize))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrReadBody, "Error reading body")
+		return
+	}
+	// Callers may send more than the header block: the body is left out
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	if end := bytes.Index(raw, []byte("\n\n")); end >= 0 {
+		raw = raw[:end]
+	}
+	env, err := verdictEnvelope(VerdictRequest{Headers: string(raw)})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid headers")
+		return
+	}
+	meta := envelopeMeta(r)
+	tenant := tenantOf(env, meta)
+	reqLogger := logger.With(append([]any{"message_id", env.GetHeader("Message-ID")}, meta.logAttrs()...)...)
+
+	res := AnalysisResult{Action: "allow"}
+	var listedBy string
+	signals := headerSignals(env)
+	fromDomain := addressDomain(env.GetHeader("From"))
+	source := classifyTrustedSource(env, meta)
+	// Without a body, only the sender domain can be blocked
+	blockedSender, _ := blockedDomain(env)
+	switch {
+	case trustedDkimDomain(env) != "":
+		res.Label = "trusted_sender"
+	case blockedSender != "":
+		res = AnalysisResult{Action: "spam", Label: "blocked_sender"}
+	case underScrutiny(fromDomain) && dmarcRequireDkim.Load() && !dkimAligned(env, fromDomain):
+		res = AnalysisResult{Action: "spam", Label: "dmarc_spoof"}
+	case source != "":
+		// Mail relayed by a trusted forwarder or a mailing list comes from their IP
+	default:
+		if ratio, poor := poorReputation(meta.ClientIP); poor {
+			reqLogger.Debug("Client IP with a poor reputation", "spam_ratio", ratio)
+			res = AnalysisResult{Action: "spam", Label: "poor_reputation"}
+		} else if listedBy = dnsblListed(meta.ClientIP); listedBy != "" {
+			res = AnalysisResult{Action: "spam", Label: "dnsbl"}
+		}
+	}
+	if res.Action == "spam" {
+		reqLogger.Info("Pre-check spam", "label", res.Label, "dnsbl", listedBy, "from", env.GetHeader("From"), "subject", env.GetHeader("Subject"))
+	}
+	for _, s := range signals {
+		promSignals.WithLabelValues(s, tenant).Inc()
+	}
+	verdict := res.Label
+	if verdict == "" {
+		verdict = res.Action
+	}
+	promPrecheck.WithLabelValues(verdict).Inc()
+
+	mtaActionName, smtpResponse := mtaAction(res, len(meta.RcptTo))
+	respBytes, _ := json.Marshal(PrecheckResponse{
+		Action:       res.Action,
+		Label:        res.Label,
+		DNSBL:        listedBy,
+		Signals:      signals,
+		MTAAction:    mtaActionName,
+		SMTPResponse: smtpResponse,
+		Reasons:      verdictReasons(res, signals, false, reasonsLanguage(r)),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
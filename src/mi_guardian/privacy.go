@@ -0,0 +1,123 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Privacy controls ---
+
+const (
+	TelemetryOff     = 0 // Nothing sent to the Oracle /stats
+	TelemetryMinimal = 1 // Counter deltas only
+	TelemetryFull    = 2 // Deltas plus lifetime counters
+)
+
+var (
+	telemetryLevel     int64 = TelemetryFull
+	logMessageMetadata atomic.Bool
+	oracleHashOnly     atomic.Bool
+)
+
+func init() {
+	logMessageMetadata.Store(true)
+}
+
+// Log attributes identifying a message or a person, dropped when LOG_MESSAGE_METADATA is off
+var sensitiveLogKeys = map[string]bool{
+	"subject": true, "message_id": true, "from": true, "to": true, "recipient": true,
+	"reporter": true, "url": true, "filename": true, "attachments": true,
+	"client_ip": true, "helo": true, "mail_from": true, "rcpt_to": true, "auth_user": true,
+}
+
+// loadPrivacyConfig applies PRIVACY_MODE, which overrides the individual settings
+func loadPrivacyConfig() {
+	privacy := strings.ToLower(getEnv("PRIVACY_MODE", "false")) == "true"
+
+	level := int64(TelemetryFull)
+	switch strings.ToLower(getEnv("TELEMETRY", "full")) {
+	case "off":
+		level = TelemetryOff
+	case "minimal":
+		level = TelemetryMinimal
+	}
+	logMetadata := strings.ToLower(getEnv("LOG_MESSAGE_METADATA", "true")) == "true"
+	hashOnly := strings.ToLower(getEnv("ORACLE_HASH_ONLY", "false")) == "true"
+
+	if privacy {
+		level, logMetadata, hashOnly = TelemetryOff, false, true
+	}
+	atomic.StoreInt64(&telemetryLevel, level)
+	logMessageMetadata.Store(logMetadata)
+	oracleHashOnly.Store(hashOnly)
+}
+
+// privacyHandler drops sensitive attributes from log records unless
+// LOG_MESSAGE_METADATA is enabled. The setting is checked per record so
+// loggers created before a reload (logger.With) follow it too.
+type privacyHandler struct {
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func newPrivacyHandler(next slog.Handler) *privacyHandler {
+	return &privacyHandler{next: next}
+}
+
+func (h *privacyHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *privacyHandler) Handle(ctx context.Context, r slog.Record) error {
+	redact := !logMessageMetadata.Load()
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	keep := func(a slog.Attr) bool {
+		if !redact || !sensitiveLogKeys[a.Key] {
+			out.AddAttrs(a)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		keep(a)
+	}
+	r.Attrs(keep)
+	return h.next.Handle(ctx, out)
+}
+
+func (h *privacyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	all := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	all = append(all, h.attrs...)
+	return &privacyHandler{next: h.next, attrs: append(all, attrs...)}
+}
+
+func (h *privacyHandler) WithGroup(name string) slog.Handler {
+	// Attributes collected so far belong outside the group
+	next := h.next
+	if len(h.attrs) > 0 {
+		var kept []slog.Attr
+		for _, a := range h.attrs {
+			if logMessageMetadata.Load() || !sensitiveLogKeys[a.Key] {
+				kept = append(kept, a)
+			}
+		}
+		next = next.WithAttrs(kept)
+	}
+	return &privacyHandler{next: next.WithGroup(name)}
+}
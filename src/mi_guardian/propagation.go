@@ -0,0 +1,162 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Inter-node report propagation ---
+//
+// Guardians of one site often share an Oracle but not a Redis (one per MX). A spam
+// reported on MX1 then only protects MX2 once the Oracle confirmed it and MX2
+// synced. With PROPAGATION_REDIS_HOST, every report learned locally is also
+// published to a Redis stream that all nodes read: the others learn it within
+// seconds, weighted by the trust earned by the publishing node like any reporter.
+
+const (
+	DefaultPropagationStream = "mi:propagation"
+	DefaultPropagationMaxLen = 10000
+	PropagationLastIDKey     = "mi_meta:propagation_last" // Last stream entry learned, in the local Redis
+	PeerReporterPrefix       = "node:"                    // Reporter of the reports learned from another node
+)
+
+// propagationClient is the Redis holding the shared stream, nil when disabled
+var propagationClient *redis.Client
+
+// PropagationEvent is a report published to the other nodes
+type PropagationEvent struct {
+	Node      string            `json:"node"`
+	Type      string            `json:"type"` // spam or ham
+	Hashes    []string          `json:"hashes"`
+	Kinds     map[string]string `json:"kinds,omitempty"`
+	Structure string            `json:"structure,omitempty"`
+	Subject   string            `json:"subject_sig,omitempty"`
+	Time      int64             `json:"ts"`
+}
+
+// propagationStream names the shared stream
+func propagationStream() string {
+	return getEnv("PROPAGATION_STREAM", DefaultPropagationStream)
+}
+
+// connectPropagation connects to PROPAGATION_REDIS_HOST. An unreachable server only
+// disables propagation: reports are still learned locally and sent to the Oracle.
+func connectPropagation() {
+	host := getEnv("PROPAGATION_REDIS_HOST", "")
+	if host == "" {
+		return
+	}
+	addr := fmt.Sprintf("%s:%s", host, getEnv("PROPAGATION_REDIS_PORT", "6379"))
+	client := redis.NewClient(&redis.Options{
+		Addr:        addr,
+		Password:    getEnv("PROPAGATION_REDIS_PASSWORD", ""),
+		DialTimeout: 2 * time.Second,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		logger.Warn("Propagation Redis unreachable, report propagation disabled", "address", addr, "error", err)
+		return
+	}
+	propagationClient = client
+	logger.Info("Report propagation enabled", "address", addr, "stream", propagationStream())
+}
+
+// publishReport shares a report learned locally with the other nodes. Reports
+// learned from another node (propagated or gossiped) are not published again.
+func publishReport(scanData ScanResult, reportType, reporter string) {
+	if propagationClient == nil || isRelayedReporter(reporter) {
+		return
+	}
+	payload, _ := json.Marshal(PropagationEvent{
+		Node:      nodeID,
+		Type:      reportType,
+		Hashes:    scanData.Hashes,
+		Kinds:     scanData.Kinds,
+		Structure: scanData.Structure,
+		Subject:   scanData.Subject,
+		Time:      time.Now().Unix(),
+	})
+	err := propagationClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: propagationStream(),
+		MaxLen: getEnvPositiveInt("PROPAGATION_MAXLEN", DefaultPropagationMaxLen),
+		Approx: true,
+		Values: map[string]interface{}{"event": string(payload)},
+	}).Err()
+	if err != nil {
+		logger.Warn("Report not propagated", "error", err)
+		promPropagation.WithLabelValues("publish_error").Inc()
+		return
+	}
+	promPropagation.WithLabelValues("published").Inc()
+}
+
+// applyPropagated learns the reports of other nodes and remembers the last entry read
+func applyPropagated(msgs []redis.XMessage) {
+	for _, msg := range msgs {
+		var event PropagationEvent
+		raw, _ := msg.Values["event"].(string)
+		if err := json.Unmarshal([]byte(raw), &event); err != nil || event.Node == "" {
+			promPropagation.WithLabelValues("invalid").Inc()
+		} else if event.Node == nodeID {
+			// Our own report, already learned
+		} else if event.Type == "spam" || event.Type == "ham" {
+			scanData := ScanResult{Hashes: dedupeSignatures(event.Hashes), Kinds: event.Kinds, Structure: event.Structure, Subject: event.Subject}
+			learnFromReport(scanData, event.Type, PeerReporterPrefix+event.Node, "")
+			promPropagation.WithLabelValues("received").Inc()
+		}
+		rdb.Set(ctx, PropagationLastIDKey, msg.ID, 0)
+	}
+}
+
+// propagationWorker reads the shared stream and learns the reports of other nodes.
+// A new node starts from the reports published after it started.
+func propagationWorker() {
+	if propagationClient == nil {
+		return
+	}
+	lastID, err := rdb.Get(ctx, PropagationLastIDKey).Result()
+	if err != nil {
+		// "$" would skip the reports published between two reads
+		lastID = "0"
+		if latest, err := propagationClient.XRevRangeN(ctx, propagationStream(), "+", "-", 1).Result(); err == nil && len(latest) > 0 {
+			lastID = latest[0].ID
+		}
+	}
+	for {
+		streams, err := propagationClient.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{propagationStream(), lastID},
+			Count:   100,
+			Block:   5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			logger.Warn("Propagation stream unreadable", "error", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, stream := range streams {
+			if len(stream.Messages) > 0 {
+				applyPropagated(stream.Messages)
+				lastID = stream.Messages[len(stream.Messages)-1].ID
+			}
+		}
+	}
+}
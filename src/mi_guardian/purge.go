@@ -0,0 +1,203 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// --- Erasure (GDPR) ---
+
+// normalizeMessageID adds the angle brackets clients often strip
+func normalizeMessageID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" {
+		return ""
+	}
+	if !strings.HasPrefix(id, "<") {
+		id = "<" + id
+	}
+	if !strings.HasSuffix(id, ">") {
+		id = id + ">"
+	}
+	return id
+}
+
+// messageIDHash is the key suffix under which per-message data is stored
+func messageIDHash(id string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(id))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// purgeMessageID removes the scan result, report dedup keys and quarantine record
+// of a message, its entries in the asynchronous queue and on the dashboard
+func purgeMessageID(id string, dryRun bool) []string {
+	id = normalizeMessageID(id)
+	sha1Hash := messageIDHash(id)
+	keys := []string{"mi:msgid:" + sha1Hash, QuarantinedPrefix + sha1Hash}
+	iter := rdb.Scan(ctx, 0, "mi:rpt:"+sha1Hash+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	removed := deleteExisting(keys, dryRun)
+	removed = append(removed, purgeQueued(func(messageID string, _ EnvelopeMeta) bool {
+		return strings.TrimSpace(messageID) == id
+	}, dryRun)...)
+	for i := forgetRecentVerdicts(sha1Hash, dryRun); i > 0; i-- {
+		removed = append(removed, "recent_spam#"+sha1Hash)
+	}
+	return removed
+}
+
+// purgeQueued removes the messages of the asynchronous queue that match, with their
+// attempt, verdict and moved records, and returns them as mi:queue#<entry ID>
+func purgeQueued(match func(messageID string, meta EnvelopeMeta) bool, dryRun bool) []string {
+	removed := []string{}
+	entries, err := rdb.XRange(ctx, AsyncQueueKey, "-", "+").Result()
+	if err != nil {
+		return removed
+	}
+	for _, msg := range entries {
+		header := http.Header{}
+		if s, ok := msg.Values["header"].(string); ok {
+			json.Unmarshal([]byte(s), &header)
+		}
+		messageID := ""
+		if s, ok := msg.Values["message"].(string); ok {
+			if raw, err := openValue(s); err == nil {
+				if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+					messageID = m.Header.Get("Message-ID")
+				}
+			}
+		}
+		if !match(messageID, envelopeMeta(&http.Request{Header: header})) {
+			continue
+		}
+		removed = append(removed, AsyncQueueKey+"#"+msg.ID)
+		if !dryRun {
+			pipe := rdb.Pipeline()
+			pipe.XAck(ctx, AsyncQueueKey, AsyncQueueGroup, msg.ID)
+			pipe.XDel(ctx, AsyncQueueKey, msg.ID)
+			pipe.Del(ctx, AsyncAttemptsPrefix+msg.ID, AsyncMovedPrefix+msg.ID, AsyncVerdictPrefix+msg.ID)
+			pipe.Exec(ctx)
+		}
+	}
+	return removed
+}
+
+// purgeRecipient removes what was stored about a person: report quotas, reporter
+// trust, report provenance entries, quarantine records and queued messages
+func purgeRecipient(addr string, dryRun bool) []string {
+	addr = strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+	keys := []string{ReporterTrustPrefix + addr}
+	iter := rdb.Scan(ctx, 0, ReportQuotaPrefix+"reporter:"+addr+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	removed := deleteExisting(keys, dryRun)
+
+	// Provenance and quarantine hashes hold one field per reporter or recipient
+	removed = append(removed, deleteFields(LocalReporterPrefix, addr, dryRun)...)
+	removed = append(removed, deleteFields(QuarantinedPrefix, addr, dryRun)...)
+	return append(removed, purgeQueued(func(_ string, meta EnvelopeMeta) bool {
+		for _, rcpt := range meta.RcptTo {
+			if strings.EqualFold(rcpt, addr) {
+				return true
+			}
+		}
+		return false
+	}, dryRun)...)
+}
+
+// deleteFields deletes the field of every hash under prefix that has it, and
+// returns them as key#field
+func deleteFields(prefix, field string, dryRun bool) []string {
+	removed := []string{}
+	iter := rdb.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if exists, _ := rdb.HExists(ctx, key, field).Result(); exists {
+			removed = append(removed, key+"#"+field)
+			if !dryRun {
+				rdb.HDel(ctx, key, field)
+			}
+		}
+	}
+	return removed
+}
+
+// deleteExisting deletes the keys that exist and returns them
+func deleteExisting(keys []string, dryRun bool) []string {
+	removed := []string{}
+	for _, key := range keys {
+		if n, err := rdb.Exists(ctx, key).Result(); err != nil || n == 0 {
+			continue
+		}
+		removed = append(removed, key)
+		if !dryRun {
+			rdb.Del(ctx, key)
+		}
+	}
+	return removed
+}
+
+// purgeHandler erases stored artifacts tied to a Message-ID and/or a recipient
+// (POST {"message_id": ..., "recipient": ...}, ?dry_run=1 to preview)
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var reqBody struct {
+		MessageID string `json:"message_id"`
+		Recipient string `json:"recipient"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil || (reqBody.MessageID == "" && reqBody.Recipient == "") {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "message_id or recipient required")
+		return
+	}
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		writeError(w, http.StatusServiceUnavailable, ErrStoreUnavailable, "Redis unavailable")
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true"
+	removed := []string{}
+	if reqBody.MessageID != "" {
+		removed = append(removed, purgeMessageID(reqBody.MessageID, dryRun)...)
+	}
+	if reqBody.Recipient != "" {
+		removed = append(removed, purgeRecipient(reqBody.Recipient, dryRun)...)
+	}
+	// Identifiers themselves are not logged: only the size of the erasure
+	logger.Info("Purge request", "dry_run", dryRun, "removed", len(removed))
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"dry_run": dryRun,
+		"removed": removed,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,143 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// --- QR codes in images (quishing) ---
+//
+// Quishing campaigns put the phishing URL in a QR code so that no link appears in
+// the message. Codes are decoded with gozxing (a port of ZXing). The cost of a
+// decode grows with the number of pixels, so images are bounded in size, in number
+// per message and in concurrent decodes across the instance.
+
+// qrSlots bounds the QR decodes running at the same time
+var qrSlots = make(chan struct{}, MaxQRDecodes)
+
+// messageQRURLs decodes the QR codes of the attached and inline images of a message
+// and returns the http(s) URLs they hold
+func messageQRURLs(env *enmime.Envelope) []string {
+	var urls []string
+	searched := 0
+	for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines} {
+		for _, p := range group {
+			if !strings.HasPrefix(p.ContentType, "image/") || len(p.Content) == 0 {
+				continue
+			}
+			if searched++; searched > MaxQRImagesPerMessage {
+				return urls
+			}
+			if url := qrURL(p.Content); url != "" {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// cacheQRURL remembers the QR URL of a fetched image as long as its signature is cached,
+// so that messages served from the image cache report it too
+func cacheQRURL(imageURL, qr string) {
+	if qr == "" {
+		return
+	}
+	urlHash := sha1.Sum([]byte(imageURL))
+	rdb.Set(ctx, "mi:qr:"+hex.EncodeToString(urlHash[:]), qr, 24*time.Hour)
+}
+
+// cachedQRURL returns the QR URL remembered for a fetched image, if any
+func cachedQRURL(imageURL string) string {
+	urlHash := sha1.Sum([]byte(imageURL))
+	qr, _ := rdb.Get(ctx, "mi:qr:"+hex.EncodeToString(urlHash[:])).Result()
+	return qr
+}
+
+// qrURL returns the URL encoded in a QR code of the image, or "" when there is none
+func qrURL(data []byte) string {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > MaxQRImagePixels {
+		return ""
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+	text, err := decodeQR(img)
+	if err != nil {
+		return ""
+	}
+	text = strings.TrimSpace(text)
+	lower := strings.ToLower(text)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return text
+	}
+	return ""
+}
+
+// decodeQR finds and decodes a QR code in the image
+func decodeQR(img image.Image) (string, error) {
+	b := img.Bounds()
+	if b.Dx()*b.Dy() > MaxQRImagePixels {
+		return "", gozxing.NewNotFoundException("image too large")
+	}
+	qrSlots <- struct{}{}
+	defer func() { <-qrSlots }()
+
+	source, err := gozxing.NewPlanarYUVLuminanceSource(luminance(img), b.Dx(), b.Dy(), 0, 0, b.Dx(), b.Dy(), false)
+	if err != nil {
+		return "", err
+	}
+	bitmap, err := gozxing.NewBinaryBitmap(gozxing.NewHybridBinarizer(source))
+	if err != nil {
+		return "", err
+	}
+	result, err := qrcode.NewQRCodeReader().Decode(bitmap, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.GetText(), nil
+}
+
+// luminance returns the gray levels of the image, one byte per pixel, reading the
+// pixel buffers directly instead of converting every pixel through img.At
+func luminance(img image.Image) []byte {
+	b := img.Bounds()
+	switch m := img.(type) {
+	case *image.Gray:
+		if m.Stride == b.Dx() {
+			return m.Pix[m.PixOffset(b.Min.X, b.Min.Y):][:b.Dx()*b.Dy()]
+		}
+	case *image.YCbCr:
+		if m.YStride == b.Dx() {
+			return m.Y[m.YOffset(b.Min.X, b.Min.Y):][:b.Dx()*b.Dy()]
+		}
+	}
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	return gray.Pix
+}
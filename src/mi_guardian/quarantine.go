@@ -0,0 +1,359 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Quarantine delivery ---
+//
+// With QUARANTINE_DELIVERY set, messages whose MTA action is "quarantine" are
+// appended to QUARANTINE_MAILBOX over IMAP or JMAP, with X-Guardian-* headers
+// carrying the verdict and the envelope, so existing mailbox-based review and
+// release workflows apply. /analyze reports "quarantined": true once the message
+// is stored; the MTA should only drop it then.
+
+const (
+	QuarantinedPrefix        = "mi:quarantined:" // Recipients a message was delivered for, by Message-ID hash, against retries
+	DefaultQuarantineMailbox = "Quarantine"
+	DefaultQuarantineTimeout = 10 // Seconds to deliver one message
+)
+
+var errQuarantineRefused = errors.New("quarantine mailbox refused the message")
+
+// quarantineMessage prepends the Guardian headers to a raw message and normalizes
+// its line endings to CRLF, as IMAP literals require
+func quarantineMessage(raw []byte, res AnalysisResult, meta EnvelopeMeta) []byte {
+	var b bytes.Buffer
+	header := func(name, value string) {
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+		b.WriteString(name + ": " + value + "\r\n")
+	}
+	header("X-Guardian-Verdict", res.Action)
+	if res.Label != "" {
+		header("X-Guardian-Label", res.Label)
+	}
+	if res.Distance > 0 {
+		header("X-Guardian-Distance", strconv.Itoa(res.Distance))
+	}
+	if meta.MailFrom != "" {
+		header("X-Guardian-Mail-From", meta.MailFrom)
+	}
+	if len(meta.RcptTo) > 0 {
+		header("X-Guardian-Rcpt-To", strings.Join(meta.RcptTo, ", "))
+	}
+	header("X-Guardian-Node", nodeID)
+	body := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	b.Write(bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n")))
+	return b.Bytes()
+}
+
+// quarantineRecipients are the fields of the quarantine record of a message: its
+// envelope recipients, or "*" when the MTA passes none
+func quarantineRecipients(meta EnvelopeMeta) []string {
+	if len(meta.RcptTo) == 0 {
+		return []string{"*"}
+	}
+	rcpts := make([]string, 0, len(meta.RcptTo))
+	for _, rcpt := range meta.RcptTo {
+		rcpts = append(rcpts, strings.ToLower(strings.Trim(rcpt, "<> ")))
+	}
+	return rcpts
+}
+
+// quarantine delivers a message with the "quarantine" MTA action to the quarantine
+// mailbox and tells whether it is stored there. A message is delivered once per
+// recipient: MTA retries find it already stored, copies split per recipient do not.
+func quarantine(raw []byte, messageID string, res AnalysisResult, meta EnvelopeMeta) bool {
+	method := strings.ToLower(getEnv("QUARANTINE_DELIVERY", ""))
+	if method == "" {
+		return false
+	}
+	key := QuarantinedPrefix + messageIDHash(messageID)
+	rcpts := quarantineRecipients(meta)
+	if messageID != "" {
+		stored := true
+		for _, rcpt := range rcpts {
+			stored = stored && rdb.HExists(ctx, key, rcpt).Val()
+		}
+		if stored {
+			return true
+		}
+	}
+
+	timeout := time.Duration(getEnvPositiveInt("QUARANTINE_TIMEOUT", DefaultQuarantineTimeout)) * time.Second
+	mailbox := getEnv("QUARANTINE_MAILBOX", DefaultQuarantineMailbox)
+	msg := quarantineMessage(raw, res, meta)
+	var err error
+	switch method {
+	case "imap":
+		err = imapAppend(mailbox, msg, timeout)
+	case "jmap":
+		err = jmapImport(mailbox, msg, timeout)
+	default:
+		err = fmt.Errorf("unknown QUARANTINE_DELIVERY %q", method)
+	}
+	if err != nil {
+		logger.Warn("Quarantine delivery failed", "method", method, "mailbox", mailbox, "message_id", messageID, "error", err)
+		promQuarantine.WithLabelValues(method, "error").Inc()
+		return false
+	}
+	if messageID != "" {
+		fields := make([]interface{}, 0, 2*len(rcpts))
+		for _, rcpt := range rcpts {
+			fields = append(fields, rcpt, time.Now().Unix())
+		}
+		pipe := rdb.Pipeline()
+		pipe.HSet(ctx, key, fields...)
+		pipe.Expire(ctx, key, 24*time.Hour)
+		pipe.Exec(ctx)
+	}
+	promQuarantine.WithLabelValues(method, "delivered").Inc()
+	logger.Info("Message quarantined", "method", method, "mailbox", mailbox, "message_id", messageID, "label", res.Label)
+	return true
+}
+
+// imapQuote quotes an IMAP string
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+var errIMAPRefused = errors.New("IMAP server refused the command")
+
+// imapClient is a logged in IMAP connection
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// imapLogin connects to an IMAP server and logs in. The connection uses TLS (port
+// 993) unless plain is set.
+func imapLogin(addr string, plain bool, user, password string, timeout time.Duration) (*imapClient, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if plain {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+
+	if line, err := c.response(""); err != nil {
+		conn.Close()
+		return nil, err
+	} else if !strings.HasPrefix(line, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", errIMAPRefused, line)
+	}
+	fmt.Fprintf(conn, "g1 LOGIN %s %s\r\n", imapQuote(user), imapQuote(password))
+	if err := c.expectOK("g1"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// response reads up to the tagged response of a command ("" for the greeting)
+func (c *imapClient) response(tag string) (string, error) {
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if tag == "" || strings.HasPrefix(line, tag+" ") || strings.HasPrefix(line, "+") {
+			return line, nil
+		}
+	}
+}
+
+// expectOK reads the tagged response of a command and fails unless it is OK
+func (c *imapClient) expectOK(tag string) error {
+	line, err := c.response(tag)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, tag+" OK") {
+		return fmt.Errorf("%w: %s", errIMAPRefused, line)
+	}
+	return nil
+}
+
+// logout ends the session and closes the connection
+func (c *imapClient) logout() {
+	fmt.Fprintf(c.conn, "g9 LOGOUT\r\n")
+	c.conn.Close()
+}
+
+// imapAppend appends a message to a mailbox of QUARANTINE_IMAP_ADDR. The connection
+// uses TLS (port 993) unless QUARANTINE_IMAP_TLS=false.
+func imapAppend(mailbox string, msg []byte, timeout time.Duration) error {
+	addr := getEnv("QUARANTINE_IMAP_ADDR", "")
+	if addr == "" {
+		return errors.New("QUARANTINE_IMAP_ADDR not set")
+	}
+	plain := strings.ToLower(getEnv("QUARANTINE_IMAP_TLS", "true")) == "false"
+	c, err := imapLogin(addr, plain, getEnv("QUARANTINE_IMAP_USER", ""), getEnv("QUARANTINE_IMAP_PASSWORD", ""), timeout)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	fmt.Fprintf(c.conn, "g2 APPEND %s {%d}\r\n", imapQuote(mailbox), len(msg))
+	if line, err := c.response("g2"); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "+") {
+		return fmt.Errorf("%w: %s", errQuarantineRefused, line)
+	}
+	c.conn.Write(msg)
+	c.conn.Write([]byte("\r\n"))
+	if err := c.expectOK("g2"); err != nil {
+		return fmt.Errorf("%w: %v", errQuarantineRefused, err)
+	}
+	return nil
+}
+
+// jmapSession is the part of a JMAP session resource Guardian uses
+type jmapSession struct {
+	APIURL          string            `json:"apiUrl"`
+	UploadURL       string            `json:"uploadUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+}
+
+// jmapRequest sends a request to the JMAP server with the configured credentials
+func jmapRequest(client *http.Client, method, url, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token := getEnv("QUARANTINE_JMAP_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.SetBasicAuth(getEnv("QUARANTINE_JMAP_USER", ""), getEnv("QUARANTINE_JMAP_PASSWORD", ""))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%w: %s %s: HTTP %d", errQuarantineRefused, method, url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// jmapCall runs one JMAP method and returns its arguments
+func jmapCall(client *http.Client, session jmapSession, name string, args map[string]interface{}) (map[string]interface{}, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"using":       []string{"urn:ietf:params:jmap:core", "urn:ietf:params:jmap:mail"},
+		"methodCalls": []interface{}{[]interface{}{name, args, "g"}},
+	})
+	var resp struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := jmapRequest(client, http.MethodPost, session.APIURL, "application/json", body, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.MethodResponses) == 0 || len(resp.MethodResponses[0]) < 2 {
+		return nil, fmt.Errorf("%w: empty %s response", errQuarantineRefused, name)
+	}
+	var respName string
+	var result map[string]interface{}
+	json.Unmarshal(resp.MethodResponses[0][0], &respName)
+	json.Unmarshal(resp.MethodResponses[0][1], &result)
+	if respName == "error" {
+		return nil, fmt.Errorf("%w: %s: %v", errQuarantineRefused, name, result["type"])
+	}
+	return result, nil
+}
+
+// jmapImport uploads a message to the JMAP server of QUARANTINE_JMAP_URL (its
+// session resource) and imports it into the mailbox of that name
+func jmapImport(mailbox string, msg []byte, timeout time.Duration) error {
+	sessionURL := getEnv("QUARANTINE_JMAP_URL", "")
+	if sessionURL == "" {
+		return errors.New("QUARANTINE_JMAP_URL not set")
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var session jmapSession
+	if err := jmapRequest(client, http.MethodGet, sessionURL, "", nil, &session); err != nil {
+		return err
+	}
+	accountID := session.PrimaryAccounts["urn:ietf:params:jmap:mail"]
+	if accountID == "" || session.APIURL == "" || session.UploadURL == "" {
+		return fmt.Errorf("%w: no mail account in the JMAP session", errQuarantineRefused)
+	}
+
+	var upload struct {
+		BlobID string `json:"blobId"`
+	}
+	uploadURL := strings.ReplaceAll(session.UploadURL, "{accountId}", accountID)
+	if err := jmapRequest(client, http.MethodPost, uploadURL, "message/rfc822", msg, &upload); err != nil {
+		return err
+	}
+
+	found, err := jmapCall(client, session, "Mailbox/query", map[string]interface{}{
+		"accountId": accountID,
+		"filter":    map[string]string{"name": mailbox},
+	})
+	if err != nil {
+		return err
+	}
+	ids, _ := found["ids"].([]interface{})
+	if len(ids) == 0 {
+		return fmt.Errorf("%w: no mailbox %q", errQuarantineRefused, mailbox)
+	}
+	mailboxID, _ := ids[0].(string)
+
+	imported, err := jmapCall(client, session, "Email/import", map[string]interface{}{
+		"accountId": accountID,
+		"emails": map[string]interface{}{
+			"q": map[string]interface{}{
+				"blobId":     upload.BlobID,
+				"mailboxIds": map[string]bool{mailboxID: true},
+				"keywords":   map[string]bool{"$junk": true},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if notCreated, _ := imported["notCreated"].(map[string]interface{}); len(notCreated) > 0 {
+		return fmt.Errorf("%w: %v", errQuarantineRefused, notCreated["q"])
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// --- Human readable reasons for MUA banners ---
+
+// defaultReasons is the built-in catalog: language -> label, signal or action -> text.
+// "spam" is used for labels without a text of their own (e.g. new Oracle labels).
+var defaultReasons = map[string]map[string]string{
+	"en": {
+		"spam":                 "This message resembles known spam.",
+		"local_spam":           "This message resembles messages reported as spam by users of this server.",
+		"oracle_spam":          "This message resembles a known spam or scam campaign.",
+		"oracle_cache_match":   "This message resembles a known spam or scam campaign.",
+		"blocked_attachment":   "This message carries a file known to be malicious.",
+		"blocked_filename":     "This message carries a file of a type that is not accepted.",
+		"blocked_sender":       "The sender of this message is blocked on this server.",
+		"blocked_url":          "This message links to a website blocked on this server.",
+		"credential_form":      "This message asks for a password or sends what you type to another site.",
+		"double_extension":     "An attachment hides a program behind a document name.",
+		"suspicious_filename":  "An attachment has a name often used to spread malware.",
+		"qr_url":               "An image of this message holds a QR code leading to a website.",
+		"kill_switch":          "This message belongs to an ongoing phishing or spam wave.",
+		"structure_match":      "This message was built like messages reported as spam.",
+		"subject_match":        "The subject of this message is a template of messages reported as spam.",
+		"text_anomaly":         "This message hides its text with emoji, invisible characters or look-alike letters.",
+		"bayes":                "The words and links of this message are typical of messages reported as spam.",
+		"classifier":           "The spam filter model of this server rates this message as spam.",
+		"calendar_mass_invite": "This calendar invitation was sent to many people by an unverified organizer.",
+		"encrypted_attachment": "This message carries a password protected attachment, a common way to hide malware.",
+		"dmarc_spoof":          "This message may impersonate its sender: the sender domain is being spoofed.",
+		"poor_reputation":      "The server that sent this message mostly sends spam.",
+		"dnsbl":                "The server that sent this message is listed as a source of spam.",
+		"display_name_spoof":   "The sender name shows an address that is not the real sender.",
+		"trusted_sender":       "This message was signed by a trusted partner.",
+		"test":                 "This is a Mailuminati Guardian test message.",
+		"nested_match":         "An attached message resembles known spam.",
+	},
+	"fr": {
+		"spam":                 "Ce message ressemble à un spam connu.",
+		"local_spam":           "Ce message ressemble à des messages signalés comme spam par les utilisateurs de ce serveur.",
+		"oracle_spam":          "Ce message ressemble à une campagne de spam ou d'arnaque connue.",
+		"oracle_cache_match":   "Ce message ressemble à une campagne de spam ou d'arnaque connue.",
+		"blocked_attachment":   "Ce message contient un fichier connu comme malveillant.",
+		"blocked_filename":     "Ce message contient un type de fichier qui n'est pas accepté.",
+		"blocked_sender":       "L'expéditeur de ce message est bloqué sur ce serveur.",
+		"blocked_url":          "Ce message contient un lien vers un site bloqué sur ce serveur.",
+		"credential_form":      "Ce message demande un mot de passe ou envoie ce que vous saisissez vers un autre site.",
+		"double_extension":     "Une pièce jointe cache un programme derrière un nom de document.",
+		"suspicious_filename":  "Une pièce jointe porte un nom souvent utilisé pour diffuser des logiciels malveillants.",
+		"qr_url":               "Une image de ce message contient un QR code menant vers un site web.",
+		"kill_switch":          "Ce message fait partie d'une vague de phishing ou de spam en cours.",
+		"structure_match":      "Ce message est construit comme des messages signalés comme spam.",
+		"subject_match":        "L'objet de ce message reprend celui de messages signalés comme spam.",
+		"text_anomaly":         "Ce message masque son texte avec des emoji, des caractères invisibles ou des lettres trompeuses.",
+		"bayes":                "Les mots et les liens de ce message sont typiques des messages signalés comme spam.",
+		"classifier":           "Le modèle de filtrage de ce serveur classe ce message comme spam.",
+		"calendar_mass_invite": "Cette invitation a été envoyée à de nombreuses personnes par un organisateur non vérifié.",
+		"encrypted_attachment": "Ce message contient une pièce jointe protégée par mot de passe, souvent utilisée pour cacher un logiciel malveillant.",
+		"dmarc_spoof":          "Ce message usurpe peut-être son expéditeur : son domaine fait l'objet d'usurpations.",
+		"poor_reputation":      "Le serveur qui a envoyé ce message envoie surtout du spam.",
+		"dnsbl":                "Le serveur qui a envoyé ce message est répertorié comme source de spam.",
+		"display_name_spoof":   "Le nom de l'expéditeur affiche une adresse qui n'est pas celle de l'expéditeur réel.",
+		"trusted_sender":       "Ce message est signé par un partenaire de confiance.",
+		"test":                 "Ceci est un message de test de Mailuminati Guardian.",
+		"nested_match":         "Un message joint ressemble à un spam connu.",
+	},
+}
+
+var (
+	reasonsMu      sync.RWMutex
+	reasonsCatalog = defaultReasons
+)
+
+// loadReasonsCatalog merges REASONS_CATALOG_FILE (JSON, {"lang": {"label": "text"}})
+// over the built-in catalog. An empty text removes a reason.
+func loadReasonsCatalog() error {
+	catalog := make(map[string]map[string]string, len(defaultReasons))
+	for lang, texts := range defaultReasons {
+		catalog[lang] = make(map[string]string, len(texts))
+		for k, v := range texts {
+			catalog[lang][k] = v
+		}
+	}
+
+	if path := getEnv("REASONS_CATALOG_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var custom map[string]map[string]string
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return err
+		}
+		for lang, texts := range custom {
+			lang = strings.ToLower(lang)
+			if catalog[lang] == nil {
+				catalog[lang] = make(map[string]string, len(texts))
+			}
+			for k, v := range texts {
+				catalog[lang][k] = v
+			}
+		}
+	}
+
+	reasonsMu.Lock()
+	reasonsCatalog = catalog
+	reasonsMu.Unlock()
+	return nil
+}
+
+// reasonsLanguage picks the catalog language: ?lang=, then Accept-Language, then
+// REASONS_LANG (default "en")
+func reasonsLanguage(r *http.Request) string {
+	reasonsMu.RLock()
+	defer reasonsMu.RUnlock()
+
+	candidates := []string{r.URL.Query().Get("lang")}
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(tag, ";")
+		candidates = append(candidates, tag)
+	}
+	for _, tag := range candidates {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if reasonsCatalog[tag] != nil {
+			return tag
+		}
+		if base, _, ok := strings.Cut(tag, "-"); ok && reasonsCatalog[base] != nil {
+			return base
+		}
+	}
+	return strings.ToLower(getEnv("REASONS_LANG", "en"))
+}
+
+// verdictReasons returns the texts explaining a verdict: the label first, then the
+// signals and an attached message match. Unknown spam labels get the generic text.
+func verdictReasons(res AnalysisResult, signals []string, nestedMatch bool, lang string) []string {
+	reasonsMu.RLock()
+	defer reasonsMu.RUnlock()
+	texts := reasonsCatalog[lang]
+	if texts == nil {
+		texts = reasonsCatalog["en"]
+	}
+
+	var reasons []string
+	add := func(key string) bool {
+		if text := texts[key]; text != "" {
+			for _, r := range reasons {
+				if r == text {
+					return true
+				}
+			}
+			reasons = append(reasons, text)
+			return true
+		}
+		return false
+	}
+
+	if (res.Label == "" || !add(res.Label)) && res.Action == "spam" {
+		add("spam")
+	}
+	for _, s := range signals {
+		add(s)
+	}
+	if nestedMatch {
+		add("nested_match")
+	}
+	return reasons
+}
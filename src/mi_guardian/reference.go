@@ -0,0 +1,202 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Analysis by reference ---
+//
+// Guardian running next to the MTA queue does not need the message copied through
+// HTTP. A JSON body (Content-Type: application/json) names it instead: a file of the
+// spool ({"path": ...}, within ANALYZE_SPOOL_DIRS) or a message of the IMAP account
+// of ANALYZE_IMAP_ADDR ({"imap_uid": ..., "imap_mailbox": ...}). The message is
+// read by Guardian and analyzed as if it had been posted.
+
+const (
+	DefaultReferenceMailbox = "INBOX"
+	DefaultReferenceTimeout = 10 // Seconds to fetch a message over IMAP
+)
+
+var errReferenceNotFound = errors.New("referenced message not found")
+
+// AnalyzeReference is an /analyze body naming the message instead of carrying it
+type AnalyzeReference struct {
+	Path        string `json:"path,omitempty"`
+	IMAPUID     uint32 `json:"imap_uid,omitempty"`
+	IMAPMailbox string `json:"imap_mailbox,omitempty"`
+}
+
+// readAnalyzeBody reads the message of an /analyze request, fetching it when the
+// body is a reference. It writes the error response and returns false on failure.
+// A resolved request is marked as carrying the message itself, so that reading it
+// again (after coalescing) does not fetch it twice.
+func readAnalyzeBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxProcessSize))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, ErrReadBody, "Error reading body")
+		return nil, false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		return body, true
+	}
+
+	var ref AnalyzeReference
+	if err := json.Unmarshal(body, &ref); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON reference")
+		return nil, false
+	}
+	var source string
+	switch {
+	case ref.Path != "" && ref.IMAPUID == 0:
+		source = "path"
+		body, err = readSpoolFile(ref.Path)
+	case ref.IMAPUID != 0 && ref.Path == "":
+		source = "imap"
+		body, err = fetchIMAPMessage(ref.IMAPMailbox, ref.IMAPUID)
+	default:
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Either path or imap_uid is required")
+		return nil, false
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, os.ErrPermission):
+		writeError(w, http.StatusForbidden, ErrForbidden, err.Error())
+		return nil, false
+	case errors.Is(err, errReferenceNotFound):
+		writeError(w, http.StatusNotFound, ErrNotFound, "Referenced message not found")
+		return nil, false
+	default:
+		logger.Warn("Referenced message could not be read", "source", source, "error", err)
+		writeError(w, http.StatusBadGateway, ErrFetchFailed, "Referenced message could not be read")
+		return nil, false
+	}
+	r.Header.Set("Content-Type", "message/rfc822")
+	return body, true
+}
+
+// readSpoolFile reads a message file within one of the ANALYZE_SPOOL_DIRS. Symbolic
+// links are resolved before the check, so they cannot lead out of the spool.
+func readSpoolFile(path string) ([]byte, error) {
+	var dirs []string
+	for _, dir := range strings.Split(getEnv("ANALYZE_SPOOL_DIRS", ""), ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("%w: analysis by path is disabled (ANALYZE_SPOOL_DIRS)", os.ErrPermission)
+	}
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("%w: path must be absolute", os.ErrPermission)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errReferenceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, dir := range dirs {
+		if d, err := filepath.EvalSymlinks(dir); err == nil && strings.HasPrefix(resolved, d+string(filepath.Separator)) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: path outside ANALYZE_SPOOL_DIRS", os.ErrPermission)
+	}
+
+	f, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: not a regular file", os.ErrPermission)
+	}
+	return io.ReadAll(io.LimitReader(f, MaxProcessSize))
+}
+
+// fetchIMAPMessage reads a message by UID from a mailbox of ANALYZE_IMAP_ADDR,
+// without setting its \Seen flag. The connection uses TLS (port 993) unless
+// ANALYZE_IMAP_TLS=false.
+func fetchIMAPMessage(mailbox string, uid uint32) ([]byte, error) {
+	addr := getEnv("ANALYZE_IMAP_ADDR", "")
+	if addr == "" {
+		return nil, fmt.Errorf("%w: analysis by IMAP UID is disabled (ANALYZE_IMAP_ADDR)", os.ErrPermission)
+	}
+	if mailbox == "" {
+		mailbox = getEnv("ANALYZE_IMAP_MAILBOX", DefaultReferenceMailbox)
+	}
+	timeout := time.Duration(getEnvPositiveInt("ANALYZE_IMAP_TIMEOUT", DefaultReferenceTimeout)) * time.Second
+	plain := strings.ToLower(getEnv("ANALYZE_IMAP_TLS", "true")) == "false"
+	c, err := imapLogin(addr, plain, getEnv("ANALYZE_IMAP_USER", ""), getEnv("ANALYZE_IMAP_PASSWORD", ""), timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.logout()
+
+	fmt.Fprintf(c.conn, "g2 EXAMINE %s\r\n", imapQuote(mailbox))
+	if err := c.expectOK("g2"); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.conn, "g3 UID FETCH %d (BODY.PEEK[])\r\n", uid)
+	// The message comes as the literal of the untagged FETCH response: "* 4 FETCH (UID 12 BODY[] {2048}"
+	var msg []byte
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "g3 ") {
+			if !strings.HasPrefix(line, "g3 OK") {
+				return nil, fmt.Errorf("%w: %s", errIMAPRefused, line)
+			}
+			break
+		}
+		open := strings.LastIndexByte(line, '{')
+		if msg != nil || !strings.HasPrefix(line, "* ") || open < 0 || !strings.HasSuffix(line, "}") {
+			continue
+		}
+		size, err := strconv.ParseInt(line[open+1:len(line)-1], 10, 64)
+		if err != nil || size > MaxProcessSize {
+			return nil, fmt.Errorf("%w: %s", errIMAPRefused, line)
+		}
+		msg = make([]byte, size)
+		if _, err := io.ReadFull(c.r, msg); err != nil {
+			return nil, err
+		}
+	}
+	if msg == nil {
+		return nil, errReferenceNotFound
+	}
+	return msg, nil
+}
@@ -0,0 +1,164 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// --- Oracle registration ---
+
+// Settings the Oracle may recommend. They replace the built-in defaults only:
+// values from the config file or the environment always win.
+var oracleTunableSettings = map[string]bool{
+	"SPAM_THRESHOLD":           true,
+	"LIST_SPAM_THRESHOLD":      true,
+	"CONFLICT_MARGIN":          true,
+	"STRUCTURE_SPAM_THRESHOLD": true,
+	"SYNC_INTERVAL":            true,
+	"STATS_INTERVAL":           true,
+}
+
+var (
+	oracleSettingsMu sync.RWMutex
+	oracleSettings   = map[string]string{}
+)
+
+// oracleSetting returns the value recommended by the Oracle for k
+func oracleSetting(k string) (string, bool) {
+	oracleSettingsMu.RLock()
+	defer oracleSettingsMu.RUnlock()
+	v, ok := oracleSettings[k]
+	return v, ok
+}
+
+// setOracleSettings keeps the tunable settings and drops anything else
+func setOracleSettings(settings map[string]string) map[string]string {
+	kept := make(map[string]string, len(settings))
+	for k, v := range settings {
+		if oracleTunableSettings[k] {
+			kept[k] = v
+		} else {
+			logger.Debug("Ignoring Oracle setting", "key", k)
+		}
+	}
+	oracleSettingsMu.Lock()
+	oracleSettings = kept
+	oracleSettingsMu.Unlock()
+	return kept
+}
+
+// nodeCapabilities describes this node to the Oracle
+func nodeCapabilities() map[string]interface{} {
+	payload := map[string]interface{}{
+		"node_id":       nodeID,
+		"version":       EngineVersion,
+		"band_geometry": BandGeometry,
+		"public_key":    nodePublicKey(),
+		"encodings":     []string{"json", "cbor"},
+		"compressions":  []string{"gzip"},
+	}
+	if atomic.LoadInt64(&telemetryLevel) != TelemetryOff {
+		payload["features"] = map[string]interface{}{
+			"image_analysis":     enableImageAnalysis,
+			"adaptive_threshold": adaptiveEnabled.Load(),
+			"canary":             atomic.LoadInt64(&canaryPercent) > 0,
+			"oracle_hash_only":   oracleHashOnly.Load(),
+			"file_blocklist":     true,
+		}
+	}
+	return payload
+}
+
+// registerNode announces the node to the Oracle and applies the settings it recommends.
+// Settings are kept in Redis so a restart with the Oracle unreachable still uses them.
+// Returns false when the Oracle did not accept the registration (e.g. older Oracle).
+func registerNode() bool {
+	payloadBytes, _ := json.Marshal(nodeCapabilities())
+	req, err := http.NewRequest(http.MethodPost, oracleURL+"/register", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signOracleRequest(req, payloadBytes)
+
+	resp, err := oracleClient(10 * time.Second).Do(req)
+	if err != nil {
+		logger.Warn("Oracle registration failed (network)", "error", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		logger.Debug("Oracle does not support registration")
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Warn("Oracle registration failed (status)", "status", resp.StatusCode)
+		return false
+	}
+
+	var regResp struct {
+		Settings    map[string]json.Number `json:"settings"`
+		Encoding    string                 `json:"encoding"`
+		Compression string                 `json:"compression"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&regResp); err != nil {
+		logger.Warn("Oracle registration failed (invalid json)", "error", err)
+		return false
+	}
+
+	settings := make(map[string]string, len(regResp.Settings))
+	for k, v := range regResp.Settings {
+		settings[k] = v.String()
+	}
+	kept := setOracleSettings(settings)
+	setOracleWireAccepted(regResp.Encoding, regResp.Compression)
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, MetaOracleSettings)
+	for k, v := range kept {
+		pipe.HSet(ctx, MetaOracleSettings, k, v)
+	}
+	pipe.Exec(ctx)
+
+	logger.Info("Registered with Oracle", "settings", kept, "encoding", regResp.Encoding, "compression", regResp.Compression)
+	return true
+}
+
+// loadStoredOracleSettings restores the settings of the last registration
+func loadStoredOracleSettings() {
+	if stored, err := rdb.HGetAll(ctx, MetaOracleSettings).Result(); err == nil && len(stored) > 0 {
+		setOracleSettings(stored)
+	}
+}
+
+// Registration worker: registers at startup, then periodically so new
+// recommendations are picked up without restart
+func registrationWorker() {
+	for {
+		if registerNode() {
+			refreshLogicConfig()
+		}
+		time.Sleep(jittered(RegistrationInterval))
+	}
+}
@@ -0,0 +1,77 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// --- Startup state verification ---
+
+// hasKeys reports whether at least one key matches pattern
+func hasKeys(pattern string) bool {
+	iter := rdb.Scan(ctx, 0, pattern, 1000).Iterator()
+	return iter.Next(ctx)
+}
+
+// verifyState checks that the node ID, the sync sequence and the Oracle index
+// (mi_f:) agree, as they may not after a partial Redis restore, and repairs them.
+// Repairs only reset the sequence (and drop the index when it cannot be trusted):
+// the sync worker then downloads the full index again.
+// Returns the problems found; must run before initNode.
+func verifyState() []string {
+	hasID := rdb.Exists(ctx, MetaNodeID).Val() > 0
+	rawSeq, err := rdb.Get(ctx, MetaVer).Result()
+	if err != nil && err != redis.Nil {
+		logger.Warn("State verification skipped (redis error)", "error", err)
+		return nil
+	}
+	hasSeq := err == nil
+	seq, parseErr := strconv.Atoi(rawSeq)
+	indexed := hasKeys(FragKeyPrefix + "*")
+
+	var problem string
+	resetIndex := false
+	switch {
+	case !hasID && (indexed || (hasSeq && seq != 0)):
+		problem, resetIndex = "node ID missing with an existing Oracle index", true
+	case !hasSeq && indexed:
+		problem, resetIndex = "sync sequence missing with an existing Oracle index", true
+	case hasSeq && (parseErr != nil || seq < 0):
+		problem, resetIndex = "invalid sync sequence", true
+	case seq > 0 && !indexed:
+		problem = "sync sequence set but Oracle index empty"
+	}
+	if problem == "" {
+		logger.Debug("State verified", "node_id_present", hasID, "seq", rawSeq, "indexed", indexed)
+		return nil
+	}
+
+	logger.Warn("Inconsistent state detected, repairing", "problem", problem, "seq", rawSeq, "indexed", indexed)
+	if resetIndex {
+		unlinkByPattern(FragKeyPrefix + "*")
+		bandExistsCache.Purge()
+		rdb.Del(ctx, BlocklistOracleKey)
+		logger.Warn("Oracle index dropped")
+	}
+	if hasID {
+		rdb.Set(ctx, MetaVer, 0, 0)
+	}
+	logger.Warn("Full resync from the Oracle scheduled", "previous_seq", rawSeq)
+	return []string{problem}
+}
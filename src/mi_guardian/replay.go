@@ -0,0 +1,209 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Replay ---
+
+// proximityMatches returns distances to hashes sharing at least 4 bands with sig under prefix.
+// ok is false when too few bands match.
+func proximityMatches(sig, prefix string) (map[string]int, bool) {
+	bands := extractBands_6_3(sig)
+	keys := make([]string, 0, len(bands))
+	for _, b := range bands {
+		keys = append(keys, prefix+b)
+	}
+	var matched []string
+	for key, exists := range bandsExist(keys) {
+		if exists {
+			matched = append(matched, key)
+		}
+	}
+	if len(matched) < 4 {
+		return nil, false
+	}
+
+	hashes := bandMembers(prefix, matched)
+	distances, err := computeDistanceBatch(sig, hashes, hashes, false)
+	if err != nil {
+		return nil, true
+	}
+	return distances, true
+}
+
+// replayVerdict evaluates signatures like analyzeHandler does, but read-only and
+// without calling the Oracle. needsOracle reports signatures whose verdict depends
+// on a live Oracle query.
+func replayVerdict(signatures []string, profile thresholdProfile) (result AnalysisResult, needsOracle bool) {
+	result = AnalysisResult{Action: "allow"}
+	for _, sig := range signatures {
+		if cached, err := getOracleDecision(OracleDecisionPrefix + sig); err == nil {
+			var res AnalysisResult
+			if json.Unmarshal([]byte(cached), &res) == nil && res.Action == "spam" {
+				return res, false
+			}
+		}
+
+		if distances, ok := proximityMatches(sig, OracleCacheFragPrefix); ok {
+			for _, dist := range distances {
+				if dist <= ProximityDistance {
+					return AnalysisResult{Action: "spam", Label: "oracle_cache_match", ProximityMatch: true, Distance: dist}, false
+				}
+			}
+		}
+
+		if distances, ok := proximityMatches(sig, LocalFragPrefix); ok {
+			if match, isSpam := profile.match(loadLocalCandidates(distances)); isSpam {
+				return AnalysisResult{Action: "spam", Label: "local_spam", ProximityMatch: true, Distance: match.Distance}, false
+			}
+			result.ProximityMatch = true
+			continue
+		}
+
+		if _, ok := proximityMatches(sig, FragKeyPrefix); ok {
+			result.ProximityMatch = true
+			needsOracle = true
+		}
+	}
+	return result, needsOracle
+}
+
+// replayHandler re-evaluates recent scans (or uploaded hashes) against the current
+// thresholds, local store and Oracle cache, and reports how many verdicts would change.
+// POST, optional body {"hashes": [...]}, query: hours, limit, profile=canary
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var reqBody struct {
+		Hashes []string `json:"hashes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+		return
+	}
+
+	profile := baselineProfile()
+	if r.URL.Query().Get("profile") == "canary" {
+		canary, ok := canaryProfile()
+		if !ok {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "No canary profile configured")
+			return
+		}
+		profile = canary
+	}
+	hours := DefaultReplayHours
+	if h, err := strconv.Atoi(r.URL.Query().Get("hours")); err == nil && h > 0 {
+		hours = h
+	}
+	limit := DefaultReplayLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > MaxReplayLimit {
+		limit = MaxReplayLimit
+	}
+
+	var scans []ScanResult
+	if len(reqBody.Hashes) > 0 {
+		for _, hash := range reqBody.Hashes {
+			if len(scans) >= limit {
+				break
+			}
+			scans = append(scans, ScanResult{Hashes: []string{hash}})
+		}
+	} else {
+		cutoff := time.Now().Add(-time.Duration(hours) * time.Hour).Unix()
+		iter := rdb.Scan(ctx, 0, "mi:msgid:*", 1000).Iterator()
+		for iter.Next(ctx) && len(scans) < limit {
+			scan, err := loadScanResult(iter.Val())
+			if err != nil || scan.Timestamp < cutoff {
+				continue
+			}
+			scans = append(scans, scan)
+		}
+		if err := iter.Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrStoreUnavailable, "Redis error")
+			return
+		}
+	}
+
+	report := ReplayReport{Profile: profile.Name, Verdicts: map[string]int{}, Samples: []ReplayChange{}}
+	for _, scan := range scans {
+		report.Evaluated++
+		result, needsOracle := replayVerdict(scan.Hashes, profile.forSource(scan.Source))
+		if _, ok := structureSpam(scan.Structure); ok && result.Action != "spam" {
+			result, needsOracle = AnalysisResult{Action: "spam", Label: "structure_match", ProximityMatch: true}, false
+		}
+		if _, _, ok := subjectSpam(scan.Subject); ok && result.Action != "spam" {
+			result, needsOracle = AnalysisResult{Action: "spam", Label: "subject_match", ProximityMatch: true}, false
+		}
+		if needsOracle && result.Action != "spam" {
+			report.Verdicts["oracle_candidate"]++
+			report.Undetermined++
+			continue
+		}
+
+		label := result.Label
+		if label == "" {
+			label = result.Action
+		}
+		report.Verdicts[label]++
+
+		if scan.Action == "" {
+			// Scanned before verdicts were stored, or uploaded hash
+			report.Unknown++
+			continue
+		}
+		if scan.Action == result.Action {
+			continue
+		}
+		report.Changed++
+		if result.Action == "spam" {
+			report.AllowToSpam++
+		} else {
+			report.SpamToAllow++
+		}
+		if len(report.Samples) < MaxReplaySamples {
+			before := scan.Label
+			if before == "" {
+				before = scan.Action
+			}
+			report.Samples = append(report.Samples, ReplayChange{
+				Hashes: scan.Hashes,
+				Before: before,
+				After:  label,
+			})
+		}
+	}
+
+	logger.Info("Replay finished", "profile", report.Profile, "evaluated", report.Evaluated, "changed", report.Changed,
+		"allow_to_spam", report.AllowToSpam, "spam_to_allow", report.SpamToAllow, "undetermined", report.Undetermined)
+
+	respBytes, _ := json.Marshal(report)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
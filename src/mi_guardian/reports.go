@@ -0,0 +1,478 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"mailuminati-guardian/internal/oracle"
+)
+
+// --- Reports ---
+
+// reportRequest is the body of /report
+type reportRequest struct {
+	MessageID  string `json:"message-id"`
+	ReportType string `json:"report_type"`
+	Recipient  string `json:"recipient,omitempty"`
+	Reporter   string `json:"reporter,omitempty"`
+}
+
+var (
+	errDuplicateReport = errors.New("message already reported")
+	errNoScanData      = errors.New("no scan data found")
+	errNoHashes        = errors.New("no hashes to report")
+)
+
+// reportQuotaError is returned when the reporter or its domain ran out of reports
+type reportQuotaError struct {
+	Scope string
+}
+
+func (e *reportQuotaError) Error() string {
+	return "report quota exceeded (" + e.Scope + ")"
+}
+
+// submitReport learns from a spam or ham report on a scanned message and forwards
+// it to the Oracle. reporter is the identity the report is weighted by, quotaID
+// the one its quota is charged to.
+func submitReport(rep reportRequest, reporter, quotaID string) (ReportSummary, error) {
+	// Silently fix missing brackets in Message-ID
+	rep.MessageID = normalizeMessageID(rep.MessageID)
+	sha1Hash := messageIDHash(rep.MessageID)
+
+	// Prevent duplicate reports for the same type
+	reportKey := "mi:rpt:" + sha1Hash + ":" + rep.ReportType
+	if added, err := rdb.SetNX(ctx, reportKey, "1", 24*time.Hour).Result(); err != nil {
+		return ReportSummary{}, fmt.Errorf("report dedup: %w", err)
+	} else if !added {
+		logger.Warn("Duplicate report ignored", "type", rep.ReportType, "message_id", rep.MessageID)
+		return ReportSummary{}, errDuplicateReport
+	}
+
+	scanData, err := loadScanResult("mi:msgid:" + sha1Hash)
+	if err == redis.Nil {
+		return ReportSummary{}, errNoScanData
+	} else if err != nil {
+		logger.Warn("Unreadable scan data", "message_id", rep.MessageID, "error", err)
+	}
+
+	// Quotas are charged once the scan is found, so unknown Message-IDs cost nothing
+	if scope := checkReportQuota(quotaID, addressDomain(rep.Recipient)); scope != "" {
+		// Release the dedup key so the report can be resubmitted once the quota resets
+		rdb.Del(ctx, reportKey)
+		logger.Warn("Report quota exceeded", "scope", scope, "reporter", quotaID, "type", rep.ReportType, "message_id", rep.MessageID)
+		return ReportSummary{}, &reportQuotaError{Scope: scope}
+	}
+
+	// Ham reports on local verdicts drive the adaptive threshold of the tenant
+	if rep.ReportType == "ham" && scanData.Label == "local_spam" {
+		recordAdaptiveSample(scanData.Tenant, "ham")
+	}
+
+	// Check if we have hashes to report, else return error
+	if len(scanData.Hashes) == 0 {
+		return ReportSummary{}, errNoHashes
+	}
+
+	// Scans stored before deduplication may list the same signature twice
+	scanData.Hashes = dedupeSignatures(scanData.Hashes)
+
+	learned, skipOracleReport := learnFromReport(scanData, rep.ReportType, reporter, rep.MessageID)
+	summary := ReportSummary{Status: "ok", ReportType: rep.ReportType, Signatures: len(scanData.Hashes), Learned: learned}
+	for _, lh := range learned {
+		summary.MatchedExisting = summary.MatchedExisting || lh.Matched
+	}
+
+	if rep.ReportType == "spam" && skipOracleReport {
+		logger.Info("Skip Oracle report (Already known)", "message_id", rep.MessageID)
+		summary.Status, summary.Reason = "skipped_oracle", "known_locally"
+		return summary, nil
+	}
+
+	// Only the reporter role and trust are shared, never the identity
+	reporterRole := "user"
+	if isAdminReporter(reporter) {
+		reporterRole = "admin"
+	}
+	report := map[string]interface{}{
+		"node_id":        nodeID,
+		"signatures":     scanData.Hashes,
+		"report_type":    rep.ReportType,
+		"reporter_role":  reporterRole,
+		"reporter_trust": reporterTrust(reporter),
+	}
+	if oracleHashOnly.Load() {
+		// Hash-only mode: bare signatures, nothing about the reporter
+		delete(report, "reporter_role")
+		delete(report, "reporter_trust")
+	}
+	resp, err := oraclePost(oracleClient(5*time.Second), "/report", report)
+	if err != nil {
+		// Learned locally all the same; a retry would only be a duplicate
+		logger.Warn("Oracle report failed", "message_id", rep.MessageID, "error", err)
+		summary.Status, summary.OracleError = "learned_locally", ErrOracleUnavailable
+		return summary, nil
+	}
+	defer resp.Body.Close()
+
+	summary.OracleStatus = resp.StatusCode
+	summary.OracleNotified = resp.StatusCode/100 == 2
+	if !summary.OracleNotified {
+		summary.Status, summary.OracleError = "learned_locally", ErrOracleUnavailable
+	}
+	if body, err := oracle.ResponseJSON(resp); err == nil && json.Valid(body) {
+		summary.Oracle = body
+	}
+	return summary, nil
+}
+
+// --- Report quotas ---
+
+// reportClientIP returns the IP of the caller submitting a report
+func reportClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// addressDomain returns the lowercase domain part of an address
+func addressDomain(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return strings.ToLower(strings.Trim(addr[at+1:], "<> "))
+	}
+	return ""
+}
+
+// checkReportQuota enforces the daily report quotas in order reporter, domain, global.
+// Counters are only incremented up to the first exceeded scope, so an abusive
+// reporter does not consume the domain or global budget.
+// Returns the exceeded scope, or "" when the report is allowed.
+func checkReportQuota(reporter, domain string) string {
+	day := time.Now().UTC().Format("20060102")
+	scopes := []struct {
+		name  string
+		id    string
+		limit int64
+	}{
+		{"reporter", reporter, atomic.LoadInt64(&reportQuotaReporter)},
+		{"domain", domain, atomic.LoadInt64(&reportQuotaDomain)},
+		{"global", "all", atomic.LoadInt64(&reportQuotaGlobal)},
+	}
+
+	for _, scope := range scopes {
+		if scope.limit <= 0 || scope.id == "" {
+			continue
+		}
+		key := ReportQuotaPrefix + scope.name + ":" + strings.ToLower(scope.id) + ":" + day
+		pipe := rdb.Pipeline()
+		incr := pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 48*time.Hour)
+		if _, err := pipe.Exec(ctx); err != nil {
+			// Fail open: quotas must not block learning when Redis hiccups
+			logger.Warn("Report quota check failed", "scope", scope.name, "error", err)
+			continue
+		}
+		if incr.Val() > scope.limit {
+			return scope.name
+		}
+	}
+	return ""
+}
+
+// --- Reporter trust ---
+
+// AdminReporterPrefix marks the reports sent with ADMIN_TOKEN
+const AdminReporterPrefix = "admin:"
+
+// isAdminReporter tells whether a report was sent with ADMIN_TOKEN
+func isAdminReporter(reporter string) bool {
+	return strings.HasPrefix(reporter, AdminReporterPrefix)
+}
+
+// reservedReporter tells whether a reporter identity is one Guardian gives itself
+// (admins, nodes, peers, log tail), which /report callers cannot claim
+func reservedReporter(reporter string) bool {
+	reporter = strings.ToLower(reporter)
+	for _, prefix := range []string{AdminReporterPrefix, PeerReporterPrefix, GossipReporterPrefix} {
+		if strings.HasPrefix(reporter, prefix) {
+			return true
+		}
+	}
+	return reporter == LogTailReporter
+}
+
+// reporterTrust returns a multiplier in (0, 2) derived from the reporter's accuracy.
+// Accuracy is Laplace-smoothed so unknown reporters start at 1.0.
+func reporterTrust(reporter string) float64 {
+	if reporter == "" {
+		return 1
+	}
+	vals, err := rdb.HMGet(ctx, ReporterTrustPrefix+strings.ToLower(reporter), "agree", "conflict").Result()
+	if err != nil {
+		return 1
+	}
+	counts := parseFloatValues(vals)
+	return 2 * (counts[0] + 1) / (counts[0] + counts[1] + 2)
+}
+
+// parseFloatValues converts HMGET results to floats (missing fields are 0)
+func parseFloatValues(vals []interface{}) []float64 {
+	out := make([]float64, len(vals))
+	for i, v := range vals {
+		if str, ok := v.(string); ok {
+			out[i], _ = strconv.ParseFloat(str, 64)
+		}
+	}
+	return out
+}
+
+// reportWeight scales a base weight by reporter trust, ADMIN_REPORT_WEIGHT for admins
+// and the weight of the peer for gossiped spam
+func reportWeight(reporter string, base int64) float64 {
+	weight := float64(base) * reporterTrust(reporter)
+	if isAdminReporter(reporter) {
+		weight *= float64(atomic.LoadInt64(&adminReportWeight))
+	}
+	if peer, ok := strings.CutPrefix(reporter, GossipReporterPrefix); ok {
+		weight *= gossipPeerWeight(peer)
+	}
+	return math.Round(weight*100) / 100
+}
+
+// recordReportProvenance remembers who reported a hash and judges earlier reporters:
+// agreeing with a later report raises their accuracy, contradicting it lowers it
+func recordReportProvenance(hash, reporter, reportType string) {
+	if reporter == "" {
+		return
+	}
+	reporter = strings.ToLower(reporter)
+	provKey := LocalReporterPrefix + hash
+
+	previous, _ := rdb.HGetAll(ctx, provKey).Result()
+	pipe := rdb.Pipeline()
+	if previous[reporter] == reportType {
+		// Same verdict again (campaign variants): refresh only, don't judge others twice
+		previous = nil
+	}
+	for other, otherType := range previous {
+		if other == reporter {
+			continue
+		}
+		field := "agree"
+		if otherType != reportType {
+			field = "conflict"
+		}
+		trustKey := ReporterTrustPrefix + other
+		pipe.HIncrBy(ctx, trustKey, field, 1)
+		pipe.Expire(ctx, trustKey, ReporterTrustRetention)
+	}
+	pipe.HSet(ctx, provKey, reporter, reportType)
+	pipe.Expire(ctx, provKey, localRetentionDuration)
+	pipe.Exec(ctx)
+}
+
+// --- Spam/ham conflicts ---
+
+// recordReportCounters adds the report weight to the separate spam/ham counters of a hash.
+// Hashes holding both spam and ham weight are flagged in ConflictSetKey for manual review.
+func recordReportCounters(hash, reportType string, weight float64) bool {
+	key := LocalCounterPrefix + hash
+	pipe := rdb.Pipeline()
+	pipe.HIncrByFloat(ctx, key, reportType, weight)
+	countsCmd := pipe.HMGet(ctx, key, "spam", "ham")
+	pipe.Expire(ctx, key, localRetentionDuration)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false
+	}
+
+	counts := parseFloatValues(countsCmd.Val())
+	if counts[0] > 0 && counts[1] > 0 {
+		rdb.ZAdd(ctx, ConflictSetKey, &redis.Z{Score: float64(time.Now().Unix()), Member: hash})
+		logger.Info("Conflicting reports", "hash", hash, "spam", counts[0], "ham", counts[1])
+		return true
+	}
+	return false
+}
+
+// ReportSummary is the answer of /report: what was learned locally and whether the
+// Oracle got the report, for webmail plugins to confirm it to users
+type ReportSummary struct {
+	Status          string          `json:"status"` // ok, skipped_oracle (known locally) or learned_locally (Oracle not notified)
+	ReportType      string          `json:"report_type"`
+	Signatures      int             `json:"signatures"` // signatures of the reported message
+	Learned         []LearnedHash   `json:"learned"`
+	MatchedExisting bool            `json:"matched_existing"` // a signature matched a known local entry
+	OracleNotified  bool            `json:"oracle_notified"`
+	OracleStatus    int             `json:"oracle_status,omitempty"`
+	OracleError     string          `json:"oracle_error,omitempty"`
+	Reason          string          `json:"reason,omitempty"`
+	Oracle          json.RawMessage `json:"oracle,omitempty"` // reply of the Oracle
+}
+
+// writeReportSummary writes a /report answer
+func writeReportSummary(w http.ResponseWriter, summary ReportSummary) {
+	if summary.Learned == nil {
+		summary.Learned = []LearnedHash{}
+	}
+	respBytes, _ := json.Marshal(summary)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// LearnedHash is what a report changed for one signature of the reported message
+type LearnedHash struct {
+	Signature string  `json:"signature"`          // signature of the reported message
+	Hash      string  `json:"hash"`               // local entry learned: the signature, or the known entry it matched
+	Score     float64 `json:"score"`              // local score after the report
+	Matched   bool    `json:"matched_existing"`   // the signature matched a known local entry
+	Distance  int     `json:"distance,omitempty"` // distance to that entry
+}
+
+// learnFromReport applies a spam or ham report to the local store and returns the
+// entries it changed, and whether a reported spam was already known locally
+func learnFromReport(scanData ScanResult, reportType, reporter, messageID string) ([]LearnedHash, bool) {
+	knownLocally := false
+	var changes []LearnedHash
+	learned := make(map[string]bool, len(scanData.Hashes))
+
+	if reportType == "spam" || reportType == "ham" {
+		logger.Info("Processing report", "type", reportType, "message_id", messageID)
+
+		for _, hash := range scanData.Hashes {
+			bands := extractBands_6_3(hash)
+
+			// 1. Identify candidates using LSH
+			localKeys := make([]string, 0, len(bands))
+			for _, b := range bands {
+				localKeys = append(localKeys, LocalFragPrefix+b)
+			}
+
+			matchingBandsKeys := []string{}
+			for key, exists := range bandsExist(localKeys) {
+				if exists {
+					matchingBandsKeys = append(matchingBandsKeys, key)
+				}
+			}
+
+			var bestMatchHash string
+			var bestMatchDist int = 9999
+
+			if len(matchingBandsKeys) >= 4 {
+				// Get candidates
+				candidateList := bandMembers(LocalFragPrefix, matchingBandsKeys)
+				if len(candidateList) > 0 {
+					// Compute distances
+					distances, err := computeDistanceBatch(hash, candidateList, candidateList, false)
+					if err == nil {
+						for h, dist := range distances {
+							if dist < bestMatchDist {
+								bestMatchDist = dist
+								bestMatchHash = h
+							}
+						}
+					}
+				}
+			}
+
+			// Decision Logic
+			targetHash := hash // Default: the reported hash itself
+			if bestMatchDist <= ProximityDistance {
+				targetHash = bestMatchHash
+			}
+
+			// Two signatures matching the same local entry count as one report
+			if learned[targetHash] {
+				continue
+			}
+			learned[targetHash] = true
+
+			scoreKey := LocalScorePrefix + targetHash
+
+			if reportType == "spam" {
+				if bestMatchDist <= ProximityDistance {
+					// Already known locally
+					knownLocally = true
+				}
+
+				// Increment score, weighted by reporter trust
+				// Use atomic load for safe concurrent access during reload
+				weight := reportWeight(reporter, kindWeight(scanData.Kinds[hash], "spam"))
+				newScore, _ := rdb.IncrByFloat(ctx, scoreKey, weight).Result()
+				recordReportProvenance(targetHash, reporter, "spam")
+				recordReportCounters(targetHash, "spam", weight)
+				markSeen(targetHash, false)
+
+				// Refresh/Add bands
+				addToBands(LocalFragPrefix, extractBands_6_3(targetHash), targetHash, localRetentionDuration)
+				rdb.Expire(ctx, scoreKey, localRetentionDuration)
+				logger.Info("Learned spam hash", "hash", targetHash, "score", newScore, "weight", weight)
+				changes = append(changes, learnedHash(hash, targetHash, newScore, bestMatchDist))
+
+			} else if reportType == "ham" {
+				if bestMatchDist <= ProximityDistance {
+					// Found a corresponding spam entry to punish
+					weight := reportWeight(reporter, kindWeight(scanData.Kinds[hash], "ham"))
+					newScore, _ := rdb.IncrByFloat(ctx, scoreKey, -weight).Result()
+					recordReportProvenance(targetHash, reporter, "ham")
+					recordReportCounters(targetHash, "ham", weight)
+					logger.Info("Ham report", "hash", targetHash, "score", newScore, "weight", weight)
+					changes = append(changes, learnedHash(hash, targetHash, newScore, bestMatchDist))
+
+					// Refresh TTL (keep it alive even if negative)
+					rdb.Expire(ctx, scoreKey, localRetentionDuration)
+				}
+			}
+		}
+
+		if scanData.Structure != "" {
+			learnStructure(scanData.Structure, reportType, reporter)
+		}
+		if scanData.Subject != "" {
+			learnSubject(scanData.Subject, reportType, reporter)
+		}
+		if len(scanData.Tokens) > 0 {
+			learnTokens(scanData.Tokens, reportType)
+		}
+		countReport(reportType, scanData.Action == "spam")
+		publishReport(scanData, reportType, reporter)
+		queueGossip(scanData, reportType, reporter)
+	}
+	return changes, knownLocally
+}
+
+// learnedHash describes the change of a local entry for one reported signature
+func learnedHash(signature, target string, score float64, distance int) LearnedHash {
+	lh := LearnedHash{Signature: signature, Hash: target, Score: score}
+	if distance <= ProximityDistance {
+		lh.Matched, lh.Distance = true, distance
+	}
+	return lh
+}
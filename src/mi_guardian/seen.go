@@ -0,0 +1,157 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// --- First/last seen tracking ---
+//
+// Each learned hash keeps when it was first learned, when it was last reported or
+// matched by a scanned message, and how many messages matched it (lg_t:<hash>).
+// A campaign still running is more telling than one gone quiet for ten days: past
+// RECENCY_GRACE_HOURS without being seen, the score of a spam hash is halved every
+// RECENCY_HALF_LIFE_DAYS when compared with the threshold.
+
+const (
+	DefaultRecencyGrace    = 24 // Hours a hash keeps its full score after being seen
+	DefaultRecencyHalfLife = 7  // Days for the score of a hash not seen to halve
+	DefaultCampaignsLimit  = 20
+)
+
+var (
+	recencyGraceHours   int64 = DefaultRecencyGrace
+	recencyHalfLifeDays int64 = DefaultRecencyHalfLife // 0 = scores do not decay
+)
+
+// HashSeen tells when a learned hash was seen and how often it matched
+type HashSeen struct {
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	LastSeen  int64 `json:"last_seen,omitempty"`
+	Hits      int64 `json:"hits"`
+}
+
+// loadRecency reads the decay of the scores of hashes not seen lately
+func loadRecency() {
+	atomic.StoreInt64(&recencyGraceHours, getEnvInt("RECENCY_GRACE_HOURS", DefaultRecencyGrace))
+	atomic.StoreInt64(&recencyHalfLifeDays, getEnvInt("RECENCY_HALF_LIFE_DAYS", DefaultRecencyHalfLife))
+}
+
+// markSeen records that a learned hash was reported (hit false) or matched by a
+// scanned message (hit true)
+func markSeen(hash string, hit bool) {
+	key := LocalSeenPrefix + hash
+	now := time.Now().Unix()
+	pipe := rdb.Pipeline()
+	pipe.HSetNX(ctx, key, "first", now)
+	pipe.HSet(ctx, key, "last", now)
+	if hit {
+		pipe.HIncrBy(ctx, key, "hits", 1)
+	}
+	pipe.Expire(ctx, key, localRetentionDuration)
+	pipe.Exec(ctx)
+}
+
+// parseSeen converts the HMGET of first, last and hits
+func parseSeen(vals []interface{}) HashSeen {
+	n := parseFloatValues(vals)
+	if len(n) < 3 {
+		return HashSeen{}
+	}
+	return HashSeen{FirstSeen: int64(n[0]), LastSeen: int64(n[1]), Hits: int64(n[2])}
+}
+
+// recencyFactor is the share of its score a hash last seen at lastSeen keeps. Hashes
+// learned before tracking started keep all of it.
+func recencyFactor(lastSeen int64, now time.Time) float64 {
+	halfLife := atomic.LoadInt64(&recencyHalfLifeDays)
+	if halfLife <= 0 || lastSeen <= 0 {
+		return 1
+	}
+	idle := now.Sub(time.Unix(lastSeen, 0)) - time.Duration(atomic.LoadInt64(&recencyGraceHours))*time.Hour
+	if idle <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, idle.Hours()/float64(halfLife*24))
+}
+
+// HashDetails is the answer of GET /admin/lookup
+type HashDetails struct {
+	Hash           string            `json:"hash"`
+	Score          float64           `json:"score"`           // stored score
+	EffectiveScore float64           `json:"effective_score"` // score after recency, compared with the threshold
+	Spam           float64           `json:"spam"`
+	Ham            float64           `json:"ham"`
+	Reporters      map[string]string `json:"reporters,omitempty"`
+	HashSeen
+}
+
+// lookupHashHandler serves GET /admin/lookup?hash=: what is known locally about a
+// learned hash
+func lookupHashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+	hash := r.URL.Query().Get("hash")
+	if !validTLSH(hash) {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid hash")
+		return
+	}
+	candidates := loadLocalCandidates(map[string]int{hash: 0})
+	score, err := rdb.Get(ctx, LocalScorePrefix+hash).Float64()
+	if err != nil || len(candidates) == 0 {
+		writeError(w, http.StatusNotFound, ErrNotFound, "Hash not learned")
+		return
+	}
+	c := candidates[0]
+	reporters, _ := rdb.HGetAll(ctx, LocalReporterPrefix+hash).Result()
+	respBytes, _ := json.Marshal(HashDetails{
+		Hash:           hash,
+		Score:          score,
+		EffectiveScore: c.Score,
+		Spam:           c.Spam,
+		Ham:            c.Ham,
+		Reporters:      reporters,
+		HashSeen:       c.Seen,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// campaignsHandler serves GET /admin/campaigns?limit=: the learned hashes with the
+// highest score, with when they were seen
+func campaignsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+	limit := DefaultCampaignsLimit
+	if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+		limit = v
+	}
+	respBytes, _ := json.Marshal(map[string]interface{}{"campaigns": topCampaigns(limit)})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
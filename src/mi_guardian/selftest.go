@@ -0,0 +1,84 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Self test ---
+
+// isTestMessage tells whether a message carries the Guardian test pattern
+func isTestMessage(env *enmime.Envelope) bool {
+	return strings.Contains(env.Text, TestSpamPattern) || strings.Contains(env.HTML, TestSpamPattern)
+}
+
+// selftestMessage builds a canned message long enough to be hashed like real mail
+func selftestMessage() string {
+	return fmt.Sprintf("From: selftest@mailuminati.local\r\n"+
+		"To: postmaster@mailuminati.local\r\n"+
+		"Subject: Mailuminati Guardian self test\r\n"+
+		"Message-ID: <selftest-%s@mailuminati.local>\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n"+
+		"This message checks that Mailuminati Guardian parses, hashes and looks up mail end to end.\r\n"+
+		"It must always be flagged as spam with the label \"test\".\r\n\r\n%s\r\n",
+		uuid.New().String(), TestSpamPattern)
+}
+
+// selftestHandler runs a canned test message through the analysis and checks the verdict
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	raw := []byte(selftestMessage())
+	a, err := analyzeMessage(&http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/analyze"}, Header: http.Header{}}, raw)
+	if err == nil {
+		applyVerdict(raw, a, false)
+	}
+	verdict := a.Out.Result
+
+	redisStatus := "ok"
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		redisStatus = err.Error()
+	}
+
+	status := "ok"
+	code := http.StatusOK
+	if err != nil || verdict.Action != "spam" || verdict.Label != "test" || len(a.Out.Signatures) == 0 || redisStatus != "ok" {
+		status = "fail"
+		code = http.StatusServiceUnavailable
+		logger.Warn("Self test failed", "error", err, "action", verdict.Action, "label", verdict.Label, "redis", redisStatus)
+	}
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"status":      status,
+		"action":      verdict.Action,
+		"label":       verdict.Label,
+		"hashes":      len(a.Out.Signatures),
+		"redis":       redisStatus,
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(respBytes)
+}
@@ -0,0 +1,153 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mailuminati-guardian/internal/oracle"
+)
+
+// --- Node key and request signing ---
+
+// Each node holds an Ed25519 key, created with the node. Its seed is kept in a local
+// file readable by the Guardian only (NODE_KEY_FILE); Redis holds the public key, so
+// Guardians sharing a Redis can tell they do not share the key file. Oracle-bound
+// requests are signed so the Oracle can authenticate the node; the public key is
+// enrolled at registration and shown by /status.
+
+var (
+	nodeKeyMu sync.RWMutex
+	nodeKey   ed25519.PrivateKey
+)
+
+// initNodeKey loads the node key from NODE_KEY_FILE, generating it on first start.
+// A seed kept in Redis by former versions is moved to the file.
+func initNodeKey() error {
+	path := getEnv("NODE_KEY_FILE", DefaultNodeKeyFile)
+	seed, err := readNodeKeyFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed, err = createNodeKeyFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	setNodeKey(ed25519.NewKeyFromSeed(seed))
+
+	public := nodePublicKey()
+	if created, err := rdb.SetNX(ctx, MetaNodePublicKey, public, 0).Result(); err == nil && !created {
+		if stored := rdb.Get(ctx, MetaNodePublicKey).Val(); stored != public {
+			logger.Warn("Node key differs from the one of the Guardians sharing this Redis, copy their NODE_KEY_FILE",
+				"public_key", public, "stored_public_key", stored)
+		}
+	}
+	return nil
+}
+
+// readNodeKeyFile reads a base64 seed
+func readNodeKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid node key file " + path)
+	}
+	return seed, nil
+}
+
+// createNodeKeyFile writes the seed moved from Redis, or a new one, to path (mode 0600)
+func createNodeKeyFile(path string) ([]byte, error) {
+	var seed []byte
+	legacy := false
+	if stored, err := rdb.Get(ctx, MetaNodeKey).Result(); err == nil {
+		if seed, err = openValue(stored); err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, errors.New("invalid node key in Redis")
+		}
+		legacy = true
+	} else {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// O_EXCL: another Guardian sharing this file may have created it meanwhile
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return readNodeKeyFile(path)
+	} else if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(base64.StdEncoding.EncodeToString(seed) + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	if legacy {
+		rdb.Del(ctx, MetaNodeKey)
+		logger.Info("Node key moved from Redis to the key file", "path", path)
+	} else {
+		logger.Info("Node key generated", "path", path)
+	}
+	return seed, nil
+}
+
+func setNodeKey(key ed25519.PrivateKey) {
+	nodeKeyMu.Lock()
+	nodeKey = key
+	nodeKeyMu.Unlock()
+}
+
+// nodePublicKey returns the base64 public key of the node, "" before initNodeKey
+func nodePublicKey() string {
+	nodeKeyMu.RLock()
+	defer nodeKeyMu.RUnlock()
+	if nodeKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(nodeKey.Public().(ed25519.PublicKey))
+}
+
+// signOracleRequest adds the node ID, timestamp and signature headers to an Oracle request
+func signOracleRequest(req *http.Request, body []byte) {
+	nodeKeyMu.RLock()
+	key := nodeKey
+	nodeKeyMu.RUnlock()
+	if key == nil {
+		return
+	}
+	oracle.Sign(req, body, nodeID, key)
+}
@@ -0,0 +1,76 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"sync/atomic"
+)
+
+// --- Size tiers ---
+//
+// Most messages are a few kilobytes, but newsletters with megabytes of HTML and
+// 10 MB attachments must still be answered within the MTA timeout. Hashing cost
+// grows with size, so large content can be hashed partially: the raw body hash (a
+// second pass over the same text) is skipped beyond RAW_HASH_MAX_KB, and
+// attachments beyond twice ATTACHMENT_SAMPLE_KB are hashed on their first and last
+// ATTACHMENT_SAMPLE_KB. Both change the signatures of large messages, which then
+// no longer match those of Oracles and nodes hashing in full: they are off by
+// default. Analysis latency is reported per size tier.
+
+const (
+	SizeTierMedium            = 512 * 1024      // Raw message size from which a message is "medium"
+	SizeTierLarge             = 4 * 1024 * 1024 // Raw message size from which a message is "large"
+	DefaultRawHashMaxKB       = 0               // Text and HTML size over which the raw body is not hashed
+	DefaultAttachmentSampleKB = 0               // Head and tail hashed of large attachments
+)
+
+var (
+	rawHashMaxBytes       int64 = DefaultRawHashMaxKB * 1024       // 0 = always hashed
+	attachmentSampleBytes int64 = DefaultAttachmentSampleKB * 1024 // 0 = hashed in full
+)
+
+// loadSizeTiers reads the hashing limits of large content
+func loadSizeTiers() {
+	atomic.StoreInt64(&rawHashMaxBytes, getEnvInt("RAW_HASH_MAX_KB", DefaultRawHashMaxKB)*1024)
+	atomic.StoreInt64(&attachmentSampleBytes, getEnvInt("ATTACHMENT_SAMPLE_KB", DefaultAttachmentSampleKB)*1024)
+}
+
+// sizeTier names the size class of a raw message, the label of the latency metrics
+func sizeTier(size int) string {
+	switch {
+	case size >= SizeTierLarge:
+		return "large"
+	case size >= SizeTierMedium:
+		return "medium"
+	}
+	return "small"
+}
+
+// hashRawBody tells whether the raw body of that size gets its own signature
+func hashRawBody(size int) bool {
+	limit := atomic.LoadInt64(&rawHashMaxBytes)
+	return limit <= 0 || int64(size) <= limit
+}
+
+// attachmentSample returns the content hashed for an attachment: all of it, or its
+// head and tail when it is over twice ATTACHMENT_SAMPLE_KB
+func attachmentSample(content []byte) string {
+	n := int(atomic.LoadInt64(&attachmentSampleBytes))
+	if n <= 0 || len(content) <= 2*n {
+		return string(content)
+	}
+	return string(content[:n]) + string(content[len(content)-n:])
+}
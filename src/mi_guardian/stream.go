@@ -0,0 +1,135 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+)
+
+// --- Live verdict stream ---
+
+// VerdictEvent is pushed to /admin/stream clients for every analyzed message.
+// The Message-ID is only sent hashed, as in the scan keys (mi:msgid:<sha1>).
+type VerdictEvent struct {
+	Time      int64  `json:"ts"`
+	MessageID string `json:"msgid,omitempty"`
+	Action    string `json:"action"`
+	Label     string `json:"label,omitempty"`
+	Distance  int    `json:"distance,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+var (
+	streamMu      sync.Mutex
+	streamClients = make(map[chan VerdictEvent]struct{})
+	streamCount   int64 // Connected clients, read without the lock on the hot path
+)
+
+// subscribeVerdicts registers a client; the returned function unregisters it
+func subscribeVerdicts() (chan VerdictEvent, func()) {
+	events := make(chan VerdictEvent, StreamBufferSize)
+	streamMu.Lock()
+	streamClients[events] = struct{}{}
+	atomic.StoreInt64(&streamCount, int64(len(streamClients)))
+	streamMu.Unlock()
+	return events, func() {
+		streamMu.Lock()
+		delete(streamClients, events)
+		atomic.StoreInt64(&streamCount, int64(len(streamClients)))
+		streamMu.Unlock()
+	}
+}
+
+// publishVerdict hands an event to every client without waiting: a client whose
+// buffer is full misses it rather than slowing down the analysis
+func publishVerdict(ev VerdictEvent) {
+	rememberVerdict(ev)
+	if atomic.LoadInt64(&streamCount) == 0 {
+		return
+	}
+	streamMu.Lock()
+	defer streamMu.Unlock()
+	for events := range streamClients {
+		select {
+		case events <- ev:
+		default:
+			promStreamDropped.Inc()
+		}
+	}
+}
+
+// streamHandler upgrades to a WebSocket and sends one JSON VerdictEvent per message.
+// ?action=spam (or allow) only sends those verdicts.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET required")
+		return
+	}
+	only := r.URL.Query().Get("action")
+	websocket.Server{Handshake: checkStreamOrigin, Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		events, unsubscribe := subscribeVerdicts()
+		defer unsubscribe()
+
+		// Clients send nothing: the read ends when they go away
+		gone := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, ws)
+			close(gone)
+		}()
+
+		for {
+			select {
+			case ev := <-events:
+				if only != "" && ev.Action != only {
+					continue
+				}
+				if err := websocket.JSON.Send(ws, ev); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// checkStreamOrigin refuses browser connections from other sites, which would
+// otherwise ride on the admin's credentials (cross-site WebSocket hijacking).
+// Clients without an Origin (websocat, scripts) are not browsers and pass.
+func checkStreamOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if origin == nil || strings.EqualFold(origin.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range getEnvList("ADMIN_ALLOWED_ORIGINS") {
+		if strings.TrimSuffix(allowed, "/") == strings.ToLower(origin.Scheme+"://"+origin.Host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
@@ -0,0 +1,143 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- MIME structure fingerprint ---
+
+// Headers added in transit or by the receiving site: they say nothing about the generator
+var transitHeaders = map[string]bool{
+	"received": true, "return-path": true, "delivered-to": true, "x-original-to": true,
+	"authentication-results": true, "received-spf": true, "arc-seal": true,
+	"arc-message-signature": true, "arc-authentication-results": true,
+}
+
+// headerOrder returns the lowercase names of the top-level headers in order,
+// without transit headers and consecutive repeats
+func headerOrder(raw []byte) []string {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = bytes.Index(raw, []byte("\n\n"))
+	}
+	if end < 0 {
+		end = len(raw)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(raw[:end]), "\n") {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			continue // Folded continuation
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:colon]))
+		if transitHeaders[name] || strings.HasPrefix(name, "x-spam") || strings.HasPrefix(name, "x-mailuminati") {
+			continue
+		}
+		if len(names) > 0 && names[len(names)-1] == name {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// shapeOf keeps the style of a generated token (boundary, mailer) but not its value:
+// digits become 9, letters a/A
+func shapeOf(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return '9'
+		case r >= 'a' && r <= 'z':
+			return 'a'
+		case r >= 'A' && r <= 'Z':
+			return 'A'
+		}
+		return r
+	}, s)
+}
+
+// writePartStructure describes a MIME part and its children
+func writePartStructure(b *strings.Builder, p *enmime.Part, depth int) {
+	for ; p != nil; p = p.NextSibling {
+		fmt.Fprintf(b, "|%d:%s;%s;%s;%s", depth,
+			strings.ToLower(p.ContentType),
+			strings.ToLower(p.Disposition),
+			strings.ToLower(p.Header.Get("Content-Transfer-Encoding")),
+			strings.ToLower(p.Charset))
+		if p.Boundary != "" {
+			b.WriteString(";b=" + shapeOf(p.Boundary))
+		}
+		writePartStructure(b, p.FirstChild, depth+1)
+	}
+}
+
+// mimeStructure fingerprints how a message was generated: header order, mailer,
+// MIME tree and boundary style. Campaigns mutating their text keep it identical.
+func mimeStructure(raw []byte, env *enmime.Envelope) string {
+	if env.Root == nil {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("h:" + strings.Join(headerOrder(raw), ","))
+	mailer := env.GetHeader("X-Mailer")
+	if mailer == "" {
+		mailer = env.GetHeader("User-Agent")
+	}
+	b.WriteString("|m:" + shapeOf(mailer))
+	writePartStructure(&b, env.Root, 0)
+
+	sum := sha256.Sum256([]byte(b.String()))
+	return "S1" + hex.EncodeToString(sum[:16])
+}
+
+// structureSpam tells whether a structure fingerprint was reported enough to act on it
+func structureSpam(structure string) (float64, bool) {
+	threshold := atomic.LoadInt64(&structureSpamThreshold)
+	if structure == "" || threshold <= 0 {
+		return 0, false
+	}
+	score, err := rdb.Get(ctx, LocalStructurePrefix+structure).Float64()
+	return score, err == nil && score >= float64(threshold)
+}
+
+// learnStructure applies a spam or ham report to a structure fingerprint
+func learnStructure(structure, reportType, reporter string) {
+	weight := reportWeight(reporter, atomic.LoadInt64(&spamWeight))
+	if reportType == "ham" {
+		weight = -reportWeight(reporter, atomic.LoadInt64(&hamWeight))
+	}
+	key := LocalStructurePrefix + structure
+	pipe := rdb.Pipeline()
+	score := pipe.IncrByFloat(ctx, key, weight)
+	pipe.Expire(ctx, key, localRetentionDuration)
+	if _, err := pipe.Exec(ctx); err == nil {
+		logger.Debug("Learned structure", "structure", structure, "type", reportType, "score", score.Val())
+	}
+}
@@ -0,0 +1,202 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+// --- Subject signature ---
+//
+// Many campaigns rotate their bodies but reuse a subject template, only changing
+// numbers, names or emoji. The subject is normalized (case, reply prefixes, digits,
+// symbols), then summarized by a MinHash over its character trigrams, which is
+// compared on its own band index. Reported subjects flag similar ones once their
+// local score reaches SUBJECT_SPAM_THRESHOLD (label subject_match).
+
+const (
+	SubjectSignaturePrefix = "U1"
+	SubjectMinHashes       = 16 // MinHash values of a subject signature
+	SubjectBandRows        = 2  // Values per band: similar subjects share a band with probability similarity^2
+	MinSubjectLength       = 12 // Letters a normalized subject needs to be signed; shorter ones are too generic
+	DefaultSubjectLimit    = 0  // Local score required to act on a subject signature (0 = learned only)
+	DefaultSubjectSimilar  = 80 // Percentage of equal MinHash values for two subjects to match
+)
+
+// Reply and forward prefixes of the common mail clients, after lowercasing
+var subjectReplyPrefixes = []string{"re", "fw", "fwd", "aw", "wg", "sv", "vs", "tr", "rv", "rif", "antw", "res", "enc"}
+
+// normalizeSubject lowercases a subject, drops its reply prefixes and list tags and
+// keeps its words only: digits, emoji and punctuation are what campaigns vary
+func normalizeSubject(subject string) string {
+	s := strings.ToLower(strings.TrimSpace(subject))
+	for changed := true; changed; {
+		changed = false
+		if strings.HasPrefix(s, "[") {
+			if end := strings.IndexByte(s, ']'); end > 0 {
+				s, changed = strings.TrimSpace(s[end+1:]), true
+				continue
+			}
+		}
+		if prefix, rest, ok := strings.Cut(s, ":"); ok {
+			prefix = strings.TrimSpace(strings.TrimRight(prefix, "0123456789[]() "))
+			for _, p := range subjectReplyPrefixes {
+				if prefix == p {
+					s, changed = strings.TrimSpace(rest), true
+					break
+				}
+			}
+		}
+	}
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) }), " ")
+}
+
+// subjectSignature returns the MinHash signature of a subject, "" when it is too short
+func subjectSignature(subject string) string {
+	text := []rune(" " + normalizeSubject(subject) + " ")
+	if len(text)-2 < MinSubjectLength {
+		return ""
+	}
+	mins := make([]uint32, SubjectMinHashes)
+	for i := range mins {
+		mins[i] = ^uint32(0)
+	}
+	for i := 0; i+3 <= len(text); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(text[i : i+3])))
+		base := h.Sum64()
+		for j := range mins {
+			if v := uint32(mix64(base ^ uint64(j+1)*0x9e3779b97f4a7c15)); v < mins[j] {
+				mins[j] = v
+			}
+		}
+	}
+	buf := make([]byte, 4*SubjectMinHashes)
+	for j, v := range mins {
+		binary.BigEndian.PutUint32(buf[4*j:], v)
+	}
+	return SubjectSignaturePrefix + hex.EncodeToString(buf)
+}
+
+// mix64 is the splitmix64 finalizer, deriving the MinHash functions from one hash
+func mix64(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// subjectValues returns the MinHash values of a signature, in hex
+func subjectValues(sig string) []string {
+	body := strings.TrimPrefix(sig, SubjectSignaturePrefix)
+	if len(body) != 8*SubjectMinHashes {
+		return nil
+	}
+	values := make([]string, SubjectMinHashes)
+	for j := range values {
+		values[j] = body[8*j : 8*j+8]
+	}
+	return values
+}
+
+// subjectBands returns the band names of a subject signature
+func subjectBands(sig string) []string {
+	values := subjectValues(sig)
+	var bands []string
+	for i := 0; i+SubjectBandRows <= len(values); i += SubjectBandRows {
+		bands = append(bands, strconv.Itoa(i/SubjectBandRows)+":"+strings.Join(values[i:i+SubjectBandRows], ""))
+	}
+	return bands
+}
+
+// subjectSimilarity returns the share of equal MinHash values of two signatures,
+// an estimate of the trigram similarity of the subjects
+func subjectSimilarity(a, b string) float64 {
+	va, vb := subjectValues(a), subjectValues(b)
+	if va == nil || vb == nil {
+		return 0
+	}
+	equal := 0
+	for j := range va {
+		if va[j] == vb[j] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(va))
+}
+
+// closestSubject returns the learned subject signature most similar to sig, at
+// least SUBJECT_MIN_SIMILARITY percent
+func closestSubject(sig string) (string, float64) {
+	bands := subjectBands(sig)
+	keys := make([]string, 0, len(bands))
+	for _, b := range bands {
+		keys = append(keys, LocalSubjectFragPrefix+b)
+	}
+	minSimilarity := float64(getEnvPositiveInt("SUBJECT_MIN_SIMILARITY", DefaultSubjectSimilar)) / 100
+	best, bestSimilarity := "", 0.0
+	for _, candidate := range bandMembers(LocalSubjectFragPrefix, keys) {
+		if s := subjectSimilarity(sig, candidate); s >= minSimilarity && s > bestSimilarity {
+			best, bestSimilarity = candidate, s
+		}
+	}
+	return best, bestSimilarity
+}
+
+// subjectSpam tells whether a subject is similar to subjects reported enough to act on it
+func subjectSpam(sig string) (float64, float64, bool) {
+	threshold := atomic.LoadInt64(&subjectSpamThreshold)
+	if sig == "" || threshold <= 0 {
+		return 0, 0, false
+	}
+	match, similarity := closestSubject(sig)
+	if match == "" {
+		return 0, 0, false
+	}
+	score, err := rdb.Get(ctx, LocalSubjectPrefix+match).Float64()
+	return score, similarity, err == nil && score >= float64(threshold)
+}
+
+// learnSubject applies a spam or ham report to the learned subject closest to sig,
+// or to sig itself for a spam report on a new subject
+func learnSubject(sig, reportType, reporter string) {
+	target, _ := closestSubject(sig)
+	if target == "" {
+		if reportType == "ham" {
+			return
+		}
+		target = sig
+	}
+	weight := reportWeight(reporter, atomic.LoadInt64(&spamWeight))
+	if reportType == "ham" {
+		weight = -reportWeight(reporter, atomic.LoadInt64(&hamWeight))
+	}
+	key := LocalSubjectPrefix + target
+	pipe := rdb.Pipeline()
+	score := pipe.IncrByFloat(ctx, key, weight)
+	pipe.Expire(ctx, key, localRetentionDuration)
+	if _, err := pipe.Exec(ctx); err == nil {
+		logger.Debug("Learned subject", "subject_signature", target, "type", reportType, "score", score.Val())
+	}
+	if reportType == "spam" {
+		addToBands(LocalSubjectFragPrefix, subjectBands(target), target, localRetentionDuration)
+	}
+}
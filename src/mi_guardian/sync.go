@@ -0,0 +1,104 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// --- Sync inspection ---
+
+// summarizeDelta describes what applying a sync response would change
+func summarizeDelta(currentSeq int, status int, syncData SyncResponse) SyncPreview {
+	preview := SyncPreview{
+		CurrentSeq: currentSeq,
+		NewSeq:     syncData.NewSeq,
+		Action:     syncData.Action,
+		Status:     status,
+	}
+	if status == http.StatusNotModified {
+		preview.Action = "UP_TO_DATE"
+		preview.NewSeq = currentSeq
+		return preview
+	}
+	for _, op := range syncData.Ops {
+		switch op.Action {
+		case "add":
+			preview.BandsAdded += len(op.Bands)
+			preview.FilesAdded += len(op.Files)
+			for _, b := range op.Bands {
+				if len(preview.SampleAdded) < MaxSyncSamples {
+					preview.SampleAdded = append(preview.SampleAdded, b)
+				}
+			}
+		case "del":
+			preview.BandsRemoved += len(op.Bands)
+			preview.FilesRemoved += len(op.Files)
+			for _, b := range op.Bands {
+				if len(preview.SampleRemoved) < MaxSyncSamples {
+					preview.SampleRemoved = append(preview.SampleRemoved, b)
+				}
+			}
+		default:
+			preview.Ignored += len(op.Bands) + len(op.Files)
+		}
+	}
+	return preview
+}
+
+// syncPreviewHandler fetches the next delta from the Oracle and reports it without applying it
+func syncPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "GET or POST required")
+		return
+	}
+
+	currentSeq, _ := rdb.Get(ctx, MetaVer).Int()
+	syncData, status, err := fetchSyncDelta(currentSeq)
+	if err != nil {
+		logger.Warn("Sync preview failed", "status", status, "error", err)
+		writeError(w, http.StatusBadGateway, ErrOracleUnavailable, "Oracle sync failed: "+err.Error())
+		return
+	}
+
+	respBytes, _ := json.Marshal(summarizeDelta(currentSeq, status, syncData))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
+
+// syncApplyHandler runs a sync right away instead of waiting for the worker
+func syncApplyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	before, _ := rdb.Get(ctx, MetaVer).Int()
+	doSync()
+	after, _ := rdb.Get(ctx, MetaVer).Int()
+	logger.Info("Manual sync", "previous_seq", before, "current_seq", after)
+
+	respBytes, _ := json.Marshal(map[string]interface{}{
+		"previous_seq": before,
+		"current_seq":  after,
+		"sync":         syncStatus(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
@@ -0,0 +1,93 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// --- Tarpit ---
+//
+// Borderline senders, whose mail is not spam yet but who send a lot of it or burst,
+// are slowed down rather than refused (teergrube): with TARPIT_MAX_SECONDS set,
+// /analyze recommends a delay the MTA applies to the connection. The delay grows
+// with the spam ratio of the client IP over SenderReputationTTL and with its
+// messages per minute beyond TARPIT_BURST.
+
+const (
+	SenderReputationPrefix = "mi:rep:"   // Hash of verdict counts per client IP
+	SenderBurstPrefix      = "mi:burst:" // Messages per client IP and minute
+	SenderReputationTTL    = 7 * 24 * time.Hour
+	DefaultTarpitBurst     = 30 // Messages per minute from one client IP before it is slowed down
+	DefaultTarpitMinVolume = 5  // Messages before the spam ratio of a client IP counts
+)
+
+// recordSenderVerdict counts a verdict for the reputation and burst rate of the
+// client IP, and returns its spam ratio, message count and messages this minute
+func recordSenderVerdict(clientIP, action string) (float64, int64, int64) {
+	key := SenderReputationPrefix + clientIP
+	burstKey := SenderBurstPrefix + clientIP + ":" + strconv.FormatInt(time.Now().Unix()/60, 10)
+	pipe := rdb.Pipeline()
+	total := pipe.HIncrBy(ctx, key, "total", 1)
+	spamField := "spam"
+	if action != "spam" {
+		spamField = "ham"
+	}
+	pipe.HIncrBy(ctx, key, spamField, 1)
+	spam := pipe.HGet(ctx, key, "spam")
+	pipe.Expire(ctx, key, SenderReputationTTL)
+	burst := pipe.Incr(ctx, burstKey)
+	pipe.Expire(ctx, burstKey, 2*time.Minute)
+	pipe.Exec(ctx)
+	if total.Err() != nil {
+		return 0, 0, 0
+	}
+	spamCount, _ := spam.Int64() // Missing until a first spam
+	return float64(spamCount) / float64(total.Val()), total.Val(), burst.Val()
+}
+
+// tarpitDelay returns the seconds a message from the client IP should be delayed
+// by, 0 when TARPIT_MAX_SECONDS is unset or the sender is unknown or trusted
+func tarpitDelay(clientIP string, res AnalysisResult, source string) int {
+	maxDelay := getEnvInt("TARPIT_MAX_SECONDS", 0)
+	if clientIP == "" || (maxDelay <= 0 && precheckSpamRatio() <= 0) {
+		return 0
+	}
+	// The reputation is also kept for /precheck (PRECHECK_SPAM_RATIO)
+	ratio, total, burst := recordSenderVerdict(clientIP, res.Action)
+	if maxDelay <= 0 {
+		return 0
+	}
+	if source != "" || res.Label == "trusted_sender" {
+		return 0
+	}
+
+	pressure := 0.0
+	if total >= getEnvPositiveInt("TARPIT_MIN_MESSAGES", DefaultTarpitMinVolume) {
+		pressure = ratio
+	}
+	if limit := getEnvPositiveInt("TARPIT_BURST", DefaultTarpitBurst); burst > limit {
+		pressure += float64(burst-limit) / float64(limit)
+	}
+	delay := int(math.Round(math.Min(pressure, 1) * float64(maxDelay)))
+	if delay > 0 {
+		promTarpit.Inc()
+		promTarpitSeconds.Add(float64(delay))
+	}
+	return delay
+}
@@ -0,0 +1,70 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"strings"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Tenant breakdown of metrics ---
+
+// Tenant label values besides the ones configured in TENANT_MAP
+const (
+	TenantDefault = "default" // No TENANT_MAP configured
+	TenantOther   = "other"   // Recipient domain not in TENANT_MAP
+	TenantUnknown = "unknown" // Request rejected before the message was parsed
+)
+
+// recipientDomain returns the domain of the first envelope recipient, passed by the MTA
+// (X-Guardian-Rcpt-To) or recorded in the message (X-Original-To, Delivered-To),
+// falling back to the first To address
+func recipientDomain(env *enmime.Envelope, meta EnvelopeMeta) string {
+	for _, rcpt := range meta.RcptTo {
+		if domain := addressDomain(rcpt); domain != "" {
+			return domain
+		}
+	}
+	for _, h := range []string{"X-Original-To", "Delivered-To", "To"} {
+		first, _, _ := strings.Cut(env.GetHeader(h), ",")
+		if domain := addressDomain(first); domain != "" {
+			return domain
+		}
+	}
+	return ""
+}
+
+// tenantOf maps the recipient domain to a tenant with TENANT_MAP ("domain:tenant,...",
+// subdomains included). The label only takes configured values, to keep the
+// cardinality of the metrics bounded.
+func tenantOf(env *enmime.Envelope, meta EnvelopeMeta) string {
+	mapping := getEnvList("TENANT_MAP")
+	if len(mapping) == 0 {
+		return TenantDefault
+	}
+	domain := recipientDomain(env, meta)
+	if domain == "" {
+		return TenantOther
+	}
+	for _, entry := range mapping {
+		d, tenant, ok := strings.Cut(entry, ":")
+		if ok && tenant != "" && domainMatches(domain, strings.TrimSpace(d)) {
+			return strings.TrimSpace(tenant)
+		}
+	}
+	return TenantOther
+}
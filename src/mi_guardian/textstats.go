@@ -0,0 +1,149 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Text statistics ---
+//
+// Fuzzy hashes normalize away what spammers use to defeat filters: emoji walls,
+// zero-width characters splitting words and homoglyphs from other scripts
+// ("pаypal" with a Cyrillic а). Their extreme values are raised as signals
+// (emoji_density, zero_width_chars, mixed_script) that TEXT_ANOMALY_SCORE can act on.
+
+const (
+	DefaultEmojiDensity = 20 // Percentage of emoji among letters and emoji
+	DefaultZeroWidthMax = 5  // Zero-width characters in subject and body
+	DefaultMixedScript  = 10 // Percentage of words mixing scripts
+	MinTextStatsRunes   = 20 // Letters and emoji below which densities are not computed
+)
+
+// TextStats are the statistics of the subject and body of a message
+type TextStats struct {
+	Letters    int     `json:"letters"`
+	Emoji      int     `json:"emoji"`
+	ZeroWidth  int     `json:"zero_width"`
+	Words      int     `json:"words"`
+	MixedWords int     `json:"mixed_words"`
+	EmojiRatio float64 `json:"emoji_ratio"`
+	MixedRatio float64 `json:"mixed_ratio"`
+}
+
+// isZeroWidth tells whether r is an invisible character used to split words. The
+// joiners are legitimate in emoji sequences and some scripts, see textStats.
+func isZeroWidth(r rune) bool {
+	switch r {
+	case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+		return true
+	}
+	return false
+}
+
+// isEmoji tells whether r is a pictograph, dingbat or regional indicator
+func isEmoji(r rune) bool {
+	return (r >= 0x1f000 && r <= 0x1faff) || (r >= 0x2600 && r <= 0x27bf)
+}
+
+// letterScript returns the script of a letter among those homoglyphs come from
+func letterScript(r rune) string {
+	switch {
+	case unicode.Is(unicode.Latin, r):
+		return "latin"
+	case unicode.Is(unicode.Cyrillic, r):
+		return "cyrillic"
+	case unicode.Is(unicode.Greek, r):
+		return "greek"
+	case unicode.Is(unicode.Armenian, r):
+		return "armenian"
+	}
+	return "other"
+}
+
+// textStats computes the statistics of a text
+func textStats(text string) TextStats {
+	var st TextStats
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsPunct(r) }) {
+		script, mixed, letters := "", false, 0
+		prev := rune(0)
+		for _, r := range word {
+			switch {
+			case isZeroWidth(r):
+				// Joiners inside emoji sequences or outside the homoglyph scripts are legitimate
+				if (r != '\u200c' && r != '\u200d') || (prev != 0 && !isEmoji(prev) && letterScript(prev) != "other") {
+					st.ZeroWidth++
+				}
+			case isEmoji(r):
+				st.Emoji++
+			case unicode.IsLetter(r):
+				letters++
+				s := letterScript(r)
+				if s == "other" {
+					// Scripts without homoglyphs (CJK, Arabic...) mix with Latin legitimately
+				} else if script == "" {
+					script = s
+				} else if s != script {
+					mixed = true
+				}
+			}
+			prev = r
+		}
+		if letters > 0 {
+			st.Words++
+			st.Letters += letters
+			if mixed {
+				st.MixedWords++
+			}
+		}
+	}
+	if st.Letters+st.Emoji >= MinTextStatsRunes {
+		st.EmojiRatio = float64(st.Emoji) / float64(st.Letters+st.Emoji)
+	}
+	if st.Words > 0 && st.Letters+st.Emoji >= MinTextStatsRunes {
+		st.MixedRatio = float64(st.MixedWords) / float64(st.Words)
+	}
+	return st
+}
+
+// messageTextStats computes the statistics of the subject and text body. Zero-width
+// characters are also counted in the HTML body, where they are usually hidden.
+func messageTextStats(env *enmime.Envelope) TextStats {
+	st := textStats(env.GetHeader("Subject") + "\n" + env.Text)
+	if env.HTML != "" {
+		st.ZeroWidth = max(st.ZeroWidth, textStats(html.UnescapeString(env.HTML)).ZeroWidth)
+	}
+	return st
+}
+
+// textSignals returns the signals raised by the statistics, against the TEXT_* limits
+func textSignals(st TextStats) []string {
+	var signals []string
+	if limit := getEnvPositiveInt("TEXT_EMOJI_DENSITY", DefaultEmojiDensity); st.EmojiRatio*100 >= float64(limit) {
+		signals = append(signals, "emoji_density")
+	}
+	if limit := getEnvPositiveInt("TEXT_ZERO_WIDTH_MAX", DefaultZeroWidthMax); int64(st.ZeroWidth) >= limit {
+		signals = append(signals, "zero_width_chars")
+	}
+	if limit := getEnvPositiveInt("TEXT_MIXED_SCRIPT", DefaultMixedScript); st.MixedRatio*100 >= float64(limit) {
+		signals = append(signals, "mixed_script")
+	}
+	return signals
+}
@@ -13,7 +13,7 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 type AnalysisResult struct {
 	Action         string `json:"action"`
@@ -31,9 +31,92 @@ type SyncResponse struct {
 type SyncOp struct {
 	Action string   `json:"action"`
 	Bands  []string `json:"bands"`
+	Files  []string `json:"files,omitempty"` // SHA-256 of known malicious attachments
+}
+
+// HashedPart is a signature computed by /hash, with the content it comes from
+type HashedPart struct {
+	Kind        string `json:"kind"` // body, raw, attachment, calendar, vcard, file, image
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type HashResponse struct {
+	Signatures []string     `json:"signatures"`
+	Parts      []HashedPart `json:"parts,omitempty"`
+	Nested     []string     `json:"nested_hashes,omitempty"`
+	Files      []HashedPart `json:"files,omitempty"`
+	Images     []HashedPart `json:"images,omitempty"`
+	Structure  string       `json:"structure,omitempty"`
+	Source     string       `json:"source,omitempty"`
+}
+
+// SyncPreview is the next Oracle delta, as reported by /admin/sync/preview
+type SyncPreview struct {
+	Status        int      `json:"status"`
+	Action        string   `json:"action"`
+	CurrentSeq    int      `json:"current_seq"`
+	NewSeq        int      `json:"new_seq"`
+	BandsAdded    int      `json:"bands_added"`
+	BandsRemoved  int      `json:"bands_removed"`
+	FilesAdded    int      `json:"files_added,omitempty"`
+	FilesRemoved  int      `json:"files_removed,omitempty"`
+	Ignored       int      `json:"ignored,omitempty"`
+	SampleAdded   []string `json:"sample_added,omitempty"`
+	SampleRemoved []string `json:"sample_removed,omitempty"`
 }
 
 type ScanResult struct {
-	Hashes    []string `json:"hashes"`
-	Timestamp int64    `json:"timestamp"`
+	Hashes    []string          `json:"hashes"`
+	Timestamp int64             `json:"timestamp"`
+	Action    string            `json:"action,omitempty"`
+	Label     string            `json:"label,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Structure string            `json:"structure,omitempty"`
+	Subject   string            `json:"subject_sig,omitempty"`
+	Tenant    string            `json:"tenant,omitempty"`
+	Tokens    []string          `json:"tokens,omitempty"`
+	Kinds     map[string]string `json:"kinds,omitempty"` // signature -> attachment or image (body otherwise)
+	Matched   bool              `json:"-"`               // Some signature was close to a known hash (not stored)
+}
+
+type ConflictEntry struct {
+	Hash      string  `json:"hash"`
+	Spam      float64 `json:"spam"`
+	Ham       float64 `json:"ham"`
+	Score     float64 `json:"score"`
+	UpdatedAt int64   `json:"updated_at"`
+}
+
+type MigrationReport struct {
+	DryRun        bool     `json:"dry_run"`
+	FromVersion   int      `json:"from_version"`
+	ToVersion     int      `json:"to_version"`
+	RenamedKeys   int      `json:"renamed_keys"`
+	MergedKeys    int      `json:"merged_keys"`
+	ConvertedKeys int      `json:"converted_keys"`
+	RebuiltBands  int      `json:"rebuilt_bands"`
+	Steps         []string `json:"steps"`
+}
+
+type ReplayChange struct {
+	Hashes []string `json:"hashes"`
+	Before string   `json:"before"`
+	After  string   `json:"after"`
+}
+
+type ReplayReport struct {
+	Profile      string         `json:"profile"`
+	Evaluated    int            `json:"evaluated"`
+	Changed      int            `json:"changed"`
+	AllowToSpam  int            `json:"allow_to_spam"`
+	SpamToAllow  int            `json:"spam_to_allow"`
+	Unknown      int            `json:"unknown"`
+	Undetermined int            `json:"undetermined"`
+	Verdicts     map[string]int `json:"verdicts"`
+	Samples      []ReplayChange `json:"samples"`
 }
@@ -0,0 +1,232 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Update check ---
+//
+// Fleet operators need to know which nodes run outdated engines, whose detection is
+// weaker. With UPDATE_CHECK_URL set, Guardian fetches a release manifest signed with
+// the Ed25519 key of UPDATE_PUBLIC_KEY and reports a newer release built for its
+// platform in /status and the metrics. Nothing is downloaded or installed.
+
+const (
+	DefaultUpdateCheckHours = 24
+	MaxUpdateManifestSize   = 64 << 10
+)
+
+// UpdateManifest describes the latest release. Builds are keyed by "os/arch".
+type UpdateManifest struct {
+	Version  string                 `json:"version"`
+	Released string                 `json:"released,omitempty"`
+	Security bool                   `json:"security,omitempty"`
+	NotesURL string                 `json:"notes_url,omitempty"`
+	Builds   map[string]UpdateBuild `json:"builds"`
+}
+
+// UpdateBuild is the binary of a release for one platform
+type UpdateBuild struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// signedManifest is the document served by UPDATE_CHECK_URL: the manifest JSON and
+// its signature, both in base64
+type signedManifest struct {
+	Manifest  string `json:"manifest"`
+	Signature string `json:"signature"`
+}
+
+// UpdateStatus is the outcome of the last update check
+type UpdateStatus struct {
+	Available   bool         `json:"available"`
+	Current     string       `json:"current"`
+	Latest      string       `json:"latest,omitempty"`
+	Security    bool         `json:"security,omitempty"`
+	NotesURL    string       `json:"notes_url,omitempty"`
+	Platform    string       `json:"platform"`
+	Build       *UpdateBuild `json:"build,omitempty"`
+	LastCheck   int64        `json:"last_check,omitempty"`
+	LastError   string       `json:"last_error,omitempty"`
+	LastSuccess int64        `json:"last_success,omitempty"`
+}
+
+var (
+	updateMu     sync.Mutex
+	updateStatus *UpdateStatus // nil until the first check
+)
+
+// platform names the os/arch of the running binary, as in the manifest builds
+func platform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// compareVersions compares dotted versions numerically: -1, 0 or 1. A pre-release
+// ("0.8.0-rc1") is older than its release.
+func compareVersions(a, b string) int {
+	a, preA, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	b, preB, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			nb, _ = strconv.Atoi(pb[i])
+		}
+		if na != nb {
+			if na < nb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	case preA < preB:
+		return -1
+	}
+	return 1
+}
+
+// verifyManifest checks the signature of a manifest against UPDATE_PUBLIC_KEY and
+// decodes it
+func verifyManifest(doc signedManifest) (*UpdateManifest, error) {
+	key, err := base64.StdEncoding.DecodeString(getEnv("UPDATE_PUBLIC_KEY", ""))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("UPDATE_PUBLIC_KEY must be a base64 Ed25519 public key")
+	}
+	raw, err := base64.StdEncoding.DecodeString(doc.Manifest)
+	if err != nil {
+		return nil, errors.New("manifest is not base64")
+	}
+	sig, err := base64.StdEncoding.DecodeString(doc.Signature)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(key), raw, sig) {
+		return nil, errors.New("invalid manifest signature")
+	}
+	var m UpdateManifest
+	if err := json.Unmarshal(raw, &m); err != nil || m.Version == "" {
+		return nil, errors.New("invalid manifest")
+	}
+	return &m, nil
+}
+
+// checkUpdate fetches and verifies the release manifest and records the outcome
+func checkUpdate() error {
+	status := &UpdateStatus{Current: EngineVersion, Platform: platform()}
+	updateMu.Lock()
+	previous := updateStatus
+	if previous != nil {
+		*status = *previous // A failed check keeps the previous outcome
+	}
+	updateMu.Unlock()
+	status.LastCheck, status.LastError = time.Now().Unix(), ""
+
+	m, err := fetchManifest(getEnv("UPDATE_CHECK_URL", ""))
+	if err != nil {
+		status.LastError = err.Error()
+		promUpdateCheck.WithLabelValues("error").Inc()
+	} else {
+		status.LastSuccess = status.LastCheck
+		status.Latest, status.NotesURL = m.Version, m.NotesURL
+		status.Available, status.Security, status.Build = false, false, nil
+		// Only a release built for this platform can be installed here
+		if build, ok := m.Builds[platform()]; ok && compareVersions(m.Version, EngineVersion) > 0 {
+			status.Available, status.Security, status.Build = true, m.Security, &build
+		}
+		promUpdateCheck.WithLabelValues("ok").Inc()
+	}
+
+	updateMu.Lock()
+	updateStatus = status
+	updateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if status.Available {
+		promUpdateAvailable.Set(1)
+		if previous == nil || previous.Latest != status.Latest {
+			logger.Warn("Guardian update available", "current", EngineVersion, "latest", status.Latest, "security", status.Security)
+		}
+	} else {
+		promUpdateAvailable.Set(0)
+	}
+	return nil
+}
+
+// fetchManifest downloads a signed manifest and verifies it
+func fetchManifest(url string) (*UpdateManifest, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mailuminati-Guardian/"+EngineVersion+" ("+platform()+")")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release endpoint answered %d", resp.StatusCode)
+	}
+	var doc signedManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxUpdateManifestSize)).Decode(&doc); err != nil {
+		return nil, errors.New("invalid manifest document")
+	}
+	return verifyManifest(doc)
+}
+
+// currentUpdateStatus returns the outcome of the last check, nil when checks are off
+// or none ran yet
+func currentUpdateStatus() *UpdateStatus {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	return updateStatus
+}
+
+// updateWorker checks for a new release at start, then every UPDATE_CHECK_HOURS
+func updateWorker() {
+	if getEnv("UPDATE_CHECK_URL", "") == "" {
+		return
+	}
+	for {
+		if err := checkUpdate(); err != nil {
+			logger.Warn("Update check failed", "error", err)
+		}
+		time.Sleep(time.Duration(getEnvPositiveInt("UPDATE_CHECK_HOURS", DefaultUpdateCheckHours)) * time.Hour)
+	}
+}
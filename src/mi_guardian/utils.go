@@ -13,13 +13,20 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log/slog"
 	"net/http"
@@ -27,7 +34,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"mailuminati-guardian/internal/analyze"
 )
 
 var (
@@ -39,30 +52,38 @@ func initLogger() {
 	logLevelStr := getEnv("LOG_LEVEL", "INFO")
 	logFormat := getEnv("LOG_FORMAT", "JSON")
 
-	var level slog.Level
-	switch strings.ToUpper(logLevelStr) {
-	case "DEBUG":
-		level = slog.LevelDebug
-	case "WARN":
-		level = slog.LevelWarn
-	case "ERROR":
-		level = slog.LevelError
-	default:
-		level = slog.LevelInfo
-	}
+	level, _ := parseLogLevel(logLevelStr)
+	atomic.StoreInt64(&configuredLogRank, int64(level))
+	logLevel.Set(level)
 
 	opts := &slog.HandlerOptions{
-		Level: level,
+		Level: &logLevel,
+	}
+
+	out, outErr := openLogOutput()
+	if outErr != nil {
+		out = os.Stdout
 	}
 
 	var handler slog.Handler
 	if strings.ToUpper(logFormat) == "TEXT" {
-		handler = slog.NewTextHandler(os.Stdout, opts)
+		handler = slog.NewTextHandler(out, opts)
 	} else {
-		handler = slog.NewJSONHandler(os.Stdout, opts)
+		handler = slog.NewJSONHandler(out, opts)
 	}
 
-	logger = slog.New(handler)
+	// Message metadata (subjects, Message-IDs...) is filtered per LOG_MESSAGE_METADATA
+	logger = slog.New(newPrivacyHandler(handler))
+
+	// Close the sink of a previous initialization
+	if c, ok := logOutput.(io.Closer); ok && logOutput != out && logOutput != io.Writer(os.Stdout) {
+		c.Close()
+	}
+	logOutput = out
+	logFile, _ = out.(*rotatingFile)
+	if outErr != nil {
+		logger.Warn("Log output unavailable, logging to stdout", "error", outErr)
+	}
 }
 
 func loadConfigFile(path string) error {
@@ -125,6 +146,25 @@ func getEnv(k, f string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
 	}
+	if v, ok := oracleSetting(k); ok {
+		return v
+	}
+	return f
+}
+
+// getEnvInt reads an integer setting, falling back to f when it is missing or invalid
+func getEnvInt(k string, f int64) int64 {
+	if v, err := strconv.ParseInt(getEnv(k, ""), 10, 64); err == nil {
+		return v
+	}
+	return f
+}
+
+// getEnvPositiveInt reads an integer setting, falling back to f when it is missing, invalid or < 1
+func getEnvPositiveInt(k string, f int64) int64 {
+	if v, err := strconv.ParseInt(getEnv(k, ""), 10, 64); err == nil && v > 0 {
+		return v
+	}
 	return f
 }
 
@@ -143,11 +183,12 @@ func shouldAnalyzeImages(html string) bool {
 	return countWords(text) < 10
 }
 
-// extractImageURLs uses regex to find img src URLs (limit 10)
+// extractImageURLs uses regex to find img src URLs (limit MI_MAX_EXTERNAL_IMAGES)
 func extractImageURLs(html string) []string {
 	matches := reImgSrc.FindAllStringSubmatch(html, -1)
+	limit := int(atomic.LoadInt64(&maxExternalImages))
 
-	urls := make([]string, 0, 10)
+	urls := make([]string, 0, limit)
 	seen := make(map[string]bool)
 
 	for _, m := range matches {
@@ -156,7 +197,7 @@ func extractImageURLs(html string) []string {
 			if !seen[url] {
 				urls = append(urls, url)
 				seen[url] = true
-				if len(urls) >= maxExternalImages {
+				if len(urls) >= limit {
 					break
 				}
 			}
@@ -165,14 +206,15 @@ func extractImageURLs(html string) []string {
 	return urls
 }
 
-// fetchImageSizeAndHash checks cache or downloads image to get size (and data if needed)
+// fetchImageForAnalysis checks cache or downloads image to get size (and data if needed)
+// The download is bound to fetchCtx so the per-message timeout covers it
 // Returns: data (if downloaded), hash (if cached), size, fromCache, error
-func fetchImageForAnalysis(url string) ([]byte, string, int, bool, error) {
+func fetchImageForAnalysis(fetchCtx context.Context, url string) ([]byte, string, int, bool, error) {
 	urlHash := sha1.Sum([]byte(url))
 	cacheKey := "mi:img:" + hex.EncodeToString(urlHash[:])
 
 	// 1. Check Redis Cache (Format: "SIZE|HASH")
-	if cachedVal, err := rdb.Get(ctx, cacheKey).Result(); err == nil {
+	if cachedVal, err := rdb.Get(fetchCtx, cacheKey).Result(); err == nil {
 		parts := strings.SplitN(cachedVal, "|", 2)
 		if len(parts) == 2 {
 			if size, err := strconv.Atoi(parts[0]); err == nil {
@@ -182,40 +224,174 @@ func fetchImageForAnalysis(url string) ([]byte, string, int, bool, error) {
 		}
 	}
 
-	// 2. Fetch Image
+	// 2. Privacy mode: the Oracle or the fetch proxy downloads and hashes it
+	if mode := imageFetchMode(); mode != "direct" {
+		hash, size, err := remoteImageHash(fetchCtx, mode, url)
+		if err != nil {
+			return nil, "", size, false, err
+		}
+		rdb.Set(ctx, cacheKey, fmt.Sprintf("%d|%s", size, hash), 24*time.Hour)
+		return nil, hash, size, false, nil
+	}
+
+	// 3. Fetch Image
+	data, err := downloadImage(fetchCtx, url)
+	if err != nil {
+		return nil, "", len(data), false, err
+	}
+
+	return data, "", len(data), false, nil
+}
+
+// downloadImage fetches an external image, bound to fetchCtx, and enforces the size limits
+func downloadImage(fetchCtx context.Context, url string) ([]byte, error) {
+	if !allowHostFetch(url) {
+		logger.Debug("Skipped image (host rate limit)", "component", "img_analysis", "url", url)
+		return nil, errHostRateLimited
+	}
+	release, err := acquireFetchSlot(fetchCtx)
+	if err != nil {
+		logger.Debug("Skipped image (no download slot)", "component", "img_analysis", "url", url)
+		return nil, err
+	}
+	defer release()
+
 	logger.Debug("Fetching image", "component", "img_analysis", "url", url)
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(url)
+	req, err := http.NewRequestWithContext(fetchCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported image URL scheme %q", req.URL.Scheme)
+	}
+	req.Header.Set("User-Agent", getEnv("MI_IMAGE_USER_AGENT", DefaultImageUserAgent))
+	resp, err := imageClient(time.Duration(atomic.LoadInt64(&imageFetchTimeout)) * time.Second).Do(req)
 	if err != nil {
 		logger.Warn("Fetch error", "component", "img_analysis", "url", url, "error", err)
-		return nil, "", 0, false, err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		logger.Warn("HTTP error", "component", "img_analysis", "url", url, "status", resp.StatusCode)
-		return nil, "", 0, false, fmt.Errorf("status %d", resp.StatusCode)
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
 	}
 
-	// 3. Size Limits Check
-	data, err := io.ReadAll(io.LimitReader(resp.Body, 10*1024*1024))
+	// Size Limits Check: a truncated image would hash differently from the original
+	if resp.ContentLength > MaxExternalImageSize {
+		logger.Debug("Skipped image (too large)", "component", "img_analysis", "url", url, "size", resp.ContentLength, "max_size", MaxExternalImageSize)
+		return nil, errImageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxExternalImageSize+1))
 	if err != nil {
 		logger.Warn("Read error", "component", "img_analysis", "url", url, "error", err)
-		return nil, "", 0, false, err
+		return nil, err
+	}
+	if len(data) > MaxExternalImageSize {
+		logger.Debug("Skipped image (too large)", "component", "img_analysis", "url", url, "max_size", MaxExternalImageSize)
+		return nil, errImageTooLarge
 	}
 
 	if len(data) < MinExternalImageSize {
 		logger.Debug("Skipped image (too small)", "component", "img_analysis", "url", url, "size", len(data), "min_size", MinExternalImageSize)
-		return nil, "", len(data), false, fmt.Errorf("too small")
+		return data, fmt.Errorf("too small")
+	}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && cfg.Width*cfg.Height > MaxImagePixels {
+		logger.Debug("Skipped image (too many pixels)", "component", "img_analysis", "url", url, "width", cfg.Width, "height", cfg.Height, "max_pixels", MaxImagePixels)
+		return nil, errImageTooManyPixels
 	}
 
-	return data, "", len(data), false, nil
+	return data, nil
+}
+
+// normalizeImage decodes an image (first frame for animations), downscales it to
+// a canonical resolution and converts it to grayscale, so that re-encoded copies
+// of the same visual produce the same bytes before hashing
+func normalizeImage(data []byte) ([]byte, error) {
+	if frame, ok := webpFirstFrame(data); ok {
+		// The WebP decoder does not support animations: decode the first frame alone
+		data = frame
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, errImageTooManyPixels
+	}
+	// image.Decode only returns the first frame of animated GIFs
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewGray(image.Rect(0, 0, ImageCanonicalSize, ImageCanonicalSize))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	return dst.Pix, nil
+}
+
+// webpFirstFrame extracts the first frame (ANMF chunk) of an animated WebP as a
+// still WebP file. ok is false when data is not an animated WebP.
+func webpFirstFrame(data []byte) (frame []byte, ok bool) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+	for pos := 12; pos+8 <= len(data); {
+		id, size := string(data[pos:pos+4]), int(binary.LittleEndian.Uint32(data[pos+4:pos+8]))
+		body := pos + 8
+		if size < 0 || size > len(data)-body {
+			return nil, false
+		}
+		if id != "ANMF" {
+			pos = body + size + size&1 // Chunks are padded to an even size
+			continue
+		}
+		// Frame header: X, Y, width-1, height-1 and duration on 24 bits, then flags
+		if size < 16 {
+			return nil, false
+		}
+		header, chunks := data[body:body+16], data[body+16:body+size]
+		vp8x := make([]byte, 18)
+		copy(vp8x, "VP8X")
+		binary.LittleEndian.PutUint32(vp8x[4:], 10)
+		if len(chunks) >= 4 && string(chunks[:4]) == "ALPH" {
+			vp8x[8] = 1 << 4 // Alpha flag: the alpha chunk precedes the image one
+		}
+		copy(vp8x[12:18], header[6:12])
+
+		frame = append([]byte("RIFF\x00\x00\x00\x00WEBP"), vp8x...)
+		frame = append(frame, chunks...)
+		binary.LittleEndian.PutUint32(frame[4:], uint32(len(frame)-8))
+		return frame, true
+	}
+	return nil, false
+}
+
+// imageSignature hashes the normalized pixels when the format is supported, raw bytes otherwise.
+// Raw byte signatures only match byte-identical copies, so they are counted.
+func imageSignature(url string, data []byte) (string, error) {
+	content := data
+	normalized := false
+	if pix, err := normalizeImage(data); err == nil {
+		content = pix
+		normalized = true
+	} else {
+		promImageRawHashed.Inc()
+		logger.Debug("Image normalization skipped", "component", "img_analysis", "url", url, "error", err)
+	}
+
+	// Compute TLSH
+	sig, err := analyze.TLSH(string(content))
+	if err != nil && normalized {
+		// Flat visuals may lack the variance TLSH needs once downscaled
+		sig, err = analyze.TLSH(string(data))
+	}
+	return sig, err
 }
 
 // computeAndCacheImageHash processes the chosen image
 func computeAndCacheImageHash(url string, data []byte) (string, error) {
-	// Compute TLSH
-	sig, err := computeLocalTLSH(string(data))
+	sig, err := imageSignature(url, data)
 	if err != nil {
 		logger.Warn("TLSH error", "component", "img_analysis", "url", url, "error", err)
 		return "", err
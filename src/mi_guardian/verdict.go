@@ -0,0 +1,243 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Simple verdict API ---
+//
+// /v1/verdict serves lightweight MTA plugins (Haraka, webhooks) that do not want to
+// post whole messages: they send the header block and either the body text or
+// TLSH signatures they computed themselves, and get a minimal verdict back. The
+// request and response fields are a stable contract: fields may be added, never
+// renamed or removed.
+
+// VerdictRequest is the body of POST /v1/verdict
+type VerdictRequest struct {
+	Headers     string   `json:"headers,omitempty"`           // raw header block of the message
+	Signatures  []string `json:"signatures,omitempty"`        // TLSH digests computed by the client
+	Text        string   `json:"text,omitempty"`              // text body, hashed by Guardian
+	HTML        string   `json:"html,omitempty"`              // HTML body, hashed by Guardian
+	Attachments []string `json:"attachment_sha256,omitempty"` // SHA-256 of the attachments
+}
+
+// VerdictResponse is the answer of POST /v1/verdict
+type VerdictResponse struct {
+	Verdict      string   `json:"verdict"` // allow or spam
+	Label        string   `json:"label,omitempty"`
+	Distance     int      `json:"distance,omitempty"`
+	MTAAction    string   `json:"mta_action,omitempty"`
+	SMTPResponse string   `json:"smtp_response,omitempty"`
+	Signatures   []string `json:"signatures,omitempty"` // signatures looked up, including the computed ones
+	MatchedSig   string   `json:"matched_signature,omitempty"`
+}
+
+// MatchRequest is the body of POST /match: fuzzy hashes only, no message content
+type MatchRequest struct {
+	Signatures  []string `json:"signatures"`
+	Attachments []string `json:"attachment_sha256,omitempty"`
+	MessageID   string   `json:"message_id,omitempty"` // lets /report reference the message
+}
+
+// verdictEnvelope builds a message from the posted header block and body, for the
+// checks /analyze runs on the parsed message
+func verdictEnvelope(req VerdictRequest) (*enmime.Envelope, error) {
+	headers := strings.TrimRight(req.Headers, "\r\n")
+	if headers != "" {
+		headers += "\r\n"
+	}
+	env, err := enmime.ReadEnvelope(strings.NewReader(headers + "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	env.Text, env.HTML = req.Text, req.HTML
+	return env, nil
+}
+
+// verdictHandler serves POST /v1/verdict: the collision search of /analyze on client
+// supplied signatures and headers, without MIME parsing, images or the verdict cache
+func verdictHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var req VerdictRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxProcessSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+		return
+	}
+	serveVerdict(w, r, req)
+}
+
+// matchHandler serves POST /match: only the lookup and decision stages, on
+// signatures computed by integrators who keep message content on their side
+func matchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "POST required")
+		return
+	}
+
+	var req MatchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, MaxProcessSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidJSON, "Invalid JSON body")
+		return
+	}
+	if len(req.Signatures) == 0 && len(req.Attachments) == 0 {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "signatures or attachment_sha256 required")
+		return
+	}
+	if strings.ContainsAny(req.MessageID, "\r\n") {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid message_id")
+		return
+	}
+	var headers string
+	if id := strings.TrimSpace(req.MessageID); id != "" {
+		headers = "Message-ID: " + normalizeMessageID(id)
+	}
+	serveVerdict(w, r, VerdictRequest{Headers: headers, Signatures: req.Signatures, Attachments: req.Attachments})
+}
+
+// serveVerdict looks up a /v1/verdict or /match request and writes the verdict
+func serveVerdict(w http.ResponseWriter, r *http.Request, req VerdictRequest) {
+	atomic.AddInt64(&scanCount, 1)
+	tenant := TenantUnknown
+	defer func() { promScanned.WithLabelValues(tenant).Inc() }()
+
+	env, err := verdictEnvelope(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid headers")
+		return
+	}
+	digests, invalid := normalizeDigests(req.Attachments)
+	if len(invalid) > 0 {
+		writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid attachment_sha256")
+		return
+	}
+
+	meta := envelopeMeta(r)
+	tenant = tenantOf(env, meta)
+	messageID := env.GetHeader("Message-ID")
+	subject := env.GetHeader("Subject")
+	reqLogger := logger.With(append([]any{"message_id", messageID}, meta.logAttrs()...)...)
+
+	source := classifyTrustedSource(env, meta)
+	profile, shadow := selectProfiles(messageID, source, tenant)
+	spoofed := false
+	if fromDomain := addressDomain(env.GetHeader("From")); underScrutiny(fromDomain) {
+		profile = profile.tightened()
+		if shadow != nil {
+			tightened := shadow.tightened()
+			shadow = &tightened
+		}
+		spoofed = dmarcRequireDkim.Load() && !dkimAligned(env, fromDomain)
+	}
+	trustedSender := trustedDkimDomain(env)
+
+	// Client signatures first, then the ones of the posted body
+	var signatures []string
+	for _, sig := range req.Signatures {
+		if !validTLSH(sig) {
+			writeError(w, http.StatusBadRequest, ErrInvalidRequest, "Invalid signature")
+			return
+		}
+		signatures = append(signatures, sig)
+	}
+	kinds := map[string]string{}
+	for _, ms := range messageSignatures(env, source, reqLogger) {
+		signatures = append(signatures, ms.Signature)
+		if ms.Kind == KindAttachment {
+			kinds[ms.Signature] = attachmentKind(ms.ContentType)
+		}
+	}
+	signatures = dedupeSignatures(signatures)
+
+	trail := newDecisionTrail()
+	trail.note("context", "source", source, "tenant", tenant, "profile", profile.Name, "threshold", profile.SpamThreshold,
+		"signatures", len(signatures), "trusted_sender", trustedSender, "spoofed", spoofed)
+	domain, domainList := blockedDomain(env)
+	result, matchedSig, matched := lookupSignatures(signatureLookup{
+		Signatures:    signatures,
+		Kinds:         kinds,
+		Digests:       digests,
+		BlockedDomain: domain,
+		BlockedList:   domainList,
+		TrustedSender: trustedSender,
+		Profile:       profile,
+		Shadow:        shadow,
+		Tenant:        tenant,
+		Subject:       subject,
+		MessageID:     messageID,
+		Log:           reqLogger,
+		Trail:         trail,
+	})
+	if result.Action != "spam" {
+		matchedSig = ""
+	}
+	if spoofed && trustedSender == "" && result.Action != "spam" {
+		reqLogger.Info("Unauthenticated mail from spoofed domain", "from", env.GetHeader("From"), "subject", subject)
+		result = AnalysisResult{Action: "spam", Label: "dmarc_spoof"}
+		trail.note("dmarc_spoof")
+	}
+	if isTestMessage(env) {
+		result = AnalysisResult{Action: "spam", Label: "test"}
+		trail.note("test_pattern")
+	}
+	trail.log(reqLogger, result)
+
+	// Stored like /analyze scans, so /report can reference the message
+	go storeScanResult(env, ScanResult{
+		Hashes:  signatures,
+		Kinds:   kinds,
+		Action:  result.Action,
+		Label:   result.Label,
+		Source:  source,
+		Tenant:  tenant,
+		Matched: matched || result.ProximityMatch,
+	})
+	publishVerdict(VerdictEvent{
+		Time:      time.Now().Unix(),
+		MessageID: messageIDHash(messageID),
+		Action:    result.Action,
+		Label:     result.Label,
+		Distance:  result.Distance,
+		Tenant:    tenant,
+	})
+
+	mtaActionName, smtpResponse := mtaAction(result, len(meta.RcptTo))
+	resp := VerdictResponse{
+		Verdict:      result.Action,
+		Label:        result.Label,
+		Distance:     result.Distance,
+		MTAAction:    mtaActionName,
+		SMTPResponse: smtpResponse,
+		Signatures:   signatures,
+		MatchedSig:   matchedSig,
+	}
+	respBytes, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBytes)
+}
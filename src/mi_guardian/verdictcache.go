@@ -0,0 +1,126 @@
+// Mailuminati Guardian
+// Copyright (C) 2025 Simon Bressier
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package guardian
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/jhillyerd/enmime"
+)
+
+// --- Verdict cache ---
+//
+// Request coalescing only helps byte-identical requests. Retried deliveries and
+// copies split per recipient by the MTA differ in their Received, To or Message-ID
+// headers, yet carry the same content and get the same verdict. The outcome of an
+// analysis is kept VERDICT_CACHE_TTL seconds, in memory and in Redis (shared by
+// Guardians on the same Redis), under a digest of everything the verdict depends
+// on besides those headers. A hit skips hashing, image fetching and every lookup.
+
+// analysisOutcome is what /analyze concluded about a message: the response and the
+// stored scan are built from it
+type analysisOutcome struct {
+	Result      AnalysisResult    `json:"result"`
+	Signatures  []string          `json:"signatures"`
+	Nested      map[string]bool   `json:"nested,omitempty"`
+	NestedMatch bool              `json:"nested_match,omitempty"`
+	Signals     []string          `json:"signals,omitempty"`
+	Digests     []string          `json:"digests,omitempty"`
+	Structure   string            `json:"structure,omitempty"`
+	Subject     string            `json:"subject_sig,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	Matched     bool              `json:"matched,omitempty"`
+	QRURL       string            `json:"qr_url,omitempty"`
+	Evidence    []string          `json:"evidence,omitempty"` // decision trail, for want_evidence
+	Links       []LinkVerdict     `json:"links,omitempty"`
+	Tokens      []string          `json:"tokens,omitempty"`
+	Kinds       map[string]string `json:"kinds,omitempty"`
+}
+
+var verdictCacheTTL int64 = DefaultVerdictCacheTTL
+
+// verdictCacheKey digests the normalized body, the attachments (content and name)
+// and the per-message context the pipeline takes into account
+func verdictCacheKey(env *enmime.Envelope, context ...string) string {
+	h := sha256.New()
+	h.Write([]byte(normalizeEmailBody(env.Text, env.HTML)))
+	for _, group := range [][]*enmime.Part{env.Attachments, env.Inlines, env.OtherParts} {
+		for _, p := range group {
+			sum := sha256.Sum256(p.Content)
+			h.Write([]byte{0})
+			h.Write(sum[:])
+			h.Write([]byte(p.FileName))
+		}
+	}
+	for _, c := range context {
+		h.Write([]byte{0})
+		h.Write([]byte(c))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedVerdict looks the outcome of key up, memory first then Redis, and returns
+// the level that answered
+func cachedVerdict(key string) (analysisOutcome, string, bool) {
+	if atomic.LoadInt64(&verdictCacheTTL) <= 0 {
+		return analysisOutcome{}, "", false
+	}
+	if out, ok := verdictCache.Get(key); ok {
+		return out, "memory", true
+	}
+
+	stored, err := rdb.Get(ctx, VerdictCachePrefix+key).Result()
+	if err != nil {
+		return analysisOutcome{}, "", false
+	}
+	plain, err := openValue(stored)
+	if err != nil {
+		return analysisOutcome{}, "", false
+	}
+	var out analysisOutcome
+	if json.Unmarshal(plain, &out) != nil {
+		return analysisOutcome{}, "", false
+	}
+	verdictCache.Set(key, out, memoryCacheTTL(time.Duration(atomic.LoadInt64(&verdictCacheTTL))*time.Second))
+	return out, "redis", true
+}
+
+// cacheVerdict keeps the outcome of key for VERDICT_CACHE_TTL seconds
+func cacheVerdict(key string, out analysisOutcome) {
+	ttl := time.Duration(atomic.LoadInt64(&verdictCacheTTL)) * time.Second
+	if ttl <= 0 {
+		return
+	}
+	verdictCache.Set(key, out, memoryCacheTTL(ttl))
+
+	data, _ := json.Marshal(out)
+	sealed, err := sealValue(data)
+	if err != nil {
+		return
+	}
+	rdb.Set(ctx, VerdictCachePrefix+key, sealed, ttl)
+}
+
+// forgetVerdicts drops every cached outcome, after an admin change that must apply
+// at once (other Guardians keep theirs in memory up to MEMORY_CACHE_TTL)
+func forgetVerdicts() {
+	verdictCache.Purge()
+	unlinkByPattern(VerdictCachePrefix + "*")
+}
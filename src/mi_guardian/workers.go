@@ -13,139 +13,361 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package main
+package guardian
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
+	"math/rand"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"mailuminati-guardian/internal/oracle"
 )
 
-// Database sync worker
+// jittered spreads a worker interval by ±WORKER_JITTER_PERCENT so fleets of
+// Guardians started together do not hit the Oracle in the same second
+func jittered(interval time.Duration) time.Duration {
+	spread := int64(interval) * atomic.LoadInt64(&workerJitterPercent) / 100
+	if spread <= 0 {
+		return interval
+	}
+	return interval - time.Duration(spread) + time.Duration(rand.Int63n(2*spread+1))
+}
+
+// Database sync worker (SYNC_INTERVAL, re-read after each run)
 func syncWorker() {
 	doSync()
-	ticker := time.NewTicker(1 * time.Minute)
-	for range ticker.C {
+	for {
+		time.Sleep(jittered(time.Duration(atomic.LoadInt64(&syncIntervalSeconds)) * time.Second))
+		if fullResyncPending() && !maintenanceAllowed("resync") {
+			continue
+		}
 		doSync()
 	}
 }
 
-func doSync() {
-	currentSeq, _ := rdb.Get(ctx, MetaVer).Int()
-	payload, _ := json.Marshal(map[string]interface{}{
+// fullResyncPending tells whether the next sync fetches the whole Oracle index
+// again (sequence reset by a repair). The first sync of a node is never deferred.
+func fullResyncPending() bool {
+	seq, err := rdb.Get(ctx, MetaVer).Int()
+	return err == nil && seq == 0
+}
+
+// syncMu serializes the sync worker and manual /admin/sync/apply runs
+var syncMu sync.Mutex
+
+// fetchSyncDelta asks the Oracle for the changes after currentSeq.
+// The status is 0 when the Oracle could not be reached; the response is empty on 304.
+func fetchSyncDelta(currentSeq int) (SyncResponse, int, error) {
+	var syncData SyncResponse
+	payload := map[string]interface{}{
 		"node_id":     nodeID,
 		"current_seq": currentSeq,
 		"version":     EngineVersion,
-	})
+	}
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Post(oracleURL+"/sync", "application/json", bytes.NewBuffer(payload))
+	resp, err := oraclePost(oracleClient(30*time.Second), "/sync", payload)
 	if err != nil {
-		logger.Warn("Sync failed (request error)", "error", err)
-		return
+		return syncData, 0, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
-		logger.Warn("Sync failed (status)", "status", resp.StatusCode)
-		return
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := oracle.ResponseJSON(resp)
+		if err == nil {
+			err = json.Unmarshal(body, &syncData)
+		}
+		if err != nil {
+			return syncData, resp.StatusCode, fmt.Errorf("invalid response: %w", err)
+		}
+	case http.StatusNotModified:
+	default:
+		return syncData, resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
 	}
+	return syncData, resp.StatusCode, nil
+}
 
-	var syncData SyncResponse
-	if err := json.NewDecoder(resp.Body).Decode(&syncData); err != nil {
-		logger.Warn("Sync failed (invalid json)", "error", err)
+func doSync() {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+
+	currentSeq, _ := rdb.Get(ctx, MetaVer).Int()
+	promSyncSeq.Set(float64(currentSeq))
+
+	syncData, status, err := fetchSyncDelta(currentSeq)
+	recordSyncStatus(status)
+	if err != nil {
+		logger.Warn("Sync failed", "status", status, "error", err)
+		return
+	}
+	if status == http.StatusNotModified {
+		// Already up to date
+		atomic.StoreInt64(&syncLastSuccess, time.Now().Unix())
 		return
 	}
 
 	if syncData.Action == "UPDATE_DELTA" {
 		pipe := rdb.Pipeline()
-		count := 0
+		var added, removed int64
 		for _, op := range syncData.Ops {
-			count += len(op.Bands)
 			for _, band := range op.Bands {
 				if op.Action == "add" {
 					pipe.Set(ctx, FragKeyPrefix+band, "1", 0)
+					added++
 				} else if op.Action == "del" {
 					pipe.Del(ctx, FragKeyPrefix+band)
+					removed++
 				}
 			}
+			forgetBands(FragKeyPrefix, op.Bands)
+			for _, file := range op.Files {
+				if op.Action == "add" {
+					pipe.SAdd(ctx, BlocklistOracleKey, file)
+				} else if op.Action == "del" {
+					pipe.SRem(ctx, BlocklistOracleKey, file)
+				}
+			}
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			// Keep the previous seq so the delta is requested again
+			logger.Warn("Sync failed (redis error)", "error", err)
+			return
 		}
-		pipe.Exec(ctx)
 		rdb.Set(ctx, MetaVer, syncData.NewSeq, 0)
-		logger.Debug("Sync delta applied", "ops", len(syncData.Ops), "bands", count, "new_seq", syncData.NewSeq)
+		atomic.AddInt64(&syncBandsAdded, added)
+		atomic.AddInt64(&syncBandsRemoved, removed)
+		promSyncBands.WithLabelValues("add").Add(float64(added))
+		promSyncBands.WithLabelValues("del").Add(float64(removed))
+		promSyncSeq.Set(float64(syncData.NewSeq))
+		logger.Debug("Sync delta applied", "ops", len(syncData.Ops), "added", added, "removed", removed, "new_seq", syncData.NewSeq)
 	} else if syncData.Action == "RESET_DB" {
 		logger.Info("Received RESET_DB from Oracle")
-		iter := rdb.Scan(ctx, 0, FragKeyPrefix+"*", 0).Iterator()
-		var keys []string
-		for iter.Next(ctx) {
-			keys = append(keys, iter.Val())
-			if len(keys) >= 1000 {
-				rdb.Unlink(ctx, keys...)
-				keys = keys[:0] // Clear slice, keeping capacity
+		unlinkByPattern(FragKeyPrefix + "*")
+		bandExistsCache.Purge()
+		rdb.Del(ctx, BlocklistOracleKey)
+		rdb.Set(ctx, MetaVer, 0, 0)
+		promSyncSeq.Set(0)
+	}
+	atomic.StoreInt64(&syncLastSuccess, time.Now().Unix())
+}
+
+// recordSyncStatus counts an Oracle /sync response by status code (0 = no response)
+func recordSyncStatus(code int) {
+	atomic.StoreInt64(&syncLastStatus, int64(code))
+	label := strconv.Itoa(code)
+	if code == 0 {
+		label = "error"
+	}
+	promSyncResponses.WithLabelValues(label).Inc()
+}
+
+// syncStatus summarizes the sync health for /status
+func syncStatus() map[string]interface{} {
+	status := map[string]interface{}{
+		"last_status":   atomic.LoadInt64(&syncLastStatus),
+		"bands_added":   atomic.LoadInt64(&syncBandsAdded),
+		"bands_removed": atomic.LoadInt64(&syncBandsRemoved),
+		"oracle_outage": oracleOutageActive.Load(),
+	}
+	if last := atomic.LoadInt64(&syncLastSuccess); last > 0 {
+		status["last_success"] = last
+		status["seconds_since_success"] = time.Now().Unix() - last
+	}
+	return status
+}
+
+// --- Counters ---
+
+type statCounter struct {
+	Name  string
+	Value *int64
+}
+
+// statCounters are monotonic process counters; workers keep their own snapshots
+// of what was already reported or persisted and only ship the difference
+var statCounters = []statCounter{
+	{"scanned_count", &scanCount},
+	{"partial_match_count", &partialMatchCount},
+	{"spam_confirmed_count", &spamConfirmedCount},
+	{"cached_positive_count", &cachedPositiveCount},
+	{"cached_negative_count", &cachedNegativeCount},
+	{"local_spam_count", &localSpamCount},
+}
+
+// counterDeltas returns the increase of every counter since the given snapshot
+func counterDeltas(snapshot map[string]int64) (map[string]int64, bool) {
+	deltas := make(map[string]int64, len(statCounters))
+	changed := false
+	for _, c := range statCounters {
+		d := atomic.LoadInt64(c.Value) - snapshot[c.Name]
+		deltas[c.Name] = d
+		if d != 0 {
+			changed = true
+		}
+	}
+	return deltas, changed
+}
+
+var (
+	persistedCounters   = make(map[string]int64)
+	persistedCountersMu sync.Mutex
+)
+
+// persistCounters adds the counters not yet persisted to the lifetime totals in Redis
+func persistCounters() {
+	persistedCountersMu.Lock()
+	defer persistedCountersMu.Unlock()
+
+	deltas, changed := counterDeltas(persistedCounters)
+	if !changed {
+		return
+	}
+	pipe := rdb.Pipeline()
+	for name, d := range deltas {
+		if d != 0 {
+			pipe.HIncrBy(ctx, MetaCounters, name, d)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.Warn("Failed to persist counters", "error", err)
+		return
+	}
+	for name, d := range deltas {
+		persistedCounters[name] += d
+	}
+}
+
+// lifetimeCounters returns totals across restarts and the time they started
+func lifetimeCounters() (map[string]int64, int64) {
+	persistedCountersMu.Lock()
+	defer persistedCountersMu.Unlock()
+
+	stored, _ := rdb.HGetAll(ctx, MetaCounters).Result()
+	deltas, _ := counterDeltas(persistedCounters)
+	totals := make(map[string]int64, len(statCounters))
+	for _, c := range statCounters {
+		v, _ := strconv.ParseInt(stored[c.Name], 10, 64)
+		totals[c.Name] = v + deltas[c.Name]
+	}
+	since, _ := strconv.ParseInt(stored["since"], 10, 64)
+	return totals, since
+}
+
+// Counter persistence worker
+func counterPersistWorker() {
+	// Lifetime totals start with the first Guardian run on this Redis
+	rdb.HSetNX(ctx, MetaCounters, "since", time.Now().Unix())
+	ticker := time.NewTicker(CounterPersistInterval)
+	for range ticker.C {
+		persistCounters()
+	}
+}
+
+// writeMetricsTextfile writes the Guardian metrics in the text format for node_exporter's
+// textfile collector. Go runtime and process metrics are left out: node_exporter
+// exposes its own under the same names.
+func writeMetricsTextfile(path string) error {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := prometheus.DefaultGatherer.Gather()
+		kept := families[:0]
+		for _, mf := range families {
+			if strings.HasPrefix(mf.GetName(), "mailuminati_guardian_") {
+				kept = append(kept, mf)
 			}
 		}
-		if len(keys) > 0 {
-			rdb.Unlink(ctx, keys...)
+		return kept, err
+	})
+	// Written to a temporary file then renamed, so the collector never reads a partial file
+	return prometheus.WriteToTextfile(path, gatherer)
+}
+
+// Metrics textfile worker (METRICS_TEXTFILE, re-read after each run)
+func textfileWorker() {
+	for {
+		path := getEnv("METRICS_TEXTFILE", "")
+		if path == "" {
+			// Disabled, check again after a reload
+			time.Sleep(1 * time.Minute)
+			continue
+		}
+		if err := writeMetricsTextfile(path); err != nil {
+			logger.Warn("Failed to write metrics textfile", "path", path, "error", err)
 		}
-		rdb.Set(ctx, MetaVer, 0, 0)
+		time.Sleep(time.Duration(getEnvPositiveInt("METRICS_TEXTFILE_INTERVAL", DefaultTextfileInterval)) * time.Second)
 	}
 }
 
 // Statistics reporting worker
 func statsWorker() {
-	ticker := time.NewTicker(10 * time.Minute)
-	for range ticker.C {
-		scanned := atomic.SwapInt64(&scanCount, 0)
-		partials := atomic.SwapInt64(&partialMatchCount, 0)
-		spams := atomic.SwapInt64(&spamConfirmedCount, 0)
-		cachedPositives := atomic.SwapInt64(&cachedPositiveCount, 0)
-		cachedNegatives := atomic.SwapInt64(&cachedNegativeCount, 0)
-		localSpams := atomic.SwapInt64(&localSpamCount, 0)
-
-		if scanned == 0 && partials == 0 && spams == 0 && cachedPositives == 0 && cachedNegatives == 0 && localSpams == 0 {
+	reported := make(map[string]int64)
+	for {
+		interval := atomic.LoadInt64(&statsIntervalSeconds)
+		if interval <= 0 {
+			// STATS_INTERVAL=0: disabled, check again after a reload
+			time.Sleep(1 * time.Minute)
+			continue
+		}
+		time.Sleep(jittered(time.Duration(interval) * time.Second))
+
+		deltas, changed := counterDeltas(reported)
+		if !changed {
 			continue
 		}
 
 		logger.Info("Report Stats",
-			"scanned", scanned,
-			"local_spam", localSpams,
-			"oracle_spam", spams,
-			"cache_hits", cachedPositives+cachedNegatives)
-
-		payload, _ := json.Marshal(map[string]interface{}{
-			"node_id":               nodeID,
-			"scanned_count":         scanned,
-			"partial_match_count":   partials,
-			"spam_confirmed_count":  spams,
-			"cached_positive_count": cachedPositives,
-			"cached_negative_count": cachedNegatives,
-			"local_spam_count":      localSpams,
-		})
-
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Post(oracleURL+"/stats", "application/json", bytes.NewBuffer(payload))
+			"scanned", deltas["scanned_count"],
+			"local_spam", deltas["local_spam_count"],
+			"oracle_spam", deltas["spam_confirmed_count"],
+			"cache_hits", deltas["cached_positive_count"]+deltas["cached_negative_count"])
+
+		level := atomic.LoadInt64(&telemetryLevel)
+		if level == TelemetryOff {
+			// Nothing leaves the node: consider the deltas reported
+			for name, d := range deltas {
+				reported[name] += d
+			}
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"node_id": nodeID,
+		}
+		if level == TelemetryFull {
+			lifetime, since := lifetimeCounters()
+			payload["lifetime"] = lifetime
+			payload["counters_since"] = since
+		}
+		for name, d := range deltas {
+			payload[name] = d
+		}
+		resp, err := oraclePost(oracleClient(30*time.Second), "/stats", payload)
 
 		failed := false
 		if err != nil {
 			logger.Warn("Failed to send stats (network)", "error", err)
 			failed = true
 		} else {
-			defer resp.Body.Close() // Ensure we close the body if request was successful
+			resp.Body.Close()
 			if resp.StatusCode > 299 {
 				logger.Warn("Failed to send stats (status)", "status", resp.StatusCode)
 				failed = true
 			}
 		}
 
-		if failed {
-			atomic.AddInt64(&scanCount, scanned)
-			atomic.AddInt64(&partialMatchCount, partials)
-			atomic.AddInt64(&spamConfirmedCount, spams)
-			atomic.AddInt64(&cachedPositiveCount, cachedPositives)
-			atomic.AddInt64(&cachedNegativeCount, cachedNegatives)
-			atomic.AddInt64(&localSpamCount, localSpams)
+		// On failure the snapshot is kept, so the deltas are sent again next time
+		if !failed {
+			for name, d := range deltas {
+				reported[name] += d
+			}
 		}
 	}
 }